@@ -32,9 +32,33 @@ const (
 	DiskAccessIDField                 = "diskaccessid"
 	DiskIOPSReadWriteField            = "diskiopsreadwrite"
 	DiskMBPSReadWriteField            = "diskmbpsreadwrite"
+	DiskControllerTypeField           = "diskcontrollertype"
+	DiskControllerTypeNVMe            = "nvme"
+	DiskControllerTypeSCSI            = "scsi"
 	DiskNameField                     = "diskname"
+	DiskUniqueID                      = "diskUniqueID"
 	EnableBurstingField               = "enablebursting"
+	EncryptionField                   = "encryption"
+	EncryptionLuks                    = "luks"
+	EncryptionNone                    = "none"
 	ErrDiskNotFound                   = "not found"
+	FencingModeField                  = "fencingmode"
+	FencingModeNone                   = "none"
+	FencingModePersistentReservation  = "persistentreservation"
+	FencingPreemptKeys                = "fencingPreemptKeys"
+	FormatPolicyField                 = "formatpolicy"
+	FormatPolicyAlways                = "always"
+	FormatPolicyIfEmpty               = "ifempty"
+	FormatPolicyNever                 = "never"
+	FsckPolicyField                   = "fsckpolicy"
+	FsckPolicyAlways                  = "always"
+	FsckPolicyAuto                    = "auto"
+	FsckPolicyNever                   = "never"
+	FsckPolicyRepairOnError           = "repaironerror"
+	FsckTimeoutField                  = "fscktimeout"
+	DefaultFsckTimeoutSec             = 600
+	FsFeaturesField                   = "fsfeatures"
+	FstrimField                       = "fstrim"
 	FsTypeField                       = "fstype"
 	IncrementalField                  = "incremental"
 	KindField                         = "kind"
@@ -43,9 +67,13 @@ const (
 	LUN                               = "LUN"
 	MaxSharesField                    = "maxshares"
 	MinimumDiskSizeGiB                = 1
+	MkfsOptionsField                  = "mkfsoptions"
+	MkfsOptionsXattr                  = "user.disk.csi.azure.com.mkfs-options"
 	NetworkAccessPolicyField          = "networkaccesspolicy"
 	PublicNetworkAccessField          = "publicnetworkaccess"
 	NotFound                          = "NotFound"
+	OrphanedSinceTag                  = "k8s-azure-orphaned-since"
+	PreferredLunTag                   = "k8s-azure-preferred-lun"
 	PerfProfileBasic                  = "basic"
 	PerfProfileAdvanced               = "advanced"
 	PerfProfileField                  = "perfprofile"
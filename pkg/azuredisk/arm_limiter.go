@@ -0,0 +1,479 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+// armOperationClass groups ARM operations sharing a token bucket
+type armOperationClass string
+
+const (
+	armDiskRead      armOperationClass = "disk-read"
+	armDiskWrite     armOperationClass = "disk-write"
+	armSnapshotRead  armOperationClass = "snapshot-read"
+	armSnapshotWrite armOperationClass = "snapshot-write"
+	armVMRead        armOperationClass = "vm-read"
+	armVMWrite       armOperationClass = "vm-write"
+)
+
+func isARMWriteClass(class armOperationClass) bool {
+	return strings.HasSuffix(string(class), "-write")
+}
+
+// armCircuitState is the state of the circuit breaker of an operation class in a subscription
+type armCircuitState int
+
+const (
+	// ARM calls are allowed
+	armCircuitClosed armCircuitState = iota
+	// one probe call is allowed, its result closes or opens the circuit again
+	armCircuitHalfOpen
+	// ARM calls fail fast until the circuit is half open
+	armCircuitOpen
+)
+
+func (s armCircuitState) String() string {
+	switch s {
+	case armCircuitHalfOpen:
+		return "half-open"
+	case armCircuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// ARMLimiterDebugPath is the path of the debug endpoint serving the state of the ARM rate limiter
+const ARMLimiterDebugPath = "/debug/arm-limiter"
+
+// ListenDebugEndpoint listens on endpoint serving ARMLimiterDebugHandler, which is not authenticated: endpoint must be
+// a unix socket, only accessible by root, or a TCP address bound to the loopback interface
+func ListenDebugEndpoint(ctx context.Context, endpoint string) (net.Listener, error) {
+	return listenLocalEndpoint(ctx, endpoint)
+}
+
+// the limiter of the running driver, served on ARMLimiterDebugPath
+var defaultARMLimiter atomic.Pointer[armLimiter]
+
+// armLimiterConfig is the configuration of armLimiter
+type armLimiterConfig struct {
+	ReadQPS    float32
+	ReadBurst  int
+	WriteQPS   float32
+	WriteBurst int
+	// number of consecutive throttling or server errors which opens the circuit
+	FailureThreshold int
+	// time the circuit stays open when ARM doesn't return Retry-After
+	OpenDuration time.Duration
+}
+
+// armUnavailableError is returned for ARM calls rejected while the circuit of their operation class is open
+type armUnavailableError struct {
+	subscriptionID string
+	class          armOperationClass
+	retryAt        time.Time
+}
+
+func (e *armUnavailableError) Error() string {
+	return fmt.Sprintf("ARM %s calls in subscription(%s) are suspended until %s after throttling or server errors", e.class, e.subscriptionID, e.retryAt.Format(time.RFC3339))
+}
+
+// GRPCStatus maps the error to codes.Unavailable when it's returned from an RPC
+func (e *armUnavailableError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// armCircuitBreaker is the circuit breaker of an operation class in a subscription
+type armCircuitBreaker struct {
+	state               armCircuitState
+	consecutiveFailures int
+	openUntil           time.Time
+	// a probe call is in flight in half open state
+	probing   bool
+	lastError string
+}
+
+// armLimiter rate limits ARM calls with token buckets per subscription and operation class, and suspends ARM calls
+// of an operation class in a subscription after throttling (honoring Retry-After) or repeated server errors, since
+// ARM throttles reads and writes of each resource provider separately.
+type armLimiter struct {
+	config armLimiterConfig
+	now    func() time.Time
+
+	lock sync.Mutex
+	// <lower-case subscriptionID, <class, bucket>>
+	buckets map[string]map[armOperationClass]flowcontrol.RateLimiter
+	// <lower-case subscriptionID, <class, breaker>>
+	breakers map[string]map[armOperationClass]*armCircuitBreaker
+}
+
+func newARMLimiter(config armLimiterConfig) *armLimiter {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 1
+	}
+	registerMetrics()
+	return &armLimiter{
+		config:   config,
+		now:      time.Now,
+		buckets:  make(map[string]map[armOperationClass]flowcontrol.RateLimiter),
+		breakers: make(map[string]map[armOperationClass]*armCircuitBreaker),
+	}
+}
+
+// setupARMLimiter routes disk, snapshot and VM calls of the driver and of the cloud provider through a new ARM rate
+// limiter
+func (d *DriverCore) setupARMLimiter(options *DriverOptions) {
+	d.armLimiter = newARMLimiter(armLimiterConfig{
+		ReadQPS:          float32(options.ARMRateLimitReadQPS),
+		ReadBurst:        options.ARMRateLimitReadBucket,
+		WriteQPS:         float32(options.ARMRateLimitWriteQPS),
+		WriteBurst:       options.ARMRateLimitWriteBucket,
+		FailureThreshold: options.ARMCircuitBreakerFailureThreshold,
+		OpenDuration:     time.Duration(options.ARMCircuitBreakerOpenDurationInSec) * time.Second,
+	})
+	defaultARMLimiter.Store(d.armLimiter)
+	d.clientFactory = newLimitedClientFactory(d.clientFactory, d.armLimiter, d.cloud.SubscriptionID)
+	limitCloudClients(d.cloud, d.armLimiter)
+	if d.diskController != nil {
+		d.diskController.clientFactory = d.clientFactory
+		d.diskController.armLimiter = d.armLimiter
+	}
+	klog.V(2).Infof("ARM rate limiter is enabled, read QPS: %f, bucket: %d, write QPS: %f, bucket: %d",
+		options.ARMRateLimitReadQPS, options.ARMRateLimitReadBucket, options.ARMRateLimitWriteQPS, options.ARMRateLimitWriteBucket)
+}
+
+// do runs fn as an ARM call of class in subscriptionID once the circuit allows it and a token is available
+func (l *armLimiter) do(ctx context.Context, subscriptionID string, class armOperationClass, fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	sub := strings.ToLower(subscriptionID)
+	if err := l.allow(sub, class); err != nil {
+		return err
+	}
+	bucket := l.getBucket(sub, class)
+	if !bucket.TryAccept() {
+		armRequestsDelayed.WithLabelValues(sub, string(class)).Inc()
+		if err := bucket.Wait(ctx); err != nil {
+			l.release(sub, class)
+			return err
+		}
+	}
+	err := fn()
+	l.record(sub, class, err)
+	return err
+}
+
+// allow returns armUnavailableError if the circuit of class in sub doesn't allow a call now
+func (l *armLimiter) allow(sub string, class armOperationClass) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.getBreaker(sub, class)
+	now := l.now()
+	if b.state == armCircuitOpen && !now.Before(b.openUntil) {
+		klog.V(2).Infof("ARM circuit of %s calls in subscription(%s) is half open, allow a probe call", class, sub)
+		l.setState(sub, class, b, armCircuitHalfOpen)
+	}
+	switch {
+	case b.state == armCircuitOpen, b.state == armCircuitHalfOpen && b.probing:
+		armRequestsRejected.WithLabelValues(sub, string(class)).Inc()
+		retryAt := b.openUntil
+		if retryAt.Before(now) {
+			retryAt = now.Add(time.Second)
+		}
+		return &armUnavailableError{subscriptionID: sub, class: class, retryAt: retryAt}
+	case b.state == armCircuitHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// release gives up the probe slot of a call which didn't reach ARM
+func (l *armLimiter) release(sub string, class armOperationClass) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.getBreaker(sub, class).probing = false
+}
+
+// record updates the circuit of class in sub with the result of an ARM call
+func (l *armLimiter) record(sub string, class armOperationClass, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.getBreaker(sub, class)
+	b.probing = false
+	if !isARMServiceError(err) {
+		// successful calls and client errors mean ARM is serving requests
+		b.consecutiveFailures = 0
+		if b.state != armCircuitClosed {
+			klog.V(2).Infof("ARM circuit of %s calls in subscription(%s) is closed", class, sub)
+			l.setState(sub, class, b, armCircuitClosed)
+		}
+		return
+	}
+
+	b.consecutiveFailures++
+	b.lastError = err.Error()
+	now := l.now()
+	if retryAfter := getRetryAfter(err, now); retryAfter > 0 {
+		l.open(sub, class, b, now.Add(retryAfter))
+		return
+	}
+	if b.state == armCircuitHalfOpen || b.consecutiveFailures >= l.config.FailureThreshold {
+		l.open(sub, class, b, now.Add(l.config.OpenDuration))
+	}
+}
+
+// open opens the circuit of class in sub until the given time, the caller must hold the lock
+func (l *armLimiter) open(sub string, class armOperationClass, b *armCircuitBreaker, until time.Time) {
+	if b.state == armCircuitOpen && until.Before(b.openUntil) {
+		return
+	}
+	klog.Warningf("ARM circuit of %s calls in subscription(%s) is open until %s after %d consecutive failures, last error: %s",
+		class, sub, until.Format(time.RFC3339), b.consecutiveFailures, b.lastError)
+	b.openUntil = until
+	l.setState(sub, class, b, armCircuitOpen)
+}
+
+// setState sets the state of the circuit of class in sub, the caller must hold the lock
+func (l *armLimiter) setState(sub string, class armOperationClass, b *armCircuitBreaker, state armCircuitState) {
+	b.state = state
+	armCircuitBreakerState.WithLabelValues(sub, string(class)).Set(float64(state))
+}
+
+// isOpen returns true if ARM calls of class in subscriptionID fail fast now
+func (l *armLimiter) isOpen(subscriptionID string, class armOperationClass) (bool, time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.getBreaker(strings.ToLower(subscriptionID), class)
+	return b.state == armCircuitOpen && l.now().Before(b.openUntil), b.openUntil
+}
+
+// getBreaker returns the breaker of class in sub, the caller must hold the lock
+func (l *armLimiter) getBreaker(sub string, class armOperationClass) *armCircuitBreaker {
+	breakers, ok := l.breakers[sub]
+	if !ok {
+		breakers = make(map[armOperationClass]*armCircuitBreaker)
+		l.breakers[sub] = breakers
+	}
+	b, ok := breakers[class]
+	if !ok {
+		b = &armCircuitBreaker{}
+		breakers[class] = b
+	}
+	return b
+}
+
+func (l *armLimiter) getBucket(sub string, class armOperationClass) flowcontrol.RateLimiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	buckets, ok := l.buckets[sub]
+	if !ok {
+		buckets = make(map[armOperationClass]flowcontrol.RateLimiter)
+		l.buckets[sub] = buckets
+	}
+	bucket, ok := buckets[class]
+	if !ok {
+		qps, burst := l.config.ReadQPS, l.config.ReadBurst
+		if isARMWriteClass(class) {
+			qps, burst = l.config.WriteQPS, l.config.WriteBurst
+		}
+		bucket = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+		buckets[class] = bucket
+	}
+	return bucket
+}
+
+// armControllerMethodClasses is the operation class of the ARM calls each controller RPC can't complete without
+var armControllerMethodClasses = map[string]armOperationClass{
+	"/csi.v1.Controller/CreateVolume":              armDiskWrite,
+	"/csi.v1.Controller/DeleteVolume":              armDiskWrite,
+	"/csi.v1.Controller/ControllerExpandVolume":    armDiskWrite,
+	"/csi.v1.Controller/ControllerModifyVolume":    armDiskWrite,
+	"/csi.v1.Controller/ControllerPublishVolume":   armVMWrite,
+	"/csi.v1.Controller/ControllerUnpublishVolume": armVMWrite,
+	"/csi.v1.Controller/CreateSnapshot":            armSnapshotWrite,
+	"/csi.v1.Controller/DeleteSnapshot":            armSnapshotWrite,
+	"/csi.v1.Controller/ListVolumes":               armDiskRead,
+	"/csi.v1.Controller/ListSnapshots":             armSnapshotRead,
+}
+
+// unaryServerInterceptor fails controller RPCs fast with codes.Unavailable while the circuit of the operation class
+// they need in subscriptionID is open
+func (l *armLimiter) unaryServerInterceptor(subscriptionID string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if class, ok := armControllerMethodClasses[info.FullMethod]; ok {
+			if open, retryAt := l.isOpen(subscriptionID, class); open {
+				return nil, (&armUnavailableError{subscriptionID: strings.ToLower(subscriptionID), class: class, retryAt: retryAt}).GRPCStatus().Err()
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// armLimiterState is the state of the ARM rate limiter served on the debug endpoint
+type armLimiterState struct {
+	Subscriptions []armSubscriptionState `json:"subscriptions"`
+}
+
+type armSubscriptionState struct {
+	SubscriptionID string          `json:"subscriptionID"`
+	Classes        []armClassState `json:"classes,omitempty"`
+}
+
+// armClassState is the state of the token bucket and circuit breaker of an operation class
+type armClassState struct {
+	Class               string     `json:"class"`
+	QPS                 float32    `json:"qps,omitempty"`
+	Burst               int        `json:"burst,omitempty"`
+	CircuitState        string     `json:"circuitState"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenUntil           *time.Time `json:"openUntil,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// state returns a snapshot of the limiter state
+func (l *armLimiter) state() armLimiterState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	classes := make(map[string]map[armOperationClass]*armClassState)
+	getClass := func(sub string, class armOperationClass) *armClassState {
+		if _, ok := classes[sub]; !ok {
+			classes[sub] = make(map[armOperationClass]*armClassState)
+		}
+		c, ok := classes[sub][class]
+		if !ok {
+			c = &armClassState{Class: string(class), CircuitState: armCircuitClosed.String()}
+			classes[sub][class] = c
+		}
+		return c
+	}
+	for sub, buckets := range l.buckets {
+		for class, bucket := range buckets {
+			c := getClass(sub, class)
+			c.QPS, c.Burst = bucket.QPS(), l.config.ReadBurst
+			if isARMWriteClass(class) {
+				c.Burst = l.config.WriteBurst
+			}
+		}
+	}
+	for sub, breakers := range l.breakers {
+		for class, b := range breakers {
+			c := getClass(sub, class)
+			c.CircuitState = b.state.String()
+			c.ConsecutiveFailures = b.consecutiveFailures
+			c.LastError = b.lastError
+			if b.state != armCircuitClosed {
+				openUntil := b.openUntil
+				c.OpenUntil = &openUntil
+			}
+		}
+	}
+	result := armLimiterState{Subscriptions: []armSubscriptionState{}}
+	for sub, subClasses := range classes {
+		s := armSubscriptionState{SubscriptionID: sub}
+		for _, c := range subClasses {
+			s.Classes = append(s.Classes, *c)
+		}
+		sort.Slice(s.Classes, func(i, j int) bool { return s.Classes[i].Class < s.Classes[j].Class })
+		result.Subscriptions = append(result.Subscriptions, s)
+	}
+	sort.Slice(result.Subscriptions, func(i, j int) bool {
+		return result.Subscriptions[i].SubscriptionID < result.Subscriptions[j].SubscriptionID
+	})
+	return result
+}
+
+// ARMLimiterDebugHandler serves the state of the ARM rate limiter and circuit breakers of the running driver as JSON
+func ARMLimiterDebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		l := defaultARMLimiter.Load()
+		if l == nil {
+			http.Error(w, "ARM rate limiter is not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(l.state()); err != nil {
+			klog.Errorf("failed to encode ARM rate limiter state: %v", err)
+		}
+	})
+}
+
+// isARMServiceError returns true if err is throttling or a server error of ARM
+func isARMServiceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= http.StatusInternalServerError
+	}
+	var retryErr *retryError
+	if errors.As(err, &retryErr) {
+		return retryErr.rerr.IsThrottled() || retryErr.rerr.HTTPStatusCode >= http.StatusInternalServerError
+	}
+	return azureutils.IsThrottlingError(err)
+}
+
+// getRetryAfter returns the Retry-After duration returned by ARM with err, or 0 if there is none
+func getRetryAfter(err error, now time.Time) time.Duration {
+	var retryErr *retryError
+	if errors.As(err, &retryErr) {
+		if retryErr.rerr.RetryAfter.After(now) {
+			return retryErr.rerr.RetryAfter.Sub(now)
+		}
+		return 0
+	}
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) || respErr.RawResponse == nil {
+		return 0
+	}
+	value := respErr.RawResponse.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
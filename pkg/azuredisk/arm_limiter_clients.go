@@ -0,0 +1,414 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/virtualmachineclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmssvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// limitedClientFactory returns disk, snapshot and VM clients whose calls go through the ARM rate limiter
+type limitedClientFactory struct {
+	azclient.ClientFactory
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+// newLimitedClientFactory wraps factory with limiter, subscriptionID is the subscription of clients without explicit subscription
+func newLimitedClientFactory(factory azclient.ClientFactory, limiter *armLimiter, subscriptionID string) azclient.ClientFactory {
+	if factory == nil || limiter == nil {
+		return factory
+	}
+	if f, ok := factory.(*limitedClientFactory); ok {
+		factory = f.ClientFactory
+	}
+	return &limitedClientFactory{ClientFactory: factory, limiter: limiter, subscriptionID: subscriptionID}
+}
+
+func (f *limitedClientFactory) GetDiskClient() diskclient.Interface {
+	return &limitedDiskClient{Interface: f.ClientFactory.GetDiskClient(), limiter: f.limiter, subscriptionID: f.subscriptionID}
+}
+
+func (f *limitedClientFactory) GetDiskClientForSub(subscriptionID string) (diskclient.Interface, error) {
+	client, err := f.ClientFactory.GetDiskClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionID == "" {
+		subscriptionID = f.subscriptionID
+	}
+	return &limitedDiskClient{Interface: client, limiter: f.limiter, subscriptionID: subscriptionID}, nil
+}
+
+func (f *limitedClientFactory) GetSnapshotClient() snapshotclient.Interface {
+	return &limitedSnapshotClient{Interface: f.ClientFactory.GetSnapshotClient(), limiter: f.limiter, subscriptionID: f.subscriptionID}
+}
+
+func (f *limitedClientFactory) GetSnapshotClientForSub(subscriptionID string) (snapshotclient.Interface, error) {
+	client, err := f.ClientFactory.GetSnapshotClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionID == "" {
+		subscriptionID = f.subscriptionID
+	}
+	return &limitedSnapshotClient{Interface: client, limiter: f.limiter, subscriptionID: subscriptionID}, nil
+}
+
+func (f *limitedClientFactory) GetVirtualMachineClient() virtualmachineclient.Interface {
+	return &limitedVMClient{Interface: f.ClientFactory.GetVirtualMachineClient(), limiter: f.limiter, subscriptionID: f.subscriptionID}
+}
+
+type limitedDiskClient struct {
+	diskclient.Interface
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+func (c *limitedDiskClient) Get(ctx context.Context, resourceGroupName string, resourceName string) (result *armcompute.Disk, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armDiskRead, func() error {
+		result, err = c.Interface.Get(ctx, resourceGroupName, resourceName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedDiskClient) List(ctx context.Context, resourceGroupName string) (result []*armcompute.Disk, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armDiskRead, func() error {
+		result, err = c.Interface.List(ctx, resourceGroupName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedDiskClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, resourceParam armcompute.Disk) (result *armcompute.Disk, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armDiskWrite, func() error {
+		result, err = c.Interface.CreateOrUpdate(ctx, resourceGroupName, resourceName, resourceParam)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedDiskClient) Patch(ctx context.Context, resourceGroupName string, resourceName string, parameters armcompute.DiskUpdate) (result *armcompute.Disk, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armDiskWrite, func() error {
+		result, err = c.Interface.Patch(ctx, resourceGroupName, resourceName, parameters)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedDiskClient) Delete(ctx context.Context, resourceGroupName string, resourceName string) error {
+	return c.limiter.do(ctx, c.subscriptionID, armDiskWrite, func() error {
+		return c.Interface.Delete(ctx, resourceGroupName, resourceName)
+	})
+}
+
+type limitedSnapshotClient struct {
+	snapshotclient.Interface
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+func (c *limitedSnapshotClient) Get(ctx context.Context, resourceGroupName string, resourceName string) (result *armcompute.Snapshot, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armSnapshotRead, func() error {
+		result, err = c.Interface.Get(ctx, resourceGroupName, resourceName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedSnapshotClient) List(ctx context.Context, resourceGroupName string) (result []*armcompute.Snapshot, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armSnapshotRead, func() error {
+		result, err = c.Interface.List(ctx, resourceGroupName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedSnapshotClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, resourceParam armcompute.Snapshot) (result *armcompute.Snapshot, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armSnapshotWrite, func() error {
+		result, err = c.Interface.CreateOrUpdate(ctx, resourceGroupName, resourceName, resourceParam)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedSnapshotClient) Delete(ctx context.Context, resourceGroupName string, resourceName string) error {
+	return c.limiter.do(ctx, c.subscriptionID, armSnapshotWrite, func() error {
+		return c.Interface.Delete(ctx, resourceGroupName, resourceName)
+	})
+}
+
+// BeginUpdate is passed through to the wrapped client if it supports PATCH, see snapshotUpdater
+func (c *limitedSnapshotClient) BeginUpdate(ctx context.Context, resourceGroupName string, snapshotName string, snapshot armcompute.SnapshotUpdate, options *armcompute.SnapshotsClientBeginUpdateOptions) (result *runtime.Poller[armcompute.SnapshotsClientUpdateResponse], err error) {
+	updater, ok := c.Interface.(snapshotUpdater)
+	if !ok {
+		return nil, fmt.Errorf("snapshot client %T does not support PATCH", c.Interface)
+	}
+	err = c.limiter.do(ctx, c.subscriptionID, armSnapshotWrite, func() error {
+		result, err = updater.BeginUpdate(ctx, resourceGroupName, snapshotName, snapshot, options)
+		return err
+	})
+	return result, err
+}
+
+type limitedVMClient struct {
+	virtualmachineclient.Interface
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+func (c *limitedVMClient) Get(ctx context.Context, resourceGroupName string, resourceName string, expand *string) (result *armcompute.VirtualMachine, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMRead, func() error {
+		result, err = c.Interface.Get(ctx, resourceGroupName, resourceName, expand)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) List(ctx context.Context, resourceGroupName string) (result []*armcompute.VirtualMachine, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMRead, func() error {
+		result, err = c.Interface.List(ctx, resourceGroupName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) InstanceView(ctx context.Context, resourceGroupName string, vmName string) (result *armcompute.VirtualMachineInstanceView, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMRead, func() error {
+		result, err = c.Interface.InstanceView(ctx, resourceGroupName, vmName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) ListVMInstanceView(ctx context.Context, resourceGroupName string) (result []*armcompute.VirtualMachine, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMRead, func() error {
+		result, err = c.Interface.ListVMInstanceView(ctx, resourceGroupName)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, resourceParam armcompute.VirtualMachine) (result *armcompute.VirtualMachine, err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMWrite, func() error {
+		result, err = c.Interface.CreateOrUpdate(ctx, resourceGroupName, resourceName, resourceParam)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) Delete(ctx context.Context, resourceGroupName string, resourceName string) error {
+	return c.limiter.do(ctx, c.subscriptionID, armVMWrite, func() error {
+		return c.Interface.Delete(ctx, resourceGroupName, resourceName)
+	})
+}
+
+func (c *limitedVMClient) BeginAttachDetachDataDisks(ctx context.Context, resourceGroupName string, vmName string, parameters armcompute.AttachDetachDataDisksRequest, options *armcompute.VirtualMachinesClientBeginAttachDetachDataDisksOptions) (result *runtime.Poller[armcompute.VirtualMachinesClientAttachDetachDataDisksResponse], err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMWrite, func() error {
+		result, err = c.Interface.BeginAttachDetachDataDisks(ctx, resourceGroupName, vmName, parameters, options)
+		return err
+	})
+	return result, err
+}
+
+func (c *limitedVMClient) BeginUpdate(ctx context.Context, resourceGroupName string, vmName string, parameters armcompute.VirtualMachineUpdate, options *armcompute.VirtualMachinesClientBeginUpdateOptions) (result *runtime.Poller[armcompute.VirtualMachinesClientUpdateResponse], err error) {
+	err = c.limiter.do(ctx, c.subscriptionID, armVMWrite, func() error {
+		result, err = c.Interface.BeginUpdate(ctx, resourceGroupName, vmName, parameters, options)
+		return err
+	})
+	return result, err
+}
+
+// limitCloudClients routes the disk, snapshot and VM calls the cloud provider makes on behalf of the driver, e.g.
+// through vmset, through limiter
+func limitCloudClients(cloud *provider.Cloud, limiter *armLimiter) {
+	if cloud == nil || limiter == nil {
+		return
+	}
+	cloud.ComputeClientFactory = newLimitedClientFactory(cloud.ComputeClientFactory, limiter, cloud.SubscriptionID)
+	if client, ok := cloud.VirtualMachinesClient.(*limitedLegacyVMClient); ok {
+		cloud.VirtualMachinesClient = client.Interface
+	}
+	if cloud.VirtualMachinesClient != nil {
+		cloud.VirtualMachinesClient = &limitedLegacyVMClient{Interface: cloud.VirtualMachinesClient, limiter: limiter, subscriptionID: cloud.SubscriptionID}
+	}
+	if client, ok := cloud.VirtualMachineScaleSetVMsClient.(*limitedVMSSVMClient); ok {
+		cloud.VirtualMachineScaleSetVMsClient = client.Interface
+	}
+	if cloud.VirtualMachineScaleSetVMsClient != nil {
+		cloud.VirtualMachineScaleSetVMsClient = &limitedVMSSVMClient{Interface: cloud.VirtualMachineScaleSetVMsClient, limiter: limiter, subscriptionID: cloud.SubscriptionID}
+	}
+}
+
+// retryError is the error of a call of the clients of the cloud provider passed through the limiter
+type retryError struct {
+	rerr *retry.Error
+}
+
+func (e *retryError) Error() string {
+	return e.rerr.Error().Error()
+}
+
+// doRetry runs fn, a call of the clients of the cloud provider, through l
+func (l *armLimiter) doRetry(ctx context.Context, subscriptionID string, class armOperationClass, fn func() *retry.Error) *retry.Error {
+	err := l.do(ctx, subscriptionID, class, func() error {
+		if rerr := fn(); rerr != nil {
+			return &retryError{rerr: rerr}
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	var retryErr *retryError
+	if errors.As(err, &retryErr) {
+		return retryErr.rerr
+	}
+	var unavailableErr *armUnavailableError
+	if errors.As(err, &unavailableErr) {
+		return &retry.Error{Retriable: true, RetryAfter: unavailableErr.retryAt, RawError: err}
+	}
+	return retry.NewError(true, err)
+}
+
+// limitedLegacyVMClient is the VM client of the cloud provider whose calls go through the ARM rate limiter
+type limitedLegacyVMClient struct {
+	vmclient.Interface
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+func (c *limitedLegacyVMClient) Get(ctx context.Context, resourceGroupName string, vmName string, expand compute.InstanceViewTypes) (result compute.VirtualMachine, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.Get(ctx, resourceGroupName, vmName, expand)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) List(ctx context.Context, resourceGroupName string) (result []compute.VirtualMachine, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.List(ctx, resourceGroupName)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) ListVmssFlexVMsWithoutInstanceView(ctx context.Context, vmssFlexID string) (result []compute.VirtualMachine, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.ListVmssFlexVMsWithoutInstanceView(ctx, vmssFlexID)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) ListVmssFlexVMsWithOnlyInstanceView(ctx context.Context, vmssFlexID string) (result []compute.VirtualMachine, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.ListVmssFlexVMsWithOnlyInstanceView(ctx, vmssFlexID)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, vmName string, parameters compute.VirtualMachine, source string) *retry.Error {
+	return c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		return c.Interface.CreateOrUpdate(ctx, resourceGroupName, vmName, parameters, source)
+	})
+}
+
+func (c *limitedLegacyVMClient) Update(ctx context.Context, resourceGroupName string, vmName string, parameters compute.VirtualMachineUpdate, source string) (result *compute.VirtualMachine, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		result, rerr = c.Interface.Update(ctx, resourceGroupName, vmName, parameters, source)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) UpdateAsync(ctx context.Context, resourceGroupName string, vmName string, parameters compute.VirtualMachineUpdate, source string) (result *azure.Future, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		result, rerr = c.Interface.UpdateAsync(ctx, resourceGroupName, vmName, parameters, source)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedLegacyVMClient) Delete(ctx context.Context, resourceGroupName string, vmName string) *retry.Error {
+	return c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		return c.Interface.Delete(ctx, resourceGroupName, vmName)
+	})
+}
+
+// limitedVMSSVMClient is the VMSS VM client of the cloud provider whose calls go through the ARM rate limiter
+type limitedVMSSVMClient struct {
+	vmssvmclient.Interface
+	limiter        *armLimiter
+	subscriptionID string
+}
+
+func (c *limitedVMSSVMClient) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, expand compute.InstanceViewTypes) (result compute.VirtualMachineScaleSetVM, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.Get(ctx, resourceGroupName, vmScaleSetName, instanceID, expand)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedVMSSVMClient) List(ctx context.Context, resourceGroupName string, vmScaleSetName string, expand string) (result []compute.VirtualMachineScaleSetVM, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMRead, func() *retry.Error {
+		result, rerr = c.Interface.List(ctx, resourceGroupName, vmScaleSetName, expand)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedVMSSVMClient) Update(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, source string) (result *compute.VirtualMachineScaleSetVM, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		result, rerr = c.Interface.Update(ctx, resourceGroupName, vmScaleSetName, instanceID, parameters, source)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedVMSSVMClient) UpdateAsync(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, source string) (result *azure.Future, rerr *retry.Error) {
+	rerr = c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		result, rerr = c.Interface.UpdateAsync(ctx, resourceGroupName, vmScaleSetName, instanceID, parameters, source)
+		return rerr
+	})
+	return result, rerr
+}
+
+func (c *limitedVMSSVMClient) UpdateVMs(ctx context.Context, resourceGroupName string, vmScaleSetName string, instances map[string]compute.VirtualMachineScaleSetVM, source string, batchSize int) *retry.Error {
+	return c.limiter.doRetry(ctx, c.subscriptionID, armVMWrite, func() *retry.Error {
+		return c.Interface.UpdateVMs(ctx, resourceGroupName, vmScaleSetName, instances, source, batchSize)
+	})
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmssvmclient/mockvmssvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func newTestARMLimiter(now *time.Time) *armLimiter {
+	l := newARMLimiter(armLimiterConfig{
+		ReadQPS:          1000,
+		ReadBurst:        1000,
+		WriteQPS:         1000,
+		WriteBurst:       1000,
+		FailureThreshold: 3,
+		OpenDuration:     30 * time.Second,
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func newARMResponseError(statusCode int, retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return &azcore.ResponseError{StatusCode: statusCode, RawResponse: &http.Response{StatusCode: statusCode, Header: header}}
+}
+
+func TestARMLimiterCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	ctx := context.Background()
+	serverErr := newARMResponseError(http.StatusInternalServerError, "")
+	fail := func() error { return serverErr }
+	succeed := func() error { return nil }
+
+	// client errors don't count as failures
+	for i := 0; i < 5; i++ {
+		assert.Error(t, l.do(ctx, "sub", armDiskRead, func() error { return newARMResponseError(http.StatusNotFound, "") }))
+	}
+	open, _ := l.isOpen("sub", armDiskRead)
+	assert.False(t, open)
+
+	// circuit opens after consecutive server errors
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, serverErr, l.do(ctx, "sub", armDiskRead, fail))
+	}
+	open, retryAt := l.isOpen("SUB", armDiskRead)
+	assert.True(t, open)
+	assert.Equal(t, now.Add(30*time.Second), retryAt)
+
+	called := false
+	err := l.do(ctx, "sub", armDiskRead, func() error { called = true; return nil })
+	assert.False(t, called)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	var unavailableErr *armUnavailableError
+	assert.True(t, errors.As(err, &unavailableErr))
+
+	// other operation classes and subscriptions are not affected
+	assert.NoError(t, l.do(ctx, "sub", armVMWrite, succeed))
+	assert.NoError(t, l.do(ctx, "sub", armDiskWrite, succeed))
+	assert.NoError(t, l.do(ctx, "sub2", armDiskRead, succeed))
+
+	// half open allows one probe, a failed probe opens the circuit again
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, serverErr, l.do(ctx, "sub", armDiskRead, fail))
+	open, _ = l.isOpen("sub", armDiskRead)
+	assert.True(t, open)
+
+	// a successful probe closes the circuit
+	now = now.Add(31 * time.Second)
+	assert.NoError(t, l.allow("sub", armDiskRead))
+	assert.Equal(t, codes.Unavailable, status.Code(l.allow("sub", armDiskRead)), "only one probe is allowed in half open state")
+	l.record("sub", armDiskRead, nil)
+	assert.NoError(t, l.do(ctx, "sub", armDiskRead, succeed))
+	assert.Equal(t, armCircuitClosed, l.breakers["sub"][armDiskRead].state)
+}
+
+func TestARMLimiterRetryAfter(t *testing.T) {
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	ctx := context.Background()
+
+	err := l.do(ctx, "sub", armDiskRead, func() error { return newARMResponseError(http.StatusTooManyRequests, "120") })
+	assert.Error(t, err)
+	open, retryAt := l.isOpen("sub", armDiskRead)
+	assert.True(t, open, "Retry-After opens the circuit without reaching the failure threshold")
+	assert.Equal(t, now.Add(120*time.Second), retryAt)
+
+	// a throttled read does not suspend writes or reads of other resources
+	for _, class := range []armOperationClass{armDiskWrite, armSnapshotRead, armVMRead, armVMWrite} {
+		assert.NoError(t, l.do(ctx, "sub", class, func() error { return nil }), class)
+	}
+
+	now = now.Add(60 * time.Second)
+	assert.Equal(t, codes.Unavailable, status.Code(l.do(ctx, "sub", armDiskRead, func() error { return nil })))
+	now = now.Add(61 * time.Second)
+	assert.NoError(t, l.do(ctx, "sub", armDiskRead, func() error { return nil }))
+}
+
+func TestARMLimiterRateLimit(t *testing.T) {
+	l := newARMLimiter(armLimiterConfig{ReadQPS: 1000, ReadBurst: 1000, WriteQPS: 0.001, WriteBurst: 1, FailureThreshold: 3})
+	assert.NoError(t, l.do(context.Background(), "sub", armDiskWrite, func() error { return nil }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	called := false
+	err := l.do(ctx, "sub", armDiskWrite, func() error { called = true; return nil })
+	assert.Error(t, err, "no write token is available within the context deadline")
+	assert.False(t, called)
+
+	// buckets are per subscription and operation class
+	assert.NoError(t, l.do(ctx, "sub", armSnapshotWrite, func() error { return nil }))
+	assert.NoError(t, l.do(ctx, "sub2", armDiskWrite, func() error { return nil }))
+	assert.NoError(t, l.do(ctx, "sub", armDiskRead, func() error { return nil }))
+}
+
+func TestARMLimiterNil(t *testing.T) {
+	var l *armLimiter
+	called := false
+	assert.NoError(t, l.do(context.Background(), "sub", armDiskRead, func() error { called = true; return nil }))
+	assert.True(t, called)
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		desc     string
+		err      error
+		expected time.Duration
+	}{
+		{
+			desc: "non ARM error",
+			err:  errors.New("error"),
+		},
+		{
+			desc: "no Retry-After",
+			err:  newARMResponseError(http.StatusTooManyRequests, ""),
+		},
+		{
+			desc:     "Retry-After in seconds",
+			err:      newARMResponseError(http.StatusTooManyRequests, "15"),
+			expected: 15 * time.Second,
+		},
+		{
+			desc:     "Retry-After in HTTP date",
+			err:      newARMResponseError(http.StatusTooManyRequests, now.Add(time.Minute).UTC().Format(http.TimeFormat)),
+			expected: time.Minute,
+		},
+		{
+			desc: "invalid Retry-After",
+			err:  newARMResponseError(http.StatusTooManyRequests, "soon"),
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getRetryAfter(test.err, now), test.desc)
+	}
+}
+
+func TestARMLimiterUnaryServerInterceptor(t *testing.T) {
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	interceptor := l.unaryServerInterceptor("sub")
+	handler := func(_ context.Context, _ interface{}) (interface{}, error) { return "ok", nil }
+
+	resp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+
+	l.record("sub", armVMWrite, newARMResponseError(http.StatusTooManyRequests, "60"))
+	for _, method := range []string{"/csi.v1.Controller/ControllerPublishVolume", "/csi.v1.Controller/ControllerUnpublishVolume"} {
+		_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		assert.Equal(t, codes.Unavailable, status.Code(err), method)
+	}
+	// RPCs which don't update VMs are served
+	for _, method := range []string{"/csi.v1.Controller/CreateVolume", "/csi.v1.Controller/ControllerGetCapabilities", "/csi.v1.Node/NodeStageVolume", "/csi.v1.Identity/Probe"} {
+		_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		assert.NoError(t, err, method)
+	}
+}
+
+func TestListenDebugEndpoint(t *testing.T) {
+	// the debug endpoint is not authenticated, it's not served on addresses reachable from other hosts
+	for _, endpoint := range []string{"tcp://0.0.0.0:0", "tcp://:0", "tcp://10.0.0.4:0"} {
+		_, err := ListenDebugEndpoint(context.Background(), endpoint)
+		assert.Error(t, err, endpoint)
+	}
+	l, err := ListenDebugEndpoint(context.Background(), "tcp://127.0.0.1:0")
+	assert.NoError(t, err)
+	l.Close()
+}
+
+func TestARMLimiterDebugHandler(t *testing.T) {
+	defer defaultARMLimiter.Store(nil)
+
+	defaultARMLimiter.Store(nil)
+	recorder := httptest.NewRecorder()
+	ARMLimiterDebugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ARMLimiterDebugPath, nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	defaultARMLimiter.Store(l)
+	assert.NoError(t, l.do(context.Background(), "sub", armDiskRead, func() error { return nil }))
+	l.record("sub2", armVMWrite, newARMResponseError(http.StatusTooManyRequests, "60"))
+
+	recorder = httptest.NewRecorder()
+	ARMLimiterDebugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ARMLimiterDebugPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	state := armLimiterState{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.Len(t, state.Subscriptions, 2)
+	assert.Equal(t, "sub", state.Subscriptions[0].SubscriptionID)
+	assert.Equal(t, []armClassState{{Class: string(armDiskRead), QPS: 1000, Burst: 1000, CircuitState: "closed"}}, state.Subscriptions[0].Classes)
+	assert.Len(t, state.Subscriptions[1].Classes, 1)
+	assert.Equal(t, string(armVMWrite), state.Subscriptions[1].Classes[0].Class)
+	assert.Equal(t, "open", state.Subscriptions[1].Classes[0].CircuitState)
+	assert.NotNil(t, state.Subscriptions[1].Classes[0].OpenUntil)
+	assert.Equal(t, 1, state.Subscriptions[1].Classes[0].ConsecutiveFailures)
+}
+
+func TestLimitedClientFactory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	mockFactory := mock_azclient.NewMockClientFactory(ctrl)
+	mockDiskClient := mock_diskclient.NewMockInterface(ctrl)
+	mockFactory.EXPECT().GetDiskClientForSub("sub").Return(mockDiskClient, nil).AnyTimes()
+	mockDiskClient.EXPECT().Get(gomock.Any(), "rg", "disk").Return(&armcompute.Disk{}, nil).Times(2)
+	mockDiskClient.EXPECT().Delete(gomock.Any(), "rg", "disk").Return(newARMResponseError(http.StatusTooManyRequests, "60")).Times(1)
+
+	factory := newLimitedClientFactory(mockFactory, l, "sub")
+	assert.Equal(t, factory, newLimitedClientFactory(factory, l, "sub"), "factory is not wrapped twice")
+	assert.Equal(t, mockFactory, newLimitedClientFactory(mockFactory, nil, "sub"))
+
+	diskClient, err := factory.GetDiskClientForSub("sub")
+	assert.NoError(t, err)
+	disk, err := diskClient.Get(context.Background(), "rg", "disk")
+	assert.NoError(t, err)
+	assert.NotNil(t, disk)
+	assert.Error(t, diskClient.Delete(context.Background(), "rg", "disk"))
+
+	// the circuit of disk writes is open after Retry-After, calls fail fast without reaching ARM
+	assert.Equal(t, codes.Unavailable, status.Code(diskClient.Delete(context.Background(), "rg", "disk")))
+	// disk reads are served
+	_, err = diskClient.Get(context.Background(), "rg", "disk")
+	assert.NoError(t, err)
+}
+
+func TestLimitCloudClients(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	l := newTestARMLimiter(&now)
+	testCloud := provider.GetTestCloud(ctrl)
+	mockVMClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+	mockVMSSVMClient := testCloud.VirtualMachineScaleSetVMsClient.(*mockvmssvmclient.MockInterface)
+	throttled := &retry.Error{Retriable: true, HTTPStatusCode: http.StatusTooManyRequests, RetryAfter: now.Add(time.Minute), RawError: errors.New("throttled")}
+	mockVMClient.EXPECT().Get(gomock.Any(), "rg", "vm", gomock.Any()).Return(compute.VirtualMachine{}, throttled).Times(1)
+	mockVMSSVMClient.EXPECT().Get(gomock.Any(), "rg", "vmss", "0", gomock.Any()).Return(compute.VirtualMachineScaleSetVM{}, nil).Times(1)
+
+	limitCloudClients(testCloud, l)
+	limitCloudClients(testCloud, l)
+	client, ok := testCloud.VirtualMachinesClient.(*limitedLegacyVMClient)
+	assert.True(t, ok)
+	assert.Equal(t, mockVMClient, client.Interface, "client is not wrapped twice")
+	_, ok = testCloud.ComputeClientFactory.(*limitedClientFactory)
+	assert.True(t, ok)
+
+	_, rerr := testCloud.VirtualMachinesClient.Get(context.Background(), "rg", "vm", "")
+	assert.Equal(t, throttled, rerr)
+	open, retryAt := l.isOpen("subscription", armVMRead)
+	assert.True(t, open, "Retry-After of the cloud provider client opens the circuit")
+	assert.Equal(t, now.Add(time.Minute), retryAt)
+
+	// calls fail fast without reaching ARM
+	_, rerr = testCloud.VirtualMachinesClient.Get(context.Background(), "rg", "vm", "")
+	assert.NotNil(t, rerr)
+	assert.True(t, rerr.Retriable)
+	assert.Equal(t, now.Add(time.Minute), rerr.RetryAfter)
+	_, rerr = testCloud.VirtualMachineScaleSetVMsClient.Get(context.Background(), "rg", "vmss", "0", "")
+	assert.NotNil(t, rerr)
+
+	// calls reach ARM again after Retry-After
+	now = now.Add(2 * time.Minute)
+	_, rerr = testCloud.VirtualMachineScaleSetVMsClient.Get(context.Background(), "rg", "vmss", "0", "")
+	assert.Nil(t, rerr)
+}
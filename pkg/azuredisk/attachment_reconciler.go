@@ -0,0 +1,436 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+)
+
+const (
+	// AttachmentReconcileModeReport only reports dangling and orphaned attachments through events and metrics
+	AttachmentReconcileModeReport = "report"
+	// AttachmentReconcileModeFix detaches dangling disks in addition to reporting them
+	AttachmentReconcileModeFix = "fix"
+
+	danglingAttachmentReason = "DanglingDiskAttachment"
+	orphanedAttachmentReason = "OrphanedVolumeAttachment"
+	reconcileDetachReason    = "DanglingDiskDetached"
+	reconcileDetachFailed    = "DanglingDiskDetachFailed"
+
+	// value of consts.CreatedByTag set on disks created by the driver
+	azureDDCreatedByTagValue = "kubernetes-azure-dd"
+
+	// time after which another controller replica takes over the attachment reconciler of a replica that stopped renewing its Lease
+	attachmentReconcileLeaseDuration = 30 * time.Second
+)
+
+// volumeAttachmentRef is the VolumeAttachment of a disk on a node
+type volumeAttachmentRef struct {
+	name     string
+	attached bool
+}
+
+// attachmentCloud is the subset of the disk controller used by the attachment reconciler
+type attachmentCloud interface {
+	GetNodeDataDisks(nodeName types.NodeName, crt azcache.AzureCacheReadType) ([]*armcompute.DataDisk, *string, error)
+	DetachDisk(ctx context.Context, diskName, diskURI string, nodeName types.NodeName) error
+}
+
+// attachmentReconciler periodically compares the data disks attached to every node with
+// the VolumeAttachments of the driver, and reports (or detaches) disks left attached after
+// a failed detach or a controller crash.
+type attachmentReconciler struct {
+	driverName    string
+	mode          string
+	interval      time.Duration
+	allowlist     []*regexp.Regexp
+	kubeClient    clientset.Interface
+	cloud         attachmentCloud
+	clientFactory azclient.ClientFactory
+	recorder      record.EventRecorder
+	// leaderElection runs the reconciler in one controller replica at a time, nil runs it in every replica
+	leaderElection *leaderelection.LeaderElectionConfig
+	// runMu keeps a pass started after re-election from racing with the pass stopped by the lost election
+	runMu sync.Mutex
+
+	// <lower-case diskURI, is driver-owned>, disk tags are immutable in practice so they are only fetched once
+	ownership sync.Map
+	// dangling disks found in the previous pass, <node/diskURI, first seen>
+	// a disk is only detached when it's dangling in two consecutive passes to avoid racing with in-flight attaches
+	suspects map[string]time.Time
+	// nodes reported in metrics by the previous pass, their metrics are deleted once they leave the cluster
+	reportedNodes map[string]bool
+}
+
+// newAttachmentReconciler returns an attachmentReconciler. mode defaults to report (dry-run), allowlist is a comma separated
+// list of regular expressions matching the names or URIs of disks attached outside of the driver.
+func newAttachmentReconciler(driverName, mode string, interval time.Duration, allowlist string, kubeClient clientset.Interface,
+	cloud attachmentCloud, clientFactory azclient.ClientFactory) (*attachmentReconciler, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		mode = AttachmentReconcileModeReport
+	case AttachmentReconcileModeReport, AttachmentReconcileModeFix:
+		mode = strings.ToLower(mode)
+	default:
+		return nil, fmt.Errorf("attachment reconcile mode(%s) is not supported, supported values are %s, %s", mode, AttachmentReconcileModeReport, AttachmentReconcileModeFix)
+	}
+	if kubeClient == nil {
+		return nil, fmt.Errorf("kubeClient is nil")
+	}
+
+	var patterns []*regexp.Regexp
+	for _, p := range strings.Split(allowlist, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment reconcile allowlist entry(%s): %v", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	registerMetrics()
+	return &attachmentReconciler{
+		driverName:    driverName,
+		mode:          mode,
+		interval:      interval,
+		allowlist:     patterns,
+		kubeClient:    kubeClient,
+		cloud:         cloud,
+		clientFactory: clientFactory,
+		recorder:      newEventRecorder(kubeClient, driverName),
+		suspects:      map[string]time.Time{},
+		reportedNodes: map[string]bool{},
+	}, nil
+}
+
+// newLeaderElectionConfig returns the config of a leader election through the Lease name/namespace,
+// identity defaults to the host name (pod name)
+func newLeaderElectionConfig(name, namespace, identity string, leaseDuration time.Duration, kubeClient clientset.Interface) (*leaderelection.LeaderElectionConfig, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("kubeClient is nil")
+	}
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get host name as leader identity: %v", err)
+		}
+		identity = hostname
+	}
+	if leaseDuration <= 0 {
+		return nil, fmt.Errorf("leader lease duration(%v) must be positive", leaseDuration)
+	}
+	return &leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Client:     kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: strings.ToLower(identity)},
+		},
+		Name:            name,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseDuration * 2 / 3,
+		RetryPeriod:     leaseDuration / 3,
+		ReleaseOnCancel: true,
+	}, nil
+}
+
+// Run reconciles attachments every interval until ctx is done, only while this replica is the elected leader if
+// leaderElection is set. The replica takes part in the election again after losing it.
+func (r *attachmentReconciler) Run(ctx context.Context) {
+	if r.leaderElection == nil {
+		r.run(ctx)
+		return
+	}
+	config := *r.leaderElection
+	config.Callbacks = leaderelection.LeaderCallbacks{
+		OnStartedLeading: r.run,
+		OnStoppedLeading: func() {
+			klog.V(2).Infof("attachment reconciler is no longer the leader of %s", config.Name)
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		klog.Errorf("failed to create leader elector of attachment reconciler: %v", err)
+		return
+	}
+	wait.UntilWithContext(ctx, elector.Run, config.RetryPeriod)
+}
+
+func (r *attachmentReconciler) run(ctx context.Context) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+	klog.V(2).Infof("starting attachment reconciler with mode(%s), interval(%v), allowlist(%v)", r.mode, r.interval, r.allowlist)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.reconcile(ctx); err != nil {
+			klog.Errorf("attachment reconcile failed with %v", err)
+		}
+	}, r.interval)
+	klog.V(2).Infof("attachment reconciler stopped")
+	// another replica reports the nodes from now on, dangling disks must be seen again before being detached
+	r.forgetNodes(map[string]bool{})
+	r.suspects = map[string]time.Time{}
+}
+
+// reconcile runs one pass over all nodes in the cluster
+func (r *attachmentReconciler) reconcile(ctx context.Context) error {
+	nodes, err := r.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes failed with %v", err)
+	}
+	attachments, err := r.getVolumeAttachmentsByNode(ctx)
+	if err != nil {
+		return err
+	}
+
+	suspects := map[string]time.Time{}
+	nodeNames := map[string]bool{}
+	for _, node := range nodes.Items {
+		nodeName := strings.ToLower(node.Name)
+		nodeNames[nodeName] = true
+		if err := r.reconcileNode(ctx, nodeName, attachments[nodeName], suspects); err != nil {
+			klog.Warningf("attachment reconcile on node(%s) failed with %v", nodeName, err)
+		}
+	}
+	r.suspects = suspects
+	r.forgetNodes(nodeNames)
+	return nil
+}
+
+// forgetNodes deletes the metrics of reported nodes not in nodeNames
+func (r *attachmentReconciler) forgetNodes(nodeNames map[string]bool) {
+	for nodeName := range r.reportedNodes {
+		if nodeNames[nodeName] {
+			continue
+		}
+		klog.V(4).Infof("delete attachment reconciler metrics of node(%s)", nodeName)
+		danglingAttachments.DeleteLabelValues(nodeName)
+		orphanedAttachments.DeleteLabelValues(nodeName)
+		reconcileDetachCount.DeleteLabelValues(nodeName, "succeeded")
+		reconcileDetachCount.DeleteLabelValues(nodeName, "failed")
+	}
+	r.reportedNodes = nodeNames
+}
+
+// reconcileNode compares data disks on nodeName with its VolumeAttachments, <lower-case diskURI, VolumeAttachment>
+func (r *attachmentReconciler) reconcileNode(ctx context.Context, nodeName string, attachments map[string]volumeAttachmentRef, suspects map[string]time.Time) error {
+	disks, _, err := r.cloud.GetNodeDataDisks(types.NodeName(nodeName), azcache.CacheReadTypeDefault)
+	if err != nil {
+		return err
+	}
+
+	attachedDisks := map[string]bool{}
+	dangling := 0
+	for _, disk := range disks {
+		if disk == nil || disk.ManagedDisk == nil || disk.ManagedDisk.ID == nil {
+			continue
+		}
+		diskURI := strings.ToLower(*disk.ManagedDisk.ID)
+		attachedDisks[diskURI] = true
+		if disk.ToBeDetached != nil && *disk.ToBeDetached {
+			continue
+		}
+		if _, ok := attachments[diskURI]; ok {
+			continue
+		}
+		if r.isAllowlisted(diskURI) {
+			klog.V(6).Infof("disk(%s) on node(%s) is in attachment reconcile allowlist, skip", diskURI, nodeName)
+			continue
+		}
+		owned, err := r.isDriverOwned(ctx, diskURI)
+		if err != nil {
+			klog.Warningf("could not determine owner of disk(%s) on node(%s): %v", diskURI, nodeName, err)
+			continue
+		}
+		if !owned {
+			continue
+		}
+
+		dangling++
+		key := nodeName + "/" + diskURI
+		firstSeen, seenBefore := r.suspects[key]
+		if !seenBefore {
+			firstSeen = time.Now()
+		}
+		suspects[key] = firstSeen
+		msg := fmt.Sprintf("disk(%s) is attached to node(%s) on lun(%d) without a VolumeAttachment since %s", diskURI, nodeName, pointer.Int32Deref(disk.Lun, -1), firstSeen.Format(time.RFC3339))
+		klog.Warningf("%s", msg)
+		r.recorder.Event(nodeReference(nodeName), v1.EventTypeWarning, danglingAttachmentReason, msg)
+
+		if r.mode == AttachmentReconcileModeFix && seenBefore {
+			r.detachDanglingDisk(ctx, nodeName, diskURI, pointer.StringDeref(disk.Name, ""))
+		}
+	}
+	danglingAttachments.WithLabelValues(nodeName).Set(float64(dangling))
+
+	orphaned := 0
+	for diskURI, va := range attachments {
+		if !va.attached || attachedDisks[diskURI] {
+			continue
+		}
+		orphaned++
+		msg := fmt.Sprintf("VolumeAttachment(%s) reports disk(%s) attached to node(%s), but the disk is not found on the node", va.name, diskURI, nodeName)
+		klog.Warningf("%s", msg)
+		r.recorder.Event(nodeReference(nodeName), v1.EventTypeWarning, orphanedAttachmentReason, msg)
+	}
+	orphanedAttachments.WithLabelValues(nodeName).Set(float64(orphaned))
+	return nil
+}
+
+func (r *attachmentReconciler) detachDanglingDisk(ctx context.Context, nodeName, diskURI, diskName string) {
+	if diskName == "" {
+		diskName, _ = azureutils.GetDiskName(diskURI)
+	}
+	klog.V(2).Infof("attachment reconciler begins to detach dangling disk(%s) from node(%s)", diskURI, nodeName)
+	if err := r.cloud.DetachDisk(ctx, diskName, diskURI, types.NodeName(nodeName)); err != nil {
+		reconcileDetachCount.WithLabelValues(nodeName, "failed").Inc()
+		r.recorder.Eventf(nodeReference(nodeName), v1.EventTypeWarning, reconcileDetachFailed, "detach dangling disk(%s) failed with %v", diskURI, err)
+		klog.Errorf("attachment reconciler failed to detach dangling disk(%s) from node(%s): %v", diskURI, nodeName, err)
+		return
+	}
+	reconcileDetachCount.WithLabelValues(nodeName, "succeeded").Inc()
+	r.recorder.Eventf(nodeReference(nodeName), v1.EventTypeNormal, reconcileDetachReason, "dangling disk(%s) detached", diskURI)
+	klog.V(2).Infof("attachment reconciler detached dangling disk(%s) from node(%s) successfully", diskURI, nodeName)
+}
+
+// getVolumeAttachmentsByNode returns <lower-case node name, <lower-case diskURI, VolumeAttachment>> of the driver
+func (r *attachmentReconciler) getVolumeAttachmentsByNode(ctx context.Context) (map[string]map[string]volumeAttachmentRef, error) {
+	volumeAttachments, err := r.kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list VolumeAttachments failed with %v", err)
+	}
+	pvs, err := r.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list PersistentVolumes failed with %v", err)
+	}
+	volumeHandles := map[string]string{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == r.driverName {
+			volumeHandles[pv.Name] = pv.Spec.CSI.VolumeHandle
+		} else if pv.Spec.AzureDisk != nil {
+			// in-tree PVs migrated to the driver are attached with the VolumeAttachments of the driver
+			volumeHandles[pv.Name] = pv.Spec.AzureDisk.DataDiskURI
+		}
+	}
+
+	result := map[string]map[string]volumeAttachmentRef{}
+	for _, va := range volumeAttachments.Items {
+		if va.Spec.Attacher != r.driverName {
+			continue
+		}
+		var diskURI string
+		if pvName := pointer.StringDeref(va.Spec.Source.PersistentVolumeName, ""); pvName != "" {
+			diskURI = volumeHandles[pvName]
+		} else if va.Spec.Source.InlineVolumeSpec != nil && va.Spec.Source.InlineVolumeSpec.CSI != nil {
+			diskURI = va.Spec.Source.InlineVolumeSpec.CSI.VolumeHandle
+		} else if va.Spec.Source.InlineVolumeSpec != nil && va.Spec.Source.InlineVolumeSpec.AzureDisk != nil {
+			diskURI = va.Spec.Source.InlineVolumeSpec.AzureDisk.DataDiskURI
+		}
+		if diskURI == "" {
+			klog.V(4).Infof("could not find volume handle of VolumeAttachment(%s)", va.Name)
+			continue
+		}
+		// VolumeAttachments being attached or detached are also counted since they still hold the disk
+		nodeName := strings.ToLower(va.Spec.NodeName)
+		if _, ok := result[nodeName]; !ok {
+			result[nodeName] = map[string]volumeAttachmentRef{}
+		}
+		result[nodeName][strings.ToLower(diskURI)] = volumeAttachmentRef{name: va.Name, attached: va.Status.Attached}
+	}
+	return result, nil
+}
+
+// isDriverOwned returns true if the disk carries the tags set by the driver on disk creation
+func (r *attachmentReconciler) isDriverOwned(ctx context.Context, diskURI string) (bool, error) {
+	if v, ok := r.ownership.Load(diskURI); ok {
+		return v.(bool), nil
+	}
+	diskName, err := azureutils.GetDiskName(diskURI)
+	if err != nil {
+		return false, err
+	}
+	resourceGroup, err := azureutils.GetResourceGroupFromURI(diskURI)
+	if err != nil {
+		return false, err
+	}
+	diskClient, err := r.clientFactory.GetDiskClientForSub(azureutils.GetSubscriptionIDFromURI(diskURI))
+	if err != nil {
+		return false, err
+	}
+	disk, err := diskClient.Get(ctx, resourceGroup, diskName)
+	if err != nil {
+		return false, err
+	}
+	owned := isDriverOwnedDisk(disk)
+	r.ownership.Store(diskURI, owned)
+	return owned, nil
+}
+
+func (r *attachmentReconciler) isAllowlisted(diskURI string) bool {
+	diskName, _ := azureutils.GetDiskName(diskURI)
+	for _, re := range r.allowlist {
+		if re.MatchString(diskURI) || (diskName != "" && re.MatchString(diskName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDriverOwnedDisk returns true if the disk is created by the driver or bound to a PV
+func isDriverOwnedDisk(disk *armcompute.Disk) bool {
+	if disk == nil {
+		return false
+	}
+	if v, ok := disk.Tags[azureconsts.CreatedByTag]; ok && strings.EqualFold(pointer.StringDeref(v, ""), azureDDCreatedByTagValue) {
+		return true
+	}
+	_, ok := disk.Tags[consts.PvNameTag]
+	return ok
+}
+
+func nodeReference(nodeName string) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: nodeName,
+		UID:  types.UID(nodeName),
+	}
+}
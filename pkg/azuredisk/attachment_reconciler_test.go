@@ -0,0 +1,494 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+)
+
+const (
+	testReconcileNode   = "node-0"
+	testReconcileDiskID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/%s"
+)
+
+type fakeAttachmentCloud struct {
+	dataDisks map[string][]*armcompute.DataDisk
+	detached  []string
+	detachErr error
+}
+
+func (f *fakeAttachmentCloud) GetNodeDataDisks(nodeName types.NodeName, _ azcache.AzureCacheReadType) ([]*armcompute.DataDisk, *string, error) {
+	return f.dataDisks[string(nodeName)], nil, nil
+}
+
+func (f *fakeAttachmentCloud) DetachDisk(_ context.Context, _, diskURI string, _ types.NodeName) error {
+	if f.detachErr != nil {
+		return f.detachErr
+	}
+	f.detached = append(f.detached, diskURI)
+	return nil
+}
+
+func newTestDataDisk(name string, lun int32) *armcompute.DataDisk {
+	return &armcompute.DataDisk{
+		Name:        pointer.String(name),
+		Lun:         pointer.Int32(lun),
+		ManagedDisk: &armcompute.ManagedDiskParameters{ID: pointer.String(fmt.Sprintf(testReconcileDiskID, name))},
+	}
+}
+
+func newTestVolumeAttachment(name, pvName, nodeName string, attached bool) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: consts.DefaultDriverName,
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: pointer.String(pvName)},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+	}
+}
+
+func newTestCSIPersistentVolume(name, diskName string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       consts.DefaultDriverName,
+					VolumeHandle: fmt.Sprintf(testReconcileDiskID, diskName),
+				},
+			},
+		},
+	}
+}
+
+func newTestAttachmentReconciler(t *testing.T, ctrl *gomock.Controller, mode, allowlist string, cloud attachmentCloud,
+	diskTags map[string]map[string]*string, objects ...runtime.Object) (*attachmentReconciler, *record.FakeRecorder) {
+	objects = append(objects, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testReconcileNode}})
+	kubeClient := fake.NewSimpleClientset(objects...)
+
+	diskClient := mock_diskclient.NewMockInterface(ctrl)
+	diskClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, diskName string) (*armcompute.Disk, error) {
+			return &armcompute.Disk{Name: pointer.String(diskName), Tags: diskTags[diskName]}, nil
+		}).AnyTimes()
+	clientFactory := mock_azclient.NewMockClientFactory(ctrl)
+	clientFactory.EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+
+	r, err := newAttachmentReconciler(consts.DefaultDriverName, mode, 0, allowlist, kubeClient, cloud, clientFactory)
+	assert.NoError(t, err)
+	recorder := record.NewFakeRecorder(100)
+	r.recorder = recorder
+	return r, recorder
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func countEvents(events []string, reason string) int {
+	count := 0
+	for _, e := range events {
+		if strings.Contains(e, " "+reason+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestNewAttachmentReconciler(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	tests := []struct {
+		desc         string
+		mode         string
+		allowlist    string
+		expectedMode string
+		expectErr    bool
+	}{
+		{
+			desc:         "empty mode defaults to report",
+			expectedMode: AttachmentReconcileModeReport,
+		},
+		{
+			desc:         "fix mode is case insensitive",
+			mode:         "Fix",
+			expectedMode: AttachmentReconcileModeFix,
+		},
+		{
+			desc:      "unsupported mode",
+			mode:      "delete",
+			expectErr: true,
+		},
+		{
+			desc:      "invalid allowlist",
+			allowlist: "disk-(",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		r, err := newAttachmentReconciler(consts.DefaultDriverName, test.mode, 0, test.allowlist, kubeClient, &fakeAttachmentCloud{}, nil)
+		if test.expectErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedMode, r.mode, test.desc)
+	}
+
+	_, err := newAttachmentReconciler(consts.DefaultDriverName, "", 0, "", nil, &fakeAttachmentCloud{}, nil)
+	assert.Error(t, err)
+}
+
+func TestNewLeaderElectionConfig(t *testing.T) {
+	_, err := newLeaderElectionConfig("reconciler", "kube-system", "replica-0", 30*time.Second, nil)
+	assert.Error(t, err, "kubeClient is required")
+	_, err = newLeaderElectionConfig("reconciler", "kube-system", "replica-0", 0, fake.NewSimpleClientset())
+	assert.Error(t, err, "lease duration must be positive")
+
+	config, err := newLeaderElectionConfig("reconciler", "kube-system", "Replica-0", 30*time.Second, fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Equal(t, "replica-0", config.Lock.Identity())
+	assert.Equal(t, "kube-system/reconciler", config.Lock.Describe())
+	assert.Equal(t, 20*time.Second, config.RenewDeadline)
+	assert.Equal(t, 10*time.Second, config.RetryPeriod)
+	assert.True(t, config.ReleaseOnCancel)
+}
+
+func TestAttachmentReconcileLeaderElection(t *testing.T) {
+	const leaseName = "disk-csi-azure-com-attachment-reconciler"
+	tests := []struct {
+		desc         string
+		holder       string
+		expectLeader bool
+	}{
+		{
+			desc:         "reconcile while leading and release the Lease when ctx is done",
+			expectLeader: true,
+		},
+		{
+			desc:   "do not reconcile while another replica holds the Lease",
+			holder: "replica-1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			cloud := &fakeAttachmentCloud{dataDisks: map[string][]*armcompute.DataDisk{}}
+			r, _ := newTestAttachmentReconciler(t, ctrl, AttachmentReconcileModeReport, "", cloud, nil)
+			r.interval = time.Hour
+			if test.holder != "" {
+				_, err := r.kubeClient.CoordinationV1().Leases("kube-system").Create(context.Background(), &coordinationv1.Lease{
+					ObjectMeta: metav1.ObjectMeta{Name: leaseName, Namespace: "kube-system"},
+					Spec: coordinationv1.LeaseSpec{
+						HolderIdentity:       pointer.String(test.holder),
+						LeaseDurationSeconds: pointer.Int32(60),
+						AcquireTime:          &metav1.MicroTime{Time: time.Now()},
+						RenewTime:            &metav1.MicroTime{Time: time.Now()},
+					},
+				}, metav1.CreateOptions{})
+				assert.NoError(t, err)
+			}
+			var err error
+			r.leaderElection, err = newLeaderElectionConfig(leaseName, "kube-system", "replica-0", 3*time.Second, r.kubeClient)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				r.Run(ctx)
+			}()
+			getHolder := func() string {
+				lease, err := r.kubeClient.CoordinationV1().Leases("kube-system").Get(context.Background(), leaseName, metav1.GetOptions{})
+				if err != nil {
+					return ""
+				}
+				return pointer.StringDeref(lease.Spec.HolderIdentity, "")
+			}
+			reconciled := func() bool {
+				for _, action := range r.kubeClient.(*fake.Clientset).Actions() {
+					if action.Matches("list", "nodes") {
+						return true
+					}
+				}
+				return false
+			}
+			if test.expectLeader {
+				assert.Eventually(t, func() bool { return getHolder() == "replica-0" && reconciled() }, 5*time.Second, 10*time.Millisecond)
+			} else {
+				time.Sleep(200 * time.Millisecond)
+				assert.Equal(t, test.holder, getHolder())
+			}
+			cancel()
+			<-stopped
+
+			r.runMu.Lock()
+			defer r.runMu.Unlock()
+			assert.Equal(t, test.expectLeader, reconciled())
+			if test.expectLeader {
+				assert.Empty(t, getHolder(), "the Lease is released")
+			} else {
+				assert.Equal(t, test.holder, getHolder())
+			}
+		})
+	}
+}
+
+func TestAttachmentReconcile(t *testing.T) {
+	ownedTags := map[string]*string{azureconsts.CreatedByTag: pointer.String(azureDDCreatedByTagValue)}
+	diskTags := map[string]map[string]*string{
+		"dangling":  ownedTags,
+		"attached":  ownedTags,
+		"pvtagged":  {consts.PvNameTag: pointer.String("pv-x")},
+		"unmanaged": {"owner": pointer.String("someone")},
+		"allowed":   ownedTags,
+	}
+	objects := []runtime.Object{
+		newTestCSIPersistentVolume("pv-attached", "attached"),
+		newTestCSIPersistentVolume("pv-orphaned", "orphaned"),
+		newTestCSIPersistentVolume("pv-attaching", "attaching"),
+		newTestVolumeAttachment("va-attached", "pv-attached", testReconcileNode, true),
+		newTestVolumeAttachment("va-orphaned", "pv-orphaned", testReconcileNode, true),
+		newTestVolumeAttachment("va-attaching", "pv-attaching", testReconcileNode, false),
+	}
+	newCloud := func() *fakeAttachmentCloud {
+		detaching := newTestDataDisk("detaching", 5)
+		detaching.ToBeDetached = pointer.Bool(true)
+		return &fakeAttachmentCloud{
+			dataDisks: map[string][]*armcompute.DataDisk{
+				testReconcileNode: {
+					newTestDataDisk("dangling", 0),
+					newTestDataDisk("attached", 1),
+					newTestDataDisk("pvtagged", 2),
+					newTestDataDisk("unmanaged", 3),
+					newTestDataDisk("allowed", 4),
+					detaching,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		desc                  string
+		mode                  string
+		detachErr             error
+		expectedDangling      int
+		expectedOrphaned      int
+		expectedFirstDetached []string
+		expectedDetached      []string
+		expectedDetachEvents  int
+		expectedFailedEvents  int
+	}{
+		{
+			desc:             "report mode never detaches",
+			mode:             AttachmentReconcileModeReport,
+			expectedDangling: 4,
+			expectedOrphaned: 2,
+		},
+		{
+			desc:             "fix mode detaches dangling disks found in two consecutive passes",
+			mode:             AttachmentReconcileModeFix,
+			expectedDangling: 4,
+			expectedOrphaned: 2,
+			expectedDetached: []string{
+				strings.ToLower(fmt.Sprintf(testReconcileDiskID, "dangling")),
+				strings.ToLower(fmt.Sprintf(testReconcileDiskID, "pvtagged")),
+			},
+			expectedDetachEvents: 2,
+		},
+		{
+			desc:                 "fix mode reports detach failure",
+			mode:                 AttachmentReconcileModeFix,
+			detachErr:            fmt.Errorf("test error"),
+			expectedDangling:     4,
+			expectedOrphaned:     2,
+			expectedFailedEvents: 2,
+		},
+	}
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		cloud := newCloud()
+		cloud.detachErr = test.detachErr
+		r, recorder := newTestAttachmentReconciler(t, ctrl, test.mode, "^allow", cloud, diskTags, objects...)
+
+		// first pass only records suspects
+		assert.NoError(t, r.reconcile(context.Background()), test.desc)
+		assert.Empty(t, cloud.detached, test.desc)
+		assert.Len(t, r.suspects, 2, test.desc)
+
+		assert.NoError(t, r.reconcile(context.Background()), test.desc)
+		assert.ElementsMatch(t, test.expectedDetached, cloud.detached, test.desc)
+
+		events := drainEvents(recorder)
+		assert.Equal(t, test.expectedDangling, countEvents(events, danglingAttachmentReason), test.desc)
+		assert.Equal(t, test.expectedOrphaned, countEvents(events, orphanedAttachmentReason), test.desc)
+		assert.Equal(t, test.expectedDetachEvents, countEvents(events, reconcileDetachReason), test.desc)
+		assert.Equal(t, test.expectedFailedEvents, countEvents(events, reconcileDetachFailed), test.desc)
+		ctrl.Finish()
+	}
+}
+
+func TestAttachmentReconcileSuspectReset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	diskTags := map[string]map[string]*string{
+		"dangling": {azureconsts.CreatedByTag: pointer.String(azureDDCreatedByTagValue)},
+	}
+	cloud := &fakeAttachmentCloud{
+		dataDisks: map[string][]*armcompute.DataDisk{testReconcileNode: {newTestDataDisk("dangling", 0)}},
+	}
+	r, _ := newTestAttachmentReconciler(t, ctrl, AttachmentReconcileModeFix, "", cloud, diskTags)
+
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.Len(t, r.suspects, 1)
+
+	// the disk gets a VolumeAttachment before the second pass, so it must not be detached
+	_, err := r.kubeClient.CoreV1().PersistentVolumes().Create(context.Background(), newTestCSIPersistentVolume("pv-dangling", "dangling"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = r.kubeClient.StorageV1().VolumeAttachments().Create(context.Background(), newTestVolumeAttachment("va-dangling", "pv-dangling", testReconcileNode, false), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.Empty(t, r.suspects)
+	assert.Empty(t, cloud.detached)
+}
+
+func TestAttachmentReconcileMigratedVolume(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	diskTags := map[string]map[string]*string{
+		"migrated": {azureconsts.CreatedByTag: pointer.String(azureDDCreatedByTagValue)},
+		"inline":   {azureconsts.CreatedByTag: pointer.String(azureDDCreatedByTagValue)},
+	}
+	cloud := &fakeAttachmentCloud{
+		dataDisks: map[string][]*armcompute.DataDisk{testReconcileNode: {newTestDataDisk("migrated", 0), newTestDataDisk("inline", 1)}},
+	}
+	// in-tree PV migrated to the driver, its VolumeAttachment is created for the driver
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-migrated"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				AzureDisk: &v1.AzureDiskVolumeSource{
+					DiskName:    "migrated",
+					DataDiskURI: fmt.Sprintf(testReconcileDiskID, "migrated"),
+				},
+			},
+		},
+	}
+	inline := newTestVolumeAttachment("va-inline", "", testReconcileNode, true)
+	inline.Spec.Source = storagev1.VolumeAttachmentSource{
+		InlineVolumeSpec: &v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				AzureDisk: &v1.AzureDiskVolumeSource{
+					DiskName:    "inline",
+					DataDiskURI: fmt.Sprintf(testReconcileDiskID, "inline"),
+				},
+			},
+		},
+	}
+	r, recorder := newTestAttachmentReconciler(t, ctrl, AttachmentReconcileModeFix, "", cloud, diskTags,
+		pv, newTestVolumeAttachment("va-migrated", "pv-migrated", testReconcileNode, true), inline)
+
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.Empty(t, r.suspects)
+	assert.Empty(t, cloud.detached, "disks of migrated volumes are not dangling")
+	events := drainEvents(recorder)
+	assert.Zero(t, countEvents(events, danglingAttachmentReason))
+	assert.Zero(t, countEvents(events, orphanedAttachmentReason))
+}
+
+func TestIsDriverOwnedDisk(t *testing.T) {
+	tests := []struct {
+		desc     string
+		disk     *armcompute.Disk
+		expected bool
+	}{
+		{
+			desc: "nil disk",
+		},
+		{
+			desc:     "created by driver",
+			disk:     &armcompute.Disk{Tags: map[string]*string{azureconsts.CreatedByTag: pointer.String("Kubernetes-Azure-DD")}},
+			expected: true,
+		},
+		{
+			desc:     "bound to pv",
+			disk:     &armcompute.Disk{Tags: map[string]*string{consts.PvNameTag: pointer.String("pv")}},
+			expected: true,
+		},
+		{
+			desc: "created by others",
+			disk: &armcompute.Disk{Tags: map[string]*string{azureconsts.CreatedByTag: pointer.String("other")}},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isDriverOwnedDisk(test.disk), test.desc)
+	}
+}
+
+func TestAttachmentReconcileForgetNodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloud := &fakeAttachmentCloud{dataDisks: map[string][]*armcompute.DataDisk{}}
+	r, _ := newTestAttachmentReconciler(t, ctrl, AttachmentReconcileModeReport, "", cloud, nil,
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-removed"}})
+
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.Equal(t, map[string]bool{testReconcileNode: true, "node-removed": true}, r.reportedNodes)
+
+	assert.NoError(t, r.kubeClient.CoreV1().Nodes().Delete(context.Background(), "node-removed", metav1.DeleteOptions{}))
+	assert.NoError(t, r.reconcile(context.Background()))
+	assert.Equal(t, map[string]bool{testReconcileNode: true}, r.reportedNodes)
+	// metrics of the removed node are already deleted, those of the remaining node are not
+	assert.False(t, danglingAttachments.DeleteLabelValues("node-removed"))
+	assert.False(t, orphanedAttachments.DeleteLabelValues("node-removed"))
+	assert.True(t, danglingAttachments.DeleteLabelValues(testReconcileNode))
+}
@@ -35,14 +35,33 @@ import (
 const sysClassBlockPath = "/sys/class/block/"
 
 // Note: This file is added only to ensure that the UTs can be run from MacOS.
-func scsiHostRescan(io azureutils.IOHandler, m *mount.SafeFormatAndMount) {
+func scsiHostRescan(io azureutils.IOHandler, m *mount.SafeFormatAndMount, lun int) {
 }
 
 func formatAndMount(source, target, fstype string, options []string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
 
-func findDiskByLun(lun int, io azureutils.IOHandler, m *mount.SafeFormatAndMount) (string, error) {
+func getDiskFormat(source string, m *mount.SafeFormatAndMount) (string, error) {
+	return "", nil
+}
+
+func formatWithOptions(source, fstype string, args []string, m *mount.SafeFormatAndMount) (bool, error) {
+	return false, nil
+}
+
+func recordMkfsOptions(target, mkfsOptions string) error {
+	return nil
+}
+
+func getRecordedMkfsOptions(target string) (string, bool, error) {
+	return "", false, nil
+}
+
+func nvmeControllerRescan(io azureutils.IOHandler) {
+}
+
+func findDiskByLun(lun int, io azureutils.IOHandler, m *mount.SafeFormatAndMount, diskControllerType string) (string, error) {
 	return "", fmt.Errorf("findDiskByLun not implemented")
 }
 
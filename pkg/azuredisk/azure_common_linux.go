@@ -21,6 +21,7 @@ package azuredisk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -28,11 +29,13 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
 	mount "k8s.io/mount-utils"
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
 )
 
@@ -81,12 +84,17 @@ func getDiskLinkByDevName(io azureutils.IOHandler, devLinkPath, devName string)
 	return "", fmt.Errorf("read %s error: %v", devLinkPath, err)
 }
 
-func scsiHostRescan(io azureutils.IOHandler, _ *mount.SafeFormatAndMount) {
+// scsiHostRescan scans lun on the hosts of the Hyper-V storage controller instead of all devices on all hosts
+func scsiHostRescan(io azureutils.IOHandler, _ *mount.SafeFormatAndMount, lun int) {
 	scsiPath := "/sys/class/scsi_host/"
 	if dirs, err := io.ReadDir(scsiPath); err == nil {
 		for _, f := range dirs {
+			if procName, err := io.ReadFile(scsiPath + f.Name() + "/proc_name"); err == nil && strings.TrimSpace(string(procName)) != "storvsc" {
+				klog.V(6).Infof("skip rescanning scsi host %s of %s", f.Name(), strings.TrimSpace(string(procName)))
+				continue
+			}
 			name := scsiPath + f.Name() + "/scan"
-			data := []byte("- - -")
+			data := []byte(fmt.Sprintf("- - %d", lun))
 			if err = io.WriteFile(name, data, 0666); err != nil {
 				klog.Warningf("failed to rescan scsi host %s", name)
 			}
@@ -96,15 +104,70 @@ func scsiHostRescan(io azureutils.IOHandler, _ *mount.SafeFormatAndMount) {
 	}
 }
 
-func findDiskByLun(lun int, io azureutils.IOHandler, _ *mount.SafeFormatAndMount) (string, error) {
-	azureDisks := listAzureDiskPath(io)
-	return findDiskByLunWithConstraint(lun, io, azureDisks)
+// findDiskByLun finds the data disk on lun attached to the SCSI or NVMe controller of diskControllerType,
+// the disk is looked up on SCSI first and then on NVMe if diskControllerType is empty
+func findDiskByLun(lun int, io azureutils.IOHandler, _ *mount.SafeFormatAndMount, diskControllerType string) (string, error) {
+	if diskControllerType != consts.DiskControllerTypeNVMe {
+		azureDisks := listAzureDiskPath(io)
+		diskPath, err := findDiskByLunWithConstraint(lun, io, azureDisks)
+		if err != nil || diskPath != "" || diskControllerType == consts.DiskControllerTypeSCSI {
+			return diskPath, err
+		}
+	}
+	return findNVMeDiskByLun(lun, io)
 }
 
 func formatAndMount(source, target, fstype string, options []string, m *mount.SafeFormatAndMount) error {
 	return m.FormatAndMount(source, target, fstype, options)
 }
 
+// getDiskFormat returns the filesystem or partition table type found on source, empty if none
+func getDiskFormat(source string, m *mount.SafeFormatAndMount) (string, error) {
+	return m.GetDiskFormat(source)
+}
+
+// formatWithOptions formats source as fstype with mkfs arguments args if it is not formatted yet,
+// returns whether source was formatted
+func formatWithOptions(source, fstype string, args []string, m *mount.SafeFormatAndMount) (bool, error) {
+	existingFormat, err := m.GetDiskFormat(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to get disk format of %s: %v", source, err)
+	}
+	if existingFormat != "" {
+		return false, nil
+	}
+
+	// same defaults as mount-utils, args take precedence
+	mkfsArgs := []string{"-F", "-m0"}
+	if fstype == "xfs" {
+		mkfsArgs = []string{"-f"}
+	}
+	mkfsArgs = append(append(mkfsArgs, args...), source)
+	klog.V(2).Infof("formatting %s as %s with options %v", source, fstype, mkfsArgs)
+	if output, err := m.Exec.Command("mkfs."+fstype, mkfsArgs...).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("mkfs.%s %v failed with %v, output: %s", fstype, mkfsArgs, err, string(output))
+	}
+	return true, nil
+}
+
+// recordMkfsOptions records the mkfs options of the filesystem mounted at target in an xattr of its root directory
+func recordMkfsOptions(target, mkfsOptions string) error {
+	return unix.Setxattr(target, consts.MkfsOptionsXattr, []byte(mkfsOptions), 0)
+}
+
+// getRecordedMkfsOptions returns the mkfs options recorded on the filesystem mounted at target, ok is false if there is none
+func getRecordedMkfsOptions(target string) (string, bool, error) {
+	buf := make([]byte, 4096)
+	n, err := unix.Getxattr(target, consts.MkfsOptionsXattr, buf)
+	if err != nil {
+		if errors.Is(err, unix.ENODATA) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return string(buf[:n]), true, nil
+}
+
 // finds a device mounted to "current" node
 func findDiskByLunWithConstraint(lun int, io azureutils.IOHandler, azureDisks []string) (string, error) {
 	var err error
@@ -243,16 +306,28 @@ func needResizeVolume(devicePath, volumePath string, m *mount.SafeFormatAndMount
 }
 
 // rescanVolume rescan device for detecting device size expansion
-// devicePath e.g. `/dev/sdc`
+// devicePath e.g. `/dev/sdc`, `/dev/nvme0n2`, or a udev link like `/dev/disk/azure/data/by-lun/0`
 func rescanVolume(io azureutils.IOHandler, devicePath string) error {
 	klog.V(6).Infof("rescanVolume - begin to rescan %s", devicePath)
-	deviceName := filepath.Base(devicePath)
+	// the name of the device the udev link points to
+	deviceName, disk, _, err := getPartition(io, devicePath)
+	if err == nil && disk != "" {
+		// a partition has no device of its own, its disk is rescanned
+		deviceName = disk
+	}
 	rescanPath := filepath.Join(sysClassBlockPath, deviceName, "device/rescan")
+	if nvmeNamespaceRegexp.MatchString(deviceName) {
+		// the device of a namespace is its NVMe controller
+		rescanPath = filepath.Join(sysClassBlockPath, deviceName, "device/rescan_controller")
+	}
 	return io.WriteFile(rescanPath, []byte("1"), 0666)
 }
 
 // rescanAllVolumes rescan all sd* devices under /sys/class/block/sd* starting from sdc
+// and the NVMe controllers of remote disks
 func rescanAllVolumes(io azureutils.IOHandler) error {
+	nvmeControllerRescan(io)
+
 	dirs, err := io.ReadDir(sysClassBlockPath)
 	if err != nil {
 		return err
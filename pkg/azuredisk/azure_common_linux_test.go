@@ -20,7 +20,13 @@ import (
 	"runtime"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
 )
 
 func TestRescanAllVolumes(t *testing.T) {
@@ -32,3 +38,82 @@ func TestRescanAllVolumes(t *testing.T) {
 		t.Errorf("rescanAllVolumes failed with error: %v", err)
 	}
 }
+
+func TestFormatWithOptions(t *testing.T) {
+	blkidFormattedAction := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdc\nTYPE=ext4"), []byte{}, nil
+	}
+	blkidUnformattedAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	mkfsAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	mkfsFailedAction := func() ([]byte, []byte, error) {
+		return []byte("invalid blocksize"), []byte{}, &testingexec.FakeExitError{Status: 1}
+	}
+
+	tests := []struct {
+		desc              string
+		fstype            string
+		outputScripts     []testingexec.FakeAction
+		expectedFormatted bool
+		expectedMkfsArgs  []string
+		expectedErr       bool
+	}{
+		{
+			desc:          "already formatted",
+			fstype:        "ext4",
+			outputScripts: []testingexec.FakeAction{blkidFormattedAction},
+		},
+		{
+			desc:              "format ext4",
+			fstype:            "ext4",
+			outputScripts:     []testingexec.FakeAction{blkidUnformattedAction, mkfsAction},
+			expectedFormatted: true,
+			expectedMkfsArgs:  []string{"mkfs.ext4", "-F", "-m0", "-b", "4096", "/dev/sdc"},
+		},
+		{
+			desc:              "format xfs",
+			fstype:            "xfs",
+			outputScripts:     []testingexec.FakeAction{blkidUnformattedAction, mkfsAction},
+			expectedFormatted: true,
+			expectedMkfsArgs:  []string{"mkfs.xfs", "-f", "-b", "4096", "/dev/sdc"},
+		},
+		{
+			desc:          "mkfs failure",
+			fstype:        "ext4",
+			outputScripts: []testingexec.FakeAction{blkidUnformattedAction, mkfsFailedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		var mkfsArgs []string
+		fakeExec := &testingexec.FakeExec{ExactOrder: true}
+		for i, script := range test.outputScripts {
+			script := script
+			isMkfs := i == 1
+			fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+				if isMkfs {
+					mkfsArgs = append([]string{cmd}, args...)
+				}
+				fakeCmd := &testingexec.FakeCmd{
+					OutputScript:         []testingexec.FakeAction{script},
+					CombinedOutputScript: []testingexec.FakeAction{script},
+				}
+				return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+			})
+		}
+		m := &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: fakeExec}
+
+		formatted, err := formatWithOptions("/dev/sdc", test.fstype, []string{"-b", "4096"}, m)
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedFormatted, formatted, test.desc)
+		assert.Equal(t, test.expectedMkfsArgs, mkfsArgs, test.desc)
+	}
+}
@@ -33,7 +33,7 @@ func TestFindDiskByLun(t *testing.T) {
 		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
 	}
 	ioHandler := azureutils.NewFakeIOHandler()
-	disk, err := findDiskByLun(lun, ioHandler, nil)
+	disk, err := findDiskByLun(lun, ioHandler, nil, "")
 	if runtime.GOOS == "windows" {
 		if err != nil {
 			t.Errorf("no data disk found: disk %v err %v", disk, err)
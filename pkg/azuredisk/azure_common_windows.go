@@ -40,7 +40,23 @@ func formatAndMount(source, target, fstype string, options []string, m *mount.Sa
 	return fmt.Errorf("could not cast to csi proxy class")
 }
 
-func scsiHostRescan(io azureutils.IOHandler, m *mount.SafeFormatAndMount) {
+func getDiskFormat(source string, _ *mount.SafeFormatAndMount) (string, error) {
+	return "", fmt.Errorf("probing the disk format of %s is not supported on Windows", source)
+}
+
+func formatWithOptions(_, fstype string, _ []string, _ *mount.SafeFormatAndMount) (bool, error) {
+	return false, fmt.Errorf("mkfs options are not supported for %s on Windows", fstype)
+}
+
+func recordMkfsOptions(_, _ string) error {
+	return nil
+}
+
+func getRecordedMkfsOptions(_ string) (string, bool, error) {
+	return "", false, nil
+}
+
+func scsiHostRescan(_ azureutils.IOHandler, m *mount.SafeFormatAndMount, _ int) {
 	var err error
 	if proxy, ok := m.Interface.(mounter.CSIProxyMounter); ok {
 		err = proxy.Rescan()
@@ -53,8 +69,11 @@ func scsiHostRescan(io azureutils.IOHandler, m *mount.SafeFormatAndMount) {
 	}
 }
 
+func nvmeControllerRescan(_ azureutils.IOHandler) {
+}
+
 // search Windows disk number by LUN
-func findDiskByLun(lun int, iohandler azureutils.IOHandler, m *mount.SafeFormatAndMount) (string, error) {
+func findDiskByLun(lun int, iohandler azureutils.IOHandler, m *mount.SafeFormatAndMount, _ string) (string, error) {
 	if proxy, ok := m.Interface.(mounter.CSIProxyMounter); ok {
 		return proxy.FindDiskByLun(strconv.Itoa(lun))
 	}
@@ -0,0 +1,252 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/virtualmachineclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// a node is not tried with the AttachDetachDataDisks API again within this period after it's reported as unsupported
+	attachDetachDataDisksUnsupportedTTL = time.Hour
+)
+
+var (
+	// standalone VMs (availability set or VMSS flex) support the AttachDetachDataDisks API of virtual machines,
+	// VMSS uniform instances (.../virtualMachineScaleSets/<vmss>/virtualMachines/<id>) do not match
+	standaloneVMIDRE = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/virtualMachines/([^/]+)$`)
+
+	// error codes returned when the AttachDetachDataDisks operation is not available for the VM
+	attachDetachDataDisksUnsupportedCodes = []string{
+		"NotSupported",
+		"OperationNotAllowed",
+		"OperationNotSupported",
+		"FeatureNotSupported",
+		"InvalidResourceType",
+		"NoRegisteredProviderFound",
+		"InvalidApiVersionParameter",
+		"UnsupportedApiVersion",
+	}
+)
+
+// attachDisksToNode attaches disks in diskMap to nodeName with the AttachDetachDataDisks API if the node supports it,
+// otherwise with a full VM update through vmset.
+// compatible is false if any disk in diskMap could not be attached with the AttachDetachDataDisks API.
+func (c *controllerCommon) attachDisksToNode(ctx context.Context, vmset provider.VMSet, nodeName types.NodeName, diskMap map[string]*provider.AttachDiskOptions, compatible bool) error {
+	if compatible {
+		if resourceGroup, vmName, ok := c.getAttachDetachDataDisksVM(vmset, nodeName); ok {
+			request := armcompute.AttachDetachDataDisksRequest{}
+			for diskURI, options := range diskMap {
+				request.DataDisksToAttach = append(request.DataDisksToAttach, &armcompute.DataDisksToAttach{
+					DiskID: to.Ptr(diskURI),
+					Lun:    to.Ptr(options.Lun),
+				})
+			}
+			klog.V(2).Infof("azureDisk - attach disks(%v) to node(%s) with AttachDetachDataDisks API", diskMap, nodeName)
+			err := attachDetachDataDisks(ctx, c.clientFactory.GetVirtualMachineClient(), resourceGroup, vmName, request)
+			if err == nil || !c.markAttachDetachDataDisksUnsupported(nodeName, err) {
+				if err == nil {
+					_ = vmset.DeleteCacheForNode(string(nodeName))
+				}
+				return err
+			}
+		}
+	}
+	return c.armLimiter.do(ctx, c.cloud.SubscriptionID, armVMWrite, func() error {
+		return vmset.AttachDisk(ctx, nodeName, diskMap)
+	})
+}
+
+// detachDisksFromNode detaches disks in diskMap from nodeName with the AttachDetachDataDisks API if the node supports it,
+// otherwise with a full VM update through vmset.
+// Disks not attached to the node are skipped as vmset.DetachDisk does, so that a retried detach succeeds.
+func (c *controllerCommon) detachDisksFromNode(ctx context.Context, vmset provider.VMSet, nodeName types.NodeName, diskMap map[string]string, forceDetach bool) error {
+	if resourceGroup, vmName, ok := c.getAttachDetachDataDisksVM(vmset, nodeName); ok {
+		attached, err := filterAttachedDisks(vmset, nodeName, diskMap)
+		if err != nil {
+			return err
+		}
+		if len(attached) == 0 {
+			klog.V(2).Infof("azureDisk - disks(%v) are not attached to node(%s), skip detach", diskMap, nodeName)
+			return nil
+		}
+		request := armcompute.AttachDetachDataDisksRequest{}
+		for diskURI := range attached {
+			toDetach := &armcompute.DataDisksToDetach{DiskID: to.Ptr(diskURI)}
+			if forceDetach {
+				toDetach.DetachOption = to.Ptr(armcompute.DiskDetachOptionTypesForceDetach)
+			}
+			request.DataDisksToDetach = append(request.DataDisksToDetach, toDetach)
+		}
+		klog.V(2).Infof("azureDisk - detach disks(%v) from node(%s) with AttachDetachDataDisks API, forceDetach: %v", attached, nodeName, forceDetach)
+		err = attachDetachDataDisks(ctx, c.clientFactory.GetVirtualMachineClient(), resourceGroup, vmName, request)
+		if err == nil || !c.markAttachDetachDataDisksUnsupported(nodeName, err) {
+			_ = vmset.DeleteCacheForNode(string(nodeName))
+			return err
+		}
+	}
+	return c.armLimiter.do(ctx, c.cloud.SubscriptionID, armVMWrite, func() error {
+		return vmset.DetachDisk(ctx, nodeName, diskMap, forceDetach)
+	})
+}
+
+// filterAttachedDisks returns the disks in diskMap attached to nodeName, matched by name or managed disk ID like vmset.DetachDisk does
+func filterAttachedDisks(vmset provider.VMSet, nodeName types.NodeName, diskMap map[string]string) (map[string]string, error) {
+	dataDisks, _, err := vmset.GetDataDisks(nodeName, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]string, len(diskMap))
+	for diskURI, diskName := range diskMap {
+		found := false
+		for _, disk := range dataDisks {
+			if disk == nil {
+				continue
+			}
+			if (disk.Name != nil && diskName != "" && strings.EqualFold(*disk.Name, diskName)) ||
+				(disk.ManagedDisk != nil && disk.ManagedDisk.ID != nil && strings.EqualFold(*disk.ManagedDisk.ID, diskURI)) {
+				found = true
+				break
+			}
+		}
+		if found {
+			attached[diskURI] = diskName
+		} else {
+			klog.Warningf("azureDisk - disk(%s) is not attached to node(%s), skip detaching it", diskURI, nodeName)
+		}
+	}
+	return attached, nil
+}
+
+// attachDetachDataDisksKey returns the key of an attach request of diskURI to nodeName, a shared disk could be
+// attached to several nodes at the same time
+func attachDetachDataDisksKey(nodeName, diskURI string) string {
+	return strings.ToLower(nodeName) + "/" + strings.ToLower(diskURI)
+}
+
+// popAttachDetachDataDisksCompatible returns true if all disks in diskMap could be attached to nodeName with the
+// AttachDetachDataDisks API, and removes their records
+func (c *controllerCommon) popAttachDetachDataDisksCompatible(nodeName string, diskMap map[string]*provider.AttachDiskOptions) bool {
+	compatible := true
+	for diskURI := range diskMap {
+		if v, ok := c.attachDetachDataDisksCompatible.LoadAndDelete(attachDetachDataDisksKey(nodeName, diskURI)); !ok || !v.(bool) {
+			compatible = false
+		}
+	}
+	return compatible
+}
+
+// getAttachDetachDataDisksVM returns the resource group and VM name of nodeName if the AttachDetachDataDisks API could be used on it
+func (c *controllerCommon) getAttachDetachDataDisksVM(vmset provider.VMSet, nodeName types.NodeName) (string, string, bool) {
+	if !c.EnableAttachDetachDataDisksAPI || c.clientFactory == nil {
+		return "", "", false
+	}
+	node := strings.ToLower(string(nodeName))
+	if v, ok := c.attachDetachDataDisksUnsupported.Load(node); ok {
+		if time.Since(v.(time.Time)) < attachDetachDataDisksUnsupportedTTL {
+			return "", "", false
+		}
+		c.attachDetachDataDisksUnsupported.Delete(node)
+	}
+	instanceID, err := vmset.GetInstanceIDByNodeName(string(nodeName))
+	if err != nil {
+		klog.V(4).Infof("could not get instance ID of node(%s): %v, fall back to VM update", nodeName, err)
+		return "", "", false
+	}
+	subscriptionID, resourceGroup, vmName, ok := parseStandaloneVMID(instanceID)
+	if !ok || (c.cloud != nil && !strings.EqualFold(subscriptionID, c.cloud.SubscriptionID)) {
+		return "", "", false
+	}
+	return resourceGroup, vmName, true
+}
+
+// markAttachDetachDataDisksUnsupported records nodeName as not supporting the AttachDetachDataDisks API if err says so,
+// returns true if the operation should fall back to a VM update
+func (c *controllerCommon) markAttachDetachDataDisksUnsupported(nodeName types.NodeName, err error) bool {
+	if !isAttachDetachDataDisksUnsupportedError(err) {
+		return false
+	}
+	klog.Warningf("azureDisk - AttachDetachDataDisks API is not supported on node(%s): %v, fall back to VM update", nodeName, err)
+	c.attachDetachDataDisksUnsupported.Store(strings.ToLower(string(nodeName)), time.Now())
+	return true
+}
+
+// attachDetachDataDisks attaches and detaches data disks of a VM without updating the whole VM model
+func attachDetachDataDisks(ctx context.Context, vmClient virtualmachineclient.Interface, resourceGroup, vmName string, request armcompute.AttachDetachDataDisksRequest) error {
+	poller, err := vmClient.BeginAttachDetachDataDisks(ctx, resourceGroup, vmName, request, nil)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, nil)
+	return err
+}
+
+// isAttachDetachDataDisksCompatible returns true if the disk could be attached with the AttachDetachDataDisks API.
+// The API only takes disk ID and lun in current compute API version, so disks are attached with the platform default
+// caching mode (ReadOnly for Premium SSD, None for others) and without write accelerator.
+func isAttachDetachDataDisksCompatible(disk *armcompute.Disk, cachingMode armcompute.CachingTypes, writeAcceleratorEnabled bool) bool {
+	if disk == nil || writeAcceleratorEnabled {
+		return false
+	}
+	defaultCachingMode := armcompute.CachingTypesNone
+	if disk.SKU != nil && disk.SKU.Name != nil &&
+		(*disk.SKU.Name == armcompute.DiskStorageAccountTypesPremiumLRS || *disk.SKU.Name == armcompute.DiskStorageAccountTypesPremiumZRS) {
+		defaultCachingMode = armcompute.CachingTypesReadOnly
+	}
+	return cachingMode == defaultCachingMode
+}
+
+// isAttachDetachDataDisksUnsupportedError returns true if err means the AttachDetachDataDisks operation is not available for the VM
+func isAttachDetachDataDisksUnsupportedError(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	if respErr.StatusCode == http.StatusMethodNotAllowed || respErr.StatusCode == http.StatusNotImplemented {
+		return true
+	}
+	for _, code := range attachDetachDataDisksUnsupportedCodes {
+		if strings.EqualFold(respErr.ErrorCode, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStandaloneVMID returns subscription, resource group and VM name of a standalone VM resource ID
+func parseStandaloneVMID(id string) (string, string, string, bool) {
+	matches := standaloneVMIDRE.FindStringSubmatch(id)
+	if len(matches) != 4 {
+		return "", "", "", false
+	}
+	return matches[1], matches[2], matches[3], true
+}
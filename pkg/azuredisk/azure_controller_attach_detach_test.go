@@ -0,0 +1,486 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/virtualmachineclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	testARMSubscription = "subscription"
+	testARMVMID         = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/%s"
+	testARMDiskID       = "/subscriptions/subscription/resourcegroups/rg/providers/microsoft.compute/disks/%s"
+)
+
+type fakeTokenCredential struct{}
+
+func (fakeTokenCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "fake", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// fakeARMServer serves the virtual machine operations used in disk attach/detach
+type fakeARMServer struct {
+	*httptest.Server
+	mu sync.Mutex
+	// <vm name, <lower-case disk ID, data disk>>
+	dataDisks map[string]map[string]*armcompute.DataDisk
+	// error code returned by attachDetachDataDisks, empty for success
+	attachDetachErrorCode   string
+	attachDetachErrorStatus int
+	attachDetachRequests    []armcompute.AttachDetachDataDisksRequest
+	requests                int
+	requestBytes            int64
+}
+
+func newFakeARMServer(vmNames ...string) *fakeARMServer {
+	s := &fakeARMServer{dataDisks: map[string]map[string]*armcompute.DataDisk{}}
+	for _, vmName := range vmNames {
+		s.dataDisks[vmName] = map[string]*armcompute.DataDisk{}
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *fakeARMServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.requestBytes += int64(len(body))
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	// subscriptions/<sub>/resourceGroups/<rg>/providers/Microsoft.Compute/virtualMachines/<vm>[/attachDetachDataDisks]
+	if len(parts) < 8 || !strings.EqualFold(parts[6], "virtualMachines") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	vmName := parts[7]
+	disks, ok := s.dataDisks[vmName]
+	if !ok {
+		writeARMError(w, http.StatusNotFound, "ResourceNotFound")
+		return
+	}
+
+	switch {
+	case len(parts) == 9 && r.Method == http.MethodPost && strings.EqualFold(parts[8], "attachDetachDataDisks"):
+		if s.attachDetachErrorCode != "" {
+			writeARMError(w, s.attachDetachErrorStatus, s.attachDetachErrorCode)
+			return
+		}
+		request := armcompute.AttachDetachDataDisksRequest{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeARMError(w, http.StatusBadRequest, "InvalidRequestContent")
+			return
+		}
+		s.attachDetachRequests = append(s.attachDetachRequests, request)
+		for _, d := range request.DataDisksToAttach {
+			disks[strings.ToLower(*d.DiskID)] = &armcompute.DataDisk{Lun: d.Lun, ManagedDisk: &armcompute.ManagedDiskParameters{ID: d.DiskID}}
+		}
+		for _, d := range request.DataDisksToDetach {
+			delete(disks, strings.ToLower(*d.DiskID))
+		}
+		writeJSON(w, armcompute.StorageProfile{DataDisks: s.dataDiskList(vmName)})
+	case len(parts) == 8 && r.Method == http.MethodPut:
+		vm := armcompute.VirtualMachine{}
+		if err := json.Unmarshal(body, &vm); err != nil {
+			writeARMError(w, http.StatusBadRequest, "InvalidRequestContent")
+			return
+		}
+		newDisks := map[string]*armcompute.DataDisk{}
+		if vm.Properties != nil && vm.Properties.StorageProfile != nil {
+			for _, d := range vm.Properties.StorageProfile.DataDisks {
+				newDisks[strings.ToLower(*d.ManagedDisk.ID)] = d
+			}
+		}
+		s.dataDisks[vmName] = newDisks
+		writeJSON(w, s.vm(vmName))
+	case len(parts) == 8 && r.Method == http.MethodGet:
+		writeJSON(w, s.vm(vmName))
+	default:
+		writeARMError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeARMServer) dataDiskList(vmName string) []*armcompute.DataDisk {
+	list := []*armcompute.DataDisk{}
+	for _, d := range s.dataDisks[vmName] {
+		list = append(list, d)
+	}
+	return list
+}
+
+func (s *fakeARMServer) vm(vmName string) armcompute.VirtualMachine {
+	return armcompute.VirtualMachine{
+		ID:       to.Ptr(fmt.Sprintf(testARMVMID, vmName)),
+		Name:     to.Ptr(vmName),
+		Location: to.Ptr("eastus"),
+		Properties: &armcompute.VirtualMachineProperties{
+			HardwareProfile: &armcompute.HardwareProfile{VMSize: to.Ptr(armcompute.VirtualMachineSizeTypesStandardD4SV3)},
+			StorageProfile: &armcompute.StorageProfile{
+				OSDisk: &armcompute.OSDisk{
+					Name:         to.Ptr(vmName + "-os"),
+					CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+					ManagedDisk:  &armcompute.ManagedDiskParameters{ID: to.Ptr(fmt.Sprintf(testARMDiskID, vmName+"-os"))},
+				},
+				DataDisks: s.dataDiskList(vmName),
+			},
+			ProvisioningState: to.Ptr("Succeeded"),
+		},
+	}
+}
+
+func (s *fakeARMServer) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.requestBytes
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeARMError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintf(w, `{"error":{"code":%q,"message":"fake error %s"}}`, code, code)
+}
+
+func newFakeARMVMClient(t testing.TB, server *fakeARMServer) virtualmachineclient.Interface {
+	client, err := virtualmachineclient.New(testARMSubscription, fakeTokenCredential{}, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				ActiveDirectoryAuthorityHost: server.URL,
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {Audience: "https://management.azure.com", Endpoint: server.URL},
+				},
+			},
+			Transport: server.Client(),
+			Retry:     policy.RetryOptions{MaxRetries: -1},
+		},
+		DisableRPRegistration: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func newTestAttachDetachCommon(ctrl *gomock.Controller, vmClient virtualmachineclient.Interface) *controllerCommon {
+	clientFactory := mock_azclient.NewMockClientFactory(ctrl)
+	clientFactory.EXPECT().GetVirtualMachineClient().Return(vmClient).AnyTimes()
+	return &controllerCommon{
+		cloud:                          provider.GetTestCloud(ctrl),
+		lockMap:                        newLockMap(),
+		clientFactory:                  clientFactory,
+		EnableAttachDetachDataDisksAPI: true,
+	}
+}
+
+func TestAttachDisksToNode(t *testing.T) {
+	diskURI := strings.ToLower(fmt.Sprintf(testARMDiskID, "disk1"))
+	tests := []struct {
+		desc                string
+		disabled            bool
+		instanceID          string
+		incompatible        bool
+		errorCode           string
+		errorStatus         int
+		expectAPI           bool
+		expectVMSetAttach   bool
+		expectErr           bool
+		expectedUnsupported bool
+	}{
+		{
+			desc:       "attach with AttachDetachDataDisks API on standalone VM",
+			instanceID: fmt.Sprintf(testARMVMID, "vm1"),
+			expectAPI:  true,
+		},
+		{
+			desc:              "fall back to VM update when API is disabled",
+			disabled:          true,
+			instanceID:        fmt.Sprintf(testARMVMID, "vm1"),
+			expectVMSetAttach: true,
+		},
+		{
+			desc:              "fall back to VM update on VMSS uniform instance",
+			instanceID:        "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0",
+			expectVMSetAttach: true,
+		},
+		{
+			desc:              "fall back to VM update when a disk is not compatible",
+			instanceID:        fmt.Sprintf(testARMVMID, "vm1"),
+			incompatible:      true,
+			expectVMSetAttach: true,
+		},
+		{
+			desc:                "fall back to VM update when API is not supported",
+			instanceID:          fmt.Sprintf(testARMVMID, "vm1"),
+			errorCode:           "OperationNotAllowed",
+			errorStatus:         http.StatusBadRequest,
+			expectVMSetAttach:   true,
+			expectedUnsupported: true,
+		},
+		{
+			desc:        "return other errors without fallback",
+			instanceID:  fmt.Sprintf(testARMVMID, "vm1"),
+			errorCode:   "Conflict",
+			errorStatus: http.StatusConflict,
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		server := newFakeARMServer("vm1")
+		server.attachDetachErrorCode = test.errorCode
+		server.attachDetachErrorStatus = test.errorStatus
+		c := newTestAttachDetachCommon(ctrl, newFakeARMVMClient(t, server))
+		c.EnableAttachDetachDataDisksAPI = !test.disabled
+
+		vmset := provider.NewMockVMSet(ctrl)
+		vmset.EXPECT().GetInstanceIDByNodeName("vm1").Return(test.instanceID, nil).AnyTimes()
+		vmset.EXPECT().DeleteCacheForNode("vm1").Return(nil).AnyTimes()
+		if test.expectVMSetAttach {
+			vmset.EXPECT().AttachDisk(gomock.Any(), types.NodeName("vm1"), gomock.Any()).Return(nil)
+		}
+
+		diskMap := map[string]*provider.AttachDiskOptions{diskURI: {Lun: 2, CachingMode: compute.CachingTypesNone}}
+		err := c.attachDisksToNode(context.Background(), vmset, "vm1", diskMap, !test.incompatible)
+		assert.Equal(t, test.expectErr, err != nil, test.desc)
+		if test.expectAPI {
+			assert.Len(t, server.attachDetachRequests, 1, test.desc)
+			assert.Equal(t, int32(2), *server.attachDetachRequests[0].DataDisksToAttach[0].Lun, test.desc)
+			assert.Contains(t, server.dataDisks["vm1"], diskURI, test.desc)
+		} else {
+			assert.Empty(t, server.attachDetachRequests, test.desc)
+		}
+		_, unsupported := c.attachDetachDataDisksUnsupported.Load("vm1")
+		assert.Equal(t, test.expectedUnsupported, unsupported, test.desc)
+		server.Close()
+		ctrl.Finish()
+	}
+}
+
+func TestDetachDisksFromNode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	server := newFakeARMServer("vm1")
+	defer server.Close()
+	diskURI := strings.ToLower(fmt.Sprintf(testARMDiskID, "disk1"))
+	server.dataDisks["vm1"][diskURI] = &armcompute.DataDisk{Lun: to.Ptr(int32(0)), ManagedDisk: &armcompute.ManagedDiskParameters{ID: to.Ptr(diskURI)}}
+	c := newTestAttachDetachCommon(ctrl, newFakeARMVMClient(t, server))
+
+	vmset := provider.NewMockVMSet(ctrl)
+	vmset.EXPECT().GetInstanceIDByNodeName("vm1").Return(fmt.Sprintf(testARMVMID, "vm1"), nil).AnyTimes()
+	vmset.EXPECT().DeleteCacheForNode("vm1").Return(nil).AnyTimes()
+	vmset.EXPECT().GetDataDisks(types.NodeName("vm1"), gomock.Any()).DoAndReturn(
+		func(types.NodeName, azcache.AzureCacheReadType) ([]*armcompute.DataDisk, *string, error) {
+			var dataDisks []*armcompute.DataDisk
+			for _, disk := range server.dataDisks["vm1"] {
+				dataDisks = append(dataDisks, disk)
+			}
+			return dataDisks, nil, nil
+		}).AnyTimes()
+
+	assert.NoError(t, c.detachDisksFromNode(context.Background(), vmset, "vm1", map[string]string{diskURI: "disk1", strings.ToLower(fmt.Sprintf(testARMDiskID, "detached")): "detached"}, true))
+	assert.Len(t, server.attachDetachRequests, 1)
+	assert.Len(t, server.attachDetachRequests[0].DataDisksToDetach, 1, "disks not attached are skipped")
+	assert.Equal(t, armcompute.DiskDetachOptionTypesForceDetach, *server.attachDetachRequests[0].DataDisksToDetach[0].DetachOption)
+	assert.Empty(t, server.dataDisks["vm1"])
+
+	// a retried detach of a disk already detached succeeds without a request
+	assert.NoError(t, c.detachDisksFromNode(context.Background(), vmset, "vm1", map[string]string{diskURI: "disk1"}, false))
+	assert.Len(t, server.attachDetachRequests, 1)
+
+	// the node is marked as unsupported and later requests go to VM update directly
+	server.dataDisks["vm1"][diskURI] = &armcompute.DataDisk{Lun: to.Ptr(int32(0)), ManagedDisk: &armcompute.ManagedDiskParameters{ID: to.Ptr(diskURI)}}
+	server.attachDetachErrorCode = "NotSupported"
+	server.attachDetachErrorStatus = http.StatusBadRequest
+	vmset.EXPECT().DetachDisk(gomock.Any(), types.NodeName("vm1"), gomock.Any()).Return(nil).Times(2)
+	assert.NoError(t, c.detachDisksFromNode(context.Background(), vmset, "vm1", map[string]string{diskURI: "disk1"}, false))
+	requests, _ := server.stats()
+	assert.NoError(t, c.detachDisksFromNode(context.Background(), vmset, "vm1", map[string]string{diskURI: "disk1"}, false))
+	requestsAfter, _ := server.stats()
+	assert.Equal(t, requests, requestsAfter)
+}
+
+func TestPopAttachDetachDataDisksCompatible(t *testing.T) {
+	c := &controllerCommon{}
+	c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey("node1", "disk1"), true)
+	c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey("node1", "disk2"), false)
+	assert.True(t, c.popAttachDetachDataDisksCompatible("node1", map[string]*provider.AttachDiskOptions{"disk1": {}}))
+	assert.False(t, c.popAttachDetachDataDisksCompatible("node1", map[string]*provider.AttachDiskOptions{"disk2": {}}))
+	// records are removed once consumed
+	c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey("node1", "disk1"), true)
+	assert.False(t, c.popAttachDetachDataDisksCompatible("node1", map[string]*provider.AttachDiskOptions{"disk1": {}, "disk3": {}}))
+	_, ok := c.attachDetachDataDisksCompatible.Load(attachDetachDataDisksKey("node1", "disk1"))
+	assert.False(t, ok)
+
+	// attaches of a shared disk to different nodes keep their own records
+	c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey("Node1", "disk1"), true)
+	c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey("node2", "disk1"), false)
+	assert.True(t, c.popAttachDetachDataDisksCompatible("node1", map[string]*provider.AttachDiskOptions{"disk1": {}}))
+	_, ok = c.attachDetachDataDisksCompatible.Load(attachDetachDataDisksKey("node2", "disk1"))
+	assert.True(t, ok)
+	assert.False(t, c.popAttachDetachDataDisksCompatible("node2", map[string]*provider.AttachDiskOptions{"disk1": {}}))
+}
+
+func TestIsAttachDetachDataDisksCompatible(t *testing.T) {
+	premium := &armcompute.Disk{SKU: &armcompute.DiskSKU{Name: to.Ptr(armcompute.DiskStorageAccountTypesPremiumLRS)}}
+	standard := &armcompute.Disk{SKU: &armcompute.DiskSKU{Name: to.Ptr(armcompute.DiskStorageAccountTypesStandardSSDLRS)}}
+	tests := []struct {
+		desc             string
+		disk             *armcompute.Disk
+		cachingMode      armcompute.CachingTypes
+		writeAccelerator bool
+		expected         bool
+	}{
+		{desc: "nil disk", cachingMode: armcompute.CachingTypesNone},
+		{desc: "premium disk with ReadOnly", disk: premium, cachingMode: armcompute.CachingTypesReadOnly, expected: true},
+		{desc: "premium disk with None", disk: premium, cachingMode: armcompute.CachingTypesNone},
+		{desc: "standard disk with None", disk: standard, cachingMode: armcompute.CachingTypesNone, expected: true},
+		{desc: "standard disk with ReadOnly", disk: standard, cachingMode: armcompute.CachingTypesReadOnly},
+		{desc: "write accelerator", disk: premium, cachingMode: armcompute.CachingTypesReadOnly, writeAccelerator: true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isAttachDetachDataDisksCompatible(test.disk, test.cachingMode, test.writeAccelerator), test.desc)
+	}
+}
+
+func TestIsAttachDetachDataDisksUnsupportedError(t *testing.T) {
+	assert.False(t, isAttachDetachDataDisksUnsupportedError(nil))
+	assert.False(t, isAttachDetachDataDisksUnsupportedError(fmt.Errorf("OperationNotAllowed")))
+	assert.True(t, isAttachDetachDataDisksUnsupportedError(&azcore.ResponseError{StatusCode: http.StatusBadRequest, ErrorCode: "OperationNotAllowed"}))
+	assert.True(t, isAttachDetachDataDisksUnsupportedError(fmt.Errorf("wrapped: %w", &azcore.ResponseError{StatusCode: http.StatusMethodNotAllowed})))
+	assert.False(t, isAttachDetachDataDisksUnsupportedError(&azcore.ResponseError{StatusCode: http.StatusConflict, ErrorCode: "Conflict"}))
+}
+
+func TestParseStandaloneVMID(t *testing.T) {
+	sub, rg, vm, ok := parseStandaloneVMID(fmt.Sprintf(testARMVMID, "vm1"))
+	assert.True(t, ok)
+	assert.Equal(t, []string{"subscription", "rg", "vm1"}, []string{sub, rg, vm})
+	_, _, _, ok = parseStandaloneVMID("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0")
+	assert.False(t, ok)
+	_, _, _, ok = parseStandaloneVMID("azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1")
+	assert.False(t, ok)
+}
+
+// BenchmarkAttachDetachDataDisks compares attaching and detaching a disk on a VM with 16 data disks with
+// the AttachDetachDataDisks API and with a full VM update against a fake ARM server.
+func BenchmarkAttachDetachDataDisks(b *testing.B) {
+	const existingDisks = 16
+	newServer := func() (*fakeARMServer, virtualmachineclient.Interface) {
+		server := newFakeARMServer("vm1")
+		for i := 0; i < existingDisks; i++ {
+			id := fmt.Sprintf(testARMDiskID, fmt.Sprintf("existing-%d", i))
+			server.dataDisks["vm1"][id] = &armcompute.DataDisk{
+				Name:         to.Ptr(fmt.Sprintf("existing-%d", i)),
+				Lun:          to.Ptr(int32(i)),
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesAttach),
+				Caching:      to.Ptr(armcompute.CachingTypesReadOnly),
+				ManagedDisk:  &armcompute.ManagedDiskParameters{ID: to.Ptr(id)},
+			}
+		}
+		return server, newFakeARMVMClient(b, server)
+	}
+	diskURI := fmt.Sprintf(testARMDiskID, "disk-new")
+	ctx := context.Background()
+
+	b.Run("AttachDetachDataDisks", func(b *testing.B) {
+		server, client := newServer()
+		defer server.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := attachDetachDataDisks(ctx, client, "rg", "vm1", armcompute.AttachDetachDataDisksRequest{
+				DataDisksToAttach: []*armcompute.DataDisksToAttach{{DiskID: to.Ptr(diskURI), Lun: to.Ptr(int32(existingDisks))}},
+			}); err != nil {
+				b.Fatal(err)
+			}
+			if err := attachDetachDataDisks(ctx, client, "rg", "vm1", armcompute.AttachDetachDataDisksRequest{
+				DataDisksToDetach: []*armcompute.DataDisksToDetach{{DiskID: to.Ptr(diskURI)}},
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		requests, bytes := server.stats()
+		b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+		b.ReportMetric(float64(bytes)/float64(b.N), "req-bytes/op")
+	})
+
+	b.Run("VMUpdate", func(b *testing.B) {
+		server, client := newServer()
+		defer server.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			vm, err := client.Get(ctx, "rg", "vm1", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			vm.Properties.StorageProfile.DataDisks = append(vm.Properties.StorageProfile.DataDisks, &armcompute.DataDisk{
+				Lun:          to.Ptr(int32(existingDisks)),
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesAttach),
+				ManagedDisk:  &armcompute.ManagedDiskParameters{ID: to.Ptr(diskURI)},
+			})
+			if vm, err = client.CreateOrUpdate(ctx, "rg", "vm1", *vm); err != nil {
+				b.Fatal(err)
+			}
+			dataDisks := []*armcompute.DataDisk{}
+			for _, d := range vm.Properties.StorageProfile.DataDisks {
+				if !strings.EqualFold(*d.ManagedDisk.ID, diskURI) {
+					dataDisks = append(dataDisks, d)
+				}
+			}
+			vm.Properties.StorageProfile.DataDisks = dataDisks
+			if _, err := client.CreateOrUpdate(ctx, "rg", "vm1", *vm); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		requests, bytes := server.stats()
+		b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+		b.ReportMetric(float64(bytes)/float64(b.N), "req-bytes/op")
+	})
+}
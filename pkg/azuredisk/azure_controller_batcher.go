@@ -0,0 +1,170 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	batchOperationAttach = "attach"
+	batchOperationDetach = "detach"
+
+	// default number of pending requests on a node which flushes the batch without waiting further
+	defaultAttachDetachMaxBatchSize = 8
+	// default upper bound in milliseconds of the batch deadline on a busy node
+	defaultAttachDetachMaxDelayInMs = 5000
+	// time constant of the exponentially decayed arrival rate of requests on a node
+	batcherRateTimeConstant = 10 * time.Second
+	// batch deadline added per request/s of recent arrival rate on a node
+	batcherDelayPerArrivalRate = 200 * time.Millisecond
+	// interval at which a waiting batch checks its size and deadline
+	batcherPollInterval = 20 * time.Millisecond
+)
+
+// diskBatcher decides how long the first attach or detach request on a node waits for more requests
+// before they are sent to the VM in one batch.
+// The zero value is ready to use, queues are created on first request of a node.
+type diskBatcher struct {
+	// <nodeName, *nodeBatchQueue>
+	queues sync.Map
+}
+
+// nodeBatchQueue tracks pending requests and the recent arrival rate on a node
+type nodeBatchQueue struct {
+	sync.Mutex
+	// exponentially decayed arrival rate in requests/s, as of lastArrival
+	rate        float64
+	lastArrival time.Time
+	// arrival before lastArrival, used to tell whether the node was idle
+	prevArrival time.Time
+	// enqueue time of requests not flushed yet
+	pending []time.Time
+}
+
+func (b *diskBatcher) getQueue(nodeName string) *nodeBatchQueue {
+	v, _ := b.queues.LoadOrStore(nodeName, &nodeBatchQueue{})
+	return v.(*nodeBatchQueue)
+}
+
+// enqueue records a new request on nodeName, it must be called together with inserting the request into the disk map
+func (b *diskBatcher) enqueue(nodeName string) {
+	b.enqueueAt(nodeName, time.Now())
+}
+
+func (b *diskBatcher) enqueueAt(nodeName string, now time.Time) {
+	q := b.getQueue(nodeName)
+	q.Lock()
+	defer q.Unlock()
+	q.rate = q.rateAt(now) + 1/batcherRateTimeConstant.Seconds()
+	q.prevArrival = q.lastArrival
+	q.lastArrival = now
+	q.pending = append(q.pending, now)
+}
+
+// flush removes pending requests of nodeName and records batch size and queue wait metrics,
+// it must be called together with taking the requests out of the disk map
+func (b *diskBatcher) flush(nodeName, operation string) {
+	q := b.getQueue(nodeName)
+	q.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	now := time.Now()
+	attachDetachBatchSize.WithLabelValues(operation).Observe(float64(len(pending)))
+	for _, t := range pending {
+		attachDetachQueueWait.WithLabelValues(operation).Observe(now.Sub(t).Seconds())
+	}
+}
+
+// wait blocks until the pending requests on nodeName should be flushed:
+// immediately if no other request arrived within initialDelay before the first one (0 disables batching),
+// once maxBatchSize requests are pending, or once a deadline growing with the recent arrival rate
+// (capped at maxDelay, which is at least initialDelay) has passed.
+func (b *diskBatcher) wait(ctx context.Context, nodeName string, initialDelay, maxDelay time.Duration, maxBatchSize int) {
+	if initialDelay <= 0 {
+		return
+	}
+	if maxDelay < initialDelay {
+		maxDelay = initialDelay
+	}
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultAttachDetachMaxBatchSize
+	}
+	q := b.getQueue(nodeName)
+	start := time.Now()
+	deadline, flush := q.deadline(start, initialDelay, maxDelay, maxBatchSize)
+	if flush {
+		return
+	}
+
+	ticker := time.NewTicker(batcherPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(start) >= deadline || q.size() >= maxBatchSize {
+				return
+			}
+		}
+	}
+}
+
+// deadline returns the time to wait for more requests, or true if the pending requests should be flushed now
+func (q *nodeBatchQueue) deadline(now time.Time, initialDelay, maxDelay time.Duration, maxBatchSize int) (time.Duration, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.pending) >= maxBatchSize {
+		return 0, true
+	}
+	// no other request arrived within initialDelay before the only pending one, don't hold it for a batch
+	if len(q.pending) <= 1 && (q.prevArrival.IsZero() || q.lastArrival.Sub(q.prevArrival) > initialDelay) {
+		return 0, true
+	}
+	deadline := time.Duration(q.rateAt(now) * float64(batcherDelayPerArrivalRate))
+	if deadline > maxDelay {
+		deadline = maxDelay
+	}
+	return deadline, false
+}
+
+// rateAt returns the arrival rate decayed to now, the caller must hold the lock
+func (q *nodeBatchQueue) rateAt(now time.Time) float64 {
+	if q.lastArrival.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(q.lastArrival)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return q.rate * math.Exp(-elapsed.Seconds()/batcherRateTimeConstant.Seconds())
+}
+
+func (q *nodeBatchQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskBatcherDeadline(t *testing.T) {
+	now := time.Now()
+	initialDelay, maxDelay := time.Second, 5*time.Second
+
+	tests := []struct {
+		desc          string
+		arrivals      []time.Duration // arrival offsets before now
+		flushedBefore int             // number of arrivals flushed before the last ones
+		maxBatchSize  int
+		expectedFlush bool
+		expectedMin   time.Duration
+		expectedMax   time.Duration
+	}{
+		{
+			desc:          "first request on an idle node is flushed immediately",
+			arrivals:      []time.Duration{0},
+			maxBatchSize:  8,
+			expectedFlush: true,
+		},
+		{
+			desc:          "request long after the previous one is flushed immediately",
+			arrivals:      []time.Duration{5 * time.Second, 0},
+			flushedBefore: 1,
+			maxBatchSize:  8,
+			expectedFlush: true,
+		},
+		{
+			desc:          "request after the initial delay is flushed immediately",
+			arrivals:      []time.Duration{1500 * time.Millisecond, 0},
+			flushedBefore: 1,
+			maxBatchSize:  8,
+			expectedFlush: true,
+		},
+		{
+			desc:          "full batch is flushed immediately",
+			arrivals:      []time.Duration{30 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond, 0},
+			maxBatchSize:  4,
+			expectedFlush: true,
+		},
+		{
+			desc:          "few recent arrivals give a short deadline",
+			arrivals:      []time.Duration{200 * time.Millisecond, 0},
+			maxBatchSize:  8,
+			expectedFlush: false,
+			expectedMin:   30 * time.Millisecond,
+			expectedMax:   50 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			b := &diskBatcher{}
+			for i, offset := range test.arrivals {
+				b.enqueueAt("node", now.Add(-offset))
+				if i+1 == test.flushedBefore {
+					b.flush("node", batchOperationAttach)
+				}
+			}
+			deadline, flush := b.getQueue("node").deadline(now, initialDelay, maxDelay, test.maxBatchSize)
+			assert.Equal(t, test.expectedFlush, flush)
+			if !flush {
+				assert.GreaterOrEqual(t, deadline, test.expectedMin)
+				assert.LessOrEqual(t, deadline, test.expectedMax)
+			}
+		})
+	}
+}
+
+func TestDiskBatcherDeadlineGrowsWithArrivalRate(t *testing.T) {
+	now := time.Now()
+	var deadlines []time.Duration
+	for _, n := range []int{2, 5, 10, 20} {
+		b := &diskBatcher{}
+		for i := n - 1; i >= 0; i-- {
+			b.enqueueAt("node", now.Add(-time.Duration(i)*10*time.Millisecond))
+		}
+		deadline, flush := b.getQueue("node").deadline(now, time.Second, 10*time.Second, 100)
+		assert.False(t, flush)
+		deadlines = append(deadlines, deadline)
+	}
+	for i := 1; i < len(deadlines); i++ {
+		assert.Greater(t, deadlines[i], deadlines[i-1])
+	}
+
+	b := &diskBatcher{}
+	for i := 0; i < 100; i++ {
+		b.enqueueAt("node", now)
+	}
+	deadline, flush := b.getQueue("node").deadline(now, time.Second, time.Second, 1000)
+	assert.False(t, flush)
+	assert.Equal(t, time.Second, deadline)
+
+	// the deadline of a busy node is not capped at the initial delay
+	deadline, flush = b.getQueue("node").deadline(now, time.Second, 5*time.Second, 1000)
+	assert.False(t, flush)
+	assert.InDelta(t, float64(100*batcherDelayPerArrivalRate/10), float64(deadline), float64(time.Millisecond))
+}
+
+func TestDiskBatcherWait(t *testing.T) {
+	t.Run("zero initial delay doesn't wait", func(t *testing.T) {
+		b := &diskBatcher{}
+		b.enqueue("node")
+		b.enqueue("node")
+		start := time.Now()
+		b.wait(context.Background(), "node", 0, time.Minute, 8)
+		assert.Less(t, time.Since(start), batcherPollInterval)
+	})
+
+	t.Run("idle node doesn't wait", func(t *testing.T) {
+		b := &diskBatcher{}
+		b.enqueue("node")
+		start := time.Now()
+		b.wait(context.Background(), "node", time.Minute, time.Minute, 8)
+		assert.Less(t, time.Since(start), batcherPollInterval)
+	})
+
+	t.Run("flush once max batch size is reached", func(t *testing.T) {
+		b := &diskBatcher{}
+		b.enqueue("node")
+		b.enqueue("node")
+		go func() {
+			time.Sleep(2 * batcherPollInterval)
+			b.enqueue("node")
+			b.enqueue("node")
+		}()
+		start := time.Now()
+		b.wait(context.Background(), "node", time.Minute, time.Minute, 4)
+		assert.Less(t, time.Since(start), 10*time.Second)
+		assert.Equal(t, 4, b.getQueue("node").size())
+	})
+
+	t.Run("context cancellation stops waiting", func(t *testing.T) {
+		b := &diskBatcher{}
+		for i := 0; i < 5; i++ {
+			b.enqueue("node")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*batcherPollInterval)
+		defer cancel()
+		start := time.Now()
+		b.wait(ctx, "node", time.Second, time.Minute, 100)
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+}
+
+func TestDiskBatcherFlush(t *testing.T) {
+	b := &diskBatcher{}
+	b.flush("node", batchOperationDetach)
+	b.enqueue("node")
+	b.enqueue("node")
+	b.enqueue("other")
+	b.flush("node", batchOperationDetach)
+	assert.Equal(t, 0, b.getQueue("node").size())
+	assert.Equal(t, 1, b.getQueue("other").size())
+}
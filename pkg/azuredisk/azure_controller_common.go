@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -31,8 +32,11 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	kwait "k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
 	volerr "k8s.io/cloud-provider/volume/errors"
@@ -63,6 +67,9 @@ const (
 	// default initial delay in milliseconds for batch disk attach/detach
 	defaultAttachDetachInitialDelayInMs = 1000
 
+	// time the data disk slots of a node are cached, the VM size of a node rarely changes
+	dataDiskSlotsCacheTTL = 5 * time.Minute
+
 	// WriteAcceleratorEnabled support for Azure Write Accelerator on Azure Disks
 	// https://docs.microsoft.com/azure/virtual-machines/windows/how-to-enable-write-accelerator
 	WriteAcceleratorEnabled = "writeacceleratorenabled"
@@ -99,9 +106,47 @@ type controllerCommon struct {
 	DisableUpdateCache bool
 	// DisableDiskLunCheck whether disable disk lun check after disk attach/detach
 	DisableDiskLunCheck bool
-	// AttachDetachInitialDelayInMs determines initial delay in milliseconds for batch disk attach/detach
+	// AttachDetachInitialDelayInMs determines whether a request waits for more requests on the same node before they
+	// are attached/detached in one batch: it doesn't if no other request arrived within this delay, 0 disables batching delay
 	AttachDetachInitialDelayInMs int
-	ForceDetachBackoff           bool
+	// AttachDetachMaxDelayInMs is the maximum delay in milliseconds a request waits for more requests on a busy node,
+	// the actual delay adapts to the recent request rate on the node
+	AttachDetachMaxDelayInMs int
+	ForceDetachBackoff       bool
+	// AttachDetachMaxBatchSize is the number of pending requests on a node which are sent without waiting further
+	AttachDetachMaxBatchSize int
+	// adaptive batching of attach and detach requests per node
+	attachBatcher diskBatcher
+	detachBatcher diskBatcher
+	// EnableAttachDetachDataDisksAPI attaches and detaches disks with the AttachDetachDataDisks API on nodes supporting it
+	EnableAttachDetachDataDisksAPI bool
+	// <lower-case nodeName/diskURI, bool> whether a pending attach request could use the AttachDetachDataDisks API
+	attachDetachDataDisksCompatible sync.Map
+	// <lower-case nodeName, time.Time> nodes on which the AttachDetachDataDisks API is not supported
+	attachDetachDataDisksUnsupported sync.Map
+	// EnableLunAffinity records the LUN of a disk in disk tags and prefers it when the disk is attached again
+	EnableLunAffinity bool
+	// <lower-case nodeName, *nodeLunReservations> LUNs assigned to in-flight attach batches
+	lunReservations sync.Map
+	// <lower-case diskURI, lun> LUNs being recorded in disk tags in the background
+	recordingLuns sync.Map
+	// EnableAttachDetachPriority schedules attach, detach and VM update operations on a node by priority instead of arrival order
+	EnableAttachDetachPriority bool
+	// per node scheduler of attach, detach and VM update operations, only used if EnableAttachDetachPriority is set
+	nodeScheduler nodeScheduler
+	// <lower-case diskURI, int32> priority of pending attach requests
+	attachPriorities sync.Map
+	// rate limiter of VM updates through vmset, nil if ARM rate limiter is disabled
+	armLimiter *armLimiter
+	// <lower-case nodeName, dataDiskSlots> data disk slots of nodes looked up in the last dataDiskSlotsCacheTTL
+	dataDiskSlots sync.Map
+}
+
+// dataDiskSlots is a cached result of getMaxDataDiskSlots
+type dataDiskSlots struct {
+	max          int64
+	instanceType string
+	expiry       time.Time
 }
 
 // ExtendedLocation contains additional info about the location of resources.
@@ -182,35 +227,53 @@ func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI str
 		DiskEncryptionSetID:     diskEncryptionSetID,
 		WriteAcceleratorEnabled: writeAcceleratorEnabled,
 	}
+	if c.EnableLunAffinity {
+		options.Lun = getPreferredLun(disk)
+	}
 	node := strings.ToLower(string(nodeName))
 	diskuri := strings.ToLower(diskURI)
+	if c.EnableAttachDetachDataDisksAPI {
+		c.attachDetachDataDisksCompatible.Store(attachDetachDataDisksKey(node, diskuri), isAttachDetachDataDisksCompatible(disk, cachingMode, writeAcceleratorEnabled))
+	}
+	if c.EnableAttachDetachPriority {
+		c.attachPriorities.Store(diskuri, getAttachDetachPriority(ctx))
+		defer c.attachPriorities.Delete(diskuri)
+	}
 	requestNum, err := c.insertAttachDiskRequest(diskuri, node, &options)
 	if err != nil {
 		return -1, err
 	}
 
-	c.lockMap.LockEntry(node)
-	unlock := false
-	defer func() {
-		if !unlock {
-			c.lockMap.UnlockEntry(node)
-		}
-	}()
+	unlock, err := c.lockNode(ctx, nodeName, nodeOperationAttach)
+	if err != nil {
+		c.removeAttachDiskRequest(diskuri, node)
+		return -1, err
+	}
+	defer unlock()
 
-	if c.AttachDetachInitialDelayInMs > 0 && requestNum == 1 {
-		klog.V(2).Infof("wait %dms for more requests on node %s, current disk attach: %s", c.AttachDetachInitialDelayInMs, node, diskURI)
-		time.Sleep(time.Duration(c.AttachDetachInitialDelayInMs) * time.Millisecond)
+	if requestNum == 1 {
+		klog.V(4).Infof("wait up to %dms for more requests on node %s, current disk attach: %s", max(c.AttachDetachInitialDelayInMs, c.AttachDetachMaxDelayInMs), node, diskURI)
+		c.attachBatcher.wait(ctx, node, time.Duration(c.AttachDetachInitialDelayInMs)*time.Millisecond, time.Duration(c.AttachDetachMaxDelayInMs)*time.Millisecond, c.AttachDetachMaxBatchSize)
 	}
 
 	diskMap, err := c.cleanAttachDiskRequests(node)
 	if err != nil {
 		return -1, err
 	}
+	if c.EnableAttachDetachPriority {
+		diskMap = c.deferAttachDiskRequests(ctx, nodeName, diskMap)
+		if _, ok := diskMap[diskuri]; !ok && c.removeAttachDiskRequest(diskuri, node) {
+			return -1, status.Errorf(codes.ResourceExhausted, "attach of disk(%s) to node(%s) is deferred since there is no free data disk slot for it after higher priority attaches", diskURI, nodeName)
+		}
+	}
+	compatible := c.popAttachDetachDataDisksCompatible(node, diskMap)
 
 	lun, err := c.SetDiskLun(nodeName, diskuri, diskMap, occupiedLuns)
 	if err != nil {
 		return -1, err
 	}
+	// keep LUNs of this batch reserved until the attach operation completes
+	defer c.releaseLuns(node, diskMap)
 
 	klog.V(2).Infof("Trying to attach volume %s lun %d to node %s, diskMap len:%d, %+v", diskURI, lun, nodeName, len(diskMap), diskMap)
 	if len(diskMap) == 0 {
@@ -239,11 +302,13 @@ func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI str
 		}
 	}()
 
-	err = vmset.AttachDisk(ctx, nodeName, diskMap)
+	err = c.attachDisksToNode(ctx, vmset, nodeName, diskMap, compatible)
 	if err != nil {
 		if IsOperationPreempted(err) {
 			klog.Errorf("Retry VM Update on node (%s) due to error (%v)", nodeName, err)
-			err = vmset.UpdateVM(ctx, nodeName)
+			err = c.armLimiter.do(ctx, c.cloud.SubscriptionID, armVMWrite, func() error {
+				return vmset.UpdateVM(ctx, nodeName)
+			})
 		}
 		if err != nil {
 			return -1, err
@@ -282,6 +347,7 @@ func (c *controllerCommon) insertAttachDiskRequest(diskURI, nodeName string, opt
 		klog.V(2).Infof("azureDisk - duplicated attach disk(%s) request on node(%s)", diskURI, nodeName)
 	} else {
 		diskMap[diskURI] = options
+		c.attachBatcher.enqueue(nodeName)
 	}
 	return len(diskMap), nil
 }
@@ -302,6 +368,7 @@ func (c *controllerCommon) cleanAttachDiskRequests(nodeName string) (map[string]
 		return diskMap, fmt.Errorf("convert attachDiskMap failure on node(%s)", nodeName)
 	}
 	c.attachDiskMap.Store(nodeName, make(map[string]*provider.AttachDiskOptions))
+	c.attachBatcher.flush(nodeName, batchOperationAttach)
 	return diskMap, nil
 }
 
@@ -330,12 +397,16 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 		return err
 	}
 
-	c.lockMap.LockEntry(node)
-	defer c.lockMap.UnlockEntry(node)
+	unlock, err := c.lockNode(ctx, nodeName, nodeOperationDetach)
+	if err != nil {
+		c.removeDetachDiskRequest(disk, node)
+		return err
+	}
+	defer unlock()
 
-	if c.AttachDetachInitialDelayInMs > 0 && requestNum == 1 {
-		klog.V(2).Infof("wait %dms for more requests on node %s, current disk detach: %s", c.AttachDetachInitialDelayInMs, node, diskURI)
-		time.Sleep(time.Duration(c.AttachDetachInitialDelayInMs) * time.Millisecond)
+	if requestNum == 1 {
+		klog.V(4).Infof("wait up to %dms for more requests on node %s, current disk detach: %s", max(c.AttachDetachInitialDelayInMs, c.AttachDetachMaxDelayInMs), node, diskURI)
+		c.detachBatcher.wait(ctx, node, time.Duration(c.AttachDetachInitialDelayInMs)*time.Millisecond, time.Duration(c.AttachDetachMaxDelayInMs)*time.Millisecond, c.AttachDetachMaxBatchSize)
 	}
 	diskMap, err := c.cleanDetachDiskRequests(node)
 	if err != nil {
@@ -346,7 +417,7 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 	if len(diskMap) > 0 {
 		c.diskStateMap.Store(disk, "detaching")
 		defer c.diskStateMap.Delete(disk)
-		if err = vmset.DetachDisk(ctx, nodeName, diskMap, false); err != nil {
+		if err = c.detachDisksFromNode(ctx, vmset, nodeName, diskMap, false); err != nil {
 			if isInstanceNotFoundError(err) {
 				// if host doesn't exist, no need to detach
 				klog.Warningf("azureDisk - got InstanceNotFoundError(%v), DetachDisk(%s) will assume disk is already detached",
@@ -355,7 +426,7 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 			}
 			if c.ForceDetachBackoff && !azureutils.IsThrottlingError(err) {
 				klog.Errorf("azureDisk - DetachDisk(%s) from node %s failed with error: %v, retry with force detach", diskURI, nodeName, err)
-				err = vmset.DetachDisk(ctx, nodeName, diskMap, true)
+				err = c.detachDisksFromNode(ctx, vmset, nodeName, diskMap, true)
 			}
 		}
 	}
@@ -383,16 +454,20 @@ func (c *controllerCommon) UpdateVM(ctx context.Context, nodeName types.NodeName
 	if err != nil {
 		return err
 	}
-	node := strings.ToLower(string(nodeName))
-	c.lockMap.LockEntry(node)
-	defer c.lockMap.UnlockEntry(node)
+	unlock, err := c.lockNode(ctx, nodeName, nodeOperationUpdate)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	defer func() {
 		_ = vmset.DeleteCacheForNode(string(nodeName))
 	}()
 
 	klog.V(2).Infof("azureDisk - update: vm(%s)", nodeName)
-	return vmset.UpdateVM(ctx, nodeName)
+	return c.armLimiter.do(ctx, c.cloud.SubscriptionID, armVMWrite, func() error {
+		return vmset.UpdateVM(ctx, nodeName)
+	})
 }
 
 // insertDetachDiskRequest return (detachDiskRequestQueueLength, error)
@@ -416,6 +491,7 @@ func (c *controllerCommon) insertDetachDiskRequest(diskName, diskURI, nodeName s
 		klog.V(2).Infof("azureDisk - duplicated detach disk(%s) request on node(%s)", diskURI, nodeName)
 	} else {
 		diskMap[diskURI] = diskName
+		c.detachBatcher.enqueue(nodeName)
 	}
 	return len(diskMap), nil
 }
@@ -437,6 +513,7 @@ func (c *controllerCommon) cleanDetachDiskRequests(nodeName string) (map[string]
 	}
 	// clean up original requests in disk map
 	c.detachDiskMap.Store(nodeName, make(map[string]string))
+	c.detachBatcher.flush(nodeName, batchOperationDetach)
 	return diskMap, nil
 }
 
@@ -450,6 +527,89 @@ func (c *controllerCommon) GetNodeDataDisks(nodeName types.NodeName, crt azcache
 	return vmset.GetDataDisks(nodeName, crt)
 }
 
+// getUsedDataDiskSlots returns the number of data disk slots on nodeName used by attached disks (including disks
+// not managed by the driver) and pending attach requests, disks being detached and diskURI itself are not counted
+func (c *controllerCommon) getUsedDataDiskSlots(nodeName types.NodeName, diskURI string) (int, error) {
+	used, err := c.getAttachedDataDisks(nodeName)
+	if err != nil {
+		return 0, err
+	}
+
+	node := strings.ToLower(string(nodeName))
+	attachDiskMapKey := node + attachDiskMapKeySuffix
+	c.lockMap.LockEntry(attachDiskMapKey)
+	if v, ok := c.attachDiskMap.Load(node); ok {
+		if diskMap, ok := v.(map[string]*provider.AttachDiskOptions); ok {
+			for uri := range diskMap {
+				used.Insert(strings.ToLower(uri))
+			}
+		}
+	}
+	c.lockMap.UnlockEntry(attachDiskMapKey)
+
+	used.Delete(strings.ToLower(diskURI))
+	return used.Len(), nil
+}
+
+// getAttachedDataDisks returns the IDs of data disks attached to nodeName which are not being detached
+func (c *controllerCommon) getAttachedDataDisks(nodeName types.NodeName) (sets.Set[string], error) {
+	dataDisks, _, err := c.GetNodeDataDisks(nodeName, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return nil, err
+	}
+	used := sets.New[string]()
+	for _, disk := range dataDisks {
+		if disk == nil || pointer.BoolDeref(disk.ToBeDetached, false) {
+			continue
+		}
+		id := ""
+		if disk.ManagedDisk != nil && disk.ManagedDisk.ID != nil {
+			id = strings.ToLower(*disk.ManagedDisk.ID)
+		} else if disk.Vhd != nil && disk.Vhd.URI != nil {
+			id = strings.ToLower(*disk.Vhd.URI)
+		} else if disk.Lun != nil {
+			id = fmt.Sprintf("lun-%d", *disk.Lun)
+		}
+		used.Insert(id)
+	}
+	return used, nil
+}
+
+// getMaxDataDiskSlots returns the data disk capacity of the VM size of nodeName, ok is false if the VM size is unknown.
+// It is compared with all disks attached to the node, the volume limit in CSINode is not used since it excludes the
+// slots reserved for disks attached outside of the driver, which are counted as attached disks already. Known results
+// are cached for dataDiskSlotsCacheTTL since this is called on every attach and detach.
+func (c *controllerCommon) getMaxDataDiskSlots(ctx context.Context, nodeName types.NodeName) (int64, string, bool) {
+	if c.cloud == nil || c.cloud.KubeClient == nil {
+		return 0, "", false
+	}
+	node := strings.ToLower(string(nodeName))
+	if v, ok := c.dataDiskSlots.Load(node); ok {
+		if slots := v.(dataDiskSlots); time.Now().Before(slots.expiry) {
+			return slots.max, slots.instanceType, true
+		}
+	}
+	maxDataDiskCount, instanceType, ok := c.lookupMaxDataDiskSlots(ctx, nodeName)
+	if ok {
+		c.dataDiskSlots.Store(node, dataDiskSlots{max: maxDataDiskCount, instanceType: instanceType, expiry: time.Now().Add(dataDiskSlotsCacheTTL)})
+	}
+	return maxDataDiskCount, instanceType, ok
+}
+
+func (c *controllerCommon) lookupMaxDataDiskSlots(ctx context.Context, nodeName types.NodeName) (int64, string, bool) {
+	_, instanceType, err := getNodeInfoFromLabels(ctx, string(nodeName), c.cloud.KubeClient)
+	if err != nil || instanceType == "" {
+		klog.V(4).Infof("failed to get instance type of node(%s): %v", nodeName, err)
+		return 0, "", false
+	}
+	maxDataDiskCount, ok := maxDataDiskCountMap[strings.ToUpper(instanceType)]
+	if !ok {
+		klog.V(4).Infof("unknown data disk capacity of VM size(%s) of node(%s)", instanceType, nodeName)
+		return 0, instanceType, false
+	}
+	return maxDataDiskCount, instanceType, true
+}
+
 // GetDiskLun finds the lun on the host that the vhd is attached to, given a vhd's diskName and diskURI.
 func (c *controllerCommon) GetDiskLun(diskName, diskURI string, nodeName types.NodeName) (int32, *string, error) {
 	// GetNodeDataDisks need to fetch the cached data/fresh data if cache expired here
@@ -488,15 +648,11 @@ func (c *controllerCommon) SetDiskLun(nodeName types.NodeName, diskURI string, d
 
 	lun := int32(-1)
 	_, isDiskInMap := diskMap[diskURI]
-	used := make([]bool, maxLUN)
-	for _, disk := range disks {
-		if disk.Lun != nil {
-			used[*disk.Lun] = true
-			if !isDiskInMap {
-				// find lun of diskURI since diskURI is not in diskMap
-				if disk.ManagedDisk != nil && strings.EqualFold(*disk.ManagedDisk.ID, diskURI) {
-					lun = *disk.Lun
-				}
+	if !isDiskInMap {
+		// find lun of diskURI since diskURI is not in diskMap
+		for _, disk := range disks {
+			if disk.Lun != nil && disk.ManagedDisk != nil && disk.ManagedDisk.ID != nil && strings.EqualFold(*disk.ManagedDisk.ID, diskURI) {
+				lun = *disk.Lun
 			}
 		}
 	}
@@ -508,40 +664,47 @@ func (c *controllerCommon) SetDiskLun(nodeName types.NodeName, diskURI string, d
 		return lun, nil
 	}
 
-	for _, lun := range occupiedLuns {
-		if lun >= 0 && lun <= maxLUN {
-			used[int32(lun)] = true
-		}
-	}
-
-	// allocate lun for every disk in diskMap
-	var diskLuns []int32
-	count := 0
-	for k, v := range used {
-		if !v {
-			diskLuns = append(diskLuns, int32(k))
-			count++
-			if count >= len(diskMap) {
-				break
-			}
-		}
-	}
+	node := strings.ToLower(string(nodeName))
+	reservations := c.getLunReservations(node)
+	reservations.Lock()
+	defer reservations.Unlock()
 
-	if len(diskLuns) != len(diskMap) {
-		return -1, fmt.Errorf("could not find enough disk luns(current: %d) for diskMap(%v, len=%d), diskURI(%s)",
-			len(diskLuns), diskMap, len(diskMap), diskURI)
-	}
+	used := reservations.usedLuns(disks, occupiedLuns, diskMap)
 
-	count = 0
+	// prefer the LUN recorded for the disk, then allocate the lowest free LUN for the rest
+	var pending []string
 	for uri, opt := range diskMap {
 		if opt == nil {
 			return -1, fmt.Errorf("unexpected nil pointer in diskMap(%v), diskURI(%s)", diskMap, diskURI)
 		}
+		if opt.Lun >= 0 && opt.Lun < maxLUN && !used[opt.Lun] {
+			used[opt.Lun] = true
+			continue
+		}
+		if opt.Lun >= 0 {
+			klog.V(2).Infof("preferred lun %d of disk(%s) is in use on node(%s), allocate a new lun", opt.Lun, uri, nodeName)
+		}
+		pending = append(pending, uri)
+	}
+	sort.Strings(pending)
+	k := 0
+	for _, uri := range pending {
+		for k < maxLUN && used[k] {
+			k++
+		}
+		if k >= maxLUN {
+			return -1, fmt.Errorf("could not find enough disk luns(current: %d) for diskMap(%v, len=%d), diskURI(%s)",
+				len(diskMap)-len(pending), diskMap, len(diskMap), diskURI)
+		}
+		diskMap[uri].Lun = int32(k)
+		used[k] = true
+	}
+
+	for uri, opt := range diskMap {
 		if strings.EqualFold(uri, diskURI) {
-			lun = diskLuns[count]
+			lun = opt.Lun
 		}
-		opt.Lun = diskLuns[count]
-		count++
+		reservations.luns[strings.ToLower(uri)] = opt.Lun
 	}
 	if lun < 0 {
 		return lun, fmt.Errorf("could not find lun of diskURI(%s), diskMap(%v)", diskURI, diskMap)
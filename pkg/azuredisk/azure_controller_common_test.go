@@ -38,8 +38,11 @@ import (
 	autorestmocks "github.com/Azure/go-autorest/autorest/mocks"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/utils/pointer"
 
@@ -1034,3 +1037,88 @@ func setTestVirtualMachines(c *provider.Cloud, vmList map[string]string, isDataD
 
 	return expectedVMs
 }
+
+func TestGetUsedDataDiskSlots(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testCases := []struct {
+		desc         string
+		diskURI      string
+		pendingDisks []string
+		expectedUsed int
+	}{
+		{
+			desc:         "attached disks are counted",
+			diskURI:      "diskURI",
+			expectedUsed: 3,
+		},
+		{
+			desc:         "pending attach requests are counted",
+			diskURI:      "diskURI",
+			pendingDisks: []string{"diskURI1", "diskURI2"},
+			expectedUsed: 5,
+		},
+		{
+			desc:         "pending request of the disk itself is not counted",
+			diskURI:      "diskURI",
+			pendingDisks: []string{"diskURI", "diskURI1"},
+			expectedUsed: 4,
+		},
+	}
+
+	for i, test := range testCases {
+		testCloud := provider.GetTestCloud(ctrl)
+		common := &controllerCommon{
+			cloud:   testCloud,
+			lockMap: newLockMap(),
+		}
+		expectedVMs := setTestVirtualMachines(testCloud, map[string]string{"vm1": "PowerState/Running"}, false)
+		mockVMsClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+		for _, vm := range expectedVMs {
+			mockVMsClient.EXPECT().Get(gomock.Any(), testCloud.ResourceGroup, *vm.Name, gomock.Any()).Return(vm, nil).AnyTimes()
+		}
+		for _, diskURI := range test.pendingDisks {
+			_, err := common.insertAttachDiskRequest(diskURI, "vm1", &provider.AttachDiskOptions{})
+			assert.NoError(t, err)
+		}
+
+		used, err := common.getUsedDataDiskSlots("vm1", test.diskURI)
+		assert.NoError(t, err, "TestCase[%d]: %s", i, test.desc)
+		assert.Equal(t, test.expectedUsed, used, "TestCase[%d]: %s", i, test.desc)
+	}
+}
+
+func TestGetMaxDataDiskSlotsCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testCloud := provider.GetTestCloud(ctrl)
+	kubeClient := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "vm1",
+			Labels: map[string]string{v1.LabelInstanceTypeStable: "Standard_D2s_v3"},
+		},
+	})
+	testCloud.KubeClient = kubeClient
+	common := &controllerCommon{cloud: testCloud, lockMap: newLockMap()}
+
+	maxDataDiskCount, instanceType, ok := common.getMaxDataDiskSlots(context.Background(), "vm1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), maxDataDiskCount)
+	assert.Equal(t, "Standard_D2s_v3", instanceType)
+	lookups := len(kubeClient.Actions())
+
+	// the node is only looked up again once the cache expires
+	_, _, ok = common.getMaxDataDiskSlots(context.Background(), "VM1")
+	assert.True(t, ok)
+	assert.Len(t, kubeClient.Actions(), lookups)
+
+	assert.NoError(t, kubeClient.CoreV1().Nodes().Delete(context.Background(), "vm1", metav1.DeleteOptions{}))
+	v, _ := common.dataDiskSlots.Load("vm1")
+	slots := v.(dataDiskSlots)
+	slots.expiry = time.Now()
+	common.dataDiskSlots.Store("vm1", slots)
+	_, _, ok = common.getMaxDataDiskSlots(context.Background(), "vm1")
+	assert.False(t, ok)
+}
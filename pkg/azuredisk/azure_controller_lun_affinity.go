@@ -0,0 +1,160 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// recordDiskLunTimeout is the timeout of recording the preferred LUN in disk tags in the background
+const recordDiskLunTimeout = 2 * time.Minute
+
+// nodeLunReservations is the LUNs assigned to disks of in-flight attach batches on a node,
+// a LUN stays reserved until the attach operation of its batch completes and VM state reflects it
+type nodeLunReservations struct {
+	sync.Mutex
+	// <lower-case diskURI, lun>
+	luns map[string]int32
+}
+
+func (c *controllerCommon) getLunReservations(nodeName string) *nodeLunReservations {
+	v, _ := c.lunReservations.LoadOrStore(nodeName, &nodeLunReservations{luns: make(map[string]int32)})
+	return v.(*nodeLunReservations)
+}
+
+// usedLuns returns the LUN view of a node combining data disks of the VM, LUNs used by VolumeAttachments (occupiedLuns)
+// and LUNs reserved by other in-flight batches, the caller must hold the lock
+func (r *nodeLunReservations) usedLuns(disks []*armcompute.DataDisk, occupiedLuns []int, diskMap map[string]*provider.AttachDiskOptions) []bool {
+	used := make([]bool, maxLUN)
+	for _, disk := range disks {
+		if disk != nil && disk.Lun != nil && *disk.Lun >= 0 && *disk.Lun < maxLUN {
+			used[*disk.Lun] = true
+		}
+	}
+	for _, lun := range occupiedLuns {
+		if lun >= 0 && lun < maxLUN {
+			used[lun] = true
+		}
+	}
+	for uri, lun := range r.luns {
+		if _, ok := diskMap[uri]; ok {
+			continue
+		}
+		if lun >= 0 && lun < maxLUN {
+			used[lun] = true
+		}
+	}
+	return used
+}
+
+// releaseLuns releases the LUNs reserved for disks in diskMap on nodeName
+func (c *controllerCommon) releaseLuns(nodeName string, diskMap map[string]*provider.AttachDiskOptions) {
+	if len(diskMap) == 0 {
+		return
+	}
+	reservations := c.getLunReservations(nodeName)
+	reservations.Lock()
+	defer reservations.Unlock()
+	for uri := range diskMap {
+		delete(reservations.luns, strings.ToLower(uri))
+	}
+}
+
+// getPreferredLun returns the LUN recorded in disk tags by a previous attach, or -1 if there is none
+func getPreferredLun(disk *armcompute.Disk) int32 {
+	if disk == nil || disk.Tags == nil {
+		return -1
+	}
+	v, ok := disk.Tags[consts.PreferredLunTag]
+	if !ok || v == nil {
+		return -1
+	}
+	lun, err := strconv.Atoi(*v)
+	if err != nil || lun < 0 || lun >= maxLUN {
+		klog.Warningf("invalid %s tag value(%s) on disk(%s)", consts.PreferredLunTag, *v, pointer.StringDeref(disk.ID, ""))
+		return -1
+	}
+	return int32(lun)
+}
+
+// recordDiskLun records lun as the preferred LUN in tags of disk in the background if LUN affinity is enabled and it's
+// not recorded yet. Recording the LUN is best effort and must not delay ControllerPublishVolume, a failure is only logged.
+// Shared disks are skipped since they are attached on different LUNs of several nodes at the same time.
+func (c *controllerCommon) recordDiskLun(disk *armcompute.Disk, diskURI string, lun int32) {
+	if !c.EnableLunAffinity || disk == nil || lun < 0 || getPreferredLun(disk) == lun {
+		return
+	}
+	if disk.Properties != nil && pointer.Int32Deref(disk.Properties.MaxShares, 1) > 1 {
+		return
+	}
+	key := strings.ToLower(diskURI)
+	if _, recording := c.recordingLuns.LoadOrStore(key, lun); recording {
+		return
+	}
+
+	go func() {
+		defer c.recordingLuns.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), recordDiskLunTimeout)
+		defer cancel()
+		if err := c.patchDiskTag(ctx, diskURI, consts.PreferredLunTag, strconv.Itoa(int(lun))); err != nil {
+			klog.Warningf("azureDisk - failed to record lun %d of disk(%s) in tag %s: %v", lun, diskURI, consts.PreferredLunTag, err)
+			return
+		}
+		klog.V(2).Infof("azureDisk - recorded lun %d of disk(%s) in tag %s", lun, diskURI, consts.PreferredLunTag)
+	}()
+}
+
+// patchDiskTag sets tag key of diskURI to value. A PATCH replaces all tags of a disk and disks have no conditional
+// update, so the tags are read right before patching to keep tags changed since the disk was read by the caller.
+func (c *controllerCommon) patchDiskTag(ctx context.Context, diskURI, key, value string) error {
+	resourceGroup, subsID, err := getInfoFromDiskURI(diskURI)
+	if err != nil {
+		return err
+	}
+	diskClient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	if err != nil {
+		return err
+	}
+	diskName := path.Base(diskURI)
+	disk, err := diskClient.Get(ctx, resourceGroup, diskName)
+	if err != nil {
+		return err
+	}
+	if v, ok := disk.Tags[key]; ok && pointer.StringDeref(v, "") == value {
+		return nil
+	}
+	tags := make(map[string]*string, len(disk.Tags)+1)
+	for k, v := range disk.Tags {
+		tags[k] = v
+	}
+	tags[key] = to.Ptr(value)
+	_, err = diskClient.Patch(ctx, resourceGroup, diskName, armcompute.DiskUpdate{Tags: tags})
+	return err
+}
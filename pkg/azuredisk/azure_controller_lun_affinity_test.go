@@ -0,0 +1,248 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"k8s.io/apimachinery/pkg/types"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestGetPreferredLun(t *testing.T) {
+	tests := []struct {
+		desc     string
+		disk     *armcompute.Disk
+		expected int32
+	}{
+		{
+			desc:     "nil disk",
+			expected: -1,
+		},
+		{
+			desc:     "no tag",
+			disk:     &armcompute.Disk{Tags: map[string]*string{"key": to.Ptr("value")}},
+			expected: -1,
+		},
+		{
+			desc:     "valid tag",
+			disk:     &armcompute.Disk{Tags: map[string]*string{consts.PreferredLunTag: to.Ptr("5")}},
+			expected: 5,
+		},
+		{
+			desc:     "invalid tag",
+			disk:     &armcompute.Disk{Tags: map[string]*string{consts.PreferredLunTag: to.Ptr("five")}},
+			expected: -1,
+		},
+		{
+			desc:     "out of range tag",
+			disk:     &armcompute.Disk{Tags: map[string]*string{consts.PreferredLunTag: to.Ptr("64")}},
+			expected: -1,
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getPreferredLun(test.disk), test.desc)
+	}
+}
+
+func TestSetDiskLunWithAffinity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testCases := []struct {
+		desc         string
+		diskMap      map[string]*provider.AttachDiskOptions
+		occupiedLuns []int
+		reserved     map[string]int32
+		expectedLuns map[string]int32
+	}{
+		{
+			desc:         "preferred LUN is assigned if it's free",
+			diskMap:      map[string]*provider.AttachDiskOptions{"diskuri": {Lun: 10}},
+			expectedLuns: map[string]int32{"diskuri": 10},
+		},
+		{
+			desc:         "preferred LUN used by the VM is not assigned",
+			diskMap:      map[string]*provider.AttachDiskOptions{"diskuri": {Lun: 1}},
+			expectedLuns: map[string]int32{"diskuri": 3},
+		},
+		{
+			desc:         "preferred LUN used by VolumeAttachments is not assigned",
+			diskMap:      map[string]*provider.AttachDiskOptions{"diskuri": {Lun: 4}},
+			occupiedLuns: []int{4},
+			expectedLuns: map[string]int32{"diskuri": 3},
+		},
+		{
+			desc:         "LUNs reserved by in-flight batches are not assigned",
+			diskMap:      map[string]*provider.AttachDiskOptions{"diskuri": {Lun: 7}, "diskuri2": {Lun: -1}},
+			reserved:     map[string]int32{"otherdisk": 7, "otherdisk2": 3},
+			expectedLuns: map[string]int32{"diskuri": 4, "diskuri2": 5},
+		},
+		{
+			desc:         "preferred LUNs are assigned before the rest",
+			diskMap:      map[string]*provider.AttachDiskOptions{"diskuri": {Lun: -1}, "diskuri2": {Lun: 3}},
+			expectedLuns: map[string]int32{"diskuri": 4, "diskuri2": 3},
+		},
+	}
+
+	for i, test := range testCases {
+		testCloud := provider.GetTestCloud(ctrl)
+		common := &controllerCommon{
+			cloud:   testCloud,
+			lockMap: newLockMap(),
+		}
+		expectedVMs := setTestVirtualMachines(testCloud, map[string]string{"vm1": "PowerState/Running"}, false)
+		mockVMsClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+		for _, vm := range expectedVMs {
+			mockVMsClient.EXPECT().Get(gomock.Any(), testCloud.ResourceGroup, *vm.Name, gomock.Any()).Return(vm, nil).AnyTimes()
+		}
+		for uri, lun := range test.reserved {
+			common.getLunReservations("vm1").luns[uri] = lun
+		}
+
+		lun, err := common.SetDiskLun(types.NodeName("vm1"), "diskuri", test.diskMap, test.occupiedLuns)
+		assert.NoError(t, err, "TestCase[%d]: %s", i, test.desc)
+		assert.Equal(t, test.expectedLuns["diskuri"], lun, "TestCase[%d]: %s", i, test.desc)
+		for uri, expectedLun := range test.expectedLuns {
+			assert.Equal(t, expectedLun, test.diskMap[uri].Lun, "TestCase[%d]: %s", i, test.desc)
+			assert.Equal(t, expectedLun, common.getLunReservations("vm1").luns[uri], "TestCase[%d]: %s", i, test.desc)
+		}
+
+		common.releaseLuns("vm1", test.diskMap)
+		assert.Equal(t, len(test.reserved), len(common.getLunReservations("vm1").luns), "TestCase[%d]: %s", i, test.desc)
+	}
+}
+
+func TestRecordDiskLun(t *testing.T) {
+	diskURI := fmt.Sprintf(managedDiskPath, "subs", "rg", "disk1")
+	tests := []struct {
+		desc        string
+		enabled     bool
+		disk        *armcompute.Disk
+		lun         int32
+		currentTags map[string]*string
+		getErr      error
+		patchErr    error
+		expectedGet bool
+		// tags patched on the disk, nil if the disk isn't patched
+		expectedTags map[string]*string
+	}{
+		{
+			desc: "LUN affinity disabled",
+			disk: &armcompute.Disk{},
+			lun:  1,
+		},
+		{
+			desc:    "LUN already recorded",
+			enabled: true,
+			disk:    &armcompute.Disk{Tags: map[string]*string{consts.PreferredLunTag: to.Ptr("1")}},
+			lun:     1,
+		},
+		{
+			desc:    "nil disk",
+			enabled: true,
+			lun:     1,
+		},
+		{
+			desc:    "shared disk",
+			enabled: true,
+			disk:    &armcompute.Disk{Properties: &armcompute.DiskProperties{MaxShares: to.Ptr(int32(2))}},
+			lun:     1,
+		},
+		{
+			desc:         "LUN recorded with current tags kept",
+			enabled:      true,
+			disk:         &armcompute.Disk{Tags: map[string]*string{"key": to.Ptr("value"), consts.PreferredLunTag: to.Ptr("2")}},
+			lun:          1,
+			currentTags:  map[string]*string{"key": to.Ptr("value"), "added": to.Ptr("later"), consts.PreferredLunTag: to.Ptr("2")},
+			expectedGet:  true,
+			expectedTags: map[string]*string{"key": to.Ptr("value"), "added": to.Ptr("later"), consts.PreferredLunTag: to.Ptr("1")},
+		},
+		{
+			desc:         "tags removed since the disk was read are not restored",
+			enabled:      true,
+			disk:         &armcompute.Disk{Tags: map[string]*string{"key": to.Ptr("value")}},
+			lun:          1,
+			expectedGet:  true,
+			expectedTags: map[string]*string{consts.PreferredLunTag: to.Ptr("1")},
+		},
+		{
+			desc:        "LUN recorded since the disk was read",
+			enabled:     true,
+			disk:        &armcompute.Disk{},
+			lun:         1,
+			currentTags: map[string]*string{consts.PreferredLunTag: to.Ptr("1")},
+			expectedGet: true,
+		},
+		{
+			desc:        "failure to read disk is ignored",
+			enabled:     true,
+			disk:        &armcompute.Disk{},
+			lun:         1,
+			getErr:      fmt.Errorf("throttled"),
+			expectedGet: true,
+		},
+		{
+			desc:         "failure to record LUN is ignored",
+			enabled:      true,
+			disk:         &armcompute.Disk{Tags: map[string]*string{"key": to.Ptr("value")}, Properties: &armcompute.DiskProperties{MaxShares: to.Ptr(int32(1))}},
+			lun:          1,
+			currentTags:  map[string]*string{"key": to.Ptr("value")},
+			patchErr:     fmt.Errorf("throttled"),
+			expectedGet:  true,
+			expectedTags: map[string]*string{"key": to.Ptr("value"), consts.PreferredLunTag: to.Ptr("1")},
+		},
+	}
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		mockFactory := mock_azclient.NewMockClientFactory(ctrl)
+		mockDisksClient := mock_diskclient.NewMockInterface(ctrl)
+		mockFactory.EXPECT().GetDiskClientForSub("subs").Return(mockDisksClient, nil).AnyTimes()
+		if test.expectedGet {
+			mockDisksClient.EXPECT().Get(gomock.Any(), "rg", "disk1").Return(&armcompute.Disk{Tags: test.currentTags}, test.getErr).Times(1)
+		}
+		if test.expectedTags != nil {
+			mockDisksClient.EXPECT().Patch(gomock.Any(), "rg", "disk1", armcompute.DiskUpdate{Tags: test.expectedTags}).
+				Return(&armcompute.Disk{}, test.patchErr).Times(1)
+		}
+		common := &controllerCommon{
+			clientFactory:     mockFactory,
+			lockMap:           newLockMap(),
+			EnableLunAffinity: test.enabled,
+		}
+		common.recordDiskLun(test.disk, diskURI, test.lun)
+		// the LUN is recorded in the background, which is done once the disk is no longer being recorded
+		assert.Eventually(t, func() bool {
+			_, recording := common.recordingLuns.Load(strings.ToLower(diskURI))
+			return !recording
+		}, 5*time.Second, 10*time.Millisecond, test.desc)
+		ctrl.Finish()
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+type nodeOperation string
+
+const (
+	nodeOperationAttach nodeOperation = "attach"
+	nodeOperationDetach nodeOperation = "detach"
+	nodeOperationUpdate nodeOperation = "update"
+
+	// a waiting operation is served before higher priority operations once it has waited this long
+	schedulerStarvationTimeout = 30 * time.Second
+)
+
+type attachDetachPriorityKey struct{}
+
+// withAttachDetachPriority returns a context carrying the scheduling priority of an attach or detach operation
+func withAttachDetachPriority(ctx context.Context, priority int32) context.Context {
+	return context.WithValue(ctx, attachDetachPriorityKey{}, priority)
+}
+
+// getAttachDetachPriority returns the scheduling priority carried by ctx, 0 by default
+func getAttachDetachPriority(ctx context.Context) int32 {
+	if priority, ok := ctx.Value(attachDetachPriorityKey{}).(int32); ok {
+		return priority
+	}
+	return 0
+}
+
+// nodeScheduler serializes attach, detach and VM update operations per node.
+// Waiting operations are served in this order:
+//  1. operations waiting longer than schedulerStarvationTimeout, oldest first
+//  2. detaches if the node is short of data disk slots for pending attaches, oldest first
+//  3. higher priority first (e.g. PriorityClass of the pod consuming the disk), oldest first among equal priorities
+//
+// The zero value is ready to use, node queues are created on first operation of a node.
+type nodeScheduler struct {
+	// <nodeName, *nodeOperationQueue>
+	queues sync.Map
+	now    func() time.Time
+}
+
+type nodeOperationQueue struct {
+	sync.Mutex
+	// an operation is running on the node
+	busy bool
+	// the node has fewer free data disk slots than pending attaches
+	lunPressure bool
+	seq         uint64
+	waiters     []*nodeOperationWaiter
+}
+
+type nodeOperationWaiter struct {
+	operation nodeOperation
+	priority  int32
+	seq       uint64
+	enqueued  time.Time
+	ready     chan struct{}
+}
+
+func (s *nodeScheduler) getQueue(nodeName string) *nodeOperationQueue {
+	v, _ := s.queues.LoadOrStore(nodeName, &nodeOperationQueue{})
+	return v.(*nodeOperationQueue)
+}
+
+func (s *nodeScheduler) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// acquire blocks until operation is scheduled on nodeName or ctx is done, the returned func must be called once the
+// operation completes
+func (s *nodeScheduler) acquire(ctx context.Context, nodeName string, operation nodeOperation, priority int32) (func(), error) {
+	q := s.getQueue(nodeName)
+	release := func() { s.release(q) }
+
+	q.Lock()
+	if !q.busy && len(q.waiters) == 0 {
+		q.busy = true
+		q.Unlock()
+		return release, nil
+	}
+	q.seq++
+	w := &nodeOperationWaiter{
+		operation: operation,
+		priority:  priority,
+		seq:       q.seq,
+		enqueued:  s.clock(),
+		ready:     make(chan struct{}),
+	}
+	q.waiters = append(q.waiters, w)
+	q.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	q.Lock()
+	for i := range q.waiters {
+		if q.waiters[i] == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			q.Unlock()
+			return nil, fmt.Errorf("%s operation on node(%s) was not scheduled: %w", operation, nodeName, ctx.Err())
+		}
+	}
+	q.Unlock()
+	// the operation was scheduled while ctx was done, the node is passed on to the next operation
+	s.release(q)
+	return nil, fmt.Errorf("%s operation on node(%s) was not scheduled: %w", operation, nodeName, ctx.Err())
+}
+
+// release schedules the next waiting operation on the node of q
+func (s *nodeScheduler) release(q *nodeOperationQueue) {
+	q.Lock()
+	defer q.Unlock()
+	i := q.next(s.clock())
+	if i < 0 {
+		q.busy = false
+		return
+	}
+	w := q.waiters[i]
+	q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+	close(w.ready)
+}
+
+// setLunPressure records whether nodeName has fewer free data disk slots than pending attaches
+func (s *nodeScheduler) setLunPressure(nodeName string, lunPressure bool) {
+	q := s.getQueue(nodeName)
+	q.Lock()
+	defer q.Unlock()
+	q.lunPressure = lunPressure
+}
+
+// next returns the index of the waiter to be served next, or -1 if there is none, the caller must hold the lock
+func (q *nodeOperationQueue) next(now time.Time) int {
+	best := -1
+	better := func(w, b *nodeOperationWaiter) bool {
+		wStarved, bStarved := now.Sub(w.enqueued) >= schedulerStarvationTimeout, now.Sub(b.enqueued) >= schedulerStarvationTimeout
+		if wStarved != bStarved {
+			return wStarved
+		}
+		if !wStarved && q.lunPressure {
+			wDetach, bDetach := w.operation == nodeOperationDetach, b.operation == nodeOperationDetach
+			if wDetach != bDetach {
+				return wDetach
+			}
+		}
+		if !wStarved && w.priority != b.priority {
+			return w.priority > b.priority
+		}
+		return w.seq < b.seq
+	}
+	for i, w := range q.waiters {
+		if best < 0 || better(w, q.waiters[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// lockNode serializes attach, detach and VM update operations on nodeName, the returned func unlocks the node,
+// an error is returned if ctx is done before the operation is scheduled
+func (c *controllerCommon) lockNode(ctx context.Context, nodeName types.NodeName, operation nodeOperation) (func(), error) {
+	node := strings.ToLower(string(nodeName))
+	if !c.EnableAttachDetachPriority {
+		c.lockMap.LockEntry(node)
+		return func() { c.lockMap.UnlockEntry(node) }, nil
+	}
+	if operation != nodeOperationUpdate {
+		c.nodeScheduler.setLunPressure(node, c.hasLunPressure(ctx, nodeName))
+	}
+	return c.nodeScheduler.acquire(ctx, node, operation, getAttachDetachPriority(ctx))
+}
+
+// getFreeDataDiskSlots returns the number of data disk slots on nodeName the driver can use which are not used by
+// attached disks, ok is false if the data disk capacity of the node is unknown
+func (c *controllerCommon) getFreeDataDiskSlots(ctx context.Context, nodeName types.NodeName) (int, bool) {
+	maxDataDiskCount, _, ok := c.getMaxDataDiskSlots(ctx, nodeName)
+	if !ok {
+		return 0, false
+	}
+	attached, err := c.getAttachedDataDisks(nodeName)
+	if err != nil {
+		klog.V(4).Infof("failed to get data disks of node(%s): %v", nodeName, err)
+		return 0, false
+	}
+	return max(int(maxDataDiskCount)-attached.Len(), 0), true
+}
+
+// hasLunPressure returns whether nodeName has fewer free data disk slots than pending attach requests
+func (c *controllerCommon) hasLunPressure(ctx context.Context, nodeName types.NodeName) bool {
+	free, ok := c.getFreeDataDiskSlots(ctx, nodeName)
+	if !ok {
+		return false
+	}
+	node := strings.ToLower(string(nodeName))
+	attachDiskMapKey := node + attachDiskMapKeySuffix
+	c.lockMap.LockEntry(attachDiskMapKey)
+	defer c.lockMap.UnlockEntry(attachDiskMapKey)
+	if v, ok := c.attachDiskMap.Load(node); ok {
+		if diskMap, ok := v.(map[string]*provider.AttachDiskOptions); ok {
+			return len(diskMap) > free
+		}
+	}
+	return false
+}
+
+// deferAttachDiskRequests keeps the requests of diskMap which fit in the free data disk slots of nodeName,
+// higher priority first, the other requests are put back to the attach queue of the node
+func (c *controllerCommon) deferAttachDiskRequests(ctx context.Context, nodeName types.NodeName, diskMap map[string]*provider.AttachDiskOptions) map[string]*provider.AttachDiskOptions {
+	free, ok := c.getFreeDataDiskSlots(ctx, nodeName)
+	if !ok || len(diskMap) <= free {
+		return diskMap
+	}
+	uris := make([]string, 0, len(diskMap))
+	for uri := range diskMap {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool {
+		pi, pj := c.getAttachPriority(uris[i]), c.getAttachPriority(uris[j])
+		if pi != pj {
+			return pi > pj
+		}
+		return uris[i] < uris[j]
+	})
+
+	node := strings.ToLower(string(nodeName))
+	attachDiskMapKey := node + attachDiskMapKeySuffix
+	c.lockMap.LockEntry(attachDiskMapKey)
+	defer c.lockMap.UnlockEntry(attachDiskMapKey)
+	pending, ok := c.attachDiskMap.Load(node)
+	if !ok {
+		pending = make(map[string]*provider.AttachDiskOptions)
+		c.attachDiskMap.Store(node, pending)
+	}
+	pendingDiskMap, ok := pending.(map[string]*provider.AttachDiskOptions)
+	if !ok {
+		return diskMap
+	}
+	deferred := uris[free:]
+	for _, uri := range deferred {
+		pendingDiskMap[uri] = diskMap[uri]
+		delete(diskMap, uri)
+	}
+	klog.V(2).Infof("node(%s) has %d free data disk slots, defer attach of lower priority disks %v", nodeName, free, deferred)
+	return diskMap
+}
+
+// removeAttachDiskRequest removes the pending attach request of diskURI on nodeName, returns false if there is none
+func (c *controllerCommon) removeAttachDiskRequest(diskURI, nodeName string) bool {
+	attachDiskMapKey := nodeName + attachDiskMapKeySuffix
+	c.lockMap.LockEntry(attachDiskMapKey)
+	defer c.lockMap.UnlockEntry(attachDiskMapKey)
+	v, ok := c.attachDiskMap.Load(nodeName)
+	if !ok {
+		return false
+	}
+	diskMap, ok := v.(map[string]*provider.AttachDiskOptions)
+	if !ok {
+		return false
+	}
+	if _, ok := diskMap[diskURI]; !ok {
+		return false
+	}
+	delete(diskMap, diskURI)
+	c.attachDetachDataDisksCompatible.Delete(attachDetachDataDisksKey(nodeName, diskURI))
+	return true
+}
+
+// removeDetachDiskRequest removes the pending detach request of diskURI on nodeName
+func (c *controllerCommon) removeDetachDiskRequest(diskURI, nodeName string) {
+	detachDiskMapKey := nodeName + detachDiskMapKeySuffix
+	c.lockMap.LockEntry(detachDiskMapKey)
+	defer c.lockMap.UnlockEntry(detachDiskMapKey)
+	if v, ok := c.detachDiskMap.Load(nodeName); ok {
+		if diskMap, ok := v.(map[string]string); ok {
+			delete(diskMap, diskURI)
+		}
+	}
+}
+
+func (c *controllerCommon) getAttachPriority(diskURI string) int32 {
+	if v, ok := c.attachPriorities.Load(strings.ToLower(diskURI)); ok {
+		return v.(int32)
+	}
+	return 0
+}
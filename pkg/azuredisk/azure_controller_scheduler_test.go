@@ -0,0 +1,369 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestNodeOperationQueueNext(t *testing.T) {
+	now := time.Now()
+	waiter := func(operation nodeOperation, priority int32, seq uint64, waited time.Duration) *nodeOperationWaiter {
+		return &nodeOperationWaiter{operation: operation, priority: priority, seq: seq, enqueued: now.Add(-waited)}
+	}
+
+	tests := []struct {
+		desc        string
+		lunPressure bool
+		waiters     []*nodeOperationWaiter
+		expected    int
+	}{
+		{
+			desc:     "no waiter",
+			expected: -1,
+		},
+		{
+			desc: "oldest first among equal priorities",
+			waiters: []*nodeOperationWaiter{
+				waiter(nodeOperationAttach, 0, 2, 0),
+				waiter(nodeOperationDetach, 0, 1, 0),
+			},
+			expected: 1,
+		},
+		{
+			desc: "higher priority first",
+			waiters: []*nodeOperationWaiter{
+				waiter(nodeOperationDetach, 0, 1, time.Second),
+				waiter(nodeOperationAttach, 1000, 2, 0),
+				waiter(nodeOperationAttach, 100, 3, 0),
+			},
+			expected: 1,
+		},
+		{
+			desc:        "detaches first under LUN pressure",
+			lunPressure: true,
+			waiters: []*nodeOperationWaiter{
+				waiter(nodeOperationAttach, 1000, 1, time.Second),
+				waiter(nodeOperationUpdate, 0, 2, 0),
+				waiter(nodeOperationDetach, 0, 3, 0),
+			},
+			expected: 2,
+		},
+		{
+			desc: "starved operations first",
+			waiters: []*nodeOperationWaiter{
+				waiter(nodeOperationAttach, 1000, 3, 0),
+				waiter(nodeOperationAttach, 0, 2, schedulerStarvationTimeout),
+				waiter(nodeOperationAttach, 0, 1, schedulerStarvationTimeout+time.Second),
+			},
+			expected: 2,
+		},
+		{
+			desc:        "starved operations first under LUN pressure",
+			lunPressure: true,
+			waiters: []*nodeOperationWaiter{
+				waiter(nodeOperationDetach, 0, 2, 0),
+				waiter(nodeOperationAttach, -100, 1, schedulerStarvationTimeout),
+			},
+			expected: 1,
+		},
+	}
+	for _, test := range tests {
+		q := &nodeOperationQueue{lunPressure: test.lunPressure, waiters: test.waiters}
+		assert.Equal(t, test.expected, q.next(now), test.desc)
+	}
+}
+
+func TestNodeSchedulerAcquire(t *testing.T) {
+	ctx := context.Background()
+	s := &nodeScheduler{}
+	release, err := s.acquire(ctx, "vm1", nodeOperationUpdate, 0)
+	assert.NoError(t, err)
+
+	// operations on other nodes are not blocked
+	releaseVM2, err := s.acquire(ctx, "vm2", nodeOperationAttach, 0)
+	assert.NoError(t, err)
+	releaseVM2()
+
+	order := make(chan int32, 3)
+	for i, priority := range []int32{0, 100, 10} {
+		priority := priority
+		go func() {
+			release, err := s.acquire(ctx, "vm1", nodeOperationAttach, priority)
+			assert.NoError(t, err)
+			defer release()
+			order <- priority
+		}()
+		// wait until the operation is queued to get a deterministic sequence
+		assert.Eventually(t, func() bool {
+			q := s.getQueue("vm1")
+			q.Lock()
+			defer q.Unlock()
+			return len(q.waiters) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	release()
+	assert.Equal(t, int32(100), <-order)
+	assert.Equal(t, int32(10), <-order)
+	assert.Equal(t, int32(0), <-order)
+
+	assert.Eventually(t, func() bool {
+		q := s.getQueue("vm1")
+		q.Lock()
+		defer q.Unlock()
+		return !q.busy
+	}, time.Second, time.Millisecond)
+}
+
+func TestNodeSchedulerAcquireContextDone(t *testing.T) {
+	s := &nodeScheduler{}
+	release, err := s.acquire(context.Background(), "vm1", nodeOperationUpdate, 0)
+	assert.NoError(t, err)
+
+	// a waiting operation leaves the queue once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, "vm1", nodeOperationAttach, 0)
+		errCh <- err
+	}()
+	assert.Eventually(t, func() bool {
+		q := s.getQueue("vm1")
+		q.Lock()
+		defer q.Unlock()
+		return len(q.waiters) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+	q := s.getQueue("vm1")
+	q.Lock()
+	assert.Empty(t, q.waiters)
+	q.Unlock()
+
+	// the node is free once the running operation completes
+	release()
+	release, err = s.acquire(context.Background(), "vm1", nodeOperationDetach, 0)
+	assert.NoError(t, err)
+	release()
+}
+
+func TestAttachDetachPriorityContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, int32(0), getAttachDetachPriority(ctx))
+	assert.Equal(t, int32(-5), getAttachDetachPriority(withAttachDetachPriority(ctx, -5)))
+	assert.Equal(t, int32(1000), getAttachDetachPriority(withAttachDetachPriority(ctx, 1000)))
+}
+
+func TestDeferAttachDiskRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testCases := []struct {
+		desc            string
+		vmSize          compute.VirtualMachineSizeTypes
+		allocatable     *int32
+		priorities      map[string]int32
+		expectedBatch   []string
+		expectedPending []string
+	}{
+		{
+			desc:          "all requests fit in free slots",
+			vmSize:        compute.StandardA3,
+			priorities:    map[string]int32{"diskuri1": 0, "diskuri2": 100},
+			expectedBatch: []string{"diskuri1", "diskuri2"},
+		},
+		{
+			desc:          "unknown VM size",
+			vmSize:        "Standard_Unknown",
+			priorities:    map[string]int32{"diskuri1": 0, "diskuri2": 100},
+			expectedBatch: []string{"diskuri1", "diskuri2"},
+		},
+		{
+			desc:            "higher priority requests are kept",
+			vmSize:          compute.StandardA2,
+			priorities:      map[string]int32{"diskuri1": 0, "diskuri2": 100, "diskuri3": 10},
+			expectedBatch:   []string{"diskuri2"},
+			expectedPending: []string{"diskuri1", "diskuri3"},
+		},
+		{
+			// the volume limit in CSINode excludes slots reserved for disks attached outside of the driver,
+			// these disks are counted in the attached disks already
+			desc:          "volume limit in CSINode is not used",
+			vmSize:        compute.StandardA3,
+			allocatable:   pointer.Int32(4),
+			priorities:    map[string]int32{"diskuri1": 0, "diskuri2": 100, "diskuri3": 10},
+			expectedBatch: []string{"diskuri1", "diskuri2", "diskuri3"},
+		},
+		{
+			desc:            "no free slot",
+			vmSize:          compute.StandardA0,
+			priorities:      map[string]int32{"diskuri1": 0},
+			expectedBatch:   []string{},
+			expectedPending: []string{"diskuri1"},
+		},
+	}
+
+	for _, test := range testCases {
+		testCloud := provider.GetTestCloud(ctrl)
+		testCloud.KubeClient = fake.NewSimpleClientset(&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "vm1",
+				Labels: map[string]string{consts.InstanceTypeKey: string(test.vmSize)},
+			},
+		})
+		if test.allocatable != nil {
+			_, err := testCloud.KubeClient.StorageV1().CSINodes().Create(context.Background(), &storagev1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm1"},
+				Spec: storagev1.CSINodeSpec{Drivers: []storagev1.CSINodeDriver{
+					{Name: fakeDriverName, Allocatable: &storagev1.VolumeNodeResources{Count: test.allocatable}},
+				}},
+			}, metav1.CreateOptions{})
+			assert.NoError(t, err, test.desc)
+		}
+		common := &controllerCommon{
+			cloud:                      testCloud,
+			lockMap:                    newLockMap(),
+			EnableAttachDetachPriority: true,
+		}
+		expectedVMs := setTestVirtualMachines(testCloud, map[string]string{"vm1": "PowerState/Running"}, false)
+		mockVMsClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+		for _, vm := range expectedVMs {
+			mockVMsClient.EXPECT().Get(gomock.Any(), testCloud.ResourceGroup, *vm.Name, gomock.Any()).Return(vm, nil).AnyTimes()
+		}
+		for uri, priority := range test.priorities {
+			common.attachPriorities.Store(uri, priority)
+			_, err := common.insertAttachDiskRequest(uri, "vm1", &provider.AttachDiskOptions{Lun: -1})
+			assert.NoError(t, err, test.desc)
+		}
+		assert.Equal(t, len(test.expectedPending) > 0, common.hasLunPressure(context.Background(), "vm1"), test.desc)
+
+		diskMap, err := common.cleanAttachDiskRequests("vm1")
+		assert.NoError(t, err, test.desc)
+		diskMap = common.deferAttachDiskRequests(context.Background(), "vm1", diskMap)
+		batch := []string{}
+		for uri := range diskMap {
+			batch = append(batch, uri)
+		}
+		assert.ElementsMatch(t, test.expectedBatch, batch, test.desc)
+
+		for _, uri := range test.expectedPending {
+			assert.True(t, common.removeAttachDiskRequest(uri, "vm1"), test.desc)
+			assert.False(t, common.removeAttachDiskRequest(uri, "vm1"), test.desc)
+		}
+		pending, err := common.cleanAttachDiskRequests("vm1")
+		assert.NoError(t, err, test.desc)
+		assert.Empty(t, pending, test.desc)
+	}
+}
+
+func TestGetAttachPriority(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	diskURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"
+	vaName := fmt.Sprintf("csi-%x", sha256.Sum256([]byte(diskURI+"disk.csi.azure.com"+"vm1")))
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: vaName},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: "disk.csi.azure.com",
+			NodeName: "vm1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: pointer.String("pv1")},
+		},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "ns", Name: "pvc1"},
+		},
+	}
+	pod := func(name, nodeName, claimName string, priority *int32) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec: v1.PodSpec{
+				NodeName: nodeName,
+				Priority: priority,
+				Volumes: []v1.Volume{{
+					Name:         "volume",
+					VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+				}},
+			},
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		nodeName types.NodeName
+		objects  []runtime.Object
+		expected int32
+	}{
+		{
+			desc:     "VolumeAttachment not found",
+			nodeName: "vm1",
+			objects:  []runtime.Object{pv, pod("pod1", "vm1", "pvc1", pointer.Int32(100))},
+		},
+		{
+			desc:     "PersistentVolume not found",
+			nodeName: "vm1",
+			objects:  []runtime.Object{va, pod("pod1", "vm1", "pvc1", pointer.Int32(100))},
+		},
+		{
+			desc:     "highest priority of pods consuming the volume on the node",
+			nodeName: "vm1",
+			objects: []runtime.Object{va, pv,
+				pod("pod1", "vm1", "pvc1", pointer.Int32(100)),
+				pod("pod2", "vm1", "pvc1", pointer.Int32(1000)),
+				pod("pod3", "vm1", "pvc2", pointer.Int32(2000)),
+				pod("pod4", "vm2", "pvc1", pointer.Int32(3000)),
+			},
+			expected: 1000,
+		},
+		{
+			desc:     "negative priority",
+			nodeName: "vm1",
+			objects:  []runtime.Object{va, pv, pod("pod1", "vm1", "pvc1", pointer.Int32(-10))},
+			expected: -10,
+		},
+	}
+
+	for _, test := range tests {
+		testCloud := provider.GetTestCloud(ctrl)
+		testCloud.KubeClient = fake.NewSimpleClientset(test.objects...)
+		d := &DriverCore{cloud: testCloud}
+		d.Name = "disk.csi.azure.com"
+		assert.Equal(t, test.expected, d.getAttachPriority(context.Background(), diskURI, test.nodeName), test.desc)
+	}
+}
@@ -45,10 +45,13 @@ type ManagedDiskController struct {
 }
 
 func NewManagedDiskController(provider *provider.Cloud) *ManagedDiskController {
+	registerMetrics()
 	common := &controllerCommon{
 		cloud:                        provider,
 		lockMap:                      newLockMap(),
 		AttachDetachInitialDelayInMs: defaultAttachDetachInitialDelayInMs,
+		AttachDetachMaxDelayInMs:     defaultAttachDetachMaxDelayInMs,
+		AttachDetachMaxBatchSize:     defaultAttachDetachMaxBatchSize,
 		clientFactory:                provider.ComputeClientFactory,
 	}
 
@@ -120,7 +123,7 @@ func (c *ManagedDiskController) CreateManagedDisk(ctx context.Context, options *
 
 	// insert original tags to newTags
 	newTags := make(map[string]*string)
-	azureDDTag := "kubernetes-azure-dd"
+	azureDDTag := azureDDCreatedByTagValue
 	newTags[consts.CreatedByTag] = &azureDDTag
 	if options.Tags != nil {
 		for k, v := range options.Tags {
@@ -33,10 +33,14 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume/util/hostutil"
 	"k8s.io/mount-utils"
@@ -45,8 +49,10 @@ import (
 	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
 	csicommon "sigs.k8s.io/azuredisk-csi-driver/pkg/csi-common"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/scsipr"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
 	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
@@ -77,14 +83,18 @@ type DriverCore struct {
 	userAgentSuffix              string
 	cloud                        *azure.Cloud
 	clientFactory                azclient.ClientFactory
+	armLimiter                   *armLimiter
 	diskController               *ManagedDiskController
 	mounter                      *mount.SafeFormatAndMount
 	deviceHelper                 optimization.Interface
+	scsiPR                       scsipr.Interface
 	nodeInfo                     *optimization.NodeInfo
 	ioHandler                    azureutils.IOHandler
 	hostUtil                     hostUtil
 	useCSIProxyGAInterface       bool
 	enableDiskOnlineResize       bool
+	removeDeviceOnUnstage        bool
+	enableVolumeMountGroup       bool
 	allowEmptyCloudConfig        bool
 	enableListVolumes            bool
 	enableListSnapshots          bool
@@ -96,6 +106,8 @@ type DriverCore struct {
 	trafficManagerPort           int64
 	vmssCacheTTLInSeconds        int64
 	attachDetachInitialDelayInMs int64
+	attachDetachMaxDelayInMs     int64
+	attachDetachMaxBatchSize     int
 	vmType                       string
 	enableWindowsHostProcess     bool
 	getNodeIDFromIMDS            bool
@@ -105,7 +117,25 @@ type DriverCore struct {
 	forceDetachBackoff           bool
 	endpoint                     string
 	disableAVSetNodes            bool
+	clusterName                  string
 	kubeClient                   kubernetes.Interface
+	// eventRecorder records events of node operations, nil without kubeClient
+	eventRecorder record.EventRecorder
+	// keyUnwrapper unwraps LUKS keys wrapped by Key Vault keys, nil without identity
+	keyUnwrapper luks.KeyUnwrapper
+	// deviceWatcher indexes the devices of data disks by lun from uevents, nil on controller
+	deviceWatcher *deviceWatcher
+	// fstrim trims the filesystems of staged volumes, nil on controller
+	fstrim *fstrimScheduler
+	// healthChecker runs the health checks reported by Probe, nil if disabled
+	healthChecker *healthChecker
+	// attachmentReconciler reports or fixes dangling disk attachments, nil if disabled
+	attachmentReconciler *attachmentReconciler
+	// orphanInventory scans orphaned disks and snapshots every orphanInventoryInterval, nil if disabled
+	orphanInventory         *inventoryScanner
+	orphanInventoryInterval time.Duration
+	// controllerShards splits attach and detach work across controller replicas, nil if disabled
+	controllerShards *controllerShards
 }
 
 // Driver is the v1 implementation of the Azure Disk CSI Driver.
@@ -133,6 +163,8 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.userAgentSuffix = options.UserAgentSuffix
 	driver.useCSIProxyGAInterface = options.UseCSIProxyGAInterface
 	driver.enableDiskOnlineResize = options.EnableDiskOnlineResize
+	driver.removeDeviceOnUnstage = options.RemoveDeviceOnUnstage
+	driver.enableVolumeMountGroup = options.EnableVolumeMountGroup
 	driver.allowEmptyCloudConfig = options.AllowEmptyCloudConfig
 	driver.enableListVolumes = options.EnableListVolumes
 	driver.enableListSnapshots = options.EnableListVolumes
@@ -141,6 +173,8 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.enableDiskCapacityCheck = options.EnableDiskCapacityCheck
 	driver.disableUpdateCache = options.DisableUpdateCache
 	driver.attachDetachInitialDelayInMs = options.AttachDetachInitialDelayInMs
+	driver.attachDetachMaxDelayInMs = options.AttachDetachMaxDelayInMs
+	driver.attachDetachMaxBatchSize = options.AttachDetachMaxBatchSize
 	driver.enableTrafficManager = options.EnableTrafficManager
 	driver.trafficManagerPort = options.TrafficManagerPort
 	driver.vmssCacheTTLInSeconds = options.VMSSCacheTTLInSeconds
@@ -153,6 +187,7 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.forceDetachBackoff = options.ForceDetachBackoff
 	driver.endpoint = options.Endpoint
 	driver.disableAVSetNodes = options.DisableAVSetNodes
+	driver.clusterName = options.ClusterName
 	driver.volumeLocks = volumehelper.NewVolumeLocks()
 	driver.ioHandler = azureutils.NewOSIOHandler()
 	driver.hostUtil = hostutil.NewHostUtil()
@@ -191,8 +226,16 @@ func newDriverV1(options *DriverOptions) *Driver {
 		driver.diskController = NewManagedDiskController(driver.cloud)
 		driver.diskController.DisableUpdateCache = driver.disableUpdateCache
 		driver.diskController.AttachDetachInitialDelayInMs = int(driver.attachDetachInitialDelayInMs)
+		driver.diskController.AttachDetachMaxDelayInMs = int(driver.attachDetachMaxDelayInMs)
+		driver.diskController.AttachDetachMaxBatchSize = driver.attachDetachMaxBatchSize
+		driver.diskController.EnableLunAffinity = options.EnableLunAffinity
+		driver.diskController.EnableAttachDetachPriority = options.EnableAttachDetachPriority
 		driver.diskController.ForceDetachBackoff = driver.forceDetachBackoff
+		driver.diskController.EnableAttachDetachDataDisksAPI = options.EnableAttachDetachDataDisksAPI
 		driver.clientFactory = driver.cloud.ComputeClientFactory
+		if options.EnableARMRateLimiter {
+			driver.setupARMLimiter(options)
+		}
 		if driver.vmType != "" {
 			klog.V(2).Infof("override VMType(%s) in cloud config as %s", driver.cloud.VMType, driver.vmType)
 			driver.cloud.VMType = driver.vmType
@@ -221,9 +264,24 @@ func newDriverV1(options *DriverOptions) *Driver {
 			driver.cloud.VMCacheTTLInSeconds = int(driver.vmssCacheTTLInSeconds)
 			driver.cloud.VmssCacheTTLInSeconds = int(driver.vmssCacheTTLInSeconds)
 		}
+
+		if driver.NodeID == "" {
+			driver.setupControllerWorkers(options)
+		}
 	}
 
 	driver.deviceHelper = optimization.NewSafeDeviceHelper()
+	driver.scsiPR = scsipr.New()
+	if driver.kubeClient != nil {
+		driver.eventRecorder = newEventRecorder(driver.kubeClient, driver.Name)
+	}
+	if driver.cloud != nil && driver.NodeID != "" {
+		driver.keyUnwrapper = newKeyVaultUnwrapper(driver.cloud)
+	}
+	if driver.NodeID != "" {
+		driver.deviceWatcher = newDeviceWatcher()
+		driver.setupFstrimScheduler(options)
+	}
 
 	if driver.getPerfOptimizationEnabled() {
 		driver.nodeInfo, err = optimization.NewNodeInfo(context.TODO(), driver.getCloud(), driver.NodeID)
@@ -236,6 +294,7 @@ func newDriverV1(options *DriverOptions) *Driver {
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
+	driver.setupHealthChecker(options)
 
 	controllerCap := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
@@ -259,16 +318,94 @@ func newDriverV1(options *DriverOptions) *Driver {
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 		})
-	driver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+	nodeCap := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-	})
+	}
+	if driver.enableVolumeMountGroup {
+		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP)
+	}
+	driver.AddNodeServiceCapabilities(nodeCap)
 	return &driver
 }
 
+// setupControllerWorkers creates the attachment reconciler, the controller shards and the orphan inventory enabled
+// by options
+func (d *DriverCore) setupControllerWorkers(options *DriverOptions) {
+	var err error
+	if options.AttachmentReconcileIntervalInSec > 0 {
+		d.attachmentReconciler, err = newAttachmentReconciler(d.Name, options.AttachmentReconcileMode,
+			time.Duration(options.AttachmentReconcileIntervalInSec)*time.Second, options.AttachmentReconcileAllowlist,
+			d.kubeClient, d.diskController, d.clientFactory)
+		if err != nil {
+			klog.Fatalf("failed to create attachment reconciler: %v", err)
+		}
+		d.attachmentReconciler.leaderElection, err = newLeaderElectionConfig(fmt.Sprintf("%s-attachment-reconciler", strings.ReplaceAll(d.Name, ".", "-")),
+			options.AttachmentReconcileLeaseNamespace, options.ShardID, attachmentReconcileLeaseDuration, d.kubeClient)
+		if err != nil {
+			klog.Fatalf("failed to create leader election of attachment reconciler: %v", err)
+		}
+	}
+
+	if options.EnableControllerSharding {
+		d.controllerShards, err = newControllerShards(d.Name, options.ShardID, options.ShardListenAddress, options.ShardLeaseNamespace,
+			time.Duration(options.ShardLeaseDurationInSec)*time.Second, options.ShardTokenPath, options.ShardTokenAudience, d.kubeClient)
+		if err != nil {
+			klog.Fatalf("failed to create controller shards: %v", err)
+		}
+		if options.ShardTLSDir != "" {
+			if d.controllerShards.tls, err = newShardTLS(options.ShardTLSDir, d.Name); err != nil {
+				klog.Fatalf("failed to load TLS of controller shards: %v", err)
+			}
+		}
+	}
+
+	if options.OrphanInventoryIntervalInSec > 0 {
+		var snapshotContents volumeSnapshotContentLister
+		if snapshotClient, err := azureutils.GetSnapshotClient(options.Kubeconfig); err != nil {
+			klog.Warningf("get snapshot client failed with %v, snapshots will not be scanned by orphan inventory", err)
+		} else {
+			snapshotContents = snapshotClient.SnapshotV1().VolumeSnapshotContents()
+		}
+		resourceGroups := []string{d.cloud.ResourceGroup}
+		for _, rg := range strings.Split(options.OrphanInventoryResourceGroups, ",") {
+			if rg = strings.TrimSpace(rg); rg != "" {
+				resourceGroups = append(resourceGroups, rg)
+			}
+		}
+		d.orphanInventory, err = newInventoryScanner(d.Name, d.clusterName, d.cloud.SubscriptionID, resourceGroups, d.kubeClient,
+			snapshotContents, d.clientFactory, options.OrphanGCEnabled, time.Duration(options.OrphanGCGracePeriodInSec)*time.Second)
+		if err != nil {
+			klog.Fatalf("failed to create orphan inventory: %v", err)
+		}
+		d.orphanInventoryInterval = time.Duration(options.OrphanInventoryIntervalInSec) * time.Second
+	}
+}
+
+// runControllerWorkers starts the workers created by setupControllerWorkers until ctx is done, RPCs forwarded by other
+// controller replicas are served by cs
+func (d *DriverCore) runControllerWorkers(ctx context.Context, cs csi.ControllerServer, armInterceptors ...grpc.UnaryServerInterceptor) {
+	if d.attachmentReconciler != nil {
+		go d.attachmentReconciler.Run(ctx)
+	}
+	if d.orphanInventory != nil {
+		go d.orphanInventory.Run(ctx, d.orphanInventoryInterval)
+	}
+	if d.controllerShards != nil {
+		go d.controllerShards.Run(ctx)
+		go func() {
+			if err := d.controllerShards.serve(ctx, cs, armInterceptors...); err != nil {
+				klog.Fatalf("failed to serve forwarded controller RPCs: %v", err)
+			}
+		}()
+	}
+}
+
 // Run driver initialization
 func (d *Driver) Run(ctx context.Context) error {
 	versionMeta, err := GetVersionYAML(d.Name)
@@ -277,9 +414,16 @@ func (d *Driver) Run(ctx context.Context) error {
 	}
 	klog.Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
 
-	grpcInterceptor := grpc.UnaryInterceptor(csicommon.LogGRPC)
+	interceptors := []grpc.UnaryServerInterceptor{csicommon.LogGRPC}
+	if d.controllerShards != nil {
+		interceptors = append(interceptors, d.controllerShards.unaryServerInterceptor())
+	}
+	var armInterceptors []grpc.UnaryServerInterceptor
+	if d.armLimiter != nil {
+		armInterceptors = append(armInterceptors, d.armLimiter.unaryServerInterceptor(d.cloud.SubscriptionID))
+	}
 	opts := []grpc.ServerOption{
-		grpcInterceptor,
+		grpc.ChainUnaryInterceptor(append(interceptors, armInterceptors...)...),
 	}
 	if d.enableOtelTracing {
 		exporter, err := InitOtelTracing()
@@ -305,6 +449,16 @@ func (d *Driver) Run(ctx context.Context) error {
 		<-ctx.Done()
 		s.GracefulStop()
 	}()
+	if d.deviceWatcher != nil {
+		go d.deviceWatcher.Run(ctx)
+	}
+	if d.fstrim != nil {
+		go d.fstrim.Run(ctx)
+	}
+	if d.healthChecker != nil {
+		go d.healthChecker.Run(ctx)
+	}
+	d.runControllerWorkers(ctx, d, armInterceptors...)
 	// Driver d act as IdentityServer, ControllerServer and NodeServer
 	listener, err := csicommon.Listen(ctx, d.endpoint)
 	if err != nil {
@@ -563,6 +717,13 @@ func (d *DriverCore) getUsedLunsFromNode(nodeName types.NodeName) ([]int, error)
 	return usedLuns, nil
 }
 
+// newEventRecorder creates an event recorder writing events through kubeClient on behalf of component
+func newEventRecorder(kubeClient clientset.Interface, component string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
 // getNodeInfoFromLabels get zone, instanceType from node labels
 func getNodeInfoFromLabels(ctx context.Context, nodeName string, kubeClient clientset.Interface) (string, string, error) {
 	if kubeClient == nil || kubeClient.CoreV1() == nil {
@@ -38,27 +38,70 @@ type DriverOptions struct {
 	EnableOtelTracing          bool
 
 	//only used in v1
-	EnableDiskOnlineResize       bool
-	AllowEmptyCloudConfig        bool
-	EnableListVolumes            bool
-	EnableListSnapshots          bool
-	SupportZone                  bool
-	GetNodeInfoFromLabels        bool
-	EnableDiskCapacityCheck      bool
-	DisableUpdateCache           bool
-	EnableTrafficManager         bool
-	TrafficManagerPort           int64
-	AttachDetachInitialDelayInMs int64
-	VMSSCacheTTLInSeconds        int64
-	VMType                       string
-	EnableWindowsHostProcess     bool
-	GetNodeIDFromIMDS            bool
-	WaitForSnapshotReady         bool
-	CheckDiskLUNCollision        bool
-	ForceDetachBackoff           bool
-	Kubeconfig                   string
-	Endpoint                     string
-	DisableAVSetNodes            bool
+	EnableDiskOnlineResize         bool
+	AllowEmptyCloudConfig          bool
+	EnableListVolumes              bool
+	EnableListSnapshots            bool
+	SupportZone                    bool
+	GetNodeInfoFromLabels          bool
+	EnableDiskCapacityCheck        bool
+	DisableUpdateCache             bool
+	EnableTrafficManager           bool
+	TrafficManagerPort             int64
+	AttachDetachInitialDelayInMs   int64
+	AttachDetachMaxDelayInMs       int64
+	AttachDetachMaxBatchSize       int
+	VMSSCacheTTLInSeconds          int64
+	VMType                         string
+	EnableWindowsHostProcess       bool
+	GetNodeIDFromIMDS              bool
+	WaitForSnapshotReady           bool
+	CheckDiskLUNCollision          bool
+	ForceDetachBackoff             bool
+	Kubeconfig                     string
+	Endpoint                       string
+	DisableAVSetNodes              bool
+	EnableAttachDetachDataDisksAPI bool
+	EnableLunAffinity              bool
+	EnableAttachDetachPriority     bool
+	RemoveDeviceOnUnstage          bool
+	EnableVolumeMountGroup         bool
+	// attachment reconciler options
+	AttachmentReconcileIntervalInSec  int64
+	AttachmentReconcileMode           string
+	AttachmentReconcileAllowlist      string
+	AttachmentReconcileLeaseNamespace string
+	// ClusterName is set as the cluster name tag of disks and snapshots created by the driver
+	ClusterName string
+	// orphan inventory options
+	OrphanInventoryIntervalInSec  int64
+	OrphanInventoryResourceGroups string
+	OrphanGCEnabled               bool
+	OrphanGCGracePeriodInSec      int64
+	// ARM rate limiter options
+	EnableARMRateLimiter               bool
+	ARMRateLimitReadQPS                float64
+	ARMRateLimitReadBucket             int
+	ARMRateLimitWriteQPS               float64
+	ARMRateLimitWriteBucket            int
+	ARMCircuitBreakerFailureThreshold  int
+	ARMCircuitBreakerOpenDurationInSec int64
+	// controller sharding options
+	EnableControllerSharding bool
+	ShardID                  string
+	ShardListenAddress       string
+	ShardLeaseNamespace      string
+	ShardLeaseDurationInSec  int64
+	ShardTokenPath           string
+	ShardTokenAudience       string
+	ShardTLSDir              string
+	// fstrim options
+	FstrimIntervalInSec    int64
+	FstrimJitterInSec      int64
+	FstrimIOPriorityClass  string
+	FstrimVolumesByDefault bool
+	// health check options
+	HealthCheckIntervalInSec int64
 }
 
 func (o *DriverOptions) AddFlags() *flag.FlagSet {
@@ -88,7 +131,9 @@ func (o *DriverOptions) AddFlags() *flag.FlagSet {
 	fs.BoolVar(&o.DisableUpdateCache, "disable-update-cache", false, "boolean flag to disable update cache during disk attach/detach")
 	fs.BoolVar(&o.EnableTrafficManager, "enable-traffic-manager", false, "boolean flag to enable traffic manager")
 	fs.Int64Var(&o.TrafficManagerPort, "traffic-manager-port", 7788, "default traffic manager port")
-	fs.Int64Var(&o.AttachDetachInitialDelayInMs, "attach-detach-initial-delay-ms", 1000, "initial delay in milliseconds for batch disk attach/detach")
+	fs.Int64Var(&o.AttachDetachInitialDelayInMs, "attach-detach-initial-delay-ms", 1000, "an attach/detach request waits for more requests on the same node to batch with if another request arrived on the node within this delay in milliseconds, 0 disables batching delay")
+	fs.Int64Var(&o.AttachDetachMaxDelayInMs, "attach-detach-max-delay-ms", defaultAttachDetachMaxDelayInMs, "maximum delay in milliseconds an attach/detach request waits for more requests on a busy node, the actual delay adapts to recent request rate on the node")
+	fs.IntVar(&o.AttachDetachMaxBatchSize, "attach-detach-max-batch-size", defaultAttachDetachMaxBatchSize, "number of pending attach/detach requests on a node which are sent in one batch without waiting further")
 	fs.Int64Var(&o.VMSSCacheTTLInSeconds, "vmss-cache-ttl-seconds", -1, "vmss cache TTL in seconds (600 by default)")
 	fs.StringVar(&o.VMType, "vm-type", "", "type of agent node. available values: vmss, standard")
 	fs.BoolVar(&o.EnableWindowsHostProcess, "enable-windows-host-process", false, "enable windows host process")
@@ -99,6 +144,40 @@ func (o *DriverOptions) AddFlags() *flag.FlagSet {
 	fs.StringVar(&o.Kubeconfig, "kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
 	fs.BoolVar(&o.DisableAVSetNodes, "disable-avset-nodes", false, "disable DisableAvailabilitySetNodes in cloud config for controller")
 	fs.StringVar(&o.Endpoint, "endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	fs.BoolVar(&o.EnableAttachDetachDataDisksAPI, "enable-attach-detach-data-disks-api", false, "attach and detach disks with the AttachDetachDataDisks API instead of a full VM update on nodes supporting it, falls back to VM update otherwise")
+	fs.BoolVar(&o.EnableLunAffinity, "enable-lun-affinity", false, "record the LUN of a disk in disk tags after attach and prefer the same LUN when the disk is attached again")
+	fs.BoolVar(&o.EnableAttachDetachPriority, "enable-attach-detach-priority", false, "schedule attach and detach operations per node by the PriorityClass of pods consuming the disks, detaches go first when a node is short of data disk slots")
+	fs.BoolVar(&o.EnableVolumeMountGroup, "enable-volume-mount-group", false, "advertise the VOLUME_MOUNT_GROUP node capability, kubelet then delegates the fsGroup of pods to the driver which only sets the group of the volume root instead of every file, existing files keep their group and a volume is only published to pods with the group it's staged with")
+	fs.BoolVar(&o.RemoveDeviceOnUnstage, "remove-device-on-unstage", false, "flush and delete the SCSI device of a volume on node after it's unstaged, or after a raw block volume is unpublished from its last target, so that the device is gone before the disk is detached")
+	fs.Int64Var(&o.AttachmentReconcileIntervalInSec, "attachment-reconcile-interval-seconds", 0, "interval in seconds to compare data disks on nodes with VolumeAttachments in controller, 0 disables the attachment reconciler")
+	fs.StringVar(&o.AttachmentReconcileMode, "attachment-reconcile-mode", AttachmentReconcileModeReport, "attachment reconciler mode. available values: report(only emit events and metrics), fix(detach dangling disks)")
+	fs.StringVar(&o.ClusterName, "cluster-name", "", "name of the cluster set as the k8s-azure-cluster-name tag of disks and snapshots created by the driver, the orphan inventory only deletes disks and snapshots tagged with it")
+	fs.Int64Var(&o.OrphanInventoryIntervalInSec, "orphan-inventory-interval-seconds", 0, "interval in seconds to scan driver-owned disks and snapshots without a PV or VolumeSnapshotContent in controller, 0 disables the orphan inventory")
+	fs.StringVar(&o.OrphanInventoryResourceGroups, "orphan-inventory-resource-groups", "", "comma separated resource groups scanned by the orphan inventory in addition to the resource groups used by the cluster")
+	fs.BoolVar(&o.OrphanGCEnabled, "orphan-gc-enabled", false, "tag orphaned disks and snapshots found by the orphan inventory and delete them after orphan-gc-grace-period-seconds")
+	fs.Int64Var(&o.OrphanGCGracePeriodInSec, "orphan-gc-grace-period-seconds", 7*24*3600, "time in seconds an orphaned disk or snapshot is kept after being tagged before it's deleted")
+	fs.BoolVar(&o.EnableARMRateLimiter, "enable-arm-rate-limiter", false, "rate limit disk, snapshot and VM calls to ARM per subscription and operation class, and fail RPCs fast with Unavailable while ARM throttles the subscription")
+	fs.Float64Var(&o.ARMRateLimitReadQPS, "arm-rate-limit-read-qps", 25, "QPS of ARM read calls per subscription and operation class")
+	fs.IntVar(&o.ARMRateLimitReadBucket, "arm-rate-limit-read-bucket", 250, "bucket size of ARM read calls per subscription and operation class")
+	fs.Float64Var(&o.ARMRateLimitWriteQPS, "arm-rate-limit-write-qps", 10, "QPS of ARM write calls per subscription and operation class")
+	fs.IntVar(&o.ARMRateLimitWriteBucket, "arm-rate-limit-write-bucket", 200, "bucket size of ARM write calls per subscription and operation class")
+	fs.IntVar(&o.ARMCircuitBreakerFailureThreshold, "arm-circuit-breaker-failure-threshold", 5, "number of consecutive ARM throttling or server errors which suspends ARM calls of a subscription")
+	fs.Int64Var(&o.ARMCircuitBreakerOpenDurationInSec, "arm-circuit-breaker-open-duration-seconds", 30, "time in seconds ARM calls of a subscription are suspended after consecutive failures when ARM doesn't return Retry-After")
+	fs.BoolVar(&o.EnableControllerSharding, "enable-controller-sharding", false, "split attach and detach work across controller replicas coordinated through Leases, RPCs of nodes owned by another replica are forwarded to it")
+	fs.StringVar(&o.ShardID, "shard-id", "", "identity of the controller replica when controller sharding is enabled, defaults to the host name")
+	fs.StringVar(&o.ShardListenAddress, "shard-listen-address", ":29610", "TCP address serving RPCs forwarded by other controller replicas, an empty host binds to the POD_IP environment variable (host name if unset). Forwarded RPCs must carry a token of the controller ServiceAccount bound to --shard-token-audience, verified by TokenReview")
+	fs.StringVar(&o.ShardLeaseNamespace, "shard-lease-namespace", "kube-system", "namespace of the Leases of controller replicas")
+	fs.Int64Var(&o.ShardLeaseDurationInSec, "shard-lease-duration-seconds", 15, "time in seconds after which the nodes of a controller replica that stopped renewing its Lease move to other replicas")
+	fs.StringVar(&o.ShardTokenPath, "shard-token-path", "/var/run/secrets/tokens/csi-azuredisk-controller-shard", "projected ServiceAccount token sent with RPCs forwarded to other controller replicas, it must be bound to --shard-token-audience")
+	fs.StringVar(&o.ShardTokenAudience, "shard-token-audience", "azuredisk-csi-controller-shard", "audience of the projected ServiceAccount token accepted from other controller replicas")
+	fs.StringVar(&o.ShardTLSDir, "shard-tls-dir", "", "directory holding tls.crt, tls.key and ca.crt used for mutual TLS between controller replicas, the certificate must be valid for controller-shard.<driver name>. Forwarded RPCs are not encrypted if empty")
+	fs.Int64Var(&o.FstrimIntervalInSec, "fstrim-interval-seconds", 0, "interval in seconds between two fstrim runs on each staged filesystem volume on node, 0 disables periodic fstrim while fstrim is still available on demand")
+	fs.Int64Var(&o.FstrimJitterInSec, "fstrim-jitter-seconds", 3600, "maximum random delay in seconds added to fstrim-interval-seconds so that volumes and nodes are not trimmed at the same time")
+	fs.StringVar(&o.FstrimIOPriorityClass, "fstrim-io-priority-class", fstrimIOPriorityIdle, "I/O scheduling class fstrim runs with: idle, best-effort or none to keep the class of the driver")
+	fs.BoolVar(&o.FstrimVolumesByDefault, "fstrim-volumes-by-default", true, "trim volumes without fstrim in their volume attributes")
+	fs.Int64Var(&o.HealthCheckIntervalInSec, "health-check-interval-seconds", 30, "interval in seconds between two runs of the health checks served on /healthz/<check> of the metrics address, only checks of the host are reported by Probe, 0 disables health checks")
+	fs.StringVar(&o.AttachmentReconcileAllowlist, "attachment-reconcile-allowlist", "", "comma separated regular expressions of disk names or URIs attached outside of the driver, which are excluded by the attachment reconciler")
+	fs.StringVar(&o.AttachmentReconcileLeaseNamespace, "attachment-reconcile-lease-namespace", "kube-system", "namespace of the Lease electing the controller replica running the attachment reconciler")
 
 	return fs
 }
@@ -41,6 +41,7 @@ import (
 	csicommon "sigs.k8s.io/azuredisk-csi-driver/pkg/csi-common"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/scsipr"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
 	consts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
 )
@@ -82,6 +83,8 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 	driver.ioHandler = azureutils.NewOSIOHandler()
 	driver.hostUtil = hostutil.NewHostUtil()
 	driver.disableAVSetNodes = options.DisableAVSetNodes
+	driver.enableVolumeMountGroup = options.EnableVolumeMountGroup
+	driver.clusterName = options.ClusterName
 	driver.endpoint = options.Endpoint
 
 	topologyKey = fmt.Sprintf("topology.%s/zone", driver.Name)
@@ -108,7 +111,14 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 		driver.diskController = NewManagedDiskController(driver.cloud)
 		driver.diskController.DisableUpdateCache = driver.disableUpdateCache
 		driver.diskController.AttachDetachInitialDelayInMs = int(driver.attachDetachInitialDelayInMs)
+		driver.diskController.AttachDetachMaxDelayInMs = int(driver.attachDetachMaxDelayInMs)
+		driver.diskController.AttachDetachMaxBatchSize = driver.attachDetachMaxBatchSize
+		driver.diskController.EnableLunAffinity = options.EnableLunAffinity
+		driver.diskController.EnableAttachDetachPriority = options.EnableAttachDetachPriority
 		driver.clientFactory = driver.cloud.ComputeClientFactory
+		if options.EnableARMRateLimiter {
+			driver.setupARMLimiter(options)
+		}
 		if driver.vmType != "" {
 			klog.V(2).Infof("override VMType(%s) in cloud config as %s", driver.cloud.VMType, driver.vmType)
 			driver.cloud.VMType = driver.vmType
@@ -130,10 +140,22 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 				driver.cloud.DisableAvailabilitySetNodes = true
 			}
 			klog.V(2).Infof("cloud: %s, location: %s, rg: %s, VMType: %s, PrimaryScaleSetName: %s, PrimaryAvailabilitySetName: %s, DisableAvailabilitySetNodes: %v", driver.cloud.Cloud, driver.cloud.Location, driver.cloud.ResourceGroup, driver.cloud.VMType, driver.cloud.PrimaryScaleSetName, driver.cloud.PrimaryAvailabilitySetName, driver.cloud.DisableAvailabilitySetNodes)
+			driver.setupControllerWorkers(options)
 		}
 	}
 
 	driver.deviceHelper = optimization.NewSafeDeviceHelper()
+	driver.scsiPR = scsipr.New()
+	if driver.kubeClient != nil {
+		driver.eventRecorder = newEventRecorder(driver.kubeClient, driver.Name)
+	}
+	if driver.cloud != nil && driver.NodeID != "" {
+		driver.keyUnwrapper = newKeyVaultUnwrapper(driver.cloud)
+	}
+	if driver.NodeID != "" {
+		driver.deviceWatcher = newDeviceWatcher()
+		driver.setupFstrimScheduler(options)
+	}
 
 	if driver.getPerfOptimizationEnabled() {
 		driver.nodeInfo, err = optimization.NewNodeInfo(context.TODO(), driver.getCloud(), driver.NodeID)
@@ -146,6 +168,7 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
+	driver.setupHealthChecker(options)
 
 	driver.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
@@ -165,13 +188,19 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 		})
-	driver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+	nodeCap := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-	})
+	}
+	if driver.enableVolumeMountGroup {
+		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP)
+	}
+	driver.AddNodeServiceCapabilities(nodeCap)
 	return &driver
 }
 
@@ -183,10 +212,18 @@ func (d *DriverV2) Run(ctx context.Context) error {
 	}
 	klog.Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
 
-	grpcInterceptor := grpc.UnaryInterceptor(csicommon.LogGRPC)
+	interceptors := []grpc.UnaryServerInterceptor{csicommon.LogGRPC}
 	if d.enableOtelTracing {
-		grpcInterceptor = grpc.ChainUnaryInterceptor(csicommon.LogGRPC, otelgrpc.UnaryServerInterceptor())
+		interceptors = append(interceptors, otelgrpc.UnaryServerInterceptor())
 	}
+	if d.controllerShards != nil {
+		interceptors = append(interceptors, d.controllerShards.unaryServerInterceptor())
+	}
+	var armInterceptors []grpc.UnaryServerInterceptor
+	if d.armLimiter != nil {
+		armInterceptors = append(armInterceptors, d.armLimiter.unaryServerInterceptor(d.cloud.SubscriptionID))
+	}
+	grpcInterceptor := grpc.ChainUnaryInterceptor(append(interceptors, armInterceptors...)...)
 	opts := []grpc.ServerOption{
 		grpcInterceptor,
 	}
@@ -200,6 +237,16 @@ func (d *DriverV2) Run(ctx context.Context) error {
 		<-ctx.Done()
 		s.GracefulStop()
 	}()
+	if d.deviceWatcher != nil {
+		go d.deviceWatcher.Run(ctx)
+	}
+	if d.fstrim != nil {
+		go d.fstrim.Run(ctx)
+	}
+	if d.healthChecker != nil {
+		go d.healthChecker.Run(ctx)
+	}
+	d.runControllerWorkers(ctx, d, armInterceptors...)
 	// Driver d act as IdentityServer, ControllerServer and NodeServer
 	listener, err := csicommon.Listen(ctx, d.endpoint)
 	if err != nil {
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
+)
+
+const (
+	// blockVolumeLunFile records the lun of a block volume in its staging path for NodeExpandVolume
+	blockVolumeLunFile = "block-lun"
+	// blockResizeTimeout is the timeout of waiting for the new size of the device of a block volume after a rescan
+	blockResizeTimeout = 2 * time.Minute
+)
+
+// recordBlockVolumeLun records lun of the block volume staged on stagingPath, the device of a volume which is
+// not published is found by it on expansion
+func recordBlockVolumeLun(stagingPath, lun string) {
+	if err := os.WriteFile(filepath.Join(stagingPath, blockVolumeLunFile), []byte(lun), 0600); err != nil {
+		klog.Warningf("failed to record lun %s in %s, all devices will be rescanned on expansion: %v", lun, stagingPath, err)
+	}
+}
+
+// removeBlockVolumeLun removes the lun recorded by recordBlockVolumeLun, nothing is removed from the staging path of
+// a filesystem volume which is the mount point of the filesystem
+func (d *DriverCore) removeBlockVolumeLun(stagingPath string) error {
+	if notMnt, err := d.mounter.IsLikelyNotMountPoint(stagingPath); err != nil || !notMnt {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(stagingPath, blockVolumeLunFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getBlockVolumeDevice returns the device of the block volume published on volumePath, or of the lun recorded
+// in stagingPath, or an empty string if it's not found
+func (d *DriverCore) getBlockVolumeDevice(volumePath, stagingPath string) string {
+	if devicePath := d.getPublishedBlockDevice(volumePath); devicePath != "" {
+		return devicePath
+	}
+	if stagingPath == "" {
+		return ""
+	}
+	lunBytes, err := os.ReadFile(filepath.Join(stagingPath, blockVolumeLunFile))
+	if err != nil {
+		klog.V(4).Infof("no lun recorded in %s: %v", stagingPath, err)
+		return ""
+	}
+	lun, err := azureutils.GetDiskLUN(strings.TrimSpace(string(lunBytes)))
+	if err != nil {
+		klog.Warningf("invalid lun recorded in %s: %v", stagingPath, err)
+		return ""
+	}
+	devicePath, err := findDiskByLun(int(lun), d.ioHandler, d.mounter, "")
+	if err != nil {
+		klog.Warningf("failed to find disk on lun %d: %v", lun, err)
+		return ""
+	}
+	return devicePath
+}
+
+// waitForBlockSize waits until the size of devicePath reaches requestGiB after the disk is resized,
+// and returns the size of the device in bytes
+func (d *DriverCore) waitForBlockSize(ctx context.Context, devicePath string, requestGiB int64) (int64, error) {
+	var sizeBytes int64
+	err := wait.PollUntilContextTimeout(ctx, devicePollInterval, blockResizeTimeout, true, func(context.Context) (bool, error) {
+		var err error
+		if sizeBytes, err = getBlockSizeBytes(devicePath, d.mounter); err != nil {
+			return false, err
+		}
+		return volumehelper.RoundUpGiB(sizeBytes) >= requestGiB, nil
+	})
+	return sizeBytes, err
+}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestGetBlockVolumeDevice(t *testing.T) {
+	d := &DriverCore{
+		ioHandler: &fakeSysfsIOHandler{dirs: map[string][]string{azureDataDiskByLunPath: {"0", "1"}}},
+		mounter:   &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}},
+	}
+	stagingPath := t.TempDir()
+	volumePath := filepath.Join(t.TempDir(), "pv")
+
+	// no device is published on volumePath and no lun is recorded
+	assert.Equal(t, "", d.getBlockVolumeDevice(volumePath, stagingPath))
+	assert.Equal(t, "", d.getBlockVolumeDevice(volumePath, ""))
+
+	recordBlockVolumeLun(stagingPath, "1")
+	assert.Equal(t, azureDataDiskByLunPath+"1", d.getBlockVolumeDevice(volumePath, stagingPath))
+
+	recordBlockVolumeLun(stagingPath, "2")
+	assert.Equal(t, "", d.getBlockVolumeDevice(volumePath, stagingPath))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(stagingPath, blockVolumeLunFile), []byte("x"), 0600))
+	assert.Equal(t, "", d.getBlockVolumeDevice(volumePath, stagingPath))
+}
+
+func TestWaitForBlockSize(t *testing.T) {
+	var commands []string
+	d := &DriverCore{mounter: &mount.SafeFormatAndMount{
+		Interface: &mounter.FakeSafeMounter{},
+		Exec:      newFakeCheckExec(&commands, exitAction("1073741824\n", 0), exitAction("2147483648\n", 0)),
+	}}
+	sizeBytes, err := d.waitForBlockSize(context.Background(), "/dev/sdc", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2147483648), sizeBytes)
+	assert.Equal(t, []string{"blockdev --getsize64 /dev/sdc", "blockdev --getsize64 /dev/sdc"}, commands)
+
+	commands = nil
+	d.mounter.Exec = newFakeCheckExec(&commands, exitAction("no such device", 1))
+	_, err = d.waitForBlockSize(context.Background(), "/dev/sdc", 2)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	commands = nil
+	d.mounter.Exec = newFakeCheckExec(&commands, exitAction("1073741824\n", 0))
+	_, err = d.waitForBlockSize(ctx, "/dev/sdc", 2)
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestBlockVolumeLun(t *testing.T) {
+	d := &DriverCore{mounter: &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}}}
+
+	stagingPath := t.TempDir()
+	recordBlockVolumeLun(stagingPath, "3")
+	lun, err := os.ReadFile(filepath.Join(stagingPath, blockVolumeLunFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(lun))
+
+	assert.NoError(t, d.removeBlockVolumeLun(stagingPath))
+	_, err = os.Stat(filepath.Join(stagingPath, blockVolumeLunFile))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, d.removeBlockVolumeLun(stagingPath))
+
+	// nothing is removed from the filesystem mounted on the staging path
+	mountedPath := filepath.Join(t.TempDir(), "false_is_likely")
+	assert.NoError(t, os.Mkdir(mountedPath, 0750))
+	assert.NoError(t, os.WriteFile(filepath.Join(mountedPath, blockVolumeLunFile), []byte("data"), 0600))
+	assert.NoError(t, d.removeBlockVolumeLun(mountedPath))
+	_, err = os.Stat(filepath.Join(mountedPath, blockVolumeLunFile))
+	assert.NoError(t, err)
+}
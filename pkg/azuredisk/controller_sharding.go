@@ -0,0 +1,636 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+
+	csicommon "sigs.k8s.io/azuredisk-csi-driver/pkg/csi-common"
+)
+
+const (
+	// label selecting the shard Leases of a driver, the value is the driver name
+	shardLeaseLabel = "disk.csi.azure.com/controller-shard"
+	// annotation of a shard Lease holding the address serving RPCs forwarded by other replicas
+	shardAddressAnnotation = "disk.csi.azure.com/controller-shard-address"
+	// label selecting the node Leases of a driver held by the replica attaching or detaching disks of the node
+	shardNodeLeaseLabel = "disk.csi.azure.com/controller-shard-node"
+	// metadata key of an RPC forwarded by another replica, the value is the identity of that replica
+	shardForwardedByKey = "x-azuredisk-forwarded-by"
+	// metadata key of the ServiceAccount token of the replica forwarding an RPC
+	shardAuthorizationKey = "authorization"
+	// time a reviewed token is trusted without another TokenReview
+	shardTokenReviewTTL = time.Minute
+
+	controllerPublishVolumeMethod   = "/csi.v1.Controller/ControllerPublishVolume"
+	controllerUnpublishVolumeMethod = "/csi.v1.Controller/ControllerUnpublishVolume"
+)
+
+// shardMember is a live controller replica
+type shardMember struct {
+	identity string
+	address  string
+}
+
+// controllerShards splits attach and detach work across controller replicas. Every replica renews its own Lease,
+// live replicas own disjoint sets of nodes by rendezvous hashing of node names, so only the nodes of a replica
+// joining or leaving move to another replica. ControllerPublishVolume and ControllerUnpublishVolume received for
+// a node owned by another replica are forwarded to it, attach and detach batches and node locks stay per replica.
+type controllerShards struct {
+	driverName    string
+	identity      string
+	listenAddress string
+	address       string
+	namespace     string
+	leaseDuration time.Duration
+	kubeClient    clientset.Interface
+	// projected ServiceAccount token bound to tokenAudience, sent with forwarded RPCs
+	tokenPath     string
+	tokenAudience string
+	// mutual TLS between replicas, RPCs are forwarded in plain text if nil
+	tls *shardTLS
+	now func() time.Time
+
+	mu sync.RWMutex
+	// live replicas sorted by identity, including this replica once its Lease is renewed
+	members []shardMember
+	// <address, *grpc.ClientConn> connections to other replicas
+	conns map[string]*grpc.ClientConn
+
+	reviewMu sync.Mutex
+	// <token hash, reviewedToken> tokens authenticated by TokenReview
+	reviewedTokens map[string]reviewedToken
+
+	nodeLeaseMu sync.Mutex
+	// <node name, *heldNodeLease> node Leases held by RPCs running in this replica
+	nodeLeases map[string]*heldNodeLease
+}
+
+type reviewedToken struct {
+	username string
+	expiry   time.Time
+}
+
+// heldNodeLease is a node Lease renewed in the background while refs RPCs of the node are running
+type heldNodeLease struct {
+	refs   int
+	cancel context.CancelFunc
+}
+
+// newControllerShards returns a controllerShards. identity defaults to the host name (pod name),
+// listenAddress is the TCP address serving RPCs forwarded by other replicas, it binds to the advertised
+// address (pod IP) if its host is empty. Forwarded RPCs carry the projected ServiceAccount token at tokenPath,
+// which must be bound to tokenAudience so that it is not accepted by other services.
+func newControllerShards(driverName, identity, listenAddress, namespace string, leaseDuration time.Duration, tokenPath, tokenAudience string, kubeClient clientset.Interface) (*controllerShards, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("kubeClient is nil")
+	}
+	if tokenPath == "" || tokenAudience == "" {
+		return nil, fmt.Errorf("shard token path(%s) and audience(%s) must not be empty", tokenPath, tokenAudience)
+	}
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get host name as shard identity: %v", err)
+		}
+		identity = hostname
+	}
+	address, err := getShardAdvertiseAddress(listenAddress, identity)
+	if err != nil {
+		return nil, err
+	}
+	if leaseDuration <= 0 {
+		return nil, fmt.Errorf("shard lease duration(%v) must be positive", leaseDuration)
+	}
+	if host, _, _ := net.SplitHostPort(listenAddress); host == "" {
+		listenAddress = address
+	}
+	return &controllerShards{
+		driverName:     driverName,
+		identity:       strings.ToLower(identity),
+		listenAddress:  listenAddress,
+		address:        address,
+		namespace:      namespace,
+		leaseDuration:  leaseDuration,
+		kubeClient:     kubeClient,
+		tokenPath:      tokenPath,
+		tokenAudience:  tokenAudience,
+		now:            time.Now,
+		conns:          map[string]*grpc.ClientConn{},
+		reviewedTokens: map[string]reviewedToken{},
+		nodeLeases:     map[string]*heldNodeLease{},
+	}, nil
+}
+
+// getShardAdvertiseAddress returns the address other replicas forward RPCs to, the host of listenAddress
+// defaults to the POD_IP environment variable, then to host
+func getShardAdvertiseAddress(listenAddress, host string) (string, error) {
+	h, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid shard listen address(%s): %v", listenAddress, err)
+	}
+	if h != "" && h != "0.0.0.0" && h != "::" {
+		return listenAddress, nil
+	}
+	if podIP := os.Getenv("POD_IP"); podIP != "" {
+		host = podIP
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (s *controllerShards) leaseName() string {
+	return fmt.Sprintf("%s-shard-%s", strings.ReplaceAll(s.driverName, ".", "-"), s.identity)
+}
+
+func (s *controllerShards) nodeLeaseName(nodeName string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(nodeName)))
+	return fmt.Sprintf("%s-node-%x", strings.ReplaceAll(s.driverName, ".", "-"), sum[:8])
+}
+
+// isLeaseExpired returns whether lease was not renewed within its duration before now
+func isLeaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// Run renews the Lease of this replica and refreshes the live replicas every third of the lease duration,
+// the Lease is deleted when ctx is done so that the nodes of this replica move to other replicas at once
+func (s *controllerShards) Run(ctx context.Context) {
+	klog.V(2).Infof("controller shard %s (%s) started with lease duration %v", s.identity, s.address, s.leaseDuration)
+	wait.UntilWithContext(ctx, s.sync, s.leaseDuration/3)
+
+	deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.kubeClient.CoordinationV1().Leases(s.namespace).Delete(deleteCtx, s.leaseName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("failed to delete controller shard lease %s/%s: %v", s.namespace, s.leaseName(), err)
+	}
+	s.mu.Lock()
+	for address, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, address)
+	}
+	s.mu.Unlock()
+}
+
+func (s *controllerShards) sync(ctx context.Context) {
+	if err := s.renew(ctx); err != nil {
+		klog.Errorf("failed to renew controller shard lease %s/%s: %v", s.namespace, s.leaseName(), err)
+	}
+	if err := s.refresh(ctx); err != nil {
+		klog.Errorf("failed to refresh controller shard members: %v", err)
+	}
+}
+
+// renew creates or renews the Lease of this replica
+func (s *controllerShards) renew(ctx context.Context) error {
+	leases := s.kubeClient.CoordinationV1().Leases(s.namespace)
+	now := metav1.NewMicroTime(s.now())
+	lease, err := leases.Get(ctx, s.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        s.leaseName(),
+				Namespace:   s.namespace,
+				Labels:      map[string]string{shardLeaseLabel: s.driverName},
+				Annotations: map[string]string{shardAddressAnnotation: s.address},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(s.identity),
+				LeaseDurationSeconds: pointer.Int32(int32(s.leaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Labels == nil {
+		lease.Labels = map[string]string{}
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Labels[shardLeaseLabel] = s.driverName
+	lease.Annotations[shardAddressAnnotation] = s.address
+	lease.Spec.HolderIdentity = pointer.String(s.identity)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(s.leaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// refresh lists the Leases of the driver and keeps the replicas whose Lease is not expired
+func (s *controllerShards) refresh(ctx context.Context) error {
+	leases, err := s.kubeClient.CoordinationV1().Leases(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: shardLeaseLabel + "=" + s.driverName})
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	var members []shardMember
+	for _, lease := range leases.Items {
+		if lease.Spec.HolderIdentity == nil {
+			continue
+		}
+		if isLeaseExpired(&lease, now) {
+			klog.V(4).Infof("controller shard lease %s/%s expired at %v", lease.Namespace, lease.Name, lease.Spec.RenewTime)
+			continue
+		}
+		members = append(members, shardMember{identity: *lease.Spec.HolderIdentity, address: lease.Annotations[shardAddressAnnotation]})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].identity < members[j].identity })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !equalShardMembers(s.members, members) {
+		klog.V(2).Infof("controller shard members changed from %v to %v, nodes are rebalanced", s.members, members)
+	}
+	s.members = members
+	controllerShardMembers.Set(float64(len(members)))
+	return nil
+}
+
+func equalShardMembers(a, b []shardMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// owner returns the replica owning nodeName, this replica owns every node until the members are known
+func (s *controllerShards) owner(nodeName string) shardMember {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner := shardMember{identity: s.identity, address: s.address}
+	var maxWeight uint64
+	for i, member := range s.members {
+		sum := sha256.Sum256([]byte(member.identity + "/" + strings.ToLower(nodeName)))
+		if weight := binary.BigEndian.Uint64(sum[:8]); i == 0 || weight > maxWeight {
+			owner, maxWeight = member, weight
+		}
+	}
+	return owner
+}
+
+// unaryServerInterceptor forwards ControllerPublishVolume and ControllerUnpublishVolume of nodes owned by
+// other replicas, RPCs already forwarded by another replica are always handled locally to avoid loops.
+// RPCs handled locally hold the Lease of their node, so that two replicas disagreeing on the owner of a node
+// while members change never attach disks to the node at the same time and pick the same LUN.
+func (s *controllerShards) unaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var nodeID string
+		switch r := req.(type) {
+		case *csi.ControllerPublishVolumeRequest:
+			nodeID = r.GetNodeId()
+		case *csi.ControllerUnpublishVolumeRequest:
+			nodeID = r.GetNodeId()
+		default:
+			return handler(ctx, req)
+		}
+		if nodeID == "" {
+			return handler(ctx, req)
+		}
+		if getShardForwardedBy(ctx) == "" {
+			if owner := s.owner(nodeID); owner.identity != s.identity {
+				return s.forward(ctx, owner, info.FullMethod, req)
+			}
+		}
+		unlock, err := s.lockNode(ctx, nodeID)
+		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.Unavailable, "failed to lock node %s: %v", nodeID, err)
+		}
+		defer unlock()
+		return handler(ctx, req)
+	}
+}
+
+// lockNode acquires the Lease of nodeName, or shares it with other RPCs of the node running in this replica.
+// The Lease is renewed until the returned function has been called by every RPC sharing it, it is not deleted
+// so that another replica taking over the node waits for it to expire.
+func (s *controllerShards) lockNode(ctx context.Context, nodeName string) (func(), error) {
+	nodeName = strings.ToLower(nodeName)
+	s.nodeLeaseMu.Lock()
+	defer s.nodeLeaseMu.Unlock()
+	held, ok := s.nodeLeases[nodeName]
+	if !ok {
+		if err := s.acquireNodeLease(ctx, nodeName); err != nil {
+			return nil, err
+		}
+		renewCtx, cancel := context.WithCancel(context.Background())
+		held = &heldNodeLease{cancel: cancel}
+		s.nodeLeases[nodeName] = held
+		go func() {
+			ticker := time.NewTicker(s.leaseDuration / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-renewCtx.Done():
+					return
+				case <-ticker.C:
+					if err := s.acquireNodeLease(renewCtx, nodeName); err != nil && renewCtx.Err() == nil {
+						klog.Errorf("failed to renew lease of node %s: %v", nodeName, err)
+					}
+				}
+			}
+		}()
+	}
+	held.refs++
+	return func() {
+		s.nodeLeaseMu.Lock()
+		defer s.nodeLeaseMu.Unlock()
+		held.refs--
+		if held.refs == 0 {
+			held.cancel()
+			delete(s.nodeLeases, nodeName)
+		}
+	}, nil
+}
+
+// acquireNodeLease creates or renews the Lease of nodeName held by this replica, it returns an Aborted error
+// if the Lease is held by another replica and not expired, the caller (external-attacher) retries later
+func (s *controllerShards) acquireNodeLease(ctx context.Context, nodeName string) error {
+	leases := s.kubeClient.CoordinationV1().Leases(s.namespace)
+	name := s.nodeLeaseName(nodeName)
+	now := metav1.NewMicroTime(s.now())
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: s.namespace,
+				Labels:    map[string]string{shardNodeLeaseLabel: s.driverName},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(s.identity),
+				LeaseDurationSeconds: pointer.Int32(int32(s.leaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return status.Errorf(codes.Aborted, "lease of node %s was acquired by another controller shard", nodeName)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != s.identity {
+		if !isLeaseExpired(lease, now.Time) {
+			return status.Errorf(codes.Aborted, "disks of node %s are being attached or detached by controller shard %s", nodeName, *holder)
+		}
+		klog.V(2).Infof("take over expired lease of node %s from controller shard %s", nodeName, *holder)
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = pointer.String(s.identity)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(s.leaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	if _, err = leases.Update(ctx, lease, metav1.UpdateOptions{}); apierrors.IsConflict(err) {
+		return status.Errorf(codes.Aborted, "lease of node %s was updated by another controller shard", nodeName)
+	}
+	return err
+}
+
+func getShardForwardedBy(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(shardForwardedByKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// forward sends req to the replica owner and returns its response
+func (s *controllerShards) forward(ctx context.Context, owner shardMember, method string, req interface{}) (interface{}, error) {
+	var resp interface{}
+	switch method {
+	case controllerPublishVolumeMethod:
+		resp = &csi.ControllerPublishVolumeResponse{}
+	case controllerUnpublishVolumeMethod:
+		resp = &csi.ControllerUnpublishVolumeResponse{}
+	default:
+		return nil, status.Errorf(codes.Internal, "method %s could not be forwarded", method)
+	}
+	if owner.address == "" {
+		return nil, status.Errorf(codes.Unavailable, "address of controller shard %s is unknown", owner.identity)
+	}
+	token, err := s.readToken()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to read token of controller shard: %v", err)
+	}
+	conn, err := s.getConn(owner.address)
+	if err != nil {
+		controllerShardForwardedRequests.WithLabelValues(method, "failed").Inc()
+		return nil, status.Errorf(codes.Unavailable, "failed to connect to controller shard %s(%s): %v", owner.identity, owner.address, err)
+	}
+	klog.V(2).Infof("forward %s to controller shard %s(%s)", method, owner.identity, owner.address)
+	ctx = metadata.AppendToOutgoingContext(ctx, shardForwardedByKey, s.identity, shardAuthorizationKey, "Bearer "+token)
+	if err := conn.Invoke(ctx, method, req, resp); err != nil {
+		controllerShardForwardedRequests.WithLabelValues(method, "failed").Inc()
+		return nil, err
+	}
+	controllerShardForwardedRequests.WithLabelValues(method, "succeeded").Inc()
+	return resp, nil
+}
+
+func (s *controllerShards) getConn(address string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.conns[address]; ok {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if s.tls != nil {
+		var err error
+		if creds, err = s.tls.clientCredentials(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[address] = conn
+	return conn, nil
+}
+
+func (s *controllerShards) readToken() (string, error) {
+	token, err := os.ReadFile(s.tokenPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+var bearerTokenRegexp = regexp.MustCompile(`^Bearer\s+(\S+)$`)
+
+func getShardBearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get(shardAuthorizationKey) {
+		if matches := bearerTokenRegexp.FindStringSubmatch(value); len(matches) == 2 {
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+// reviewToken returns the user authenticated by token for the shard token audience, tokens are reviewed by the
+// kube-apiserver and trusted for shardTokenReviewTTL
+func (s *controllerShards) reviewToken(ctx context.Context, token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := fmt.Sprintf("%x", sum)
+	now := s.now()
+	s.reviewMu.Lock()
+	if reviewed, ok := s.reviewedTokens[key]; ok && now.Before(reviewed.expiry) {
+		s.reviewMu.Unlock()
+		return reviewed.username, nil
+	}
+	s.reviewMu.Unlock()
+
+	review, err := s.kubeClient.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{s.tokenAudience}},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+	// the kube-apiserver returns the audiences of the request the token is valid for
+	if !sets.New[string](review.Status.Audiences...).Has(s.tokenAudience) {
+		return "", fmt.Errorf("token is not bound to audience %s", s.tokenAudience)
+	}
+
+	s.reviewMu.Lock()
+	defer s.reviewMu.Unlock()
+	for k, reviewed := range s.reviewedTokens {
+		if !now.Before(reviewed.expiry) {
+			delete(s.reviewedTokens, k)
+		}
+	}
+	s.reviewedTokens[key] = reviewedToken{username: review.Status.User.Username, expiry: now.Add(shardTokenReviewTTL)}
+	return review.Status.User.Username, nil
+}
+
+// authenticate accepts RPCs carrying a token of the ServiceAccount this replica runs as
+func (s *controllerShards) authenticate(ctx context.Context) error {
+	token := getShardBearerToken(ctx)
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "missing bearer token of controller shard")
+	}
+	username, err := s.reviewToken(ctx, token)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "failed to authenticate controller shard: %v", err)
+	}
+	ownToken, err := s.readToken()
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to read token of controller shard: %v", err)
+	}
+	ownUsername, err := s.reviewToken(ctx, ownToken)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to review token of controller shard: %v", err)
+	}
+	if username != ownUsername {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to forward controller RPCs", username)
+	}
+	return nil
+}
+
+// forwardedOnlyInterceptor only accepts ControllerPublishVolume and ControllerUnpublishVolume forwarded by another
+// replica running as the same ServiceAccount
+func (s *controllerShards) forwardedOnlyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod != controllerPublishVolumeMethod && info.FullMethod != controllerUnpublishVolumeMethod {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not served on the controller shard address", info.FullMethod)
+	}
+	if getShardForwardedBy(ctx) == "" {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is only served for requests forwarded by controller shards", info.FullMethod)
+	}
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// serve serves the RPCs forwarded by other replicas on the shard listen address until ctx is done
+func (s *controllerShards) serve(ctx context.Context, cs csi.ControllerServer, interceptors ...grpc.UnaryServerInterceptor) error {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{csicommon.LogGRPC, s.forwardedOnlyInterceptor, s.unaryServerInterceptor()}, interceptors...)...),
+	}
+	if s.tls != nil {
+		opts = append(opts, grpc.Creds(s.tls.serverCredentials()))
+	} else {
+		klog.Warningf("serving forwarded controller RPCs without TLS, set --shard-tls-dir to authenticate controller replicas")
+	}
+	server := grpc.NewServer(opts...)
+	csi.RegisterControllerServer(server, cs)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("serving forwarded controller RPCs on %s", s.listenAddress)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
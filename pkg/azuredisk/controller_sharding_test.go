@@ -0,0 +1,291 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestControllerShards(t *testing.T, identity string, kubeClient *fake.Clientset, now *time.Time) *controllerShards {
+	s, err := newControllerShards("disk.csi.azure.com", identity, "10.0.0.1:29610", "kube-system", 15*time.Second, "token", "shard-audience", kubeClient)
+	assert.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestNewControllerShards(t *testing.T) {
+	_, err := newControllerShards("disk.csi.azure.com", "replica", ":29610", "kube-system", 15*time.Second, "token", "shard-audience", nil)
+	assert.Error(t, err, "kubeClient is required")
+	_, err = newControllerShards("disk.csi.azure.com", "replica", "29610", "kube-system", 15*time.Second, "token", "shard-audience", fake.NewSimpleClientset())
+	assert.Error(t, err, "invalid listen address")
+	_, err = newControllerShards("disk.csi.azure.com", "replica", ":29610", "kube-system", 0, "token", "shard-audience", fake.NewSimpleClientset())
+	assert.Error(t, err, "lease duration must be positive")
+	_, err = newControllerShards("disk.csi.azure.com", "replica", ":29610", "kube-system", 15*time.Second, "token", "", fake.NewSimpleClientset())
+	assert.Error(t, err, "token audience is required")
+
+	t.Setenv("POD_IP", "10.0.0.2")
+	s, err := newControllerShards("disk.csi.azure.com", "Replica", ":29610", "kube-system", 15*time.Second, "token", "shard-audience", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Equal(t, "replica", s.identity)
+	assert.Equal(t, "10.0.0.2:29610", s.address)
+	assert.Equal(t, "10.0.0.2:29610", s.listenAddress, "listener binds to the pod IP")
+	assert.Equal(t, "disk-csi-azure-com-shard-replica", s.leaseName())
+
+	s, err = newControllerShards("disk.csi.azure.com", "replica", "0.0.0.0:29610", "kube-system", 15*time.Second, "token", "shard-audience", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2:29610", s.address)
+	assert.Equal(t, "0.0.0.0:29610", s.listenAddress, "explicit host is kept")
+}
+
+func TestControllerShardsMembership(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	now := time.Now()
+	s1 := newTestControllerShards(t, "replica1", kubeClient, &now)
+	s2 := newTestControllerShards(t, "replica2", kubeClient, &now)
+	other, err := newControllerShards("other.csi.azure.com", "replica3", "10.0.0.3:29610", "kube-system", 15*time.Second, "token", "shard-audience", kubeClient)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "replica1", s1.owner("node").identity, "replica owns every node before members are known")
+
+	assert.NoError(t, s1.renew(ctx))
+	assert.NoError(t, s2.renew(ctx))
+	assert.NoError(t, other.renew(ctx))
+	assert.NoError(t, s1.refresh(ctx))
+	assert.Equal(t, []shardMember{{identity: "replica1", address: "10.0.0.1:29610"}, {identity: "replica2", address: "10.0.0.1:29610"}}, s1.members,
+		"Leases of other drivers are ignored")
+
+	lease, err := kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, s1.leaseName(), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "replica1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(15), *lease.Spec.LeaseDurationSeconds)
+
+	// replica2 stops renewing its Lease
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, s1.renew(ctx))
+	lease, err = kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, s1.leaseName(), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, now.Unix(), lease.Spec.RenewTime.Unix())
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, s1.refresh(ctx))
+	assert.Equal(t, []shardMember{{identity: "replica1", address: "10.0.0.1:29610"}}, s1.members)
+	assert.Equal(t, "replica1", s1.owner("node").identity)
+}
+
+func TestControllerShardsOwner(t *testing.T) {
+	s := &controllerShards{identity: "replica1"}
+	nodes := make([]string, 1000)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("aks-nodepool-%d", i)
+	}
+
+	s.members = []shardMember{{identity: "replica1"}, {identity: "replica2"}, {identity: "replica3"}}
+	owners := map[string]string{}
+	count := map[string]int{}
+	for _, node := range nodes {
+		owners[node] = s.owner(node).identity
+		count[owners[node]]++
+		assert.Equal(t, owners[node], s.owner(node).identity, "ownership is stable")
+	}
+	for _, member := range s.members {
+		assert.Greater(t, count[member.identity], 200, "nodes are spread across replicas")
+	}
+	assert.Equal(t, owners["aks-nodepool-1"], s.owner("AKS-NODEPOOL-1").identity, "node names are case insensitive")
+
+	// only the nodes of the replica leaving move
+	s.members = []shardMember{{identity: "replica1"}, {identity: "replica3"}}
+	for _, node := range nodes {
+		if owners[node] != "replica2" {
+			assert.Equal(t, owners[node], s.owner(node).identity)
+		}
+	}
+}
+
+type fakeShardControllerServer struct {
+	csi.UnimplementedControllerServer
+	nodeIDs []string
+}
+
+func (f *fakeShardControllerServer) ControllerPublishVolume(_ context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	f.nodeIDs = append(f.nodeIDs, req.GetNodeId())
+	return &csi.ControllerPublishVolumeResponse{PublishContext: map[string]string{"LUN": "1"}}, nil
+}
+
+// newTokenReviewClient returns a fake client authenticating the tokens of users, tokens prefixed by "audience-"
+// are bound to shard-audience and other tokens to the kube-apiserver
+func newTokenReviewClient(users map[string]string) *fake.Clientset {
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		audience := "https://kubernetes.default.svc"
+		if strings.HasPrefix(review.Spec.Token, "audience-") {
+			audience = "shard-audience"
+		}
+		if username, ok := users[review.Spec.Token]; !ok {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		} else if len(review.Spec.Audiences) > 0 && review.Spec.Audiences[0] != audience {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "token audiences is invalid"}
+		} else {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: username}, Audiences: []string{audience}}
+		}
+		return true, review, nil
+	})
+	return kubeClient
+}
+
+func writeShardToken(t *testing.T, token string) string {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(path, []byte(token+"\n"), 0600))
+	return path
+}
+
+func TestControllerShardsForward(t *testing.T) {
+	kubeClient := newTokenReviewClient(map[string]string{
+		"audience-controller-token": "system:serviceaccount:kube-system:csi-azuredisk-controller-sa",
+		"audience-other-token":      "system:serviceaccount:default:default",
+		"sa-token":                  "system:serviceaccount:kube-system:csi-azuredisk-controller-sa",
+	})
+	now := time.Now()
+	ownerShards := newTestControllerShards(t, "replica2", kubeClient, &now)
+	ownerShards.tokenPath = writeShardToken(t, "audience-controller-token")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	owner := &fakeShardControllerServer{}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(ownerShards.forwardedOnlyInterceptor, ownerShards.unaryServerInterceptor()))
+	csi.RegisterControllerServer(server, owner)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	s := newTestControllerShards(t, "replica1", kubeClient, &now)
+	s.tokenPath = writeShardToken(t, "audience-controller-token")
+	s.members = []shardMember{{identity: "replica2", address: listener.Addr().String()}}
+	local := &fakeShardControllerServer{}
+	interceptor := s.unaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: controllerPublishVolumeMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return local.ControllerPublishVolume(ctx, req.(*csi.ControllerPublishVolumeRequest))
+	}
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: "vol", NodeId: "node1"}
+
+	resp, err := interceptor(context.Background(), req, info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LUN": "1"}, resp.(*csi.ControllerPublishVolumeResponse).PublishContext)
+	assert.Equal(t, []string{"node1"}, owner.nodeIDs, "request is forwarded to the owner")
+	assert.Empty(t, local.nodeIDs)
+
+	// the owner holds the Lease of the node, this replica must wait for it to expire
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(shardForwardedByKey, "replica2"))
+	_, err = interceptor(ctx, req, info, handler)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Empty(t, local.nodeIDs)
+
+	// requests forwarded by another replica are handled locally
+	now = now.Add(time.Minute)
+	_, err = interceptor(ctx, req, info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node1"}, local.nodeIDs)
+
+	// other RPCs are handled locally
+	called := false
+	_, err = interceptor(context.Background(), &csi.CreateVolumeRequest{}, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"},
+		func(context.Context, interface{}) (interface{}, error) { called = true; return nil, nil })
+	assert.NoError(t, err)
+	assert.True(t, called)
+
+	// the shard address only serves forwarded requests of the controller ServiceAccount
+	conn, err := s.getConn(listener.Addr().String())
+	assert.NoError(t, err)
+	client := csi.NewControllerClient(conn)
+	_, err = client.ControllerPublishVolume(context.Background(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.DeleteVolume(metadata.AppendToOutgoingContext(context.Background(), shardForwardedByKey, "replica2"), &csi.DeleteVolumeRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.ControllerPublishVolume(metadata.AppendToOutgoingContext(context.Background(), shardForwardedByKey, "replica1"), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "missing token")
+	_, err = client.ControllerPublishVolume(metadata.AppendToOutgoingContext(context.Background(), shardForwardedByKey, "replica1", shardAuthorizationKey, "Bearer invalid-token"), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "invalid token")
+	_, err = client.ControllerPublishVolume(metadata.AppendToOutgoingContext(context.Background(), shardForwardedByKey, "replica1", shardAuthorizationKey, "Bearer audience-other-token"), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "token of another ServiceAccount")
+	_, err = client.ControllerPublishVolume(metadata.AppendToOutgoingContext(context.Background(), shardForwardedByKey, "replica1", shardAuthorizationKey, "Bearer sa-token"), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "token of the controller ServiceAccount not bound to the shard audience")
+	assert.Equal(t, []string{"node1"}, owner.nodeIDs)
+
+	// owner without address
+	s.members = []shardMember{{identity: "replica2"}}
+	_, err = interceptor(context.Background(), req, info, handler)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestControllerShardsLockNode(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	now := time.Now()
+	s1 := newTestControllerShards(t, "replica1", kubeClient, &now)
+	s2 := newTestControllerShards(t, "replica2", kubeClient, &now)
+
+	unlock1, err := s1.lockNode(ctx, "Node1")
+	assert.NoError(t, err)
+	unlock2, err := s1.lockNode(ctx, "node1")
+	assert.NoError(t, err, "RPCs of a node share the Lease in a replica")
+	assert.Equal(t, 2, s1.nodeLeases["node1"].refs)
+
+	lease, err := kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, s1.nodeLeaseName("node1"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "replica1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, "disk.csi.azure.com", lease.Labels[shardNodeLeaseLabel])
+	assert.Empty(t, lease.Labels[shardLeaseLabel], "node Leases are not shard members")
+
+	_, err = s2.lockNode(ctx, "node1")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	unlock3, err := s2.lockNode(ctx, "node2")
+	assert.NoError(t, err, "other nodes are not locked")
+	unlock3()
+
+	unlock1()
+	unlock2()
+	assert.Empty(t, s1.nodeLeases)
+	_, err = s2.lockNode(ctx, "node1")
+	assert.Equal(t, codes.Aborted, status.Code(err), "released Lease is kept until it expires")
+
+	now = now.Add(16 * time.Second)
+	unlock, err := s2.lockNode(ctx, "node1")
+	assert.NoError(t, err)
+	defer unlock()
+	lease, err = kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, s1.nodeLeaseName("node1"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "replica2", *lease.Spec.HolderIdentity)
+}
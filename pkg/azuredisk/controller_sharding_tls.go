@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// files of a kubernetes.io/tls Secret holding the certificate of controller replicas and its CA
+	shardTLSCertFile = "tls.crt"
+	shardTLSKeyFile  = "tls.key"
+	shardTLSCAFile   = "ca.crt"
+)
+
+// shardTLS authenticates controller replicas to each other by mutual TLS, the server and client certificates
+// must be signed by the CA in dir and valid for serverName. Files are read on every handshake so that
+// rotated certificates are used by new connections.
+type shardTLS struct {
+	dir        string
+	serverName string
+}
+
+// newShardTLS returns a shardTLS reading certificates from dir, the certificates must be valid for
+// controller-shard.<driver name>
+func newShardTLS(dir, driverName string) (*shardTLS, error) {
+	t := &shardTLS{dir: dir, serverName: "controller-shard." + driverName}
+	if _, _, err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *shardTLS) load() (*tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(t.dir, shardTLSCertFile), filepath.Join(t.dir, shardTLSKeyFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load certificate of controller shard from %s: %v", t.dir, err)
+	}
+	ca, err := os.ReadFile(filepath.Join(t.dir, shardTLSCAFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA of controller shard from %s: %v", t.dir, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, nil, fmt.Errorf("no certificate found in %s", filepath.Join(t.dir, shardTLSCAFile))
+	}
+	return &cert, pool, nil
+}
+
+// verifyPeerName rejects client certificates which are not valid for serverName
+func (t *shardTLS) verifyPeerName(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return fmt.Errorf("no verified certificate of controller shard")
+	}
+	return verifiedChains[0][0].VerifyHostname(t.serverName)
+}
+
+func (t *shardTLS) serverCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, err := t.load()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:            tls.VersionTLS12,
+				NextProtos:            []string{"h2"},
+				Certificates:          []tls.Certificate{*cert},
+				ClientAuth:            tls.RequireAndVerifyClientCert,
+				ClientCAs:             pool,
+				VerifyPeerCertificate: t.verifyPeerName,
+			}, nil
+		},
+	})
+}
+
+func (t *shardTLS) clientCredentials() (credentials.TransportCredentials, error) {
+	cert, pool, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   t.serverName,
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+	}), nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+type testShardCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestShardCA(t *testing.T) *testShardCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "controller-shard-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testShardCA{cert: cert, key: key}
+}
+
+// writeShardTLS writes ca and a certificate for dnsName signed by it to a new directory
+func writeShardTLS(t *testing.T, ca *testShardCA, dnsName string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, shardTLSCAFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, shardTLSCertFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, shardTLSKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return dir
+}
+
+func TestNewShardTLS(t *testing.T) {
+	ca := newTestShardCA(t)
+	_, err := newShardTLS(t.TempDir(), "disk.csi.azure.com")
+	assert.Error(t, err, "missing certificate")
+
+	dir := writeShardTLS(t, ca, "controller-shard.disk.csi.azure.com")
+	s, err := newShardTLS(dir, "disk.csi.azure.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "controller-shard.disk.csi.azure.com", s.serverName)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, shardTLSCAFile), []byte("invalid"), 0600))
+	_, err = newShardTLS(dir, "disk.csi.azure.com")
+	assert.Error(t, err, "invalid CA")
+}
+
+func TestShardTLSMutualAuthentication(t *testing.T) {
+	ca := newTestShardCA(t)
+	serverTLS, err := newShardTLS(writeShardTLS(t, ca, "controller-shard.disk.csi.azure.com"), "disk.csi.azure.com")
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(serverTLS.serverCredentials()))
+	owner := &fakeShardControllerServer{}
+	csi.RegisterControllerServer(server, owner)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	publish := func(dir string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		creds, err := (&shardTLS{dir: dir, serverName: serverTLS.serverName}).clientCredentials()
+		assert.NoError(t, err)
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+		assert.NoError(t, err)
+		defer conn.Close()
+		_, err = csi.NewControllerClient(conn).ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{NodeId: "node1"})
+		return err
+	}
+
+	assert.NoError(t, publish(writeShardTLS(t, ca, "controller-shard.disk.csi.azure.com")), "replicas with certificates of the same CA")
+	assert.Error(t, publish(writeShardTLS(t, newTestShardCA(t), "controller-shard.disk.csi.azure.com")), "certificates of another CA")
+	assert.Error(t, publish(writeShardTLS(t, ca, "controller-shard.other.csi.azure.com")), "client certificate of another driver")
+	assert.Equal(t, []string{"node1"}, owner.nodeIDs)
+}
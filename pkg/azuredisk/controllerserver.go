@@ -18,6 +18,7 @@ package azuredisk
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"path"
 	"sort"
@@ -32,9 +33,11 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	cloudprovider "k8s.io/cloud-provider"
 	volerr "k8s.io/cloud-provider/volume/errors"
 	"k8s.io/klog/v2"
@@ -86,6 +89,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if err := azureutils.IsValidVolumeCapabilities(volCaps, diskParams.MaxShares); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	if err := azureutils.ValidateMkfsParameters(diskParams.FsType, volCaps, params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	isAdvancedPerfProfile := strings.EqualFold(diskParams.PerfProfile, consts.PerfProfileAdvanced)
 	// If perfProfile is set to advanced and no/invalid device settings are provided, fail the request
 	if d.getPerfOptimizationEnabled() && isAdvancedPerfProfile {
@@ -135,12 +141,16 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				cloud:               localCloud,
 				lockMap:             newLockMap(),
 				DisableDiskLunCheck: true,
-				clientFactory:       localCloud.ComputeClientFactory,
+				clientFactory:       newLimitedClientFactory(localCloud.ComputeClientFactory, d.armLimiter, localCloud.SubscriptionID),
+				armLimiter:          d.armLimiter,
 				ForceDetachBackoff:  d.forceDetachBackoff,
 			},
 		}
+		limitCloudClients(localCloud, d.armLimiter)
 		localDiskController.DisableUpdateCache = d.disableUpdateCache
 		localDiskController.AttachDetachInitialDelayInMs = int(d.attachDetachInitialDelayInMs)
+		localDiskController.AttachDetachMaxDelayInMs = int(d.attachDetachMaxDelayInMs)
+		localDiskController.AttachDetachMaxBatchSize = d.attachDetachMaxBatchSize
 
 	}
 	if azureutils.IsAzureStackCloud(localCloud.Config.Cloud, localCloud.Config.DisableAzureStackCloud) {
@@ -200,6 +210,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if strings.EqualFold(diskParams.WriteAcceleratorEnabled, consts.TrueValue) {
 		diskParams.Tags[azure.WriteAcceleratorEnabled] = consts.TrueValue
 	}
+	if d.clusterName != "" {
+		diskParams.Tags[azureconsts.ClusterNameTagKey] = d.clusterName
+	}
 	var sourceID, sourceType string
 	metricsRequest := "controller_create_volume"
 	content := req.GetVolumeContentSource()
@@ -430,6 +443,13 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI, consts.Node, string(nodeName))
 	}()
 
+	if maxShares > 1 && !req.GetReadonly() && !azureutils.IsReadOnlyAccessMode(volCap) {
+		if err := d.checkReadOnlyManyAttachments(ctx, diskURI, disk); err != nil {
+			klog.Errorf("%v", err)
+			return nil, err
+		}
+	}
+
 	lun, vmState, err := d.diskController.GetDiskLun(diskName, diskURI, nodeName)
 	if err == cloudprovider.InstanceNotFound {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("failed to get azure instance id for node %q (%v)", nodeName, err))
@@ -464,6 +484,18 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		if cachingMode, err = azureutils.GetCachingMode(volumeContext); err != nil {
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
+		if azureutils.IsMultiNodeReadOnly(volCap) && cachingMode != armcompute.CachingTypesReadOnly {
+			klog.V(2).Infof("set cachingMode of volume %s as %s since it's published with access mode %s", diskURI, armcompute.CachingTypesReadOnly, volCap.GetAccessMode().GetMode())
+			cachingMode = armcompute.CachingTypesReadOnly
+		}
+
+		if err := d.checkDataDiskSlots(ctx, nodeName, diskURI); err != nil {
+			klog.Errorf("%v", err)
+			return nil, err
+		}
+		if d.diskController.EnableAttachDetachPriority {
+			ctx = withAttachDetachPriority(ctx, d.getAttachPriority(ctx, diskURI, nodeName))
+		}
 
 		occupiedLuns := d.getOccupiedLunsFromNode(ctx, nodeName, diskURI)
 		klog.V(2).Infof("Trying to attach volume %s to node %s", diskURI, nodeName)
@@ -490,6 +522,10 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 				klog.V(2).Infof("Trying to attach volume %s to node %s again", diskURI, nodeName)
 				lun, err = d.diskController.AttachDisk(ctx, diskName, diskURI, nodeName, cachingMode, disk, occupiedLuns)
 			}
+			if status.Code(err) == codes.ResourceExhausted {
+				klog.Errorf("%v", err)
+				return nil, err
+			}
 			if err != nil {
 				klog.Errorf("Attach volume %s to instance %s failed with %v", diskURI, nodeName, err)
 				errMsg := fmt.Sprintf("Attach volume %s to instance %s failed with %v", diskURI, nodeName, err)
@@ -502,8 +538,24 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		klog.V(2).Infof("attach volume %s to node %s successfully", diskURI, nodeName)
 	}
 
+	d.diskController.recordDiskLun(disk, diskURI, lun)
+
 	publishContext := map[string]string{consts.LUN: strconv.Itoa(int(lun))}
+	if isFencedVolume(volCap, volumeContext) {
+		preemptKeys, err := d.getFencingPreemptKeys(ctx, diskURI, nodeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to get reservation keys of dead nodes attached to volume %s: %v", diskURI, err)
+		}
+		if len(preemptKeys) > 0 {
+			klog.V(2).Infof("node %s will preempt reservation keys %v of volume %s", nodeName, preemptKeys, diskURI)
+			publishContext[consts.FencingPreemptKeys] = strings.Join(preemptKeys, ",")
+		}
+	}
 	if disk != nil {
+		// the node verifies that the device on the lun is this disk before staging it
+		if disk.Properties != nil && disk.Properties.UniqueID != nil {
+			publishContext[consts.DiskUniqueID] = *disk.Properties.UniqueID
+		}
 		if _, ok := volumeContext[consts.RequestedSizeGib]; !ok {
 			klog.V(6).Infof("found static PV(%s), insert disk properties to volumeattachments", diskURI)
 			azureutils.InsertDiskProperties(disk, publishContext)
@@ -625,6 +677,170 @@ func (d *Driver) getOccupiedLunsFromNode(ctx context.Context, nodeName types.Nod
 	return occupiedLuns
 }
 
+// checkReadOnlyManyAttachments returns a FailedPrecondition error if diskURI is attached through a VolumeAttachment
+// of a read-only PersistentVolume, a shared disk mounted read-only on some nodes must not be written by other nodes
+func (d *DriverCore) checkReadOnlyManyAttachments(ctx context.Context, diskURI string, disk *armcompute.Disk) error {
+	if d.cloud == nil || d.cloud.KubeClient == nil {
+		return nil
+	}
+	// disk is nil if GetDisk is throttled, VolumeAttachments of all nodes are checked then
+	attachedNodes, nodesKnown := d.getAttachedNodes(disk)
+	if nodesKnown && attachedNodes.Len() == 0 {
+		return nil
+	}
+
+	// VolumeAttachments can't be selected by volume or node, they are listed from the cache of kube-apiserver
+	vas, err := d.cloud.KubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to list VolumeAttachments to check read-only attachments of volume %s: %v", diskURI, err)
+	}
+	pvNodes := map[string][]string{}
+	for _, va := range vas.Items {
+		if va.Spec.Attacher != d.Name || va.Spec.Source.PersistentVolumeName == nil || !va.Status.Attached || va.DeletionTimestamp != nil {
+			continue
+		}
+		if nodesKnown && !attachedNodes.Has(strings.ToLower(va.Spec.NodeName)) {
+			continue
+		}
+		pvName := *va.Spec.Source.PersistentVolumeName
+		pvNodes[pvName] = append(pvNodes[pvName], va.Spec.NodeName)
+	}
+
+	var nodes []string
+	for pvName, vaNodes := range pvNodes {
+		pv, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return status.Errorf(codes.Unavailable, "failed to get PersistentVolume %s to check read-only attachments of volume %s: %v", pvName, diskURI, err)
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.Name || !strings.EqualFold(pv.Spec.CSI.VolumeHandle, diskURI) {
+			continue
+		}
+		if isReadOnlyPersistentVolume(pv) {
+			nodes = append(nodes, vaNodes...)
+		}
+	}
+	if len(nodes) > 0 {
+		sort.Strings(nodes)
+		return status.Errorf(codes.FailedPrecondition, "volume %s is attached read-only to node(s) %v, read-write publish is refused", diskURI, nodes)
+	}
+	return nil
+}
+
+// getAttachedNodes returns the lower-case names of the nodes disk is attached to,
+// ok is false if disk is nil or a node name could not be resolved
+func (d *DriverCore) getAttachedNodes(disk *armcompute.Disk) (sets.Set[string], bool) {
+	nodes := sets.New[string]()
+	if disk == nil || d.cloud.VMSet == nil {
+		return nodes, false
+	}
+	vmIDs := disk.ManagedByExtended
+	if disk.ManagedBy != nil {
+		vmIDs = append(vmIDs, disk.ManagedBy)
+	}
+	for _, vmID := range vmIDs {
+		if vmID == nil || *vmID == "" {
+			continue
+		}
+		nodeName, err := d.cloud.VMSet.GetNodeNameByProviderID(*vmID)
+		if err != nil {
+			klog.Warningf("failed to get node name of VM %s: %v", *vmID, err)
+			return nodes, false
+		}
+		nodes.Insert(strings.ToLower(string(nodeName)))
+	}
+	return nodes, true
+}
+
+// isReadOnlyPersistentVolume returns whether pv only allows ReadOnlyMany access or is marked read-only
+func isReadOnlyPersistentVolume(pv *v1.PersistentVolume) bool {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.ReadOnly {
+		return true
+	}
+	if len(pv.Spec.AccessModes) == 0 {
+		return false
+	}
+	for _, mode := range pv.Spec.AccessModes {
+		if mode != v1.ReadOnlyMany {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDataDiskSlots returns a ResourceExhausted error if nodeName has no free data disk slot to attach diskURI,
+// the check is skipped if the data disk capacity of the node is unknown
+func (d *DriverCore) checkDataDiskSlots(ctx context.Context, nodeName types.NodeName, diskURI string) error {
+	if d.diskController == nil {
+		return nil
+	}
+	maxDataDiskCount, instanceType, ok := d.diskController.getMaxDataDiskSlots(ctx, nodeName)
+	if !ok {
+		klog.V(4).Infof("skip data disk slot check on node(%s): unknown data disk capacity", nodeName)
+		return nil
+	}
+
+	used, err := d.diskController.getUsedDataDiskSlots(nodeName, diskURI)
+	if err != nil {
+		klog.Warningf("skip data disk slot check on node(%s): %v", nodeName, err)
+		return nil
+	}
+	if int64(used) >= maxDataDiskCount {
+		return status.Errorf(codes.ResourceExhausted, "node(%s) has no free data disk slot to attach volume %s: %d of %d slots are used by attached or attaching disks (VM size: %q)",
+			nodeName, diskURI, used, maxDataDiskCount, instanceType)
+	}
+	return nil
+}
+
+// getAttachPriority returns the highest priority of pods on nodeName consuming the volume, the pods are found through
+// VolumeAttachment, PersistentVolume and PersistentVolumeClaim, 0 is returned if any of them could not be found
+func (d *DriverCore) getAttachPriority(ctx context.Context, diskURI string, nodeName types.NodeName) int32 {
+	if d.cloud == nil || d.cloud.KubeClient == nil {
+		return 0
+	}
+	// VolumeAttachment name generated by external-attacher
+	vaName := fmt.Sprintf("csi-%x", sha256.Sum256([]byte(diskURI+d.Name+string(nodeName))))
+	va, err := d.cloud.KubeClient.StorageV1().VolumeAttachments().Get(ctx, vaName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("failed to get VolumeAttachment(%s) of volume %s: %v", vaName, diskURI, err)
+		return 0
+	}
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return 0
+	}
+	pv, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().Get(ctx, *va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("failed to get PersistentVolume(%s) of volume %s: %v", *va.Spec.Source.PersistentVolumeName, diskURI, err)
+		return 0
+	}
+	claimRef := pv.Spec.ClaimRef
+	if claimRef == nil {
+		return 0
+	}
+	pods, err := d.cloud.KubeClient.CoreV1().Pods(claimRef.Namespace).List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + string(nodeName)})
+	if err != nil {
+		klog.V(4).Infof("failed to list pods on node(%s) in namespace(%s): %v", nodeName, claimRef.Namespace, err)
+		return 0
+	}
+	var priority int32
+	found := false
+	for _, pod := range pods.Items {
+		if !strings.EqualFold(pod.Spec.NodeName, string(nodeName)) || pod.Spec.Priority == nil || (found && *pod.Spec.Priority <= priority) {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimRef.Name {
+				priority, found = *pod.Spec.Priority, true
+				break
+			}
+		}
+	}
+	klog.V(4).Infof("attach priority of volume %s on node(%s) is %d", diskURI, nodeName, priority)
+	return priority
+}
+
 // ControllerGetCapabilities returns the capabilities of the Controller plugin
 func (d *Driver) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	return &csi.ControllerGetCapabilitiesResponse{
@@ -969,6 +1185,11 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
 	tags := make(map[string]*string)
+	// created-by tag marks the snapshot as driver-owned for the orphan inventory
+	tags[azureconsts.CreatedByTag] = to.Ptr(azureDDCreatedByTagValue)
+	if d.clusterName != "" {
+		tags[azureconsts.ClusterNameTagKey] = to.Ptr(d.clusterName)
+	}
 	for k, v := range customTagsMap {
 		value := v
 		tags[k] = &value
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,6 +34,10 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/utils/pointer"
 	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azuredisk/mockcorev1"
@@ -851,6 +856,10 @@ func TestControllerPublishVolume(t *testing.T) {
 				id := req.VolumeId
 				disk := &armcompute.Disk{
 					ID: &id,
+					Properties: &armcompute.DiskProperties{
+						NetworkAccessPolicy: to.Ptr(armcompute.NetworkAccessPolicyAllowAll),
+						UniqueID:            pointer.String("e4bc7e9f-1c2d-4a5b-8c7d-0123456789ab"),
+					},
 				}
 				ctrl := gomock.NewController(t)
 				defer ctrl.Finish()
@@ -888,10 +897,11 @@ func TestControllerPublishVolume(t *testing.T) {
 				vm.StorageProfile.DataDisks = &dataDisks
 				mockVMsClient := d.getCloud().VirtualMachinesClient.(*mockvmclient.MockInterface)
 				mockVMsClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(vm, nil).AnyTimes()
-				_, err = d.ControllerPublishVolume(context.Background(), req)
+				resp, err := d.ControllerPublishVolume(context.Background(), req)
 				if !reflect.DeepEqual(err, nil) {
 					t.Errorf("actualErr: (%v), expectedErr: (<nil>)", err)
 				}
+				assert.Equal(t, "e4bc7e9f-1c2d-4a5b-8c7d-0123456789ab", resp.GetPublishContext()[consts.DiskUniqueID])
 			},
 		},
 		{
@@ -2251,3 +2261,223 @@ func getFakeDriverWithKubeClient(ctrl *gomock.Controller) FakeDriver {
 	d.getCloud().KubeClient.CoreV1().(*mockcorev1.MockInterface).EXPECT().PersistentVolumes().Return(persistentvolume).AnyTimes()
 	return d
 }
+
+func TestCheckDataDiskSlots(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testCases := []struct {
+		desc         string
+		instanceType string
+		// volume limit of the driver in CSINode, nil if there is no CSINode
+		allocatable  *int32
+		pendingDisks []string
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "free slots are available",
+			instanceType: "Standard_D2s_v3",
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "pending attach requests fill the slots",
+			instanceType: "Standard_D2s_v3",
+			pendingDisks: []string{"diskURI1"},
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			// one of the 3 attached disks is not managed by the driver, its slot is reserved in the volume limit
+			// of CSINode, so the free slot is only found against the data disk capacity of the VM size
+			desc:         "disks attached outside of the driver are not counted twice",
+			instanceType: "Standard_D2s_v3",
+			allocatable:  pointer.Int32(3),
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "disks attached outside of the driver use data disk slots",
+			instanceType: "Standard_D2s_v3",
+			allocatable:  pointer.Int32(3),
+			pendingDisks: []string{"diskURI1"},
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			desc:         "check is skipped for unknown VM size",
+			instanceType: "Standard_Unknown",
+			allocatable:  pointer.Int32(1),
+			pendingDisks: []string{"diskURI1", "diskURI2"},
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "check is skipped if node is not found",
+			expectedCode: codes.OK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testCloud := azure.GetTestCloud(ctrl)
+			kubeClient := fake.NewSimpleClientset()
+			if test.instanceType != "" {
+				kubeClient = fake.NewSimpleClientset(&v1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "vm1",
+						Labels: map[string]string{consts.InstanceTypeKey: test.instanceType},
+					},
+				})
+			}
+			if test.allocatable != nil {
+				_, err := kubeClient.StorageV1().CSINodes().Create(context.Background(), &storagev1.CSINode{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm1"},
+					Spec: storagev1.CSINodeSpec{Drivers: []storagev1.CSINodeDriver{
+						{Name: "other.csi.azure.com", Allocatable: &storagev1.VolumeNodeResources{Count: pointer.Int32(64)}},
+						{Name: fakeDriverName, Allocatable: &storagev1.VolumeNodeResources{Count: test.allocatable}},
+					}},
+				}, metav1.CreateOptions{})
+				assert.NoError(t, err)
+			}
+			testCloud.KubeClient = kubeClient
+			expectedVMs := setTestVirtualMachines(testCloud, map[string]string{"vm1": "PowerState/Running"}, false)
+			mockVMsClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+			for _, vm := range expectedVMs {
+				mockVMsClient.EXPECT().Get(gomock.Any(), testCloud.ResourceGroup, *vm.Name, gomock.Any()).Return(vm, nil).AnyTimes()
+			}
+			d := &DriverCore{
+				cloud:          testCloud,
+				diskController: &ManagedDiskController{&controllerCommon{cloud: testCloud, lockMap: newLockMap()}},
+			}
+			for _, diskURI := range test.pendingDisks {
+				_, err := d.diskController.insertAttachDiskRequest(diskURI, "vm1", &azure.AttachDiskOptions{})
+				assert.NoError(t, err)
+			}
+
+			err := d.checkDataDiskSlots(context.Background(), "vm1", "diskURI")
+			assert.Equal(t, test.expectedCode, status.Code(err))
+		})
+	}
+}
+
+func TestCheckReadOnlyManyAttachments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	diskURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/shared"
+	vmID := func(name string) *string {
+		return pointer.String("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name)
+	}
+	attachedDisk := &armcompute.Disk{ManagedByExtended: []*string{vmID("node1"), vmID("Node2")}}
+	pv := func(name, volumeHandle string, readOnly bool, accessModes ...v1.PersistentVolumeAccessMode) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				AccessModes: accessModes,
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: consts.DefaultDriverName, VolumeHandle: volumeHandle, ReadOnly: readOnly},
+				},
+			},
+		}
+	}
+	va := func(name, pvName, nodeName string, attached bool) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: consts.DefaultDriverName,
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+		}
+	}
+	deletingVA := va("va1", "pv-rox", "node1", true)
+	deletingVA.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	deletingVA.Finalizers = []string{"external-attacher/disk-csi-azure-com"}
+
+	tests := []struct {
+		desc            string
+		disk            *armcompute.Disk
+		objects         []runtime.Object
+		expectedCode    codes.Code
+		expectedActions int
+	}{
+		{
+			desc:            "disk is not attached",
+			disk:            &armcompute.Disk{},
+			objects:         []runtime.Object{pv("pv-rox", diskURI, false, v1.ReadOnlyMany), va("va1", "pv-rox", "node1", true)},
+			expectedCode:    codes.OK,
+			expectedActions: 0,
+		},
+		{
+			desc:            "no read-only PersistentVolume",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rw", diskURI, false, v1.ReadWriteMany), va("va1", "pv-rw", "node1", true)},
+			expectedCode:    codes.OK,
+			expectedActions: 2,
+		},
+		{
+			desc:            "read-only PersistentVolume is not attached",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rox", diskURI, false, v1.ReadOnlyMany), va("va1", "pv-rox", "node1", false)},
+			expectedCode:    codes.OK,
+			expectedActions: 1,
+		},
+		{
+			desc:            "read-only PersistentVolume is being detached",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rox", diskURI, false, v1.ReadOnlyMany), deletingVA},
+			expectedCode:    codes.OK,
+			expectedActions: 1,
+		},
+		{
+			desc:            "read-only PersistentVolume is attached to a node the disk is not attached to",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rox", diskURI, false, v1.ReadOnlyMany), va("va1", "pv-rox", "node3", true)},
+			expectedCode:    codes.OK,
+			expectedActions: 1,
+		},
+		{
+			desc:            "read-only PersistentVolume of another disk is attached",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rox", diskURI+"2", false, v1.ReadOnlyMany), va("va1", "pv-rox", "node1", true)},
+			expectedCode:    codes.OK,
+			expectedActions: 2,
+		},
+		{
+			desc:            "PersistentVolume of an attachment is deleted",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{va("va1", "pv-rox", "node1", true)},
+			expectedCode:    codes.OK,
+			expectedActions: 2,
+		},
+		{
+			desc:            "ReadOnlyMany PersistentVolume is attached",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-rox", strings.ToUpper(diskURI), false, v1.ReadOnlyMany), va("va1", "pv-rox", "node2", true)},
+			expectedCode:    codes.FailedPrecondition,
+			expectedActions: 2,
+		},
+		{
+			desc:            "read-only CSI PersistentVolume is attached",
+			disk:            attachedDisk,
+			objects:         []runtime.Object{pv("pv-ro", diskURI, true, v1.ReadWriteOnce), va("va1", "pv-ro", "node1", true)},
+			expectedCode:    codes.FailedPrecondition,
+			expectedActions: 2,
+		},
+		{
+			desc:            "attachments of all nodes are checked if the disk is unknown",
+			objects:         []runtime.Object{pv("pv-rox", diskURI, false, v1.ReadOnlyMany), va("va1", "pv-rox", "node3", true)},
+			expectedCode:    codes.FailedPrecondition,
+			expectedActions: 2,
+		},
+	}
+
+	for _, test := range tests {
+		testCloud := azure.GetTestCloud(ctrl)
+		kubeClient := fake.NewSimpleClientset(test.objects...)
+		testCloud.KubeClient = kubeClient
+		d := &DriverCore{cloud: testCloud}
+		d.Name = consts.DefaultDriverName
+		err := d.checkReadOnlyManyAttachments(context.Background(), diskURI, test.disk)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+		// no PersistentVolume is listed
+		assert.Len(t, kubeClient.Actions(), test.expectedActions, test.desc)
+	}
+}
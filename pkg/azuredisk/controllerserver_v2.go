@@ -45,6 +45,7 @@ import (
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
 	"sigs.k8s.io/cloud-provider-azure/pkg/metrics"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
@@ -74,6 +75,9 @@ func (d *DriverV2) CreateVolume(ctx context.Context, req *csi.CreateVolumeReques
 	if err := azureutils.IsValidVolumeCapabilities(volCaps, diskParams.MaxShares); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	if err := azureutils.ValidateMkfsParameters(diskParams.FsType, volCaps, params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	isAdvancedPerfProfile := strings.EqualFold(diskParams.PerfProfile, consts.PerfProfileAdvanced)
 	// If perfProfile is set to advanced and no/invalid device settings are provided, fail the request
 	if d.getPerfOptimizationEnabled() && isAdvancedPerfProfile {
@@ -164,6 +168,9 @@ func (d *DriverV2) CreateVolume(ctx context.Context, req *csi.CreateVolumeReques
 	if strings.EqualFold(diskParams.WriteAcceleratorEnabled, consts.TrueValue) {
 		diskParams.Tags[azure.WriteAcceleratorEnabled] = consts.TrueValue
 	}
+	if d.clusterName != "" {
+		diskParams.Tags[azureconsts.ClusterNameTagKey] = d.clusterName
+	}
 	sourceID := ""
 	sourceType := ""
 	content := req.GetVolumeContentSource()
@@ -347,6 +354,13 @@ func (d *DriverV2) ControllerPublishVolume(ctx context.Context, req *csi.Control
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI, consts.Node, string(nodeName))
 	}()
 
+	if maxShares > 1 && !req.GetReadonly() && !azureutils.IsReadOnlyAccessMode(volCap) {
+		if err := d.checkReadOnlyManyAttachments(ctx, diskURI, disk); err != nil {
+			klog.Errorf("%v", err)
+			return nil, err
+		}
+	}
+
 	lun, vmState, err := d.diskController.GetDiskLun(diskName, diskURI, nodeName)
 	if err == cloudprovider.InstanceNotFound {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("failed to get azure instance id for node %q (%v)", nodeName, err))
@@ -376,6 +390,17 @@ func (d *DriverV2) ControllerPublishVolume(ctx context.Context, req *csi.Control
 		if cachingMode, err = azureutils.GetCachingMode(volumeContext); err != nil {
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
+		if azureutils.IsMultiNodeReadOnly(volCap) && cachingMode != armcompute.CachingTypesReadOnly {
+			klog.V(2).Infof("set cachingMode of volume %s as %s since it's published with access mode %s", diskURI, armcompute.CachingTypesReadOnly, volCap.GetAccessMode().GetMode())
+			cachingMode = armcompute.CachingTypesReadOnly
+		}
+		if err := d.checkDataDiskSlots(ctx, nodeName, diskURI); err != nil {
+			klog.Errorf("%v", err)
+			return nil, err
+		}
+		if d.diskController.EnableAttachDetachPriority {
+			ctx = withAttachDetachPriority(ctx, d.getAttachPriority(ctx, diskURI, nodeName))
+		}
 		klog.V(2).Infof("Trying to attach volume %s to node %s", diskURI, nodeName)
 
 		lun, err = d.diskController.AttachDisk(ctx, diskName, diskURI, nodeName, cachingMode, disk, nil)
@@ -390,6 +415,10 @@ func (d *DriverV2) ControllerPublishVolume(ctx context.Context, req *csi.Control
 				klog.V(2).Infof("Trying to attach volume %s to node %s again", diskURI, nodeName)
 				lun, err = d.diskController.AttachDisk(ctx, diskName, diskURI, nodeName, cachingMode, disk, nil)
 			}
+			if status.Code(err) == codes.ResourceExhausted {
+				klog.Errorf("%v", err)
+				return nil, err
+			}
 			if err != nil {
 				klog.Errorf("Attach volume %s to instance %s failed with %v", diskURI, nodeName, err)
 				return nil, status.Errorf(codes.Internal, "Attach volume %s to instance %s failed with %v", diskURI, nodeName, err)
@@ -398,8 +427,24 @@ func (d *DriverV2) ControllerPublishVolume(ctx context.Context, req *csi.Control
 		klog.V(2).Infof("attach volume %s to node %s successfully", diskURI, nodeName)
 	}
 
+	d.diskController.recordDiskLun(disk, diskURI, lun)
+
 	publishContext := map[string]string{consts.LUN: strconv.Itoa(int(lun))}
+	if isFencedVolume(volCap, volumeContext) {
+		preemptKeys, err := d.getFencingPreemptKeys(ctx, diskURI, nodeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to get reservation keys of dead nodes attached to volume %s: %v", diskURI, err)
+		}
+		if len(preemptKeys) > 0 {
+			klog.V(2).Infof("node %s will preempt reservation keys %v of volume %s", nodeName, preemptKeys, diskURI)
+			publishContext[consts.FencingPreemptKeys] = strings.Join(preemptKeys, ",")
+		}
+	}
 	if disk != nil {
+		// the node verifies that the device on the lun is this disk before staging it
+		if disk.Properties != nil && disk.Properties.UniqueID != nil {
+			publishContext[consts.DiskUniqueID] = *disk.Properties.UniqueID
+		}
 		if _, ok := volumeContext[consts.RequestedSizeGib]; !ok {
 			klog.V(2).Infof("found static PV(%s), insert disk properties to volumeattachments", diskURI)
 			azureutils.InsertDiskProperties(disk, publishContext)
@@ -812,6 +857,11 @@ func (d *DriverV2) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRe
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
 	tags := make(map[string]*string)
+	// created-by tag marks the snapshot as driver-owned for the orphan inventory
+	tags[azureconsts.CreatedByTag] = to.Ptr(azureDDCreatedByTagValue)
+	if d.clusterName != "" {
+		tags[azureconsts.ClusterNameTagKey] = to.Ptr(d.clusterName)
+	}
 	for k, v := range customTagsMap {
 		value := v
 		tags[k] = &value
@@ -0,0 +1,69 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+// verifyDeviceIdentity checks that the device found on the lun is the disk published by the controller,
+// the lun could be reused by another disk after a stale attachment or a detach race.
+// Volumes published without the unique ID of the disk and devices without an identifier are not verified.
+func (d *DriverCore) verifyDeviceIdentity(devicePath string, publishContext map[string]string) error {
+	uniqueID := normalizeDiskID(publishContext[consts.DiskUniqueID])
+	if uniqueID == "" {
+		return nil
+	}
+
+	ids, err := getDeviceIdentifiers(d.ioHandler, devicePath)
+	if err != nil {
+		klog.Warningf("failed to get identifiers of device %s, skip verifying it is disk %s: %v", devicePath, uniqueID, err)
+		return nil
+	}
+	if len(ids) == 0 {
+		klog.V(2).Infof("device %s has no disk identifier, skip verifying it is disk %s", devicePath, uniqueID)
+		return nil
+	}
+	for _, id := range ids {
+		if id == uniqueID {
+			klog.V(4).Infof("device %s is verified as disk %s", devicePath, uniqueID)
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "device %s with identifiers %v is not disk %s, the lun may have been reused by another disk", devicePath, ids, uniqueID)
+}
+
+// normalizeDiskID returns the 32 lowercase hex digits of a GUID, or an empty string if id is not a GUID
+func normalizeDiskID(id string) string {
+	id = strings.ToLower(strings.Trim(strings.TrimSpace(id), "{}"))
+	id = strings.ReplaceAll(id, "-", "")
+	if len(id) != 32 {
+		return ""
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return id
+}
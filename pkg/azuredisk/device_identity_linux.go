@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// SPC-4 7.8.6 device identification VPD page designators
+	vpdCodeSetBinary          = 0x1
+	vpdDesignatorTypeNAA      = 0x3
+	vpdDesignatorTypeT10      = 0x1
+	vpdT10VendorIDLength      = 8
+	vpdPageHeaderLength       = 4
+	vpdDesignatorHeaderLength = 4
+)
+
+var guidRegexp = regexp.MustCompile(`[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}`)
+
+// getDeviceIdentifiers returns the GUIDs found in the device identification (0x83) and unit serial number (0x80)
+// VPD pages of the SCSI device in sysfs
+func getDeviceIdentifiers(io azureutils.IOHandler, devicePath string) ([]string, error) {
+	deviceName := filepath.Base(devicePath)
+	if filepath.Dir(devicePath) != "/dev" {
+		// udev link, e.g. /dev/disk/azure/scsi1/lun0 -> ../../../sdc
+		link, err := io.Readlink(devicePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", devicePath, err)
+		}
+		deviceName = filepath.Base(link)
+	}
+	deviceDir := filepath.Join(sysfsPath, "block", deviceName, "device")
+	pg83, err83 := io.ReadFile(filepath.Join(deviceDir, "vpd_pg83"))
+	pg80, err80 := io.ReadFile(filepath.Join(deviceDir, "vpd_pg80"))
+	if err83 != nil && err80 != nil {
+		return nil, fmt.Errorf("failed to read VPD pages of %s: %v", devicePath, err83)
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	add := func(candidates ...string) {
+		for _, c := range candidates {
+			if id := normalizeDiskID(c); id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if err83 == nil {
+		add(parseDeviceIdentificationVPD(pg83)...)
+	}
+	if err80 == nil && len(pg80) > vpdPageHeaderLength {
+		add(guidRegexp.FindAllString(string(pg80[vpdPageHeaderLength:]), -1)...)
+	}
+	return ids, nil
+}
+
+// parseDeviceIdentificationVPD returns the GUID candidates of the designators in a device identification VPD page,
+// NAA designators are skipped since they embed the IEEE company ID instead of the disk GUID
+func parseDeviceIdentificationVPD(page []byte) []string {
+	candidates := []string{}
+	if len(page) < vpdPageHeaderLength {
+		return candidates
+	}
+	end := vpdPageHeaderLength + (int(page[2])<<8 | int(page[3]))
+	if end > len(page) {
+		end = len(page)
+	}
+	for off := vpdPageHeaderLength; off+vpdDesignatorHeaderLength <= end; {
+		codeSet := page[off] & 0x0f
+		designatorType := page[off+1] & 0x0f
+		length := int(page[off+3])
+		start := off + vpdDesignatorHeaderLength
+		off = start + length
+		if off > end {
+			break
+		}
+		if designatorType == vpdDesignatorTypeNAA {
+			continue
+		}
+		designator := page[start:off]
+		if designatorType == vpdDesignatorTypeT10 && len(designator) > vpdT10VendorIDLength {
+			designator = designator[vpdT10VendorIDLength:]
+		}
+		if codeSet == vpdCodeSetBinary {
+			if len(designator) == 16 {
+				candidates = append(candidates, hex.EncodeToString(designator), hex.EncodeToString(swapGUIDByteOrder(designator)))
+			}
+			continue
+		}
+		candidates = append(candidates, guidRegexp.FindAllString(string(designator), -1)...)
+	}
+	return candidates
+}
+
+// swapGUIDByteOrder converts the mixed-endian encoding of a GUID to big-endian and vice versa
+func swapGUIDByteOrder(b []byte) []byte {
+	return []byte{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6], b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15]}
+}
@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const testDiskUniqueID = "e4bc7e9f-1c2d-4a5b-8c7d-0123456789ab"
+
+// fakeVPDIOHandler serves the files in sysfs of the test from memory
+type fakeVPDIOHandler struct {
+	azureutils.IOHandler
+	files map[string][]byte
+}
+
+func (f *fakeVPDIOHandler) ReadFile(filename string) ([]byte, error) {
+	if content, ok := f.files[filename]; ok {
+		return content, nil
+	}
+	return nil, fmt.Errorf("open %s: no such file or directory", filename)
+}
+
+// vpdPage returns a VPD page with code and designators
+func vpdPage(code byte, designators ...[]byte) []byte {
+	body := []byte{}
+	for _, d := range designators {
+		body = append(body, d...)
+	}
+	return append([]byte{0, code, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// vpdDesignator returns a designator of the device identification VPD page
+func vpdDesignator(codeSet, designatorType byte, id []byte) []byte {
+	return append([]byte{codeSet, designatorType, 0, byte(len(id))}, id...)
+}
+
+func TestParseDeviceIdentificationVPD(t *testing.T) {
+	guid := []byte{0xe4, 0xbc, 0x7e, 0x9f, 0x1c, 0x2d, 0x4a, 0x5b, 0x8c, 0x7d, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab}
+	mixedEndianGUID := []byte{0x9f, 0x7e, 0xbc, 0xe4, 0x2d, 0x1c, 0x5b, 0x4a, 0x8c, 0x7d, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab}
+	naa := []byte{0x60, 0x02, 0x24, 0x80, 0x1c, 0x2d, 0x4a, 0x5b, 0x8c, 0x7d, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab}
+
+	tests := []struct {
+		desc     string
+		page     []byte
+		expected []string
+	}{
+		{
+			desc:     "empty page",
+			page:     []byte{0, 0x83},
+			expected: []string{},
+		},
+		{
+			desc:     "NAA designator is skipped",
+			page:     vpdPage(0x83, vpdDesignator(1, 3, naa)),
+			expected: []string{},
+		},
+		{
+			desc:     "binary T10 vendor ID designator",
+			page:     vpdPage(0x83, vpdDesignator(1, 1, append([]byte("MSFT    "), mixedEndianGUID...))),
+			expected: []string{"9f7ebce42d1c5b4a8c7d0123456789ab", "e4bc7e9f1c2d4a5b8c7d0123456789ab"},
+		},
+		{
+			desc:     "binary vendor specific designator",
+			page:     vpdPage(0x83, vpdDesignator(1, 0, guid)),
+			expected: []string{"e4bc7e9f1c2d4a5b8c7d0123456789ab", "9f7ebce42d1c5b4a8c7d0123456789ab"},
+		},
+		{
+			desc:     "ASCII T10 vendor ID designator after NAA designator",
+			page:     vpdPage(0x83, vpdDesignator(1, 3, naa), vpdDesignator(2, 1, []byte("MSFT    "+testDiskUniqueID))),
+			expected: []string{testDiskUniqueID},
+		},
+		{
+			desc:     "truncated designator",
+			page:     vpdPage(0x83, vpdDesignator(1, 0, guid))[:12],
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseDeviceIdentificationVPD(test.page), test.desc)
+	}
+}
+
+func TestVerifyDeviceIdentity(t *testing.T) {
+	pg83Path := "/sys/block/sdc/device/vpd_pg83"
+	pg80Path := "/sys/block/sdc/device/vpd_pg80"
+	tests := []struct {
+		desc         string
+		files        map[string][]byte
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "no VPD page",
+			expectedCode: codes.OK,
+		},
+		{
+			desc: "no disk identifier",
+			files: map[string][]byte{
+				pg83Path: vpdPage(0x83, vpdDesignator(1, 3, make([]byte, 16))),
+				pg80Path: vpdPage(0x80, []byte("serial")),
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			desc: "matching device identifier",
+			files: map[string][]byte{
+				pg83Path: vpdPage(0x83, vpdDesignator(2, 1, []byte("MSFT    "+testDiskUniqueID))),
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			desc: "matching serial number",
+			files: map[string][]byte{
+				pg80Path: vpdPage(0x80, []byte("E4BC7E9F1C2D4A5B8C7D0123456789AB")),
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			desc: "identifier of another disk",
+			files: map[string][]byte{
+				pg83Path: vpdPage(0x83, vpdDesignator(2, 1, []byte("MSFT    00000000-1c2d-4a5b-8c7d-0123456789ab"))),
+			},
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	for _, test := range tests {
+		d.ioHandler = &fakeVPDIOHandler{IOHandler: azureutils.NewFakeIOHandler(), files: test.files}
+		err := d.verifyDeviceIdentity("/dev/sdc", map[string]string{consts.LUN: "1", consts.DiskUniqueID: testDiskUniqueID})
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+
+	// the udev link of the fake io handler resolves to sda
+	d.ioHandler = &fakeVPDIOHandler{IOHandler: azureutils.NewFakeIOHandler(), files: map[string][]byte{
+		"/sys/block/sda/device/vpd_pg80": vpdPage(0x80, []byte("00000000-1c2d-4a5b-8c7d-0123456789ab")),
+	}}
+	err := d.verifyDeviceIdentity("/dev/disk/azure/scsi1/lun1", map[string]string{consts.LUN: "1", consts.DiskUniqueID: testDiskUniqueID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestNormalizeDiskID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{id: "", expected: ""},
+		{id: "E4BC7E9F-1C2D-4A5B-8C7D-0123456789AB", expected: "e4bc7e9f1c2d4a5b8c7d0123456789ab"},
+		{id: "{e4bc7e9f-1c2d-4a5b-8c7d-0123456789ab}", expected: "e4bc7e9f1c2d4a5b8c7d0123456789ab"},
+		{id: "e4bc7e9f1c2d4a5b8c7d0123456789ab", expected: "e4bc7e9f1c2d4a5b8c7d0123456789ab"},
+		{id: "e4bc7e9f-1c2d-4a5b-8c7d", expected: ""},
+		{id: "z4bc7e9f-1c2d-4a5b-8c7d-0123456789ab", expected: ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizeDiskID(test.id), test.id)
+	}
+}
+
+func TestVerifyDeviceIdentityWithoutUniqueID(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+
+	// volumes published before the unique ID was recorded are not verified
+	assert.NoError(t, d.verifyDeviceIdentity("/dev/sdc", map[string]string{consts.LUN: "1"}))
+	assert.NoError(t, d.verifyDeviceIdentity("/dev/sdc", map[string]string{consts.DiskUniqueID: "not-a-guid"}))
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
+)
+
+// getStagedDevice returns the disk device of volumeID staged on stagingTargetPath, the disk under the LUKS device
+// for encrypted volumes, or an empty string if it's not found
+func (d *DriverCore) getStagedDevice(volumeID, stagingTargetPath string) string {
+	if name, ok := d.getOpenEncryptedDevice(volumeID); ok {
+		device, _, err := luks.New(d.mounter.Exec).Status(name)
+		if err != nil {
+			klog.Warningf("failed to get the device of LUKS device %s: %v", name, err)
+			return ""
+		}
+		return device
+	}
+	devicePath, err := getDevicePathWithMountPath(stagingTargetPath, d.mounter)
+	if err != nil {
+		klog.V(4).Infof("no device staged on %s: %v", stagingTargetPath, err)
+		return ""
+	}
+	return devicePath
+}
+
+// removeDevice flushes and deletes the SCSI device devicePath before the disk is detached,
+// the device is left for the detach if it can't be removed
+func (d *DriverCore) removeDevice(devicePath string) {
+	if err := removeSCSIDevice(d.ioHandler, d.mounter, devicePath); err != nil {
+		klog.Warningf("failed to remove device %s, it's left for the detach: %v", devicePath, err)
+	}
+}
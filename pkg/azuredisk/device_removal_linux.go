@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+var scsiDiskNameRegexp = regexp.MustCompile(`^sd[a-z]+$`)
+
+// removeSCSIDevice syncs and flushes the buffers of the SCSI disk devicePath, or of the disk of the partition devicePath,
+// and deletes the disk if it has no holder, e.g. a device mapper or md device, other devices like NVMe namespaces are not removed
+func removeSCSIDevice(io azureutils.IOHandler, m *mount.SafeFormatAndMount, devicePath string) error {
+	devName := filepath.Base(devicePath)
+	if filepath.Dir(devicePath) != "/dev" {
+		// udev link, e.g. /dev/disk/azure/scsi1/lun0 -> ../../../sdc
+		link, err := io.Readlink(devicePath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", devicePath, err)
+		}
+		devName = filepath.Base(link)
+	}
+	// a volume staged on a partition, e.g. /dev/sdc1, removes its disk
+	devName, disk, _, err := getPartition(io, "/dev/"+devName)
+	if err != nil {
+		return err
+	}
+	if disk != "" {
+		devName = disk
+	}
+	if !scsiDiskNameRegexp.MatchString(devName) {
+		klog.V(4).Infof("skip removing device %s which is not a SCSI disk", devicePath)
+		return nil
+	}
+
+	// write back dirty pages of the device before its buffers are flushed and dropped
+	if output, err := m.Exec.Command("sync").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to sync before removing /dev/%s: %v, output: %s", devName, err, string(output))
+	}
+	if output, err := m.Exec.Command("blockdev", "--flushbufs", "/dev/"+devName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to flush buffers of /dev/%s: %v, output: %s", devName, err, string(output))
+	}
+
+	blockPath := filepath.Join(sysfsPath, "block", devName)
+	holders, err := getDeviceHolders(io, blockPath, devName)
+	if err != nil {
+		return err
+	}
+	if len(holders) > 0 {
+		return fmt.Errorf("device %s is held by %v", devName, holders)
+	}
+
+	klog.V(2).Infof("deleting SCSI device %s", devName)
+	return io.WriteFile(filepath.Join(blockPath, "device", "delete"), []byte("1"), 0200)
+}
+
+// getDeviceHolders returns the holders of the disk devName and its partitions in sysfs
+func getDeviceHolders(io azureutils.IOHandler, blockPath, devName string) ([]string, error) {
+	dirs := []string{blockPath}
+	entries, err := io.ReadDir(blockPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", blockPath, err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), devName) {
+			dirs = append(dirs, filepath.Join(blockPath, e.Name()))
+		}
+	}
+
+	var holders []string
+	for _, dir := range dirs {
+		entries, err := io.ReadDir(filepath.Join(dir, "holders"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read holders of %s: %v", filepath.Base(dir), err)
+		}
+		for _, e := range entries {
+			holders = append(holders, e.Name())
+		}
+	}
+	return holders, nil
+}
+
+// getPublishedBlockDevice returns the device of the raw block volume published on target,
+// or an empty string if target is not the bind mount of a device
+func (d *DriverCore) getPublishedBlockDevice(target string) string {
+	devicePath, err := findBlockDeviceOfTarget(mountInfoPath, target)
+	if err != nil {
+		klog.Warningf("failed to find the device published on %s: %v", target, err)
+	}
+	return devicePath
+}
+
+// removeUnpublishedBlockDevice removes the device of a raw block volume once it's not published on any target
+func (d *DriverCore) removeUnpublishedBlockDevice(devicePath string) {
+	targets, err := findBlockDeviceTargets(mountInfoPath, devicePath)
+	if err != nil {
+		klog.Warningf("failed to find the targets of device %s, it's left for the detach: %v", devicePath, err)
+		return
+	}
+	if len(targets) > 0 {
+		klog.V(2).Infof("device %s is still published on %v", devicePath, targets)
+		return
+	}
+	d.removeDevice(devicePath)
+}
+
+// findBlockDeviceOfTarget returns the device bind mounted on target from devtmpfs, e.g. /dev/sdc
+func findBlockDeviceOfTarget(mountInfoPath, target string) (string, error) {
+	mountInfos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return "", err
+	}
+	for _, mi := range mountInfos {
+		if mi.MountPoint == target && mi.FsType == "devtmpfs" {
+			return filepath.Join("/dev", mi.Root), nil
+		}
+	}
+	return "", nil
+}
+
+// findBlockDeviceTargets returns the targets devicePath is bind mounted on from devtmpfs
+func findBlockDeviceTargets(mountInfoPath, devicePath string) ([]string, error) {
+	mountInfos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	root := "/" + filepath.Base(devicePath)
+	for _, mi := range mountInfos {
+		if mi.Root == root && mi.FsType == "devtmpfs" {
+			targets = append(targets, mi.MountPoint)
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,172 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestRemoveSCSIDevice(t *testing.T) {
+	flushed := func() ([]byte, []byte, error) { return nil, nil, nil }
+	tests := []struct {
+		desc             string
+		devicePath       string
+		holders          []string
+		actions          []testingexec.FakeAction
+		expectedCommands []string
+		expectedWritten  map[string]string
+		expectedErr      bool
+	}{
+		{
+			desc:             "SCSI disk is flushed and deleted",
+			devicePath:       "/dev/sdc",
+			actions:          []testingexec.FakeAction{flushed, flushed},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{"/sys/block/sdc/device/delete": "1"},
+		},
+		{
+			desc:             "udev link is resolved",
+			devicePath:       "/dev/disk/azure/scsi1/lun0",
+			actions:          []testingexec.FakeAction{flushed, flushed},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{"/sys/block/sdc/device/delete": "1"},
+		},
+		{
+			desc:             "held disk is not deleted",
+			devicePath:       "/dev/sdc",
+			holders:          []string{"dm-0"},
+			actions:          []testingexec.FakeAction{flushed, flushed},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{},
+			expectedErr:      true,
+		},
+		{
+			desc:             "disk of a partition is flushed and deleted",
+			devicePath:       "/dev/sdc1",
+			actions:          []testingexec.FakeAction{flushed, flushed},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{"/sys/block/sdc/device/delete": "1"},
+		},
+		{
+			desc:             "udev link of a partition is resolved to its disk",
+			devicePath:       "/dev/disk/azure/scsi1/lun0-part1",
+			actions:          []testingexec.FakeAction{flushed, flushed},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{"/sys/block/sdc/device/delete": "1"},
+		},
+		{
+			desc:       "sync failure",
+			devicePath: "/dev/sdc",
+			actions: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte("io error"), nil, testingexec.FakeExitError{Status: 1} },
+			},
+			expectedCommands: []string{"sync"},
+			expectedWritten:  map[string]string{},
+			expectedErr:      true,
+		},
+		{
+			desc:       "flush failure",
+			devicePath: "/dev/sdc",
+			actions: []testingexec.FakeAction{
+				flushed,
+				func() ([]byte, []byte, error) { return []byte("busy"), nil, testingexec.FakeExitError{Status: 1} },
+			},
+			expectedCommands: []string{"sync", "blockdev --flushbufs /dev/sdc"},
+			expectedWritten:  map[string]string{},
+			expectedErr:      true,
+		},
+		{
+			desc:            "NVMe namespace is skipped",
+			devicePath:      "/dev/nvme0n3",
+			expectedWritten: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		io := &fakeSysfsIOHandler{
+			dirs: map[string][]string{
+				"/sys/block/sdc":              {"device", "holders", "sdc1"},
+				"/sys/block/sdc/holders":      {},
+				"/sys/block/sdc/sdc1/holders": test.holders,
+				"/sys/block/nvme0n3":          {"device", "holders"},
+				"/sys/block/nvme0n3/holders":  {},
+				"/dev/disk/azure/scsi1":       {"lun0"},
+			},
+			links: map[string]string{
+				"/dev/disk/azure/scsi1/lun0":       "../../../sdc",
+				"/dev/disk/azure/scsi1/lun0-part1": "../../../sdc1",
+				"/sys/class/block/sdc1":            "../../devices/vmbus/host1/target1:0:0/1:0:0:0/block/sdc/sdc1",
+			},
+			files:   map[string]string{"/sys/class/block/sdc1/partition": "1\n"},
+			written: map[string]string{},
+		}
+		var commands []string
+		m := &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: newFakeCheckExec(&commands, test.actions...)}
+		err := removeSCSIDevice(io, m, test.devicePath)
+		assert.Equal(t, test.expectedErr, err != nil, "%s: %v", test.desc, err)
+		assert.Equal(t, test.expectedCommands, commands, test.desc)
+		assert.Equal(t, test.expectedWritten, io.written, test.desc)
+	}
+}
+
+const fakeDeviceMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+25 22 0:5 / /dev rw,nosuid shared:2 - devtmpfs udev rw,size=4026036k
+301 22 0:5 /sdc /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv-1/pod-1 rw,nosuid shared:2 - devtmpfs udev rw,size=4026036k
+302 22 0:5 /sdc /var/lib/kubelet/pods/pod-1/volumeDevices/kubernetes.io~csi/pv-1 rw,nosuid shared:2 - devtmpfs udev rw,size=4026036k
+`
+
+func TestFindBlockDeviceOfTarget(t *testing.T) {
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfo, []byte(fakeDeviceMountInfo), 0600))
+
+	devicePath, err := findBlockDeviceOfTarget(mountInfo, "/var/lib/kubelet/pods/pod-1/volumeDevices/kubernetes.io~csi/pv-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sdc", devicePath)
+
+	devicePath, err = findBlockDeviceOfTarget(mountInfo, "/var/lib/kubelet/pods/pod-2/volumeDevices/kubernetes.io~csi/pv-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "", devicePath)
+
+	_, err = findBlockDeviceOfTarget(filepath.Join(t.TempDir(), "missing"), "/target")
+	assert.Error(t, err)
+}
+
+func TestFindBlockDeviceTargets(t *testing.T) {
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfo, []byte(fakeDeviceMountInfo), 0600))
+
+	targets, err := findBlockDeviceTargets(mountInfo, "/dev/sdc")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv-1/pod-1",
+		"/var/lib/kubelet/pods/pod-1/volumeDevices/kubernetes.io~csi/pv-1",
+	}, targets)
+
+	targets, err = findBlockDeviceTargets(mountInfo, "/dev/sdd")
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	mount "k8s.io/mount-utils"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+// removeSCSIDevice leaves the device for the detach on this platform
+func removeSCSIDevice(_ azureutils.IOHandler, _ *mount.SafeFormatAndMount, _ string) error {
+	return nil
+}
+
+func (d *DriverCore) getPublishedBlockDevice(_ string) string {
+	return ""
+}
+
+func (d *DriverCore) removeUnpublishedBlockDevice(_ string) {
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// devicePollInterval is the interval of looking up a device without block device events
+	devicePollInterval = time.Second
+	// deviceResyncInterval is the interval of looking up a device with block device events, in case an event is lost
+	deviceResyncInterval = 10 * time.Second
+
+	ueventActionAdd    = "add"
+	ueventActionChange = "change"
+	ueventActionRemove = "remove"
+)
+
+// blockUevent is a uevent of a block device of a data disk
+type blockUevent struct {
+	action string
+	// device name, e.g. sdc, nvme0n3
+	devName string
+	// lun of the data disk parsed from the device path, the device is verified when it's looked up
+	lun int
+}
+
+// deviceWatcher keeps an index from lun to the block devices of data disks updated by uevents,
+// device lookups wait on the index instead of polling sysfs every second
+type deviceWatcher struct {
+	mu      sync.Mutex
+	running bool
+	// device names on each lun
+	devices map[int]map[string]struct{}
+	// closed when a device is added on the lun
+	added map[int]chan struct{}
+}
+
+func newDeviceWatcher() *deviceWatcher {
+	return &deviceWatcher{
+		devices: map[int]map[string]struct{}{},
+		added:   map[int]chan struct{}{},
+	}
+}
+
+// Run listens to uevents of block devices until ctx is done, device lookups keep polling if uevents are not available
+func (w *deviceWatcher) Run(ctx context.Context) {
+	err := listenBlockUevents(ctx, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.running = true
+		klog.V(2).Infof("deviceWatcher: listening to block device uevents")
+	}, w.handle)
+	w.mu.Lock()
+	w.running = false
+	w.mu.Unlock()
+	if err != nil {
+		klog.Warningf("deviceWatcher: block device uevents are not available, devices are looked up every %v: %v", devicePollInterval, err)
+	}
+}
+
+// handle updates the index with a uevent and wakes up the lookups of its lun
+func (w *deviceWatcher) handle(e blockUevent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch e.action {
+	case ueventActionAdd, ueventActionChange:
+		if w.devices[e.lun] == nil {
+			w.devices[e.lun] = map[string]struct{}{}
+		}
+		w.devices[e.lun][e.devName] = struct{}{}
+		if added, ok := w.added[e.lun]; ok {
+			close(added)
+			delete(w.added, e.lun)
+		}
+		klog.V(4).Infof("deviceWatcher: device %s on lun %d, action: %s", e.devName, e.lun, e.action)
+	case ueventActionRemove:
+		delete(w.devices[e.lun], e.devName)
+		if len(w.devices[e.lun]) == 0 {
+			delete(w.devices, e.lun)
+		}
+		klog.V(4).Infof("deviceWatcher: device %s is removed from lun %d", e.devName, e.lun)
+	}
+}
+
+// getDevices returns the device names on lun in the index
+func (w *deviceWatcher) getDevices(lun int) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	devices := []string{}
+	for name := range w.devices[lun] {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// watch returns a channel closed when a device is added on lun and the interval of looking up the device
+// in case the channel is not closed, the channel is nil if the watcher is not running
+func (w *deviceWatcher) watch(lun int) (<-chan struct{}, time.Duration) {
+	if w == nil {
+		return nil, devicePollInterval
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.running {
+		return nil, devicePollInterval
+	}
+	added, ok := w.added[lun]
+	if !ok {
+		added = make(chan struct{})
+		w.added[lun] = added
+	}
+	return added, deviceResyncInterval
+}
+
+// waitForDevice looks up the device on lun with find until it's found or ctx is done,
+// the device is looked up again when a device is added on lun
+func (w *deviceWatcher) waitForDevice(ctx context.Context, lun int, find func() (string, error)) (string, error) {
+	for {
+		// watch before looking up the device so that a device added in between is not missed
+		added, interval := w.watch(lun)
+		devicePath, err := find()
+		if err != nil || devicePath != "" {
+			return devicePath, err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-added:
+			timer.Stop()
+			klog.V(4).Infof("deviceWatcher: looking up lun %d on devices %v", lun, w.getDevices(lun))
+		case <-timer.C:
+		}
+	}
+}
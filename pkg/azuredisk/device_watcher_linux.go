@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// multicast group of the uevents sent by the kernel, udev events are sent to group 2
+	ueventKernelGroup = 1
+	ueventBufferSize  = 64 * 1024
+)
+
+var (
+	// e.g. /devices/LNXSYSTM:00/.../host4/target4:0:0/4:0:0:1/block/sdc
+	scsiDevPathRegexp = regexp.MustCompile(`/\d+:\d+:\d+:(\d+)/block/[^/]+$`)
+	// e.g. /devices/pci0000:00/.../nvme/nvme0/nvme0n3
+	nvmeDevPathRegexp = regexp.MustCompile(`/nvme\d+/nvme\d+n(\d+)$`)
+)
+
+// listenBlockUevents calls handle with the kernel uevents of the block devices of data disks until ctx is done,
+// onListening is called once the netlink socket is bound
+func listenBlockUevents(ctx context.Context, onListening func(), handle func(blockUevent)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("failed to create netlink socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+	// wake up periodically to check ctx since closing the socket does not interrupt a blocking read
+	timeout := unix.NsecToTimeval(deviceResyncInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("failed to set timeout of netlink socket: %v", err)
+	}
+	onListening()
+
+	buf := make([]byte, ueventBufferSize)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			switch {
+			case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			case errors.Is(err, unix.ENOBUFS):
+				// device lookups resync in deviceResyncInterval
+				klog.Warningf("deviceWatcher: uevents are dropped since the socket buffer is full")
+			default:
+				return fmt.Errorf("failed to receive uevent: %v", err)
+			}
+			continue
+		}
+		if e, ok := parseBlockUevent(buf[:n]); ok {
+			handle(e)
+		}
+	}
+	return nil
+}
+
+// parseBlockUevent parses a kernel uevent, e.g. "add@/devices/...\x00ACTION=add\x00DEVPATH=...\x00SUBSYSTEM=block\x00...",
+// only disks whose lun can be derived from the device path are returned
+func parseBlockUevent(msg []byte) (blockUevent, bool) {
+	env := map[string]string{}
+	for i, field := range bytes.Split(msg, []byte{0}) {
+		if i == 0 {
+			// header of action@devpath
+			continue
+		}
+		if kv := bytes.SplitN(field, []byte("="), 2); len(kv) == 2 {
+			env[string(kv[0])] = string(kv[1])
+		}
+	}
+	if env["SUBSYSTEM"] != "block" || env["DEVTYPE"] != "disk" || env["DEVNAME"] == "" {
+		return blockUevent{}, false
+	}
+	lun, ok := getLunFromDevPath(env["DEVPATH"])
+	if !ok {
+		return blockUevent{}, false
+	}
+	return blockUevent{action: env["ACTION"], devName: env["DEVNAME"], lun: lun}, true
+}
+
+// getLunFromDevPath returns the lun of a SCSI disk or an NVMe namespace from its sysfs device path
+func getLunFromDevPath(devPath string) (int, bool) {
+	if m := scsiDevPathRegexp.FindStringSubmatch(devPath); m != nil {
+		lun, err := strconv.Atoi(m[1])
+		return lun, err == nil
+	}
+	if m := nvmeDevPathRegexp.FindStringSubmatch(devPath); m != nil {
+		nsid, err := strconv.Atoi(m[1])
+		lun := nsid - nvmeDataDiskNamespaceOffset
+		return lun, err == nil && lun >= 0
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlockUevent(t *testing.T) {
+	uevent := func(fields ...string) []byte {
+		return []byte(strings.Join(fields, "\x00") + "\x00")
+	}
+	scsiDevPath := "/devices/LNXSYSTM:00/LNXSYBUS:00/ACPI0004:00/VMBUS:00/f8b3781b-1e82-4818-a1c3-63d806ec15bb/host1/target1:0:0/1:0:0:3/block/sdf"
+	tests := []struct {
+		desc     string
+		msg      []byte
+		expected blockUevent
+		ok       bool
+	}{
+		{
+			desc:     "SCSI disk added",
+			msg:      uevent("add@"+scsiDevPath, "ACTION=add", "DEVPATH="+scsiDevPath, "SUBSYSTEM=block", "MAJOR=8", "MINOR=80", "DEVNAME=sdf", "DEVTYPE=disk", "SEQNUM=4242"),
+			expected: blockUevent{action: ueventActionAdd, devName: "sdf", lun: 3},
+			ok:       true,
+		},
+		{
+			desc:     "NVMe namespace removed",
+			msg:      uevent("remove@/devices/pci0000:00/0000:00:00.0/nvme/nvme1/nvme1n4", "ACTION=remove", "DEVPATH=/devices/pci0000:00/0000:00:00.0/nvme/nvme1/nvme1n4", "SUBSYSTEM=block", "DEVNAME=nvme1n4", "DEVTYPE=disk"),
+			expected: blockUevent{action: ueventActionRemove, devName: "nvme1n4", lun: 2},
+			ok:       true,
+		},
+		{
+			desc: "partition",
+			msg:  uevent("add@"+scsiDevPath+"/sdf1", "ACTION=add", "DEVPATH="+scsiDevPath+"/sdf1", "SUBSYSTEM=block", "DEVNAME=sdf1", "DEVTYPE=partition"),
+		},
+		{
+			desc: "SCSI device",
+			msg:  uevent("add@/devices/.../host1/target1:0:0/1:0:0:3", "ACTION=add", "DEVPATH=/devices/.../host1/target1:0:0/1:0:0:3", "SUBSYSTEM=scsi", "DEVTYPE=scsi_device"),
+		},
+		{
+			desc: "OS disk namespace",
+			msg:  uevent("add@/devices/pci0000:00/0000:00:00.0/nvme/nvme1/nvme1n1", "ACTION=add", "DEVPATH=/devices/pci0000:00/0000:00:00.0/nvme/nvme1/nvme1n1", "SUBSYSTEM=block", "DEVNAME=nvme1n1", "DEVTYPE=disk"),
+		},
+		{
+			desc: "loop device",
+			msg:  uevent("change@/devices/virtual/block/loop0", "ACTION=change", "DEVPATH=/devices/virtual/block/loop0", "SUBSYSTEM=block", "DEVNAME=loop0", "DEVTYPE=disk"),
+		},
+		{
+			desc: "empty message",
+			msg:  []byte{},
+		},
+	}
+	for _, test := range tests {
+		e, ok := parseBlockUevent(test.msg)
+		assert.Equal(t, test.ok, ok, test.desc)
+		assert.Equal(t, test.expected, e, test.desc)
+	}
+}
+
+func TestScsiHostRescan(t *testing.T) {
+	io := &fakeSysfsIOHandler{
+		dirs: map[string][]string{
+			"/sys/class/scsi_host/": {"host0", "host1", "host2"},
+		},
+		files: map[string]string{
+			"/sys/class/scsi_host/host0/proc_name": "storvsc\n",
+			"/sys/class/scsi_host/host1/proc_name": "ata_piix\n",
+		},
+		written: map[string]string{},
+	}
+	scsiHostRescan(io, nil, 3)
+	assert.Equal(t, map[string]string{
+		"/sys/class/scsi_host/host0/scan": "- - 3",
+		"/sys/class/scsi_host/host2/scan": "- - 3",
+	}, io.written)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceWatcherHandle(t *testing.T) {
+	w := newDeviceWatcher()
+	w.handle(blockUevent{action: ueventActionAdd, devName: "sdc", lun: 0})
+	w.handle(blockUevent{action: ueventActionAdd, devName: "sdd", lun: 1})
+	w.handle(blockUevent{action: ueventActionChange, devName: "nvme0n3", lun: 1})
+	assert.Equal(t, []string{"sdc"}, w.getDevices(0))
+	assert.Equal(t, []string{"nvme0n3", "sdd"}, w.getDevices(1))
+
+	w.handle(blockUevent{action: ueventActionRemove, devName: "sdd", lun: 1})
+	w.handle(blockUevent{action: ueventActionRemove, devName: "sdc", lun: 0})
+	w.handle(blockUevent{action: "bind", devName: "sde", lun: 2})
+	assert.Equal(t, []string{}, w.getDevices(0))
+	assert.Equal(t, []string{"nvme0n3"}, w.getDevices(1))
+	assert.Equal(t, []string{}, w.getDevices(2))
+}
+
+func TestWaitForDevice(t *testing.T) {
+	// find returns the device on the calls after found is closed
+	newFind := func(found <-chan struct{}, calls *int) func() (string, error) {
+		return func() (string, error) {
+			*calls++
+			select {
+			case <-found:
+				return "/dev/sdc", nil
+			default:
+				return "", nil
+			}
+		}
+	}
+
+	t.Run("device added on lun", func(t *testing.T) {
+		w := newDeviceWatcher()
+		w.running = true
+		found := make(chan struct{})
+		calls := 0
+		find := newFind(found, &calls)
+		go func() {
+			for {
+				w.mu.Lock()
+				_, watched := w.added[1]
+				w.mu.Unlock()
+				if watched {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(found)
+			w.handle(blockUevent{action: ueventActionAdd, devName: "sdc", lun: 1})
+		}()
+		start := time.Now()
+		devicePath, err := w.waitForDevice(context.Background(), 1, find)
+		assert.NoError(t, err)
+		assert.Equal(t, "/dev/sdc", devicePath)
+		assert.Less(t, time.Since(start), deviceResyncInterval)
+		assert.Equal(t, []string{"sdc"}, w.getDevices(1))
+	})
+
+	t.Run("polling without watcher", func(t *testing.T) {
+		var w *deviceWatcher
+		found := make(chan struct{})
+		calls := 0
+		find := newFind(found, &calls)
+		time.AfterFunc(devicePollInterval/2, func() { close(found) })
+		devicePath, err := w.waitForDevice(context.Background(), 1, find)
+		assert.NoError(t, err)
+		assert.Equal(t, "/dev/sdc", devicePath)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		w := newDeviceWatcher()
+		w.running = true
+		calls := 0
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := w.waitForDevice(ctx, 1, newFind(nil, &calls))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("lookup error", func(t *testing.T) {
+		w := newDeviceWatcher()
+		_, err := w.waitForDevice(context.Background(), 1, func() (string, error) {
+			return "", fmt.Errorf("lookup error")
+		})
+		assert.EqualError(t, err, "lookup error")
+	})
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// newKeyVaultUnwrapper creates the unwrapper of LUKS keys wrapped by Key Vault keys with the identity of the cloud config,
+// returns nil if there is no identity
+func newKeyVaultUnwrapper(cloud *azure.Cloud) luks.KeyUnwrapper {
+	authProvider, err := azclient.NewAuthProvider(&cloud.ARMClientConfig, &cloud.AzureAuthConfig.AzureAuthConfig)
+	if err != nil {
+		klog.Warningf("failed to create auth provider of Key Vault, wrapped LUKS keys are not supported: %v", err)
+		return nil
+	}
+	cred := authProvider.GetAzIdentity()
+	if cred == nil {
+		klog.V(2).Infof("no identity in cloud config, wrapped LUKS keys are not supported")
+		return nil
+	}
+	clientOptions, err := azclient.GetAzCoreClientOption(&cloud.ARMClientConfig)
+	if err != nil {
+		klog.Warningf("failed to get client options of Key Vault, wrapped LUKS keys are not supported: %v", err)
+		return nil
+	}
+	return luks.NewKeyVaultUnwrapper(cred, clientOptions)
+}
+
+// openEncryptedDevice opens the LUKS device on source of volume diskURI, the device is formatted as LUKS on first use,
+// returns the path of the mapper device which is formatted and mounted, or published as raw block device
+func (d *DriverCore) openEncryptedDevice(ctx context.Context, diskURI, source string, secrets map[string]string, readOnly bool) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", status.Error(codes.InvalidArgument, "LUKS encryption is not supported on Windows")
+	}
+	cryptsetup := luks.New(d.mounter.Exec)
+	name := luks.MapperName(diskURI)
+	device, active, err := cryptsetup.Status(name)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to get status of LUKS device %s: %v", name, err)
+	}
+	if active {
+		if sameDevice(device, source) {
+			klog.V(2).Infof("LUKS device %s of %s is already open", name, source)
+			return luks.MapperPath(name), nil
+		}
+		// the disk was attached again on another lun after the node lost it
+		klog.Warningf("LUKS device %s is open on %s instead of %s, closing it", name, device, source)
+		if err := cryptsetup.Close(name); err != nil {
+			return "", status.Errorf(codes.Internal, "failed to close stale LUKS device %s: %v", name, err)
+		}
+	}
+
+	passphrase, err := luks.GetPassphrase(ctx, secrets, d.keyUnwrapper)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "failed to get LUKS passphrase of volume %s: %v", diskURI, err)
+	}
+	isLuks, err := cryptsetup.IsLuks(source)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if !isLuks {
+		if readOnly {
+			return "", status.Errorf(codes.FailedPrecondition, "%s is not a LUKS device and can't be formatted read-only", source)
+		}
+		existingFormat, err := getDiskFormat(source, d.mounter)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "failed to get disk format of %s: %v", source, err)
+		}
+		if existingFormat != "" {
+			return "", status.Errorf(codes.FailedPrecondition, "%s already contains %s data, refusing to format it as LUKS device", source, existingFormat)
+		}
+		if err := cryptsetup.Format(source, passphrase); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := cryptsetup.Open(source, name, passphrase, readOnly); err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return luks.MapperPath(name), nil
+}
+
+// getOpenEncryptedDevice returns the mapper name of the LUKS device of volume diskURI, ok is false if it isn't open
+func (d *DriverCore) getOpenEncryptedDevice(diskURI string) (string, bool) {
+	name := luks.MapperName(diskURI)
+	isDevice, err := d.getHostUtil().PathIsDevice(luks.MapperPath(name))
+	return name, err == nil && isDevice
+}
+
+// closeEncryptedDevice closes the LUKS device of volume diskURI if it's open
+func (d *DriverCore) closeEncryptedDevice(diskURI string) error {
+	name, ok := d.getOpenEncryptedDevice(diskURI)
+	if !ok {
+		return nil
+	}
+	return luks.New(d.mounter.Exec).Close(name)
+}
+
+// resizeEncryptedDevice grows the LUKS device name to the size of its underlying disk, which is rescanned first
+func (d *DriverCore) resizeEncryptedDevice(ctx context.Context, name string, secrets map[string]string) error {
+	cryptsetup := luks.New(d.mounter.Exec)
+	device, active, err := cryptsetup.Status(name)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("LUKS device %s is not open", name)
+	}
+	if d.enableDiskOnlineResize {
+		klog.V(2).Infof("rescan device %s of LUKS device %s", device, name)
+		if err := rescanVolume(d.ioHandler, device); err != nil {
+			klog.Errorf("rescanVolume(%s) failed with error: %v", device, err)
+		}
+	}
+	// the volume key of LUKS2 is kept in the kernel keyring, the passphrase is only needed if it's not
+	var passphrase []byte
+	if len(secrets) > 0 {
+		if passphrase, err = luks.GetPassphrase(ctx, secrets, d.keyUnwrapper); err != nil {
+			return err
+		}
+	}
+	return cryptsetup.Resize(name, passphrase)
+}
+
+func sameDevice(a, b string) bool {
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+	return a == b
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestOpenEncryptedDevice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	const (
+		diskURI = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"
+		source  = "/dev/sdc"
+	)
+	mapperPath := luks.MapperPath(luks.MapperName(diskURI))
+	secrets := map[string]string{luks.PassphraseKey: "secret"}
+
+	ok := func(output string) testingexec.FakeAction {
+		return func() ([]byte, []byte, error) { return []byte(output), []byte{}, nil }
+	}
+	exit := func(code int) testingexec.FakeAction {
+		return func() ([]byte, []byte, error) { return []byte{}, []byte{}, testingexec.FakeExitError{Status: code} }
+	}
+	inactive, notLuks, unformatted := exit(4), exit(1), exit(2)
+
+	tests := []struct {
+		desc         string
+		secrets      map[string]string
+		readOnly     bool
+		scripts      []testingexec.FakeAction
+		expectedCode codes.Code
+	}{
+		{
+			desc:    "format and open new disk",
+			secrets: secrets,
+			// status, isLuks, blkid, luksFormat, luksOpen
+			scripts: []testingexec.FakeAction{inactive, notLuks, unformatted, ok(""), ok("")},
+		},
+		{
+			desc:    "open LUKS disk",
+			secrets: secrets,
+			// status, isLuks, luksOpen
+			scripts: []testingexec.FakeAction{inactive, ok(""), ok("")},
+		},
+		{
+			desc:    "already open",
+			secrets: secrets,
+			scripts: []testingexec.FakeAction{ok(mapperPath + " is active.\n  type:    LUKS2\n  device:  " + source + "\n")},
+		},
+		{
+			desc:    "open on another device",
+			secrets: secrets,
+			// status, luksClose, isLuks, luksOpen
+			scripts: []testingexec.FakeAction{ok("  device:  /dev/sdd\n"), ok(""), ok(""), ok("")},
+		},
+		{
+			desc:         "missing secrets",
+			scripts:      []testingexec.FakeAction{inactive},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "refuse to encrypt existing filesystem",
+			secrets:      secrets,
+			scripts:      []testingexec.FakeAction{inactive, notLuks, ok("DEVICE=/dev/sdc\nTYPE=ext4")},
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			desc:         "refuse to format read-only disk",
+			secrets:      secrets,
+			readOnly:     true,
+			scripts:      []testingexec.FakeAction{inactive, notLuks},
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			desc:         "wrong passphrase",
+			secrets:      secrets,
+			scripts:      []testingexec.FakeAction{inactive, ok(""), exit(2)},
+			expectedCode: codes.Internal,
+		},
+	}
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		d, _ := newFakeDriverV1(ctrl)
+		fakeMounter, _ := mounter.NewFakeSafeMounter()
+		d.setMounter(fakeMounter)
+		d.setNextCommandOutputScripts(test.scripts...)
+		devicePath, err := d.openEncryptedDevice(context.Background(), diskURI, source, test.secrets, test.readOnly)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+		if err == nil {
+			assert.Equal(t, mapperPath, devicePath, test.desc)
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestCloseAndResizeEncryptedDevice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d, _ := newFakeDriverV1(ctrl)
+	fakeMounter, _ := mounter.NewFakeSafeMounter()
+	d.setMounter(fakeMounter)
+	diskURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"
+	name := luks.MapperName(diskURI)
+
+	_, open := d.getOpenEncryptedDevice(diskURI)
+	assert.False(t, open)
+	assert.NoError(t, d.closeEncryptedDevice(diskURI), "not encrypted")
+
+	d.hostUtil.(*azureutils.FakeHostUtil).SetPathIsDeviceResult(luks.MapperPath(name), true, nil)
+	openName, open := d.getOpenEncryptedDevice(diskURI)
+	assert.True(t, open)
+	assert.Equal(t, name, openName)
+
+	ok := func() ([]byte, []byte, error) { return []byte("  device:  /dev/sdc\n"), []byte{}, nil }
+	inactive := func() ([]byte, []byte, error) { return []byte{}, []byte{}, testingexec.FakeExitError{Status: 4} }
+	// status, resize
+	d.setNextCommandOutputScripts(ok, ok)
+	assert.NoError(t, d.resizeEncryptedDevice(context.Background(), name, nil))
+	d.setNextCommandOutputScripts(inactive)
+	assert.Error(t, d.resizeEncryptedDevice(context.Background(), name, nil))
+	d.setNextCommandOutputScripts(ok)
+	assert.Error(t, d.resizeEncryptedDevice(context.Background(), name, map[string]string{"foo": "bar"}), "invalid secrets")
+
+	// luksClose
+	d.setNextCommandOutputScripts(ok)
+	assert.NoError(t, d.closeEncryptedDevice(diskURI))
+}
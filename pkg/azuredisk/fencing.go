@@ -0,0 +1,228 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/scsipr"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+)
+
+const (
+	// fencingStateFile records the lun of a fenced block volume in its staging path for NodeUnstageVolume
+	fencingStateFile = "fencing-lun"
+	// every registered node may write to the disk, a node is fenced by removing its registration
+	fencingReservationType = scsipr.WriteExclusiveAllRegistrants
+)
+
+// isFencedVolume returns whether the nodes writing to the block volume are fenced with SCSI persistent reservations
+func isFencedVolume(volCap *csi.VolumeCapability, volumeContext map[string]string) bool {
+	return volCap.GetBlock() != nil &&
+		volCap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER &&
+		azureutils.IsPersistentReservationFencing(volumeContext)
+}
+
+// registerFencingKey registers the reservation key of the node on device and records lun in stagingPath
+func (d *DriverCore) registerFencingKey(device, lun, stagingPath string) error {
+	key := scsipr.NodeKey(d.NodeID)
+	if err := d.scsiPR.Register(device, key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(stagingPath, fencingStateFile), []byte(lun), 0600); err != nil {
+		return fmt.Errorf("failed to record lun of %s in %s: %v", device, stagingPath, err)
+	}
+	klog.V(2).Infof("registered reservation key %s of node %s on %s", scsipr.FormatKey(key), d.NodeID, device)
+	return nil
+}
+
+// reserveForWriter makes sure the node can write to device: the keys of the dead nodes listed by the controller
+// in publishContext are preempted, then the reservation is taken if no node holds it. The node only registers when
+// the volume is staged, a node whose key was preempted stays fenced until the volume is staged on it again.
+func (d *DriverCore) reserveForWriter(device string, publishContext map[string]string) error {
+	key := scsipr.NodeKey(d.NodeID)
+	keys, err := d.scsiPR.ReadKeys(device)
+	if err != nil {
+		return err
+	}
+	registered := sets.New(keys...)
+	if !registered.Has(key) {
+		return fmt.Errorf("reservation key %s of node %s is not registered on %s: %w", scsipr.FormatKey(key), d.NodeID, device, scsipr.ErrReservationConflict)
+	}
+
+	if preemptKeys := publishContext[consts.FencingPreemptKeys]; preemptKeys != "" {
+		for _, s := range strings.Split(preemptKeys, ",") {
+			preemptKey, err := scsipr.ParseKey(s)
+			if err != nil {
+				return err
+			}
+			if preemptKey == key || !registered.Has(preemptKey) {
+				continue
+			}
+			if err := d.scsiPR.Preempt(device, key, preemptKey, fencingReservationType); err != nil {
+				return fmt.Errorf("failed to preempt reservation key %s: %w", s, err)
+			}
+			klog.V(2).Infof("preempted reservation key %s on %s, the node is fenced", s, device)
+		}
+	}
+
+	reservation, err := d.scsiPR.ReadReservation(device)
+	if err != nil {
+		return err
+	}
+	if reservation == nil {
+		if err := d.scsiPR.Reserve(device, key, fencingReservationType); err != nil {
+			return err
+		}
+		klog.V(2).Infof("node %s took the reservation of %s", d.NodeID, device)
+	}
+	return nil
+}
+
+// unregisterFencingKey removes the registration of the node from the device recorded in stagingPath by registerFencingKey
+func (d *DriverCore) unregisterFencingKey(stagingPath string, getDevicePathWithLUN func(string) (string, error)) error {
+	stateFile := filepath.Join(stagingPath, fencingStateFile)
+	lun, err := os.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	device, err := getDevicePathWithLUN(string(lun))
+	if err != nil {
+		klog.Warningf("failed to find disk on lun %s, the registration of node %s is left on the disk: %v", lun, d.NodeID, err)
+	} else {
+		if err := d.scsiPR.Unregister(device, scsipr.NodeKey(d.NodeID)); err != nil {
+			return err
+		}
+		klog.V(2).Infof("unregistered node %s from %s", d.NodeID, device)
+	}
+	return os.Remove(stateFile)
+}
+
+// getFencingPreemptKeys returns the reservation keys of the nodes other than nodeName to which diskURI is attached
+// through a VolumeAttachment while the node is confirmed dead, see isNodeDead. The controller can not reach the disk,
+// nodeName preempts these keys when it publishes diskURI so that the dead nodes can not write to the disk anymore.
+func (d *DriverCore) getFencingPreemptKeys(ctx context.Context, diskURI string, nodeName types.NodeName) ([]string, error) {
+	if d.cloud == nil || d.cloud.KubeClient == nil {
+		return nil, nil
+	}
+	kubeClient := d.cloud.KubeClient
+	pvs, err := kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+	pvNames := sets.New[string]()
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == d.Name && strings.EqualFold(pv.Spec.CSI.VolumeHandle, diskURI) {
+			pvNames.Insert(pv.Name)
+		}
+	}
+	if pvNames.Len() == 0 {
+		return nil, nil
+	}
+
+	vas, err := kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VolumeAttachments: %v", err)
+	}
+	keys := sets.New[string]()
+	for _, va := range vas.Items {
+		if va.Spec.Attacher != d.Name || va.Spec.Source.PersistentVolumeName == nil || !pvNames.Has(*va.Spec.Source.PersistentVolumeName) ||
+			strings.EqualFold(va.Spec.NodeName, string(nodeName)) {
+			continue
+		}
+		key := scsipr.FormatKey(scsipr.NodeKey(va.Spec.NodeName))
+		if keys.Has(key) {
+			continue
+		}
+		dead, reason, err := d.isNodeDead(ctx, va.Spec.NodeName)
+		if err != nil {
+			return nil, err
+		}
+		if !dead {
+			continue
+		}
+		klog.V(2).Infof("node %s attached to volume %s is dead (%s), its reservation key will be preempted", va.Spec.NodeName, diskURI, reason)
+		keys.Insert(key)
+	}
+	result := keys.UnsortedList()
+	sort.Strings(result)
+	return result, nil
+}
+
+// isNodeDead returns whether the Node object of nodeName is deleted, it is tainted out of service, or it is not ready
+// while its VM is stopped, deallocated or deleted, with the reason. A node which is only not ready may be partitioned
+// while still running, it is fenced once an administrator taints it out of service.
+func (d *DriverCore) isNodeDead(ctx context.Context, nodeName string) (bool, string, error) {
+	node, err := d.cloud.KubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, "node deleted", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1.TaintNodeOutOfService {
+			return true, "node out of service", nil
+		}
+	}
+	if isNodeReady(node) {
+		return false, "", nil
+	}
+	powerStatus, err := d.cloud.VMSet.GetPowerStatusByNodeName(nodeName)
+	if err != nil {
+		if errors.Is(err, cloudprovider.InstanceNotFound) {
+			return true, "VM deleted", nil
+		}
+		return false, "", fmt.Errorf("failed to get power status of node %s: %v", nodeName, err)
+	}
+	switch strings.ToLower(powerStatus) {
+	case azureconsts.VMPowerStateStopped, azureconsts.VMPowerStateDeallocating, azureconsts.VMPowerStateDeallocated:
+		return true, "VM " + strings.ToLower(powerStatus), nil
+	}
+	klog.V(2).Infof("node %s is not ready while its VM is %s, the node is not fenced", nodeName, powerStatus)
+	return false, "", nil
+}
+
+// isNodeReady returns whether the NodeReady condition of node is true
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/scsipr"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestIsFencedVolume(t *testing.T) {
+	volCap := func(block bool, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		c := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+		if block {
+			c.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		} else {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+		}
+		return c
+	}
+	fencing := map[string]string{consts.FencingModeField: consts.FencingModePersistentReservation}
+
+	assert.True(t, isFencedVolume(volCap(true, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), fencing))
+	assert.False(t, isFencedVolume(volCap(true, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), nil))
+	assert.False(t, isFencedVolume(volCap(true, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), fencing))
+	assert.False(t, isFencedVolume(volCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), fencing))
+}
+
+func TestFencingNodeLifecycle(t *testing.T) {
+	device := "/dev/sdc"
+	pr := scsipr.NewFake()
+	newNode := func(nodeID string) (*DriverCore, string) {
+		d := &DriverCore{scsiPR: pr}
+		d.NodeID = nodeID
+		return d, t.TempDir()
+	}
+	getDevicePathWithLUN := func(lun string) (string, error) {
+		if lun == "1" {
+			return device, nil
+		}
+		return "", fmt.Errorf("lun %s not found", lun)
+	}
+	node1, staging1 := newNode("node1")
+	node2, staging2 := newNode("node2")
+
+	assert.NoError(t, node1.registerFencingKey(device, "1", staging1))
+	assert.NoError(t, node1.reserveForWriter(device, nil))
+	assert.NoError(t, node2.registerFencingKey(device, "1", staging2))
+	assert.NoError(t, node2.reserveForWriter(device, nil))
+	keys, err := pr.ReadKeys(device)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{scsipr.NodeKey("node1"), scsipr.NodeKey("node2")}, keys)
+	reservation, err := pr.ReadReservation(device)
+	assert.NoError(t, err)
+	assert.Equal(t, &scsipr.Reservation{Type: scsipr.WriteExclusiveAllRegistrants}, reservation)
+
+	// node1 dies, node3 takes over and preempts it
+	node3, staging3 := newNode("node3")
+	assert.NoError(t, node3.registerFencingKey(device, "1", staging3))
+	publishContext := map[string]string{consts.FencingPreemptKeys: scsipr.FormatKey(scsipr.NodeKey("node1")) + "," + scsipr.FormatKey(scsipr.NodeKey("node4"))}
+	assert.NoError(t, node3.reserveForWriter(device, publishContext))
+	keys, err = pr.ReadKeys(device)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{scsipr.NodeKey("node2"), scsipr.NodeKey("node3")}, keys)
+	assert.Error(t, node3.reserveForWriter(device, map[string]string{consts.FencingPreemptKeys: "node1"}), "invalid key")
+
+	// node1 comes back, it stays fenced until the volume is staged on it again
+	err = node1.reserveForWriter(device, nil)
+	assert.ErrorIs(t, err, scsipr.ErrReservationConflict)
+	keys, err = pr.ReadKeys(device)
+	assert.NoError(t, err)
+	assert.NotContains(t, keys, scsipr.NodeKey("node1"))
+	assert.NoError(t, node1.unregisterFencingKey(staging1, getDevicePathWithLUN))
+
+	assert.NoError(t, node2.unregisterFencingKey(staging2, getDevicePathWithLUN))
+	_, err = os.Stat(filepath.Join(staging2, fencingStateFile))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, node2.unregisterFencingKey(staging2, getDevicePathWithLUN), "volume not fenced")
+	assert.NoError(t, node3.unregisterFencingKey(staging3, getDevicePathWithLUN))
+	keys, err = pr.ReadKeys(device)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	reservation, err = pr.ReadReservation(device)
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+
+	// disk already gone
+	assert.NoError(t, os.WriteFile(filepath.Join(staging1, fencingStateFile), []byte("2"), 0600))
+	assert.NoError(t, node1.unregisterFencingKey(staging1, getDevicePathWithLUN))
+	_, err = os.Stat(filepath.Join(staging1, fencingStateFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetFencingPreemptKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	diskURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"
+	pv := func(name, volumeHandle string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: "disk.csi.azure.com", VolumeHandle: volumeHandle},
+				},
+			},
+		}
+	}
+	va := func(pvName, nodeName string) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: pvName + "-" + nodeName},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: "disk.csi.azure.com",
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: pointer.String(pvName)},
+			},
+		}
+	}
+	node := func(name string, ready v1.ConditionStatus, taints ...v1.Taint) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{Taints: taints},
+			Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}}},
+		}
+	}
+
+	objects := []runtime.Object{
+		pv("pv1", diskURI), pv("pv2", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk2"),
+		va("pv1", "node1"), va("pv1", "node2"), va("pv1", "node3"), va("pv1", "node4"), va("pv1", "node5"),
+		va("pv1", "node7"), va("pv1", "node8"), va("pv2", "node6"),
+		node("node1", v1.ConditionTrue),
+		node("node2", v1.ConditionTrue),
+		node("node3", v1.ConditionUnknown),
+		node("node4", v1.ConditionTrue, v1.Taint{Key: v1.TaintNodeOutOfService, Effect: v1.TaintEffectNoExecute}),
+		node("node6", v1.ConditionFalse),
+		node("node7", v1.ConditionUnknown),
+		node("node8", v1.ConditionFalse),
+	}
+	testCloud := provider.GetTestCloud(ctrl)
+	testCloud.KubeClient = fake.NewSimpleClientset(objects...)
+	vmset := provider.NewMockVMSet(ctrl)
+	testCloud.VMSet = vmset
+	d := &DriverCore{cloud: testCloud}
+	d.Name = "disk.csi.azure.com"
+
+	// node3 is not ready while its VM is running (partitioned), node7 is deallocated, the VM of node8 is deleted
+	vmset.EXPECT().GetPowerStatusByNodeName("node3").Return("running", nil)
+	vmset.EXPECT().GetPowerStatusByNodeName("node7").Return(azureconsts.VMPowerStateDeallocated, nil)
+	vmset.EXPECT().GetPowerStatusByNodeName("node8").Return("", cloudprovider.InstanceNotFound)
+	keys, err := d.getFencingPreemptKeys(context.Background(), diskURI, "node1")
+	assert.NoError(t, err)
+	expected := []string{
+		scsipr.FormatKey(scsipr.NodeKey("node4")),
+		scsipr.FormatKey(scsipr.NodeKey("node5")),
+		scsipr.FormatKey(scsipr.NodeKey("node7")),
+		scsipr.FormatKey(scsipr.NodeKey("node8")),
+	}
+	assert.ElementsMatch(t, expected, keys, "out of service, deleted, and not ready nodes with a stopped or deleted VM are dead")
+
+	keys, err = d.getFencingPreemptKeys(context.Background(), "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk3", "node1")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	vmset.EXPECT().GetPowerStatusByNodeName("node3").Return("", fmt.Errorf("throttled"))
+	_, err = d.getFencingPreemptKeys(context.Background(), diskURI, "node1")
+	assert.Error(t, err, "the power status of a node not ready is unknown")
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// keys of the partition attribute selecting a partition by name, unique GUID or filesystem label, as in fstab
+	partitionLabelKey = "PARTLABEL"
+	partitionUUIDKey  = "PARTUUID"
+	filesystemLabel   = "LABEL"
+)
+
+// deviceSignature is the signature of a device probed by blkid
+type deviceSignature struct {
+	// fsType is the TYPE of the superblock, e.g. ext4 or LVM2_member
+	fsType string
+	// ptType is the PTTYPE of the partition table, e.g. gpt or dos
+	ptType string
+	// usage is the USAGE of the superblock, e.g. filesystem, raid, crypto or other
+	usage string
+}
+
+// foreignLayout returns what is on the device if it's not empty and not a filesystem
+func (s *deviceSignature) foreignLayout() string {
+	switch {
+	case s.ptType != "":
+		return fmt.Sprintf("a %s partition table", s.ptType)
+	case s.fsType == "LVM2_member":
+		return "an LVM physical volume"
+	case s.fsType == "crypto_LUKS":
+		return "a LUKS header"
+	case strings.HasSuffix(s.fsType, "_raid_member") || s.usage == "raid":
+		return fmt.Sprintf("a RAID member signature(%s)", s.fsType)
+	case s.fsType != "" && s.usage != "" && s.usage != "filesystem":
+		return fmt.Sprintf("a %s signature", s.fsType)
+	}
+	return ""
+}
+
+// checkFormatPolicy makes sure source is only formatted as allowed by the formatPolicy in volumeContext:
+// a device with a partition table, or an LVM, LUKS or RAID signature is only formatted with the always policy,
+// which wipes the signatures, and a device without filesystem is never formatted with the never policy
+func (d *DriverCore) checkFormatPolicy(source string, volumeContext map[string]string) error {
+	policy, err := azureutils.GetFormatPolicy(volumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	signature, err := probeDevice(source, d.mounter)
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not probe %s: %v", source, err)
+	}
+	if signature == nil {
+		// devices are not probed on this platform
+		return nil
+	}
+
+	if layout := signature.foreignLayout(); layout != "" {
+		if policy != consts.FormatPolicyAlways {
+			hint := "set formatPolicy to always to wipe and format it"
+			if signature.ptType != "" {
+				hint = "select a partition with the partition attribute, or " + hint
+			}
+			return status.Errorf(codes.FailedPrecondition, "refusing to format %s which has %s, %s", source, layout, hint)
+		}
+		klog.Warningf("wiping %s on %s before it's formatted with formatPolicy %s", layout, source, policy)
+		if err := wipeDevice(source, d.mounter); err != nil {
+			return status.Errorf(codes.Internal, "could not wipe %s: %v", source, err)
+		}
+		return nil
+	}
+	if signature.fsType == "" && policy == consts.FormatPolicyNever {
+		return status.Errorf(codes.FailedPrecondition, "%s has no filesystem and formatPolicy is %s", source, policy)
+	}
+	return nil
+}
+
+// getPartitionSource returns the device of the partition of the disk source selected by partition, which is either
+// a partition number, or PARTLABEL=<name>, PARTUUID=<unique GUID> or LABEL=<filesystem label> of the partition
+func (d *DriverCore) getPartitionSource(source, partition string) (string, error) {
+	if _, err := strconv.Atoi(partition); err == nil {
+		return source + "-part" + partition, nil
+	}
+	key, value, ok := strings.Cut(partition, "=")
+	key = strings.ToUpper(strings.TrimSpace(key))
+	if !ok || value == "" || (key != partitionLabelKey && key != partitionUUIDKey && key != filesystemLabel) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid partition %q, supported values are a partition number, %s=<name>, %s=<GUID> and %s=<label>",
+			partition, partitionLabelKey, partitionUUIDKey, filesystemLabel)
+	}
+	partitionPath, err := findPartition(d.ioHandler, d.mounter, source, key, value)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "could not find partition %s on %s: %v", partition, source, err)
+	}
+	if partitionPath == "" {
+		return "", status.Errorf(codes.NotFound, "partition %s not found on %s", partition, source)
+	}
+	klog.V(2).Infof("found partition %s of %s by %s", partitionPath, source, partition)
+	return partitionPath, nil
+}
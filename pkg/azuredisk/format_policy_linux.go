@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+// blkid exits with 2 if nothing is found on the device
+const blkidExitNotFound = 2
+
+// probeDevice returns the signature of source probed by blkid, which is empty if nothing is found
+func probeDevice(source string, m *mount.SafeFormatAndMount) (*deviceSignature, error) {
+	values, err := blkidProbe(source, m, "-s", "TYPE", "-s", "PTTYPE", "-s", "USAGE")
+	if err != nil {
+		return nil, err
+	}
+	return &deviceSignature{fsType: values["TYPE"], ptType: values["PTTYPE"], usage: values["USAGE"]}, nil
+}
+
+// wipeDevice erases the signatures of filesystems, partition tables, LVM, LUKS and RAID on source
+func wipeDevice(source string, m *mount.SafeFormatAndMount) error {
+	if output, err := m.Exec.Command("wipefs", "--all", source).CombinedOutput(); err != nil {
+		return fmt.Errorf("wipefs failed with %v, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// blkidProbe returns the values of the low-level probe of source by blkid
+func blkidProbe(source string, m *mount.SafeFormatAndMount, args ...string) (map[string]string, error) {
+	args = append(append([]string{"-p"}, args...), "-o", "export", source)
+	output, err := m.Exec.Command("blkid", args...).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == blkidExitNotFound {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("blkid %v failed with %v, output: %s", args, err, string(output))
+	}
+	return parseBlkidExport(string(output)), nil
+}
+
+// parseBlkidExport parses the KEY=value lines of blkid -o export, where special characters of values are escaped
+func parseBlkidExport(output string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		var unescaped strings.Builder
+		for i := 0; i < len(value); i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			unescaped.WriteByte(value[i])
+		}
+		values[key] = unescaped.String()
+	}
+	return values
+}
+
+// findPartition returns the partition of the disk source whose GPT name(PARTLABEL), unique GUID(PARTUUID) or
+// filesystem label(LABEL) is value, or an empty string if no partition matches
+func findPartition(io azureutils.IOHandler, m *mount.SafeFormatAndMount, source, key, value string) (string, error) {
+	disk := filepath.Base(source)
+	if filepath.Dir(source) != "/dev" {
+		// udev link, e.g. /dev/disk/azure/scsi1/lun0 -> ../../../sdc
+		link, err := io.Readlink(source)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %v", source, err)
+		}
+		disk = filepath.Base(link)
+	}
+	diskPath := filepath.Join(sysClassBlockPath, disk)
+	entries, err := io.ReadDir(diskPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to list partitions of %s: %v", disk, err)
+	}
+
+	probeKey := map[string]string{
+		partitionLabelKey: "PART_ENTRY_NAME",
+		partitionUUIDKey:  "PART_ENTRY_UUID",
+		filesystemLabel:   "LABEL",
+	}[key]
+	var partitions []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, disk) {
+			continue
+		}
+		if _, err := io.ReadFile(filepath.Join(diskPath, name, "partition")); err != nil {
+			continue
+		}
+		values, err := blkidProbe("/dev/"+name, m)
+		if err != nil {
+			return "", err
+		}
+		probed := values[probeKey]
+		klog.V(6).Infof("partition %s has %s %q", name, probeKey, probed)
+		// GUIDs are compared case-insensitively, names and labels are case-sensitive
+		if probed == value || (key == partitionUUIDKey && strings.EqualFold(probed, value)) {
+			partitions = append(partitions, "/dev/"+name)
+		}
+	}
+	if len(partitions) > 1 {
+		return "", fmt.Errorf("%s=%s matches partitions %v", key, value, partitions)
+	}
+	if len(partitions) == 0 {
+		return "", nil
+	}
+	return partitions[0], nil
+}
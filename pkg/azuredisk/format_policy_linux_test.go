@@ -0,0 +1,178 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestParseBlkidExport(t *testing.T) {
+	values := parseBlkidExport("DEVNAME=/dev/sdc1\nLABEL=my\\ data\nPART_ENTRY_NAME=a\\=b\nTYPE=ext4\n\ninvalid\n")
+	assert.Equal(t, map[string]string{
+		"DEVNAME":         "/dev/sdc1",
+		"LABEL":           "my data",
+		"PART_ENTRY_NAME": "a=b",
+		"TYPE":            "ext4",
+	}, values)
+}
+
+func TestCheckFormatPolicy(t *testing.T) {
+	const probe = "blkid -p -s TYPE -s PTTYPE -s USAGE -o export /dev/sdc"
+	tests := []struct {
+		desc             string
+		policy           string
+		actions          []testingexec.FakeAction
+		expectedCommands []string
+		expectedCode     codes.Code
+	}{
+		{
+			desc:             "empty device is formatted by default",
+			actions:          []testingexec.FakeAction{exitAction("", 2)},
+			expectedCommands: []string{probe},
+		},
+		{
+			desc:             "filesystem is mounted",
+			policy:           "never",
+			actions:          []testingexec.FakeAction{exitAction("TYPE=ext4\nUSAGE=filesystem\n", 0)},
+			expectedCommands: []string{probe},
+		},
+		{
+			desc:             "empty device is not formatted with never policy",
+			policy:           "never",
+			actions:          []testingexec.FakeAction{exitAction("", 2)},
+			expectedCommands: []string{probe},
+			expectedCode:     codes.FailedPrecondition,
+		},
+		{
+			desc:             "partition table is not formatted by default",
+			actions:          []testingexec.FakeAction{exitAction("PTTYPE=gpt\n", 0)},
+			expectedCommands: []string{probe},
+			expectedCode:     codes.FailedPrecondition,
+		},
+		{
+			desc:             "LVM physical volume is not formatted with ifEmpty policy",
+			policy:           "ifEmpty",
+			actions:          []testingexec.FakeAction{exitAction("TYPE=LVM2_member\nUSAGE=raid\n", 0)},
+			expectedCommands: []string{probe},
+			expectedCode:     codes.FailedPrecondition,
+		},
+		{
+			desc:             "RAID member is wiped with always policy",
+			policy:           "always",
+			actions:          []testingexec.FakeAction{exitAction("TYPE=linux_raid_member\nUSAGE=raid\n", 0), exitAction("", 0)},
+			expectedCommands: []string{probe, "wipefs --all /dev/sdc"},
+		},
+		{
+			desc:             "wipe failure",
+			policy:           "always",
+			actions:          []testingexec.FakeAction{exitAction("TYPE=crypto_LUKS\nUSAGE=crypto\n", 0), exitAction("busy", 1)},
+			expectedCommands: []string{probe, "wipefs --all /dev/sdc"},
+			expectedCode:     codes.Internal,
+		},
+		{
+			desc:             "probe failure",
+			actions:          []testingexec.FakeAction{exitAction("", 4)},
+			expectedCommands: []string{probe},
+			expectedCode:     codes.Internal,
+		},
+		{
+			desc:         "invalid policy",
+			policy:       "sometimes",
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		var commands []string
+		d := &DriverCore{mounter: &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: newFakeCheckExec(&commands, test.actions...)}}
+		volumeContext := map[string]string{}
+		if test.policy != "" {
+			volumeContext[consts.FormatPolicyField] = test.policy
+		}
+		err := d.checkFormatPolicy("/dev/sdc", volumeContext)
+		assert.Equal(t, test.expectedCode, status.Code(err), "%s: %v", test.desc, err)
+		assert.Equal(t, test.expectedCommands, commands, test.desc)
+	}
+}
+
+func TestGetPartitionSource(t *testing.T) {
+	io := &fakeSysfsIOHandler{
+		dirs: map[string][]string{
+			"/sys/class/block/sdc": {"device", "holders", "queue", "sdc1", "sdc2", "sdc3"},
+		},
+		links: map[string]string{"/dev/disk/azure/scsi1/lun0": "../../../sdc"},
+		files: map[string]string{
+			"/sys/class/block/sdc/sdc1/partition": "1\n",
+			"/sys/class/block/sdc/sdc2/partition": "2\n",
+			"/sys/class/block/sdc/sdc3/partition": "3\n",
+		},
+	}
+	probes := func() []testingexec.FakeAction {
+		return []testingexec.FakeAction{
+			exitAction("PART_ENTRY_NAME=boot\nPART_ENTRY_UUID=0f1e2d3c-aaaa-bbbb-cccc-000000000001\n", 0),
+			exitAction("LABEL=my\\ data\nTYPE=ext4\nPART_ENTRY_NAME=data\nPART_ENTRY_UUID=0f1e2d3c-aaaa-bbbb-cccc-000000000002\n", 0),
+			exitAction("", 2),
+		}
+	}
+	tests := []struct {
+		partition    string
+		expected     string
+		expectedCode codes.Code
+	}{
+		{partition: "PARTLABEL=data", expected: "/dev/sdc2"},
+		{partition: "partuuid=0F1E2D3C-AAAA-BBBB-CCCC-000000000001", expected: "/dev/sdc1"},
+		{partition: "LABEL=my data", expected: "/dev/sdc2"},
+		{partition: "PARTLABEL=Data", expectedCode: codes.NotFound},
+	}
+	for _, test := range tests {
+		var commands []string
+		d := &DriverCore{
+			ioHandler: io,
+			mounter:   &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: newFakeCheckExec(&commands, probes()...)},
+		}
+		source, err := d.getPartitionSource("/dev/disk/azure/scsi1/lun0", test.partition)
+		assert.Equal(t, test.expectedCode, status.Code(err), "%s: %v", test.partition, err)
+		assert.Equal(t, test.expected, source, test.partition)
+		assert.Equal(t, []string{
+			"blkid -p -o export /dev/sdc1",
+			"blkid -p -o export /dev/sdc2",
+			"blkid -p -o export /dev/sdc3",
+		}, commands, test.partition)
+	}
+
+	// the label is on more than one partition
+	var commands []string
+	d := &DriverCore{
+		ioHandler: io,
+		mounter: &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: newFakeCheckExec(&commands,
+			exitAction("LABEL=data\n", 0), exitAction("LABEL=data\n", 0), exitAction("", 2))},
+	}
+	_, err := d.getPartitionSource("/dev/sdc", "LABEL=data")
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.ErrorContains(t, err, "matches partitions [/dev/sdc1 /dev/sdc2]")
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForeignLayout(t *testing.T) {
+	tests := []struct {
+		signature deviceSignature
+		expected  string
+	}{
+		{signature: deviceSignature{}, expected: ""},
+		{signature: deviceSignature{fsType: "ext4", usage: "filesystem"}, expected: ""},
+		{signature: deviceSignature{fsType: "xfs"}, expected: ""},
+		{signature: deviceSignature{ptType: "gpt"}, expected: "a gpt partition table"},
+		{signature: deviceSignature{fsType: "ext4", ptType: "dos", usage: "filesystem"}, expected: "a dos partition table"},
+		{signature: deviceSignature{fsType: "LVM2_member", usage: "raid"}, expected: "an LVM physical volume"},
+		{signature: deviceSignature{fsType: "crypto_LUKS", usage: "crypto"}, expected: "a LUKS header"},
+		{signature: deviceSignature{fsType: "linux_raid_member", usage: "raid"}, expected: "a RAID member signature(linux_raid_member)"},
+		{signature: deviceSignature{fsType: "isw_raid_member"}, expected: "a RAID member signature(isw_raid_member)"},
+		{signature: deviceSignature{fsType: "swap", usage: "other"}, expected: "a swap signature"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.signature.foreignLayout(), "%+v", test.signature)
+	}
+}
+
+func TestGetPartitionSourceByNumber(t *testing.T) {
+	d := &DriverCore{}
+	source, err := d.getPartitionSource("/dev/disk/azure/scsi1/lun0", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/scsi1/lun0-part2", source)
+
+	for _, partition := range []string{"data", "PARTLABEL=", "NAME=data", "-part1"} {
+		_, err := d.getPartitionSource("/dev/disk/azure/scsi1/lun0", partition)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), partition)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"runtime"
+
+	mount "k8s.io/mount-utils"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+// probeDevice doesn't probe devices on this platform, formatting is left to formatAndMount
+func probeDevice(_ string, _ *mount.SafeFormatAndMount) (*deviceSignature, error) {
+	return nil, nil
+}
+
+func wipeDevice(_ string, _ *mount.SafeFormatAndMount) error {
+	return fmt.Errorf("wiping devices is not supported on %s", runtime.GOOS)
+}
+
+func findPartition(_ azureutils.IOHandler, _ *mount.SafeFormatAndMount, _, key, _ string) (string, error) {
+	return "", fmt.Errorf("selecting partitions by %s is not supported on %s", key, runtime.GOOS)
+}
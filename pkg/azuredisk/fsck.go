@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	fsckCompletedReason = "FilesystemCheckCompleted"
+	fsckFailedReason    = "FilesystemCheckFailed"
+	// maxFsckEventOutput keeps the end of the check output within the size limit of an event message
+	maxFsckEventOutput = 512
+)
+
+var (
+	// errFsckUncorrected is returned when the filesystem has errors that need manual repair
+	errFsckUncorrected = errors.New("filesystem has errors that need manual repair")
+	// errFsckTimeout is returned when the filesystem check doesn't finish within fsckTimeout
+	errFsckTimeout = errors.New("filesystem check timed out")
+)
+
+// fsckAndMount checks the filesystem on source according to the fsckPolicy in volumeContext and mounts it at target,
+// returns false if the volume is left to formatAndMount, i.e. with the auto policy or if source is not formatted yet
+func (d *DriverCore) fsckAndMount(ctx context.Context, source, target, fstype string, options []string, volumeContext map[string]string) (bool, error) {
+	policy, timeout, err := azureutils.GetFsckPolicy(volumeContext)
+	if err != nil {
+		return false, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if policy == consts.FsckPolicyAuto {
+		return false, nil
+	}
+
+	start := time.Now()
+	mounted, output, err := fsckAndMount(ctx, source, target, fstype, options, policy, timeout, d.mounter)
+	if output != "" || err != nil {
+		d.recordFsckEvent(volumeContext, source, policy, time.Since(start), output, err)
+	}
+	switch {
+	case errors.Is(err, errFsckUncorrected):
+		return false, status.Errorf(codes.FailedPrecondition, "fsck(%s) on %s: %v, output: %s", policy, source, err, output)
+	case errors.Is(err, errFsckTimeout):
+		return false, status.Errorf(codes.DeadlineExceeded, "fsck(%s) on %s: %v", policy, source, err)
+	case err != nil:
+		return false, status.Errorf(codes.Internal, "fsck(%s) on %s failed: %v", policy, source, err)
+	}
+	return mounted, nil
+}
+
+// recordFsckEvent records the result of the filesystem check on the PV of the volume, or on the node if the PV is unknown
+func (d *DriverCore) recordFsckEvent(volumeContext map[string]string, source, policy string, duration time.Duration, output string, err error) {
+	if d.eventRecorder == nil {
+		return
+	}
+	object := nodeReference(d.NodeID)
+	if pvName := volumeContext[consts.PvNameKey]; pvName != "" {
+		object = &v1.ObjectReference{Kind: "PersistentVolume", Name: pvName}
+	}
+	if len(output) > maxFsckEventOutput {
+		output = "..." + output[len(output)-maxFsckEventOutput:]
+	}
+
+	if err != nil {
+		d.eventRecorder.Eventf(object, v1.EventTypeWarning, fsckFailedReason, "fsck(%s) on %s of node %s failed after %v: %v, output: %s",
+			policy, source, d.NodeID, duration.Round(time.Second), err, output)
+		return
+	}
+	klog.V(2).Infof("fsck(%s) on %s completed in %v, output: %s", policy, source, duration, output)
+	d.eventRecorder.Eventf(object, v1.EventTypeNormal, fsckCompletedReason, "fsck(%s) on %s of node %s completed in %v, output: %s",
+		policy, source, d.NodeID, duration.Round(time.Second), output)
+}
+
+// runCheckCommand runs a filesystem check command, returns its output and exit code
+func runCheckCommand(ctx context.Context, exec utilexec.Interface, cmd string, args ...string) (string, int, error) {
+	klog.V(2).Infof("running %s %v", cmd, args)
+	output, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return string(output), 0, fmt.Errorf("%w: %s %v", errFsckTimeout, cmd, args)
+	}
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(output), exitErr.ExitStatus(), nil
+		}
+		return string(output), 0, fmt.Errorf("%s %v failed: %v", cmd, args, err)
+	}
+	return string(output), 0, nil
+}
@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	// e2fsck exit codes
+	e2fsckErrorsCorrected       = 1
+	e2fsckErrorsCorrectedReboot = 2
+	e2fsckErrorsUncorrected     = 4
+	// xfs_repair exit codes
+	xfsRepairCorruptionFound = 1
+	xfsRepairDirtyLog        = 2
+)
+
+// fsckAndMount checks the filesystem on source according to policy within timeout and mounts it at target
+// without the implicit check of FormatAndMount, returns false if source is not formatted yet
+func fsckAndMount(ctx context.Context, source, target, fstype string, options []string, policy string, timeout time.Duration, m *mount.SafeFormatAndMount) (bool, string, error) {
+	existingFormat, err := m.GetDiskFormat(source)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get disk format of %s: %v", source, err)
+	}
+	if existingFormat == "" {
+		return false, "", nil
+	}
+	if fstype != existingFormat {
+		klog.Warningf("configured to mount disk %s as %s but current format is %s", source, fstype, existingFormat)
+	}
+
+	var output string
+	if policy != consts.FsckPolicyNever {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if output, err = runFsck(ctx, source, existingFormat, policy, m.Exec); err != nil {
+			return false, output, err
+		}
+	}
+
+	klog.V(2).Infof("mounting %s at %s with fsck policy %s", source, target, policy)
+	if err := m.Mount(source, target, fstype, append(options, "defaults")); err != nil {
+		return false, output, err
+	}
+	return true, output, nil
+}
+
+// runFsck runs e2fsck or xfs_repair on source, errors are repaired without confirmation only with repairOnError policy
+func runFsck(ctx context.Context, source, format, policy string, exec utilexec.Interface) (string, error) {
+	switch format {
+	case "ext2", "ext3", "ext4":
+		// preen mode only fixes problems that can be safely fixed without human intervention,
+		// -f checks filesystems marked clean too, which would be skipped otherwise
+		output, code, err := runCheckCommand(ctx, exec, "e2fsck", "-p", "-f", source)
+		if err != nil {
+			return output, err
+		}
+		if code&e2fsckErrorsUncorrected != 0 && policy == consts.FsckPolicyRepairOnError {
+			klog.Warningf("e2fsck found errors on %s which can't be fixed in preen mode, repairing", source)
+			var repairOutput string
+			repairOutput, code, err = runCheckCommand(ctx, exec, "e2fsck", "-y", source)
+			output += repairOutput
+			if err != nil {
+				return output, err
+			}
+		}
+		switch {
+		case code&e2fsckErrorsUncorrected != 0:
+			return output, fmt.Errorf("%w: e2fsck exit code %d", errFsckUncorrected, code)
+		case code&^(e2fsckErrorsCorrected|e2fsckErrorsCorrectedReboot) != 0:
+			return output, fmt.Errorf("e2fsck on %s failed with exit code %d", source, code)
+		case code != 0:
+			klog.Infof("e2fsck corrected errors on %s", source)
+		}
+		return output, nil
+	case "xfs":
+		// xfs_repair doesn't fix anything with -n
+		output, code, err := runCheckCommand(ctx, exec, "xfs_repair", "-n", source)
+		if err != nil {
+			return output, err
+		}
+		if code == xfsRepairCorruptionFound && policy == consts.FsckPolicyRepairOnError {
+			klog.Warningf("xfs_repair found corruption on %s, repairing", source)
+			var repairOutput string
+			repairOutput, code, err = runCheckCommand(ctx, exec, "xfs_repair", source)
+			output += repairOutput
+			if err != nil {
+				return output, err
+			}
+		}
+		switch code {
+		case 0:
+			return output, nil
+		case xfsRepairDirtyLog:
+			// the log is replayed when the filesystem is mounted, which is the usual case after a node crash
+			klog.Warningf("xfs log on %s needs to be replayed, the filesystem is checked when it's mounted", source)
+			return output, nil
+		case xfsRepairCorruptionFound:
+			return output, fmt.Errorf("%w: xfs_repair exit code %d", errFsckUncorrected, code)
+		default:
+			return output, fmt.Errorf("xfs_repair on %s failed with exit code %d", source, code)
+		}
+	default:
+		klog.Warningf("fsck of %s filesystem on %s is not supported, skip it", format, source)
+		return "", nil
+	}
+}
@@ -0,0 +1,231 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	mount "k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func exitAction(output string, code int) testingexec.FakeAction {
+	return func() ([]byte, []byte, error) {
+		if code == 0 {
+			return []byte(output), nil, nil
+		}
+		return []byte(output), nil, testingexec.FakeExitError{Status: code}
+	}
+}
+
+func TestRunFsck(t *testing.T) {
+	tests := []struct {
+		desc             string
+		format           string
+		policy           string
+		actions          []testingexec.FakeAction
+		expectedCommands []string
+		expectedErr      error
+	}{
+		{
+			desc:             "clean ext4",
+			format:           "ext4",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("clean", 0)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc"},
+		},
+		{
+			desc:             "ext4 errors corrected in preen mode",
+			format:           "ext4",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("fixed", 3)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc"},
+		},
+		{
+			desc:             "ext4 errors need manual repair",
+			format:           "ext4",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("UNEXPECTED INCONSISTENCY; RUN fsck MANUALLY.", 4)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc"},
+			expectedErr:      errFsckUncorrected,
+		},
+		{
+			desc:             "ext4 errors repaired",
+			format:           "ext3",
+			policy:           consts.FsckPolicyRepairOnError,
+			actions:          []testingexec.FakeAction{exitAction("UNEXPECTED INCONSISTENCY", 4), exitAction("FILE SYSTEM WAS MODIFIED", 1)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc", "e2fsck -y /dev/sdc"},
+		},
+		{
+			desc:             "ext4 errors not repaired",
+			format:           "ext4",
+			policy:           consts.FsckPolicyRepairOnError,
+			actions:          []testingexec.FakeAction{exitAction("UNEXPECTED INCONSISTENCY", 4), exitAction("still broken", 5)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc", "e2fsck -y /dev/sdc"},
+			expectedErr:      errFsckUncorrected,
+		},
+		{
+			desc:             "e2fsck operational error",
+			format:           "ext4",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("device busy", 8)},
+			expectedCommands: []string{"e2fsck -p -f /dev/sdc"},
+			expectedErr:      errors.New("e2fsck on /dev/sdc failed with exit code 8"),
+		},
+		{
+			desc:             "clean xfs",
+			format:           "xfs",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("", 0)},
+			expectedCommands: []string{"xfs_repair -n /dev/sdc"},
+		},
+		{
+			desc:             "xfs corruption needs manual repair",
+			format:           "xfs",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("corruption", 1)},
+			expectedCommands: []string{"xfs_repair -n /dev/sdc"},
+			expectedErr:      errFsckUncorrected,
+		},
+		{
+			desc:             "xfs corruption repaired",
+			format:           "xfs",
+			policy:           consts.FsckPolicyRepairOnError,
+			actions:          []testingexec.FakeAction{exitAction("corruption", 1), exitAction("done", 0)},
+			expectedCommands: []string{"xfs_repair -n /dev/sdc", "xfs_repair /dev/sdc"},
+		},
+		{
+			desc:             "xfs dirty log is replayed on mount",
+			format:           "xfs",
+			policy:           consts.FsckPolicyAlways,
+			actions:          []testingexec.FakeAction{exitAction("log needs replay", 2)},
+			expectedCommands: []string{"xfs_repair -n /dev/sdc"},
+		},
+		{
+			desc:   "unsupported filesystem",
+			format: "btrfs",
+			policy: consts.FsckPolicyAlways,
+		},
+	}
+
+	for _, test := range tests {
+		var commands []string
+		fakeExec := newFakeCheckExec(&commands, test.actions...)
+		_, err := runFsck(context.Background(), "/dev/sdc", test.format, test.policy, fakeExec)
+		switch {
+		case test.expectedErr == nil:
+			assert.NoError(t, err, test.desc)
+		case errors.Is(test.expectedErr, errFsckUncorrected):
+			assert.True(t, errors.Is(err, errFsckUncorrected), test.desc)
+		default:
+			assert.EqualError(t, err, test.expectedErr.Error(), test.desc)
+		}
+		assert.Equal(t, test.expectedCommands, commands, test.desc)
+	}
+}
+
+func TestFsckAndMount(t *testing.T) {
+	blkidExt4 := exitAction("DEVICE=/dev/sdc\nTYPE=ext4", 0)
+	blkidUnformatted := exitAction("", 2)
+
+	tests := []struct {
+		desc             string
+		volumeContext    map[string]string
+		actions          []testingexec.FakeAction
+		expectedMounted  bool
+		expectedCommands []string
+		expectedCode     codes.Code
+		expectedEvent    bool
+	}{
+		{
+			desc:          "auto policy is left to FormatAndMount",
+			volumeContext: map[string]string{},
+		},
+		{
+			desc:          "invalid policy",
+			volumeContext: map[string]string{"fsckPolicy": "sometimes"},
+			expectedCode:  codes.InvalidArgument,
+		},
+		{
+			desc:             "unformatted disk is left to FormatAndMount",
+			volumeContext:    map[string]string{"fsckPolicy": "always"},
+			actions:          []testingexec.FakeAction{blkidUnformatted},
+			expectedCommands: []string{"blkid -p -s TYPE -s PTTYPE -o export /dev/sdc"},
+		},
+		{
+			desc:             "never check",
+			volumeContext:    map[string]string{"fsckPolicy": "never"},
+			actions:          []testingexec.FakeAction{blkidExt4},
+			expectedMounted:  true,
+			expectedCommands: []string{"blkid -p -s TYPE -s PTTYPE -o export /dev/sdc"},
+		},
+		{
+			desc:             "always check",
+			volumeContext:    map[string]string{"fsckPolicy": "Always", "fsckTimeout": "1m"},
+			actions:          []testingexec.FakeAction{blkidExt4, exitAction("clean", 0)},
+			expectedMounted:  true,
+			expectedCommands: []string{"blkid -p -s TYPE -s PTTYPE -o export /dev/sdc", "e2fsck -p -f /dev/sdc"},
+			expectedEvent:    true,
+		},
+		{
+			desc:             "manual repair needed",
+			volumeContext:    map[string]string{"fsckPolicy": "always"},
+			actions:          []testingexec.FakeAction{blkidExt4, exitAction("RUN fsck MANUALLY", 4)},
+			expectedCommands: []string{"blkid -p -s TYPE -s PTTYPE -o export /dev/sdc", "e2fsck -p -f /dev/sdc"},
+			expectedCode:     codes.FailedPrecondition,
+			expectedEvent:    true,
+		},
+	}
+
+	for _, test := range tests {
+		var commands []string
+		recorder := record.NewFakeRecorder(10)
+		d := &DriverCore{
+			mounter:       &mount.SafeFormatAndMount{Interface: &mounter.FakeSafeMounter{}, Exec: newFakeCheckExec(&commands, test.actions...)},
+			eventRecorder: recorder,
+		}
+		mounted, err := d.fsckAndMount(context.Background(), "/dev/sdc", "/tmp/staging", "ext4", nil, test.volumeContext)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+		assert.Equal(t, test.expectedMounted, mounted, test.desc)
+		assert.Equal(t, test.expectedCommands, commands, test.desc)
+		assert.Equal(t, test.expectedEvent, len(recorder.Events) > 0, test.desc)
+	}
+}
+
+func TestFsckTimeout(t *testing.T) {
+	var commands []string
+	m := &mount.SafeFormatAndMount{
+		Interface: &mounter.FakeSafeMounter{},
+		Exec:      newFakeCheckExec(&commands, exitAction("DEVICE=/dev/sdc\nTYPE=ext4", 0), exitAction("", 0)),
+	}
+	mounted, _, err := fsckAndMount(context.Background(), "/dev/sdc", "/tmp/staging", "ext4", nil, consts.FsckPolicyAlways, time.Nanosecond, m)
+	assert.True(t, errors.Is(err, errFsckTimeout))
+	assert.False(t, mounted)
+}
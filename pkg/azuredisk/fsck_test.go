@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+// newFakeCheckExec returns a FakeExec running actions in order, the command lines run are appended to commands
+func newFakeCheckExec(commands *[]string, actions ...testingexec.FakeAction) *testingexec.FakeExec {
+	fakeExec := &testingexec.FakeExec{ExactOrder: true}
+	for _, action := range actions {
+		action := action
+		fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			*commands = append(*commands, strings.Join(append([]string{cmd}, args...), " "))
+			fakeCmd := &testingexec.FakeCmd{
+				OutputScript:         []testingexec.FakeAction{action},
+				CombinedOutputScript: []testingexec.FakeAction{action},
+			}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return fakeExec
+}
+
+func TestRunCheckCommand(t *testing.T) {
+	var commands []string
+	fakeExec := newFakeCheckExec(&commands,
+		func() ([]byte, []byte, error) { return []byte("clean"), nil, nil },
+		func() ([]byte, []byte, error) { return []byte("errors"), nil, testingexec.FakeExitError{Status: 4} },
+		func() ([]byte, []byte, error) { return nil, nil, fmt.Errorf("executable file not found") },
+		func() ([]byte, []byte, error) { return nil, nil, nil },
+	)
+
+	output, code, err := runCheckCommand(context.Background(), fakeExec, "e2fsck", "-p", "/dev/sdc")
+	assert.NoError(t, err)
+	assert.Equal(t, "clean", output)
+	assert.Equal(t, 0, code)
+
+	output, code, err = runCheckCommand(context.Background(), fakeExec, "e2fsck", "-p", "/dev/sdc")
+	assert.NoError(t, err)
+	assert.Equal(t, "errors", output)
+	assert.Equal(t, 4, code)
+
+	_, _, err = runCheckCommand(context.Background(), fakeExec, "e2fsck", "-p", "/dev/sdc")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, errFsckTimeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, _, err = runCheckCommand(ctx, fakeExec, "e2fsck", "-p", "/dev/sdc")
+	assert.True(t, errors.Is(err, errFsckTimeout))
+	assert.Equal(t, []string{"e2fsck -p /dev/sdc", "e2fsck -p /dev/sdc", "e2fsck -p /dev/sdc", "e2fsck -p /dev/sdc"}, commands)
+}
+
+func TestRecordFsckEvent(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	d := &DriverCore{eventRecorder: recorder}
+	d.NodeID = "node1"
+
+	d.recordFsckEvent(map[string]string{consts.PvNameKey: "pv1"}, "/dev/sdc", consts.FsckPolicyAlways, time.Second, "clean", nil)
+	event := <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Normal FilesystemCheckCompleted fsck(always) on /dev/sdc of node node1 completed in 1s"), event)
+
+	d.recordFsckEvent(nil, "/dev/sdc", consts.FsckPolicyAlways, time.Second, strings.Repeat("x", 2*maxFsckEventOutput), errFsckUncorrected)
+	event = <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Warning FilesystemCheckFailed fsck(always) on /dev/sdc of node node1 failed after 1s"), event)
+	assert.True(t, strings.HasSuffix(event, "output: ..."+strings.Repeat("x", maxFsckEventOutput)), "output is truncated")
+
+	// no recorder without kubeClient
+	d.eventRecorder = nil
+	d.recordFsckEvent(nil, "/dev/sdc", consts.FsckPolicyAlways, time.Second, "clean", nil)
+}
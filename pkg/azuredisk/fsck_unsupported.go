@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	mount "k8s.io/mount-utils"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+// fsckAndMount leaves the volume to formatAndMount, only the never policy is accepted on this platform
+func fsckAndMount(_ context.Context, _, _, _ string, _ []string, policy string, _ time.Duration, _ *mount.SafeFormatAndMount) (bool, string, error) {
+	if policy == consts.FsckPolicyNever {
+		return false, "", nil
+	}
+	return false, "", fmt.Errorf("fsckPolicy %s is not supported on %s", policy, runtime.GOOS)
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// FstrimHookPath is the path of the endpoint trimming a staged volume on demand, e.g. before it's snapshotted
+	FstrimHookPath = "/fstrim"
+
+	fstrimIOPriorityIdle       = "idle"
+	fstrimIOPriorityBestEffort = "best-effort"
+	fstrimIOPriorityNone       = "none"
+
+	// fstrimCheckInterval is how often the scheduler looks for volumes due for fstrim
+	fstrimCheckInterval = time.Minute
+)
+
+var (
+	// the scheduler of the running node plugin, served on FstrimHookPath
+	defaultFstrimScheduler atomic.Pointer[fstrimScheduler]
+
+	errFstrimVolumeNotFound = errors.New("volume is not staged on this node")
+	errFstrimDisabled       = errors.New("fstrim is disabled for the volume")
+)
+
+// FstrimResult is the result of an on-demand fstrim served on FstrimHookPath
+type FstrimResult struct {
+	VolumeID     string `json:"volumeID"`
+	StagingPath  string `json:"stagingPath"`
+	TrimmedBytes uint64 `json:"trimmedBytes"`
+}
+
+type fstrimVolume struct {
+	// mu is held while the volume is trimmed so that unstaging waits for it
+	mu          sync.Mutex
+	stagingPath string
+	enabled     bool
+	nextTrim    time.Time
+	removed     bool
+}
+
+// fstrimScheduler discards the unused blocks of the filesystems of staged volumes periodically and on demand
+type fstrimScheduler struct {
+	driverName       string
+	interval         time.Duration
+	jitter           time.Duration
+	ioPriorityClass  string
+	volumesByDefault bool
+	// trim discards the unused blocks of the filesystem mounted at path and returns the number of bytes discarded
+	trim func(path, ioPriorityClass string) (uint64, error)
+	// stagedVolumes returns the staging paths by volume ID of the volumes of the driver mounted on the node
+	stagedVolumes func(driverName string) (map[string]string, error)
+	now           func() time.Time
+
+	// trimLock makes sure at most one volume is trimmed at a time
+	trimLock sync.Mutex
+	lock     sync.Mutex
+	volumes  map[string]*fstrimVolume
+}
+
+func newFstrimScheduler(driverName string, interval, jitter time.Duration, ioPriorityClass string, volumesByDefault bool) (*fstrimScheduler, error) {
+	switch ioPriorityClass {
+	case "":
+		ioPriorityClass = fstrimIOPriorityIdle
+	case fstrimIOPriorityIdle, fstrimIOPriorityBestEffort, fstrimIOPriorityNone:
+	default:
+		return nil, fmt.Errorf("fstrim I/O priority class %s is not supported, supported classes are %s, %s and %s",
+			ioPriorityClass, fstrimIOPriorityIdle, fstrimIOPriorityBestEffort, fstrimIOPriorityNone)
+	}
+	registerMetrics()
+	return &fstrimScheduler{
+		driverName:       driverName,
+		interval:         interval,
+		jitter:           jitter,
+		ioPriorityClass:  ioPriorityClass,
+		volumesByDefault: volumesByDefault,
+		trim:             trimFilesystem,
+		stagedVolumes:    findStagedVolumes,
+		now:              time.Now,
+		volumes:          map[string]*fstrimVolume{},
+	}, nil
+}
+
+func (d *DriverCore) setupFstrimScheduler(options *DriverOptions) {
+	fstrim, err := newFstrimScheduler(d.Name, time.Duration(options.FstrimIntervalInSec)*time.Second,
+		time.Duration(options.FstrimJitterInSec)*time.Second, options.FstrimIOPriorityClass, options.FstrimVolumesByDefault)
+	if err != nil {
+		klog.Fatalf("failed to create fstrim scheduler: %v", err)
+	}
+	d.fstrim = fstrim
+	defaultFstrimScheduler.Store(d.fstrim)
+}
+
+// register adds the filesystem volume staged at stagingPath, the volume is trimmed unless fstrim is disabled in
+// volumeContext
+func (s *fstrimScheduler) register(volumeID, stagingPath string, volumeContext map[string]string) {
+	if s == nil {
+		return
+	}
+	enabled, err := azureutils.IsFstrimEnabled(volumeContext, s.volumesByDefault)
+	if err != nil {
+		klog.Warningf("fstrim: %v, volume %s is not trimmed", err, volumeID)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.volumes[volumeID]; ok && v.stagingPath == stagingPath && v.enabled == enabled {
+		return
+	}
+	s.volumes[volumeID] = &fstrimVolume{stagingPath: stagingPath, enabled: enabled, nextTrim: s.nextTrim()}
+	klog.V(4).Infof("fstrim: registered volume %s staged at %s, enabled(%v)", volumeID, stagingPath, enabled)
+}
+
+// unregister removes the volume before it's unstaged, waiting for a running fstrim of the volume to complete
+func (s *fstrimScheduler) unregister(volumeID string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	v, ok := s.volumes[volumeID]
+	if ok {
+		v.removed = true
+		delete(s.volumes, volumeID)
+	}
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fstrimTrimmedBytes.DeleteLabelValues(volumeID)
+	fstrimOperations.DeleteLabelValues(volumeID, "succeeded")
+	fstrimOperations.DeleteLabelValues(volumeID, "failed")
+	klog.V(4).Infof("fstrim: unregistered volume %s", volumeID)
+}
+
+// nextTrim returns when a volume trimmed or registered now is due for the next periodic fstrim
+func (s *fstrimScheduler) nextTrim() time.Time {
+	next := s.now().Add(s.interval)
+	if s.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+	return next
+}
+
+// Run adds the volumes staged before the driver started and trims volumes on schedule until ctx is done
+func (s *fstrimScheduler) Run(ctx context.Context) {
+	if staged, err := s.stagedVolumes(s.driverName); err != nil {
+		klog.Warningf("fstrim: failed to find staged volumes, volumes staged before the driver started are not trimmed until they are staged again: %v", err)
+	} else {
+		s.lock.Lock()
+		for volumeID, stagingPath := range staged {
+			if _, ok := s.volumes[volumeID]; !ok {
+				// the volume context of a volume staged before the driver started is unknown
+				s.volumes[volumeID] = &fstrimVolume{stagingPath: stagingPath, enabled: s.volumesByDefault, nextTrim: s.nextTrim()}
+				klog.V(2).Infof("fstrim: found volume %s staged at %s, enabled(%v)", volumeID, stagingPath, s.volumesByDefault)
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	if s.interval <= 0 {
+		klog.V(2).Infof("fstrim: periodic fstrim is disabled, volumes are only trimmed on demand")
+		return
+	}
+	klog.V(2).Infof("fstrim: starting periodic fstrim with interval(%v), jitter(%v), ioPriorityClass(%s)", s.interval, s.jitter, s.ioPriorityClass)
+	wait.UntilWithContext(ctx, s.trimDueVolumes, fstrimCheckInterval)
+}
+
+// trimDueVolumes trims the enabled volumes whose periodic fstrim is due
+func (s *fstrimScheduler) trimDueVolumes(ctx context.Context) {
+	now := s.now()
+	var due []string
+	s.lock.Lock()
+	for volumeID, v := range s.volumes {
+		if v.enabled && !now.Before(v.nextTrim) {
+			due = append(due, volumeID)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, volumeID := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := s.trimVolume(volumeID); err != nil && !errors.Is(err, errFstrimVolumeNotFound) {
+			klog.Warningf("fstrim: %v", err)
+		}
+	}
+}
+
+// trimVolume trims the staged volume now and schedules its next periodic fstrim
+func (s *fstrimScheduler) trimVolume(volumeID string) (*FstrimResult, error) {
+	s.trimLock.Lock()
+	defer s.trimLock.Unlock()
+
+	s.lock.Lock()
+	v, ok := s.volumes[volumeID]
+	s.lock.Unlock()
+	if !ok {
+		return nil, errFstrimVolumeNotFound
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s.lock.Lock()
+	removed, enabled, stagingPath := v.removed, v.enabled, v.stagingPath
+	s.lock.Unlock()
+	if removed {
+		return nil, errFstrimVolumeNotFound
+	}
+	if !enabled {
+		return nil, errFstrimDisabled
+	}
+
+	start := s.now()
+	trimmed, err := s.trim(stagingPath, s.ioPriorityClass)
+	s.lock.Lock()
+	v.nextTrim = s.nextTrim()
+	s.lock.Unlock()
+	if err != nil {
+		fstrimOperations.WithLabelValues(volumeID, "failed").Inc()
+		return nil, fmt.Errorf("fstrim of volume %s staged at %s failed: %w", volumeID, stagingPath, err)
+	}
+	fstrimOperations.WithLabelValues(volumeID, "succeeded").Inc()
+	fstrimTrimmedBytes.WithLabelValues(volumeID).Add(float64(trimmed))
+	klog.V(2).Infof("fstrim: trimmed %d bytes of volume %s staged at %s in %v", trimmed, volumeID, stagingPath, s.now().Sub(start))
+	return &FstrimResult{VolumeID: volumeID, StagingPath: stagingPath, TrimmedBytes: trimmed}, nil
+}
+
+// ListenFstrimHook listens on endpoint serving FstrimHookHandler, which is not authenticated: endpoint must be
+// a unix socket, only accessible by root, or a TCP address bound to the loopback interface of the node
+func ListenFstrimHook(ctx context.Context, endpoint string) (net.Listener, error) {
+	return listenLocalEndpoint(ctx, endpoint)
+}
+
+// FstrimHookHandler trims the volume in the volumeID query parameter of a POST request now and returns the bytes
+// trimmed as JSON, it's meant to be called before the volume is snapshotted
+func FstrimHookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		s := defaultFstrimScheduler.Load()
+		if s == nil {
+			http.Error(w, "fstrim is only available on node", http.StatusNotFound)
+			return
+		}
+		volumeID := r.URL.Query().Get("volumeID")
+		if volumeID == "" {
+			http.Error(w, "volumeID not provided", http.StatusBadRequest)
+			return
+		}
+		result, err := s.trimVolume(volumeID)
+		switch {
+		case errors.Is(err, errFstrimVolumeNotFound):
+			http.Error(w, fmt.Sprintf("volume %s is not staged on this node", volumeID), http.StatusNotFound)
+			return
+		case errors.Is(err, errFstrimDisabled):
+			http.Error(w, fmt.Sprintf("fstrim is disabled for volume %s", volumeID), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			klog.Errorf("failed to encode fstrim result: %v", err)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// FITRIM is _IOWR('X', 121, struct fstrim_range)
+	fitrimIoctl = 0xc0185879
+
+	ioprioWhoProcess      = 1
+	ioprioClassShift      = 13
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+	// lowest priority within the best-effort class
+	ioprioBestEffortLowest = 7
+
+	// kubelet writes the driver and the volume handle of a staged volume in this file next to the staging path
+	kubeletVolumeDataFile = "vol_data.json"
+)
+
+// fstrimRange is struct fstrim_range of linux/fs.h
+type fstrimRange struct {
+	start  uint64
+	length uint64
+	minLen uint64
+}
+
+// trimFilesystem runs FITRIM on the filesystem mounted at path with the I/O priority of ioPriorityClass
+func trimFilesystem(path, ioPriorityClass string) (uint64, error) {
+	type result struct {
+		trimmed uint64
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// the I/O priority is set on the thread, which is terminated with the goroutine instead of being reused
+		runtime.LockOSThread()
+		if err := setThreadIOPriority(ioPriorityClass); err != nil {
+			ch <- result{err: err}
+			return
+		}
+		trimmed, err := fitrim(path)
+		ch <- result{trimmed: trimmed, err: err}
+	}()
+	r := <-ch
+	return r.trimmed, r.err
+}
+
+// setThreadIOPriority sets the I/O scheduling class of the calling thread
+func setThreadIOPriority(ioPriorityClass string) error {
+	var prio uintptr
+	switch ioPriorityClass {
+	case fstrimIOPriorityIdle:
+		prio = ioprioClassIdle << ioprioClassShift
+	case fstrimIOPriorityBestEffort:
+		prio = ioprioClassBestEffort<<ioprioClassShift | ioprioBestEffortLowest
+	default:
+		return nil
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); errno != 0 {
+		return fmt.Errorf("failed to set I/O priority class %s: %v", ioPriorityClass, errno)
+	}
+	return nil
+}
+
+// fitrim discards the unused blocks of the filesystem mounted at path and returns the number of bytes discarded
+func fitrim(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := fstrimRange{length: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fitrimIoctl, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return 0, fmt.Errorf("FITRIM ioctl on %s failed: %v", path, errno)
+	}
+	// the kernel returns the number of bytes discarded in length
+	return r.length, nil
+}
+
+// findStagedVolumes returns the staging paths by volume ID of the filesystems of the driver mounted read-write
+func findStagedVolumes(driverName string) (map[string]string, error) {
+	return findStagedVolumesInMountInfo(mountInfoPath, driverName)
+}
+
+func findStagedVolumesInMountInfo(mountInfoPath, driverName string) (map[string]string, error) {
+	mountInfos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]string{}
+	for _, mi := range mountInfos {
+		if filepath.Base(mi.MountPoint) != "globalmount" || hasOption(mi.MountOptions, "ro") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(mi.MountPoint), kubeletVolumeDataFile))
+		if err != nil {
+			continue
+		}
+		var volData struct {
+			DriverName   string `json:"driverName"`
+			VolumeHandle string `json:"volumeHandle"`
+		}
+		if err := json.Unmarshal(data, &volData); err != nil {
+			klog.V(4).Infof("failed to parse %s of %s: %v", kubeletVolumeDataFile, mi.MountPoint, err)
+			continue
+		}
+		if volData.DriverName == driverName && volData.VolumeHandle != "" {
+			volumes[volData.VolumeHandle] = mi.MountPoint
+		}
+	}
+	return volumes, nil
+}
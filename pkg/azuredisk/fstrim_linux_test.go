@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindStagedVolumesInMountInfo(t *testing.T) {
+	kubeletDir := t.TempDir()
+	stagingPath := func(name string) string {
+		return filepath.Join(kubeletDir, "plugins/kubernetes.io/csi", fakeDriverName, name, "globalmount")
+	}
+	volumes := map[string]string{
+		"vol-1": `{"driverName":"disk.csi.azure.com","volumeHandle":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-1"}`,
+		"vol-2": `{"driverName":"file.csi.azure.com","volumeHandle":"share-2"}`,
+		"vol-3": `{"driverName":"disk.csi.azure.com","volumeHandle":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-3"}`,
+		"vol-4": `not json`,
+	}
+	for name, data := range volumes {
+		assert.NoError(t, os.MkdirAll(stagingPath(name), 0750))
+		assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(stagingPath(name)), kubeletVolumeDataFile), []byte(data), 0600))
+	}
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfo, []byte(fmt.Sprintf(`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+301 22 8:32 / %s rw,relatime shared:2 - ext4 /dev/sdc rw
+302 22 0:52 / %s rw,relatime shared:3 - cifs //account/share-2 rw
+303 22 8:48 / %s ro,relatime shared:4 - ext4 /dev/sdd ro
+304 22 8:64 / %s rw,relatime shared:5 - ext4 /dev/sde rw
+305 22 8:80 / %s rw,relatime shared:6 - ext4 /dev/sdf rw
+`, stagingPath("vol-1"), stagingPath("vol-2"), stagingPath("vol-3"), stagingPath("vol-4"), stagingPath("vol-5"))), 0600))
+
+	staged, err := findStagedVolumesInMountInfo(mountInfo, fakeDriverName)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-1": stagingPath("vol-1"),
+	}, staged)
+
+	_, err = findStagedVolumesInMountInfo(filepath.Join(t.TempDir(), "missing"), fakeDriverName)
+	assert.Error(t, err)
+}
+
+func TestTrimFilesystem(t *testing.T) {
+	_, err := trimFilesystem(filepath.Join(t.TempDir(), "missing"), fstrimIOPriorityNone)
+	assert.Error(t, err)
+}
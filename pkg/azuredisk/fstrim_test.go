@@ -0,0 +1,239 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFstrimScheduler returns a scheduler without jitter whose trims are recorded in trimmed by staging path
+func newTestFstrimScheduler(t *testing.T, now *time.Time, trimmed map[string]int) *fstrimScheduler {
+	s, err := newFstrimScheduler(fakeDriverName, time.Hour, 0, fstrimIOPriorityIdle, true)
+	assert.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	s.trim = func(path, ioPriorityClass string) (uint64, error) {
+		assert.Equal(t, fstrimIOPriorityIdle, ioPriorityClass)
+		if path == "/failing" {
+			return 0, fmt.Errorf("discard not supported")
+		}
+		trimmed[path]++
+		return 4096, nil
+	}
+	s.stagedVolumes = func(string) (map[string]string, error) { return nil, nil }
+	return s
+}
+
+func TestNewFstrimScheduler(t *testing.T) {
+	s, err := newFstrimScheduler(fakeDriverName, time.Hour, time.Minute, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, fstrimIOPriorityIdle, s.ioPriorityClass)
+
+	_, err = newFstrimScheduler(fakeDriverName, time.Hour, time.Minute, "realtime", true)
+	assert.EqualError(t, err, "fstrim I/O priority class realtime is not supported, supported classes are idle, best-effort and none")
+}
+
+func TestFstrimSchedulerNextTrim(t *testing.T) {
+	now := time.Now()
+	s := newTestFstrimScheduler(t, &now, map[string]int{})
+	s.jitter = time.Minute
+	for i := 0; i < 10; i++ {
+		next := s.nextTrim()
+		assert.False(t, next.Before(now.Add(time.Hour)))
+		assert.True(t, next.Before(now.Add(time.Hour+time.Minute)))
+	}
+}
+
+func TestFstrimSchedulerRegister(t *testing.T) {
+	var nilScheduler *fstrimScheduler
+	nilScheduler.register("vol", "/staging", nil)
+	nilScheduler.unregister("vol")
+
+	now := time.Now()
+	s := newTestFstrimScheduler(t, &now, map[string]int{})
+	s.register("vol-1", "/staging-1", nil)
+	s.register("vol-2", "/staging-2", map[string]string{"fstrim": "false"})
+	s.register("vol-3", "/staging-3", map[string]string{"fstrim": "weekly"})
+	assert.True(t, s.volumes["vol-1"].enabled)
+	assert.False(t, s.volumes["vol-2"].enabled)
+	assert.False(t, s.volumes["vol-3"].enabled)
+	assert.Equal(t, now.Add(time.Hour), s.volumes["vol-1"].nextTrim)
+
+	// registering a volume again on restage keeps its schedule
+	now = now.Add(time.Minute)
+	s.register("vol-1", "/staging-1", nil)
+	assert.Equal(t, now.Add(-time.Minute).Add(time.Hour), s.volumes["vol-1"].nextTrim)
+
+	s.volumesByDefault = false
+	s.register("vol-4", "/staging-4", nil)
+	s.register("vol-5", "/staging-5", map[string]string{"fsTrim": "True"})
+	assert.False(t, s.volumes["vol-4"].enabled)
+	assert.True(t, s.volumes["vol-5"].enabled)
+
+	s.unregister("vol-1")
+	s.unregister("vol-missing")
+	assert.NotContains(t, s.volumes, "vol-1")
+	assert.Len(t, s.volumes, 4)
+}
+
+func TestFstrimSchedulerTrimDueVolumes(t *testing.T) {
+	now := time.Now()
+	trimmed := map[string]int{}
+	s := newTestFstrimScheduler(t, &now, trimmed)
+	s.register("vol-1", "/staging-1", nil)
+	s.register("vol-2", "/staging-2", map[string]string{"fstrim": "false"})
+	s.register("vol-3", "/failing", nil)
+
+	now = now.Add(30 * time.Minute)
+	s.trimDueVolumes(context.Background())
+	assert.Empty(t, trimmed)
+
+	now = now.Add(30 * time.Minute)
+	s.trimDueVolumes(context.Background())
+	assert.Equal(t, map[string]int{"/staging-1": 1}, trimmed)
+	assert.Equal(t, now.Add(time.Hour), s.volumes["vol-1"].nextTrim)
+	// a failed fstrim is retried on the next interval
+	assert.Equal(t, now.Add(time.Hour), s.volumes["vol-3"].nextTrim)
+
+	s.trimDueVolumes(context.Background())
+	assert.Equal(t, map[string]int{"/staging-1": 1}, trimmed)
+
+	now = now.Add(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.trimDueVolumes(ctx)
+	assert.Equal(t, map[string]int{"/staging-1": 1}, trimmed)
+}
+
+func TestFstrimSchedulerTrimVolume(t *testing.T) {
+	now := time.Now()
+	trimmed := map[string]int{}
+	s := newTestFstrimScheduler(t, &now, trimmed)
+	s.register("vol-1", "/staging-1", nil)
+	s.register("vol-2", "/staging-2", map[string]string{"fstrim": "false"})
+	s.register("vol-3", "/failing", nil)
+
+	result, err := s.trimVolume("vol-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &FstrimResult{VolumeID: "vol-1", StagingPath: "/staging-1", TrimmedBytes: 4096}, result)
+	assert.Equal(t, 1, trimmed["/staging-1"])
+
+	_, err = s.trimVolume("vol-2")
+	assert.ErrorIs(t, err, errFstrimDisabled)
+	_, err = s.trimVolume("vol-missing")
+	assert.ErrorIs(t, err, errFstrimVolumeNotFound)
+	_, err = s.trimVolume("vol-3")
+	assert.EqualError(t, err, "fstrim of volume vol-3 staged at /failing failed: discard not supported")
+}
+
+func TestFstrimSchedulerRun(t *testing.T) {
+	now := time.Now()
+	s := newTestFstrimScheduler(t, &now, map[string]int{})
+	s.interval = 0
+	s.register("vol-1", "/staging-1", map[string]string{"fstrim": "false"})
+	s.stagedVolumes = func(driverName string) (map[string]string, error) {
+		assert.Equal(t, fakeDriverName, driverName)
+		return map[string]string{"vol-1": "/staging-1", "vol-2": "/staging-2"}, nil
+	}
+
+	// periodic fstrim is disabled, Run only adds the staged volumes
+	s.Run(context.Background())
+	assert.False(t, s.volumes["vol-1"].enabled)
+	assert.True(t, s.volumes["vol-2"].enabled)
+	assert.Equal(t, "/staging-2", s.volumes["vol-2"].stagingPath)
+}
+
+func TestFstrimHookHandler(t *testing.T) {
+	defer defaultFstrimScheduler.Store(nil)
+
+	defaultFstrimScheduler.Store(nil)
+	recorder := httptest.NewRecorder()
+	FstrimHookHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, FstrimHookPath+"?volumeID=vol-1", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	now := time.Now()
+	trimmed := map[string]int{}
+	s := newTestFstrimScheduler(t, &now, trimmed)
+	s.register("vol-1", "/staging-1", nil)
+	s.register("vol-2", "/staging-2", map[string]string{"fstrim": "false"})
+	s.register("vol-3", "/failing", nil)
+	defaultFstrimScheduler.Store(s)
+
+	tests := []struct {
+		method       string
+		query        string
+		expectedCode int
+	}{
+		{method: http.MethodGet, query: "?volumeID=vol-1", expectedCode: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, expectedCode: http.StatusBadRequest},
+		{method: http.MethodPost, query: "?volumeID=vol-missing", expectedCode: http.StatusNotFound},
+		{method: http.MethodPost, query: "?volumeID=vol-2", expectedCode: http.StatusConflict},
+		{method: http.MethodPost, query: "?volumeID=vol-3", expectedCode: http.StatusInternalServerError},
+		{method: http.MethodPost, query: "?volumeID=vol-1", expectedCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		recorder = httptest.NewRecorder()
+		FstrimHookHandler().ServeHTTP(recorder, httptest.NewRequest(test.method, FstrimHookPath+test.query, nil))
+		assert.Equal(t, test.expectedCode, recorder.Code, test)
+	}
+	result := FstrimResult{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.Equal(t, FstrimResult{VolumeID: "vol-1", StagingPath: "/staging-1", TrimmedBytes: 4096}, result)
+	assert.Equal(t, map[string]int{"/staging-1": 1}, trimmed)
+}
+
+func TestListenFstrimHook(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		expectErr bool
+	}{
+		{endpoint: "tcp://127.0.0.1:0"},
+		{endpoint: "tcp://localhost:0"},
+		{endpoint: "tcp://0.0.0.0:0", expectErr: true},
+		{endpoint: "tcp://:0", expectErr: true},
+		{endpoint: "tcp://10.0.0.4:0", expectErr: true},
+		{endpoint: "127.0.0.1:0", expectErr: true},
+	}
+	for _, test := range tests {
+		l, err := ListenFstrimHook(context.Background(), test.endpoint)
+		assert.Equal(t, test.expectErr, err != nil, "%s: %v", test.endpoint, err)
+		if l != nil {
+			l.Close()
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	socket := filepath.Join(t.TempDir(), "fstrim.sock")
+	l, err := ListenFstrimHook(context.Background(), "unix://"+socket)
+	assert.NoError(t, err)
+	defer l.Close()
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+)
+
+const (
+	// HealthzPath is the path of the endpoint serving the results of all health checks of the driver,
+	// HealthzPath/<check> serves the result of a single check
+	HealthzPath = "/healthz/"
+
+	// healthCheckTimeout is the time after which a check that has not returned fails
+	healthCheckTimeout = 10 * time.Second
+	// healthCheckFailureThreshold is the number of consecutive failures after which a check is unhealthy
+	healthCheckFailureThreshold = 3
+)
+
+// the health checker of the running driver, served on HealthzPath
+var defaultHealthChecker atomic.Pointer[healthChecker]
+
+// healthCheck checks a dependency of the driver
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	// external checks a dependency outside of the host, it is only served on HealthzPath and not reported by Probe so
+	// that an outage of the dependency does not restart the driver
+	external bool
+}
+
+type healthCheckResult struct {
+	err                 error
+	consecutiveFailures int
+	lastChecked         time.Time
+}
+
+// healthChecker runs health checks in the background and caches their results for Probe and HealthzPath
+type healthChecker struct {
+	checks   []healthCheck
+	interval time.Duration
+	timeout  time.Duration
+
+	lock    sync.RWMutex
+	results map[string]*healthCheckResult
+	// checks that are still running after they timed out
+	running map[string]bool
+}
+
+func newHealthChecker(interval time.Duration, checks []healthCheck) *healthChecker {
+	return &healthChecker{
+		checks:   checks,
+		interval: interval,
+		timeout:  healthCheckTimeout,
+		results:  map[string]*healthCheckResult{},
+		running:  map[string]bool{},
+	}
+}
+
+func (d *DriverCore) setupHealthChecker(options *DriverOptions) {
+	if options.HealthCheckIntervalInSec <= 0 {
+		return
+	}
+	var checks []healthCheck
+	if d.NodeID != "" {
+		checks = d.nodeHealthChecks()
+	} else {
+		checks = d.controllerHealthChecks()
+	}
+	d.healthChecker = newHealthChecker(time.Duration(options.HealthCheckIntervalInSec)*time.Second, checks)
+	defaultHealthChecker.Store(d.healthChecker)
+}
+
+// nodeHealthChecks returns the checks of the node plugin
+func (d *DriverCore) nodeHealthChecks() []healthCheck {
+	checks := d.platformNodeHealthChecks()
+	if d.cloud != nil && d.cloud.UseInstanceMetadata && d.cloud.Metadata != nil {
+		checks = append(checks, healthCheck{name: "imds", external: true, check: func(context.Context) error {
+			_, err := d.cloud.Metadata.GetMetadata(azcache.CacheReadTypeForceRefresh)
+			return err
+		}})
+	}
+	return checks
+}
+
+// controllerHealthChecks returns the checks of the controller plugin
+func (d *DriverCore) controllerHealthChecks() []healthCheck {
+	var checks []healthCheck
+	if d.cloud != nil {
+		if check := newTokenHealthCheck(&d.cloud.ARMClientConfig, &d.cloud.AzureAuthConfig.AzureAuthConfig); check != nil {
+			checks = append(checks, *check)
+		}
+		if d.clientFactory != nil && d.cloud.ResourceGroup != "" {
+			checks = append(checks, healthCheck{name: "arm", external: true, check: func(ctx context.Context) error {
+				_, err := d.clientFactory.GetResourceGroupClient().Get(ctx, d.cloud.ResourceGroup)
+				if isARMReachable(err) {
+					return nil
+				}
+				return err
+			}})
+		}
+	}
+	if d.kubeClient != nil {
+		checks = append(checks, healthCheck{name: "kubeapi", external: true, check: func(context.Context) error {
+			_, err := d.kubeClient.Discovery().ServerVersion()
+			return err
+		}})
+	}
+	return checks
+}
+
+// newTokenHealthCheck returns the check acquiring an ARM token with the identity of the cloud config, nil if there
+// is no identity
+func newTokenHealthCheck(armConfig *azclient.ARMClientConfig, authConfig *azclient.AzureAuthConfig) *healthCheck {
+	authProvider, err := azclient.NewAuthProvider(armConfig, authConfig)
+	if err != nil {
+		klog.Warningf("failed to create auth provider, token acquisition is not checked: %v", err)
+		return nil
+	}
+	cred := authProvider.GetAzIdentity()
+	if authProvider.IsMultiTenantModeEnabled() {
+		cred = authProvider.GetMultiTenantIdentity()
+	}
+	if cred == nil {
+		return nil
+	}
+	cloudConfig, err := azclient.GetAzureCloudConfig(armConfig)
+	if err != nil {
+		klog.Warningf("failed to get cloud config, token acquisition is not checked: %v", err)
+		return nil
+	}
+	scope := strings.TrimSuffix(cloudConfig.Services[cloud.ResourceManager].Audience, "/") + "/.default"
+	return &healthCheck{name: "token", external: true, check: func(ctx context.Context) error {
+		_, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}})
+		return err
+	}}
+}
+
+// isARMReachable returns true if err of an ARM call shows that the driver is authorized to call ARM, ARM throttling or
+// a missing resource is not a failure of the driver
+func isARMReachable(err error) bool {
+	if err == nil || azureutils.IsThrottlingError(err) {
+		return true
+	}
+	var unavailableErr *armUnavailableError
+	if errors.As(err, &unavailableErr) {
+		return true
+	}
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && (respErr.StatusCode == http.StatusNotFound || respErr.StatusCode == http.StatusTooManyRequests)
+}
+
+// Run refreshes the results of the health checks until ctx is done
+func (c *healthChecker) Run(ctx context.Context) {
+	names := make([]string, 0, len(c.checks))
+	for _, check := range c.checks {
+		names = append(names, check.name)
+	}
+	klog.V(2).Infof("starting health checks %v with interval(%v)", names, c.interval)
+	wait.UntilWithContext(ctx, c.refresh, c.interval)
+}
+
+// refresh runs all checks concurrently
+func (c *healthChecker) refresh(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			c.record(check.name, c.runCheck(ctx, check))
+		}(check)
+	}
+	wg.Wait()
+}
+
+// runCheck runs check with a timeout, a check that does not return is not run again until it does
+func (c *healthChecker) runCheck(ctx context.Context, check healthCheck) error {
+	c.lock.Lock()
+	if c.running[check.name] {
+		c.lock.Unlock()
+		return fmt.Errorf("previous check has not returned after %v", c.timeout)
+	}
+	c.running[check.name] = true
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := check.check(ctx)
+		c.lock.Lock()
+		delete(c.running, check.name)
+		c.lock.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check has not returned after %v", c.timeout)
+	}
+}
+
+func (c *healthChecker) record(name string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result, ok := c.results[name]
+	if !ok {
+		result = &healthCheckResult{}
+		c.results[name] = result
+	}
+	result.lastChecked = time.Now()
+	result.err = err
+	if err == nil {
+		if result.consecutiveFailures >= healthCheckFailureThreshold {
+			klog.V(2).Infof("health check %s recovered", name)
+		}
+		result.consecutiveFailures = 0
+		return
+	}
+	result.consecutiveFailures++
+	if result.consecutiveFailures == healthCheckFailureThreshold {
+		klog.Errorf("health check %s failed %d times in a row: %v", name, result.consecutiveFailures, err)
+	} else {
+		klog.Warningf("health check %s failed: %v", name, err)
+	}
+}
+
+// status returns the reason the check is unhealthy, empty if it's healthy, found is false if there is no such check
+func (c *healthChecker) status(name string) (reason string, found bool) {
+	for _, check := range c.checks {
+		if check.name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	result, ok := c.results[name]
+	if !ok {
+		return "not checked yet", true
+	}
+	if result.consecutiveFailures >= healthCheckFailureThreshold {
+		return fmt.Sprintf("%v (failed %d times in a row, last checked at %s)", result.err, result.consecutiveFailures,
+			result.lastChecked.Format(time.RFC3339)), true
+	}
+	return "", true
+}
+
+// ready returns whether all checks that are not external are healthy and the reasons of the unhealthy ones, the
+// driver is ready if health checks are disabled
+func (c *healthChecker) ready() (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+	var reasons []string
+	for _, check := range c.checks {
+		if check.external {
+			continue
+		}
+		if reason, _ := c.status(check.name); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", check.name, reason))
+		}
+	}
+	return len(reasons) == 0, strings.Join(reasons, "; ")
+}
+
+// HealthzHandler serves the results of the health checks of the running driver, HealthzPath serves all of them and
+// HealthzPath/<check> a single one, unhealthy checks are served with status 503 and their reason
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := defaultHealthChecker.Load()
+		if c == nil {
+			http.Error(w, "health checks are not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if name := strings.TrimPrefix(r.URL.Path, HealthzPath); name != "" {
+			reason, found := c.status(name)
+			switch {
+			case !found:
+				http.Error(w, fmt.Sprintf("health check %s not found", name), http.StatusNotFound)
+			case reason != "":
+				http.Error(w, fmt.Sprintf("%s check failed: %s", name, reason), http.StatusServiceUnavailable)
+			default:
+				fmt.Fprint(w, "ok")
+			}
+			return
+		}
+
+		var body strings.Builder
+		healthy := true
+		for _, check := range c.checks {
+			if reason, _ := c.status(check.name); reason != "" {
+				healthy = false
+				fmt.Fprintf(&body, "[-]%s failed: %s\n", check.name, reason)
+			} else {
+				fmt.Fprintf(&body, "[+]%s ok\n", check.name)
+			}
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body.WriteString("healthz check failed\n")
+		} else {
+			body.WriteString("healthz check passed\n")
+		}
+		fmt.Fprint(w, body.String())
+	})
+}
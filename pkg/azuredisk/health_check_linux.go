@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const sysBusSCSIDevicesPath = "/sys/bus/scsi/devices"
+
+// binaries the node plugin runs to find, mount and resize volumes
+var requiredNodeBinaries = []string{"blkid", "findmnt", "mount", "umount"}
+
+// platformNodeHealthChecks returns the checks of sysfs, the binaries and the mounter used by the node plugin
+func (d *DriverCore) platformNodeHealthChecks() []healthCheck {
+	return []healthCheck{
+		{name: "sysfs", check: func(context.Context) error {
+			if _, err := d.ioHandler.ReadDir(sysClassBlockPath); err != nil {
+				return err
+			}
+			// VMs with NVMe disks only may not have SCSI devices
+			if _, err := d.ioHandler.ReadDir(sysBusSCSIDevicesPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}},
+		{name: "binaries", check: func(context.Context) error {
+			for _, binary := range requiredNodeBinaries {
+				if _, err := d.mounter.Exec.LookPath(binary); err != nil {
+					return fmt.Errorf("%s not found: %v", binary, err)
+				}
+			}
+			return nil
+		}},
+		{name: "mounter", check: func(context.Context) error {
+			_, err := d.mounter.List()
+			return err
+		}},
+	}
+}
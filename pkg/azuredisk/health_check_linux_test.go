@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestPlatformNodeHealthChecks(t *testing.T) {
+	missing := map[string]bool{}
+	d := &DriverCore{}
+	d.ioHandler = &fakeSysfsIOHandler{dirs: map[string][]string{
+		sysClassBlockPath:     {"sda"},
+		sysBusSCSIDevicesPath: {"0:0:0:0"},
+	}}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: mount.NewFakeMounter(nil),
+		Exec: &testingexec.FakeExec{LookPathFunc: func(file string) (string, error) {
+			if missing[file] {
+				return "", fmt.Errorf("executable file not found in $PATH")
+			}
+			return "/usr/bin/" + file, nil
+		}},
+	}
+
+	checks := map[string]func(context.Context) error{}
+	for _, check := range d.nodeHealthChecks() {
+		checks[check.name] = check.check
+	}
+	assert.Len(t, checks, 3)
+	for name, check := range checks {
+		assert.NoError(t, check(context.Background()), name)
+	}
+
+	missing["findmnt"] = true
+	assert.EqualError(t, checks["binaries"](context.Background()), "findmnt not found: executable file not found in $PATH")
+
+	d.ioHandler = &fakeSysfsIOHandler{dirs: map[string][]string{sysBusSCSIDevicesPath: {"0:0:0:0"}}}
+	assert.Error(t, checks["sysfs"](context.Background()))
+}
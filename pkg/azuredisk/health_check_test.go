@@ -0,0 +1,204 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestHealthChecker returns a checker of a healthy check and of a check and an external check failing while
+// *failing is true
+func newTestHealthChecker(failing *bool) *healthChecker {
+	return newHealthChecker(time.Minute, []healthCheck{
+		{name: "healthy", check: func(context.Context) error { return nil }},
+		{name: "flaky", check: func(context.Context) error {
+			if *failing {
+				return fmt.Errorf("dependency is down")
+			}
+			return nil
+		}},
+		{name: "external", external: true, check: func(context.Context) error {
+			if *failing {
+				return fmt.Errorf("external dependency is down")
+			}
+			return nil
+		}},
+	})
+}
+
+func TestHealthCheckerReady(t *testing.T) {
+	var nilChecker *healthChecker
+	ready, reason := nilChecker.ready()
+	assert.True(t, ready)
+	assert.Empty(t, reason)
+
+	failing := true
+	c := newTestHealthChecker(&failing)
+	ready, reason = c.ready()
+	assert.False(t, ready)
+	assert.Equal(t, "healthy: not checked yet; flaky: not checked yet", reason)
+
+	// a check is unhealthy after healthCheckFailureThreshold failures in a row
+	for i := 1; i < healthCheckFailureThreshold; i++ {
+		c.refresh(context.Background())
+		ready, reason = c.ready()
+		assert.True(t, ready, reason)
+	}
+	c.refresh(context.Background())
+	ready, reason = c.ready()
+	assert.False(t, ready)
+	assert.Contains(t, reason, "flaky: dependency is down (failed 3 times in a row, last checked at ")
+	// external checks are served but not reported by Probe
+	assert.NotContains(t, reason, "external")
+	externalReason, found := c.status("external")
+	assert.True(t, found)
+	assert.Contains(t, externalReason, "external dependency is down (failed 3 times in a row")
+
+	failing = false
+	c.refresh(context.Background())
+	ready, reason = c.ready()
+	assert.True(t, ready)
+	assert.Empty(t, reason)
+	assert.Equal(t, 0, c.results["flaky"].consecutiveFailures)
+}
+
+func TestHealthCheckerRunCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	check := healthCheck{name: "hanging", check: func(context.Context) error {
+		// ignores the context like calls without a context
+		<-release
+		return nil
+	}}
+	c := newHealthChecker(time.Minute, []healthCheck{check})
+	c.timeout = 10 * time.Millisecond
+
+	assert.EqualError(t, c.runCheck(context.Background(), check), "check has not returned after 10ms")
+	assert.EqualError(t, c.runCheck(context.Background(), check), "previous check has not returned after 10ms")
+}
+
+func TestIsARMReachable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{expected: true},
+		{err: &azcore.ResponseError{StatusCode: http.StatusNotFound}, expected: true},
+		{err: &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, expected: true},
+		{err: fmt.Errorf("wrapped: %w", &armUnavailableError{subscriptionID: "sub", retryAt: time.Now()}), expected: true},
+		{err: fmt.Errorf("Retriable: true, RetryAfter: 10s, HTTPStatusCode: 429, RawError: TooManyRequests"), expected: true},
+		{err: &azcore.ResponseError{StatusCode: http.StatusUnauthorized}, expected: false},
+		{err: &azcore.ResponseError{StatusCode: http.StatusForbidden}, expected: false},
+		{err: fmt.Errorf("failed to acquire token"), expected: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isARMReachable(test.err), test.err)
+	}
+}
+
+func TestControllerHealthChecks(t *testing.T) {
+	d := &DriverCore{}
+	assert.Empty(t, d.controllerHealthChecks())
+
+	d.kubeClient = fake.NewSimpleClientset()
+	checks := d.controllerHealthChecks()
+	assert.Len(t, checks, 1)
+	assert.Equal(t, "kubeapi", checks[0].name)
+	assert.True(t, checks[0].external)
+	assert.NoError(t, checks[0].check(context.Background()))
+}
+
+func TestProbeWithHealthChecks(t *testing.T) {
+	failing := true
+	d := &Driver{}
+	d.healthChecker = newTestHealthChecker(&failing)
+	for i := 0; i < healthCheckFailureThreshold; i++ {
+		d.healthChecker.refresh(context.Background())
+	}
+	resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.False(t, resp.Ready.Value)
+
+	failing = false
+	d.healthChecker.refresh(context.Background())
+	resp, err = d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+
+	// an outage of an external dependency does not make the driver unready
+	d.healthChecker = newHealthChecker(time.Minute, []healthCheck{
+		{name: "kubeapi", external: true, check: func(context.Context) error { return fmt.Errorf("connection refused") }},
+	})
+	for i := 0; i < healthCheckFailureThreshold; i++ {
+		d.healthChecker.refresh(context.Background())
+	}
+	resp, err = d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+}
+
+func TestHealthzHandler(t *testing.T) {
+	defer defaultHealthChecker.Store(nil)
+
+	defaultHealthChecker.Store(nil)
+	recorder := httptest.NewRecorder()
+	HealthzHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, HealthzPath, nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	failing := true
+	c := newTestHealthChecker(&failing)
+	for i := 0; i < healthCheckFailureThreshold; i++ {
+		c.refresh(context.Background())
+	}
+	defaultHealthChecker.Store(c)
+
+	tests := []struct {
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{path: HealthzPath + "healthy", expectedCode: http.StatusOK, expectedBody: "ok"},
+		{path: HealthzPath + "flaky", expectedCode: http.StatusServiceUnavailable, expectedBody: "flaky check failed: dependency is down"},
+		{path: HealthzPath + "external", expectedCode: http.StatusServiceUnavailable, expectedBody: "external check failed: external dependency is down"},
+		{path: HealthzPath + "missing", expectedCode: http.StatusNotFound, expectedBody: "health check missing not found"},
+		{path: HealthzPath, expectedCode: http.StatusServiceUnavailable, expectedBody: "[+]healthy ok\n[-]flaky failed: dependency is down"},
+		{path: HealthzPath, expectedCode: http.StatusServiceUnavailable, expectedBody: "[-]external failed: external dependency is down"},
+	}
+	for _, test := range tests {
+		recorder = httptest.NewRecorder()
+		HealthzHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		assert.Equal(t, test.expectedCode, recorder.Code, test.path)
+		assert.Contains(t, recorder.Body.String(), test.expectedBody, test.path)
+	}
+
+	failing = false
+	c.refresh(context.Background())
+	recorder = httptest.NewRecorder()
+	HealthzHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, HealthzPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "[+]healthy ok\n[+]flaky ok\n[+]external ok\nhealthz check passed\n", recorder.Body.String())
+}
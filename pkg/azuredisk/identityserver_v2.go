@@ -24,6 +24,7 @@ import (
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
@@ -46,11 +47,12 @@ func (f *DriverV2) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequ
 	}, nil
 }
 
-// Probe check whether the plugin is running or not.
-// This method does not need to return anything.
-// Currently the spec does not dictate what you should return either.
-// Hence, return an empty response
+// Probe returns whether the health checks of the driver pass, the reasons of failed checks are logged
 func (f *DriverV2) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if ready, reason := f.healthChecker.ready(); !ready {
+		klog.Warningf("Probe: driver is not ready: %s", reason)
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+	}
 	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
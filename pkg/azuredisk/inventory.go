@@ -0,0 +1,608 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+)
+
+const (
+	inventoryKindDisk     = "Disk"
+	inventoryKindSnapshot = "Snapshot"
+
+	// garbage collection actions taken on an orphan in a scan
+	orphanActionTagged       = "tagged"
+	orphanActionDeleted      = "deleted"
+	orphanActionDeleteFailed = "deleteFailed"
+	// the orphan is not tagged with the name of this cluster, so it may belong to another cluster and is never deleted
+	orphanActionNotOwned = "notOwned"
+
+	// InventoryOutputTable prints the inventory report as a table
+	InventoryOutputTable = "table"
+	// InventoryOutputJSON prints the inventory report as json
+	InventoryOutputJSON = "json"
+
+	inTreeAzureDiskProvisioner = "kubernetes.io/azure-disk"
+	// rough list prices used when the sku is unknown
+	defaultDiskPricePerGiB     = 0.075
+	defaultSnapshotPricePerGiB = 0.05
+)
+
+var (
+	// default snapshot name generated by external-snapshotter, used to recognize snapshots created before the created-by tag was set
+	defaultSnapshotNameRE = regexp.MustCompile(`^snapshot-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	// rough monthly list prices in USD per GiB, only used to estimate the cost of orphans
+	diskPricePerGiB = map[string]float64{
+		"premium_lrs":     0.132,
+		"premium_zrs":     0.198,
+		"premiumv2_lrs":   0.081,
+		"standardssd_lrs": 0.075,
+		"standardssd_zrs": 0.094,
+		"standard_lrs":    0.040,
+		"ultrassd_lrs":    0.120,
+	}
+	snapshotPricePerGiB = map[string]float64{
+		"standard_lrs": 0.050,
+		"standard_zrs": 0.063,
+		"premium_lrs":  0.132,
+	}
+)
+
+// OrphanedResource is a driver-owned disk or snapshot which is not referenced by any PV or VolumeSnapshotContent
+type OrphanedResource struct {
+	Kind          string     `json:"kind"`
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	ResourceGroup string     `json:"resourceGroup"`
+	SKU           string     `json:"sku,omitempty"`
+	SizeGiB       int32      `json:"sizeGiB"`
+	TimeCreated   *time.Time `json:"timeCreated,omitempty"`
+	OrphanedSince *time.Time `json:"orphanedSince,omitempty"`
+	// EstimatedMonthlyCost is a rough estimate in USD based on list prices
+	EstimatedMonthlyCost float64 `json:"estimatedMonthlyCost"`
+	// Action is the garbage collection action taken on the resource in this scan
+	Action string `json:"action,omitempty"`
+}
+
+// InventoryReport is the result of an orphaned disk and snapshot scan
+type InventoryReport struct {
+	ResourceGroups       []string           `json:"resourceGroups"`
+	Disks                int                `json:"disks"`
+	Snapshots            int                `json:"snapshots"`
+	Orphans              []OrphanedResource `json:"orphans"`
+	EstimatedMonthlyCost float64            `json:"estimatedMonthlyCost"`
+}
+
+// InventoryOptions defines the options of a one-off inventory run
+type InventoryOptions struct {
+	DriverName string
+	// ClusterName must match the cluster name tag of an orphan to delete it
+	ClusterName                string
+	Kubeconfig                 string
+	CloudConfigSecretName      string
+	CloudConfigSecretNamespace string
+	// ResourceGroups are scanned in addition to the resource groups used by the cluster
+	ResourceGroups []string
+	// DeleteOrphans tags orphans on first detection and deletes them once tagged longer than OrphanGracePeriod
+	DeleteOrphans     bool
+	OrphanGracePeriod time.Duration
+}
+
+// volumeSnapshotContentLister lists VolumeSnapshotContents, nil if snapshot CRDs are unavailable
+type volumeSnapshotContentLister interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*snapshotv1.VolumeSnapshotContentList, error)
+}
+
+// resourceGroupScope is a resource group in a subscription scanned by the inventory
+type resourceGroupScope struct {
+	subscriptionID string
+	resourceGroup  string
+}
+
+// snapshotUpdater updates a snapshot with a PATCH, the snapshot client of azclient implements it through the
+// embedded armcompute.SnapshotsClient although snapshotclient.Interface does not include it
+type snapshotUpdater interface {
+	BeginUpdate(ctx context.Context, resourceGroupName string, snapshotName string, snapshot armcompute.SnapshotUpdate, options *armcompute.SnapshotsClientBeginUpdateOptions) (*runtime.Poller[armcompute.SnapshotsClientUpdateResponse], error)
+}
+
+// inventoryScanner lists driver-owned disks and snapshots in the resource groups used by the cluster,
+// cross-references them with PVs and VolumeSnapshotContents and optionally garbage collects orphans.
+// Resource groups may be shared with other clusters, so only orphans tagged with clusterName are garbage collected.
+type inventoryScanner struct {
+	driverName       string
+	clusterName      string
+	subscriptionID   string
+	resourceGroups   []string
+	kubeClient       clientset.Interface
+	snapshotContents volumeSnapshotContentLister
+	clientFactory    azclient.ClientFactory
+	deleteOrphans    bool
+	gracePeriod      time.Duration
+	now              func() time.Time
+	// patchSnapshotTags replaces the tags of a snapshot
+	patchSnapshotTags func(ctx context.Context, client snapshotclient.Interface, resourceGroup, name string, tags map[string]*string) error
+}
+
+func newInventoryScanner(driverName, clusterName, subscriptionID string, resourceGroups []string, kubeClient clientset.Interface,
+	snapshotContents volumeSnapshotContentLister, clientFactory azclient.ClientFactory, deleteOrphans bool, gracePeriod time.Duration) (*inventoryScanner, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("kubeClient is nil")
+	}
+	if clientFactory == nil {
+		return nil, fmt.Errorf("clientFactory is nil")
+	}
+	if gracePeriod < 0 {
+		return nil, fmt.Errorf("orphan grace period(%v) must not be negative", gracePeriod)
+	}
+	if deleteOrphans && clusterName == "" {
+		return nil, fmt.Errorf("cluster name is required to delete orphans, otherwise disks and snapshots of other clusters could be deleted")
+	}
+	registerMetrics()
+	return &inventoryScanner{
+		driverName:        driverName,
+		clusterName:       clusterName,
+		subscriptionID:    subscriptionID,
+		resourceGroups:    resourceGroups,
+		kubeClient:        kubeClient,
+		snapshotContents:  snapshotContents,
+		clientFactory:     clientFactory,
+		deleteOrphans:     deleteOrphans,
+		gracePeriod:       gracePeriod,
+		now:               time.Now,
+		patchSnapshotTags: patchSnapshotTags,
+	}, nil
+}
+
+// RunInventory scans driver-owned disks and snapshots once and returns the orphans found
+func RunInventory(ctx context.Context, options *InventoryOptions) (*InventoryReport, error) {
+	kubeClient, err := azureutils.GetKubeClient(options.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("get kubeconfig(%s) failed with error: %v", options.Kubeconfig, err)
+	}
+	cloud, err := azureutils.GetCloudProviderFromClient(ctx, kubeClient, options.CloudConfigSecretName, options.CloudConfigSecretNamespace,
+		GetUserAgent(options.DriverName, "", "inventory"), false, false, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure Cloud Provider, error: %v", err)
+	}
+	var snapshotContents volumeSnapshotContentLister
+	if snapshotClient, err := azureutils.GetSnapshotClient(options.Kubeconfig); err != nil {
+		klog.Warningf("get snapshot client failed with %v, snapshots will not be scanned", err)
+	} else {
+		snapshotContents = snapshotClient.SnapshotV1().VolumeSnapshotContents()
+	}
+
+	scanner, err := newInventoryScanner(options.DriverName, options.ClusterName, cloud.SubscriptionID, append([]string{cloud.ResourceGroup}, options.ResourceGroups...),
+		kubeClient, snapshotContents, cloud.ComputeClientFactory, options.DeleteOrphans, options.OrphanGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	return scanner.scan(ctx)
+}
+
+// Run scans orphans every interval until ctx is done
+func (s *inventoryScanner) Run(ctx context.Context, interval time.Duration) {
+	klog.V(2).Infof("starting orphan inventory with interval(%v), deleteOrphans(%v), gracePeriod(%v)", interval, s.deleteOrphans, s.gracePeriod)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		report, err := s.scan(ctx)
+		if err != nil {
+			klog.Errorf("orphan inventory failed with %v", err)
+			return
+		}
+		for _, orphan := range report.Orphans {
+			klog.V(2).Infof("orphaned %s(%s) size(%dGiB) sku(%s) estimated monthly cost($%.2f) action(%s)",
+				orphan.Kind, orphan.ID, orphan.SizeGiB, orphan.SKU, orphan.EstimatedMonthlyCost, orphan.Action)
+		}
+		klog.V(2).Infof("orphan inventory scanned %d disks and %d snapshots in %v, found %d orphans with estimated monthly cost($%.2f)",
+			report.Disks, report.Snapshots, report.ResourceGroups, len(report.Orphans), report.EstimatedMonthlyCost)
+	}, interval)
+}
+
+// scan runs one inventory pass
+func (s *inventoryScanner) scan(ctx context.Context) (*InventoryReport, error) {
+	pvs, err := s.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list PersistentVolumes failed with %v", err)
+	}
+	scopes := map[resourceGroupScope]bool{}
+	s.addScope(scopes, "", "")
+	for _, rg := range s.resourceGroups {
+		s.addScope(scopes, "", rg)
+	}
+	pvNames := map[string]bool{}
+	referencedDisks := map[string]bool{}
+	for _, pv := range pvs.Items {
+		pvNames[pv.Name] = true
+		var diskURI string
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == s.driverName {
+			diskURI = pv.Spec.CSI.VolumeHandle
+		} else if pv.Spec.AzureDisk != nil {
+			diskURI = pv.Spec.AzureDisk.DataDiskURI
+		}
+		if diskURI == "" {
+			continue
+		}
+		referencedDisks[strings.ToLower(diskURI)] = true
+		if rg, err := azureutils.GetResourceGroupFromURI(diskURI); err == nil {
+			s.addScope(scopes, azureutils.GetSubscriptionIDFromURI(diskURI), rg)
+		}
+	}
+
+	storageClasses, err := s.kubeClient.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list StorageClasses failed with %v", err)
+	}
+	for _, sc := range storageClasses.Items {
+		if sc.Provisioner != s.driverName && sc.Provisioner != inTreeAzureDiskProvisioner {
+			continue
+		}
+		var subsID, rg string
+		for k, v := range sc.Parameters {
+			switch strings.ToLower(k) {
+			case consts.ResourceGroupField:
+				rg = v
+			case consts.SubscriptionIDField:
+				subsID = v
+			}
+		}
+		if rg != "" {
+			s.addScope(scopes, subsID, rg)
+		}
+	}
+
+	// snapshots are only scanned when all VolumeSnapshotContents could be listed, otherwise every snapshot would look orphaned
+	var referencedSnapshots map[string]bool
+	if s.snapshotContents != nil {
+		contents, err := s.snapshotContents.List(ctx, metav1.ListOptions{})
+		if err != nil {
+			klog.Warningf("list VolumeSnapshotContents failed with %v, snapshots will not be scanned", err)
+		} else {
+			referencedSnapshots = map[string]bool{}
+			for _, content := range contents.Items {
+				if content.Spec.Driver != s.driverName {
+					continue
+				}
+				if handle := pointer.StringDeref(content.Spec.Source.SnapshotHandle, ""); handle != "" {
+					referencedSnapshots[strings.ToLower(handle)] = true
+				}
+				if content.Status != nil && pointer.StringDeref(content.Status.SnapshotHandle, "") != "" {
+					referencedSnapshots[strings.ToLower(*content.Status.SnapshotHandle)] = true
+				}
+			}
+		}
+	}
+
+	report := &InventoryReport{}
+	sortedScopes := make([]resourceGroupScope, 0, len(scopes))
+	for scope := range scopes {
+		sortedScopes = append(sortedScopes, scope)
+	}
+	sort.Slice(sortedScopes, func(i, j int) bool {
+		if sortedScopes[i].subscriptionID != sortedScopes[j].subscriptionID {
+			return sortedScopes[i].subscriptionID < sortedScopes[j].subscriptionID
+		}
+		return sortedScopes[i].resourceGroup < sortedScopes[j].resourceGroup
+	})
+	seenResourceGroups := map[string]bool{}
+	for _, scope := range sortedScopes {
+		if !seenResourceGroups[scope.resourceGroup] {
+			seenResourceGroups[scope.resourceGroup] = true
+			report.ResourceGroups = append(report.ResourceGroups, scope.resourceGroup)
+		}
+		if err := s.scanDisks(ctx, scope, pvNames, referencedDisks, report); err != nil {
+			return nil, err
+		}
+		if referencedSnapshots != nil {
+			if err := s.scanSnapshots(ctx, scope, referencedSnapshots, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	orphanCount := map[string]int{inventoryKindDisk: 0, inventoryKindSnapshot: 0}
+	orphanSize := map[string]int{inventoryKindDisk: 0, inventoryKindSnapshot: 0}
+	for _, orphan := range report.Orphans {
+		report.EstimatedMonthlyCost += orphan.EstimatedMonthlyCost
+		if orphan.Action != orphanActionDeleted {
+			orphanCount[orphan.Kind]++
+			orphanSize[orphan.Kind] += int(orphan.SizeGiB)
+		}
+	}
+	for kind := range orphanCount {
+		orphanedResources.WithLabelValues(kind).Set(float64(orphanCount[kind]))
+		orphanedResourcesSize.WithLabelValues(kind).Set(float64(orphanSize[kind]))
+	}
+	return report, nil
+}
+
+func (s *inventoryScanner) addScope(scopes map[resourceGroupScope]bool, subscriptionID, resourceGroup string) {
+	if subscriptionID == "" {
+		subscriptionID = s.subscriptionID
+	}
+	if resourceGroup == "" {
+		return
+	}
+	scopes[resourceGroupScope{subscriptionID: strings.ToLower(subscriptionID), resourceGroup: strings.ToLower(resourceGroup)}] = true
+}
+
+// scanDisks finds disks created for a PV which no longer exists
+func (s *inventoryScanner) scanDisks(ctx context.Context, scope resourceGroupScope, pvNames, referencedDisks map[string]bool, report *InventoryReport) error {
+	diskClient, err := s.clientFactory.GetDiskClientForSub(scope.subscriptionID)
+	if err != nil {
+		return err
+	}
+	disks, err := diskClient.List(ctx, scope.resourceGroup)
+	if err != nil {
+		return fmt.Errorf("list disks in resource group(%s) failed with %v", scope.resourceGroup, err)
+	}
+	for _, disk := range disks {
+		if disk == nil || disk.ID == nil || disk.Name == nil {
+			continue
+		}
+		report.Disks++
+		pvName := pointer.StringDeref(disk.Tags[consts.PvNameTag], "")
+		orphaned := pvName != "" && !pvNames[pvName] && !referencedDisks[strings.ToLower(*disk.ID)] && !isDiskInUse(disk)
+		diskName := *disk.Name
+		setTags := func(tags map[string]*string) error {
+			_, err := diskClient.Patch(ctx, scope.resourceGroup, diskName, armcompute.DiskUpdate{Tags: tags})
+			return err
+		}
+		if !orphaned {
+			s.clearOrphanedSinceTag(*disk.ID, disk.Tags, setTags)
+			continue
+		}
+
+		orphan := OrphanedResource{
+			Kind:          inventoryKindDisk,
+			ID:            *disk.ID,
+			Name:          diskName,
+			ResourceGroup: scope.resourceGroup,
+		}
+		if disk.SKU != nil && disk.SKU.Name != nil {
+			orphan.SKU = string(*disk.SKU.Name)
+		}
+		if disk.Properties != nil {
+			orphan.SizeGiB = pointer.Int32Deref(disk.Properties.DiskSizeGB, 0)
+			orphan.TimeCreated = disk.Properties.TimeCreated
+		}
+		orphan.EstimatedMonthlyCost = estimateMonthlyCost(diskPricePerGiB, defaultDiskPricePerGiB, orphan.SKU, orphan.SizeGiB)
+		s.collectOrphan(&orphan, disk.Tags, setTags, func() error {
+			return diskClient.Delete(ctx, scope.resourceGroup, diskName)
+		})
+		report.Orphans = append(report.Orphans, orphan)
+	}
+	return nil
+}
+
+// scanSnapshots finds driver-owned snapshots without a VolumeSnapshotContent
+func (s *inventoryScanner) scanSnapshots(ctx context.Context, scope resourceGroupScope, referencedSnapshots map[string]bool, report *InventoryReport) error {
+	snapshotClient, err := s.clientFactory.GetSnapshotClientForSub(scope.subscriptionID)
+	if err != nil {
+		return err
+	}
+	snapshots, err := snapshotClient.List(ctx, scope.resourceGroup)
+	if err != nil {
+		return fmt.Errorf("list snapshots in resource group(%s) failed with %v", scope.resourceGroup, err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot == nil || snapshot.ID == nil || snapshot.Name == nil || !isDriverOwnedSnapshot(snapshot) {
+			continue
+		}
+		report.Snapshots++
+		snapshot := snapshot
+		setTags := func(tags map[string]*string) error {
+			return s.patchSnapshotTags(ctx, snapshotClient, scope.resourceGroup, *snapshot.Name, tags)
+		}
+		if referencedSnapshots[strings.ToLower(*snapshot.ID)] {
+			s.clearOrphanedSinceTag(*snapshot.ID, snapshot.Tags, setTags)
+			continue
+		}
+
+		orphan := OrphanedResource{
+			Kind:          inventoryKindSnapshot,
+			ID:            *snapshot.ID,
+			Name:          *snapshot.Name,
+			ResourceGroup: scope.resourceGroup,
+		}
+		if snapshot.SKU != nil && snapshot.SKU.Name != nil {
+			orphan.SKU = string(*snapshot.SKU.Name)
+		}
+		if snapshot.Properties != nil {
+			orphan.SizeGiB = pointer.Int32Deref(snapshot.Properties.DiskSizeGB, 0)
+			orphan.TimeCreated = snapshot.Properties.TimeCreated
+		}
+		// incremental snapshots are billed by used size, so this is an upper bound
+		orphan.EstimatedMonthlyCost = estimateMonthlyCost(snapshotPricePerGiB, defaultSnapshotPricePerGiB, orphan.SKU, orphan.SizeGiB)
+		s.collectOrphan(&orphan, snapshot.Tags, setTags, func() error {
+			return snapshotClient.Delete(ctx, scope.resourceGroup, *snapshot.Name)
+		})
+		report.Orphans = append(report.Orphans, orphan)
+	}
+	return nil
+}
+
+// collectOrphan tags the orphan with the time it's first found, and deletes it once it's been orphaned longer than the grace period
+func (s *inventoryScanner) collectOrphan(orphan *OrphanedResource, tags map[string]*string, setTags func(map[string]*string) error, deleteFunc func() error) {
+	if v := pointer.StringDeref(tags[consts.OrphanedSinceTag], ""); v != "" {
+		if since, err := time.Parse(time.RFC3339, v); err == nil {
+			orphan.OrphanedSince = &since
+		} else {
+			klog.Warningf("invalid %s tag(%s) on %s(%s): %v", consts.OrphanedSinceTag, v, orphan.Kind, orphan.ID, err)
+		}
+	}
+	if !s.deleteOrphans {
+		return
+	}
+	if !s.isOwnedByCluster(tags) {
+		klog.V(4).Infof("skip orphaned %s(%s) without %s tag(%s)", orphan.Kind, orphan.ID, azureconsts.ClusterNameTagKey, s.clusterName)
+		orphan.Action = orphanActionNotOwned
+		return
+	}
+
+	now := s.now().UTC()
+	if orphan.OrphanedSince == nil {
+		newTags := copyTags(tags)
+		newTags[consts.OrphanedSinceTag] = pointer.String(now.Format(time.RFC3339))
+		if err := setTags(newTags); err != nil {
+			klog.Errorf("tag orphaned %s(%s) failed with %v", orphan.Kind, orphan.ID, err)
+			return
+		}
+		klog.V(2).Infof("tagged orphaned %s(%s) with %s(%s)", orphan.Kind, orphan.ID, consts.OrphanedSinceTag, now.Format(time.RFC3339))
+		orphan.OrphanedSince = &now
+		orphan.Action = orphanActionTagged
+		return
+	}
+	if now.Sub(*orphan.OrphanedSince) < s.gracePeriod {
+		return
+	}
+	klog.V(2).Infof("deleting %s(%s) orphaned since %s", orphan.Kind, orphan.ID, orphan.OrphanedSince.Format(time.RFC3339))
+	if err := deleteFunc(); err != nil {
+		klog.Errorf("delete orphaned %s(%s) failed with %v", orphan.Kind, orphan.ID, err)
+		orphan.Action = orphanActionDeleteFailed
+		return
+	}
+	orphan.Action = orphanActionDeleted
+}
+
+// clearOrphanedSinceTag removes the orphaned-since tag from a resource which is referenced again, so it's not deleted right away if orphaned later
+func (s *inventoryScanner) clearOrphanedSinceTag(id string, tags map[string]*string, setTags func(map[string]*string) error) {
+	if !s.deleteOrphans || !s.isOwnedByCluster(tags) {
+		return
+	}
+	if _, ok := tags[consts.OrphanedSinceTag]; !ok {
+		return
+	}
+	newTags := copyTags(tags)
+	delete(newTags, consts.OrphanedSinceTag)
+	if err := setTags(newTags); err != nil {
+		klog.Warningf("remove %s tag from %s failed with %v", consts.OrphanedSinceTag, id, err)
+		return
+	}
+	klog.V(2).Infof("removed %s tag from %s since it's referenced again", consts.OrphanedSinceTag, id)
+}
+
+// Print writes the report in table or json format
+func (r *InventoryReport) Print(w io.Writer, output string) error {
+	switch strings.ToLower(output) {
+	case InventoryOutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case "", InventoryOutputTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tNAME\tRESOURCE GROUP\tSKU\tSIZE(GiB)\tCREATED\tORPHANED SINCE\tEST. MONTHLY COST\tACTION")
+		for _, o := range r.Orphans {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t$%.2f\t%s\n", o.Kind, o.Name, o.ResourceGroup, o.SKU, o.SizeGiB,
+				formatTime(o.TimeCreated), formatTime(o.OrphanedSince), o.EstimatedMonthlyCost, o.Action)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "\nscanned %d disks and %d snapshots in resource groups %v, found %d orphans with estimated monthly cost $%.2f\n",
+			r.Disks, r.Snapshots, r.ResourceGroups, len(r.Orphans), r.EstimatedMonthlyCost)
+		return err
+	default:
+		return fmt.Errorf("output format(%s) is not supported, supported values are %s, %s", output, InventoryOutputTable, InventoryOutputJSON)
+	}
+}
+
+// isDiskInUse returns true if the disk is attached or reserved by a VM
+func isDiskInUse(disk *armcompute.Disk) bool {
+	if disk.ManagedBy != nil && *disk.ManagedBy != "" {
+		return true
+	}
+	if disk.Properties != nil && disk.Properties.DiskState != nil {
+		switch *disk.Properties.DiskState {
+		case armcompute.DiskStateAttached, armcompute.DiskStateReserved, armcompute.DiskStateActiveSAS, armcompute.DiskStateActiveSASFrozen:
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnedByCluster returns true if the resource is tagged with the name of this cluster
+func (s *inventoryScanner) isOwnedByCluster(tags map[string]*string) bool {
+	return s.clusterName != "" && strings.EqualFold(pointer.StringDeref(tags[azureconsts.ClusterNameTagKey], ""), s.clusterName)
+}
+
+// patchSnapshotTags replaces the tags of a snapshot with a PATCH, which does not overwrite other properties updated concurrently
+func patchSnapshotTags(ctx context.Context, client snapshotclient.Interface, resourceGroup, name string, tags map[string]*string) error {
+	updater, ok := client.(snapshotUpdater)
+	if !ok {
+		return fmt.Errorf("snapshot client %T does not support PATCH", client)
+	}
+	poller, err := updater.BeginUpdate(ctx, resourceGroup, name, armcompute.SnapshotUpdate{Tags: tags}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, nil)
+	return err
+}
+
+// isDriverOwnedSnapshot returns true if the snapshot is tagged by the driver or named by external-snapshotter
+func isDriverOwnedSnapshot(snapshot *armcompute.Snapshot) bool {
+	if v, ok := snapshot.Tags[azureconsts.CreatedByTag]; ok {
+		return strings.EqualFold(pointer.StringDeref(v, ""), azureDDCreatedByTagValue)
+	}
+	return snapshot.Name != nil && defaultSnapshotNameRE.MatchString(*snapshot.Name)
+}
+
+func estimateMonthlyCost(prices map[string]float64, defaultPrice float64, sku string, sizeGiB int32) float64 {
+	price, ok := prices[strings.ToLower(sku)]
+	if !ok {
+		price = defaultPrice
+	}
+	return price * float64(sizeGiB)
+}
+
+func copyTags(tags map[string]*string) map[string]*string {
+	newTags := make(map[string]*string, len(tags)+1)
+	for k, v := range tags {
+		newTags[k] = v
+	}
+	return newTags
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient/mock_snapshotclient"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+)
+
+const (
+	testInventoryRG          = "rg"
+	testInventorySCRG        = "sc-rg"
+	testInventoryDiskID      = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/%s"
+	testInventorySnapshotID  = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/%s"
+	testInventorySnapshotRef = "snapshot-0c9b9b7a-3f5e-4c5a-9d6e-1a2b3c4d5e6f"
+)
+
+type fakeVolumeSnapshotContentLister struct {
+	contents []snapshotv1.VolumeSnapshotContent
+	err      error
+}
+
+func (f *fakeVolumeSnapshotContentLister) List(_ context.Context, _ metav1.ListOptions) (*snapshotv1.VolumeSnapshotContentList, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &snapshotv1.VolumeSnapshotContentList{Items: f.contents}, nil
+}
+
+func newTestInventoryDisk(name, pvName string, tags map[string]*string) *armcompute.Disk {
+	if tags == nil {
+		tags = map[string]*string{}
+	}
+	if pvName != "" {
+		tags[consts.PvNameTag] = to.Ptr(pvName)
+	}
+	return &armcompute.Disk{
+		ID:   to.Ptr(fmt.Sprintf(testInventoryDiskID, name)),
+		Name: to.Ptr(name),
+		Tags: tags,
+		SKU:  &armcompute.DiskSKU{Name: to.Ptr(armcompute.DiskStorageAccountTypesPremiumLRS)},
+		Properties: &armcompute.DiskProperties{
+			DiskSizeGB: to.Ptr(int32(100)),
+			DiskState:  to.Ptr(armcompute.DiskStateUnattached),
+		},
+	}
+}
+
+func newTestInventorySnapshot(name string, tags map[string]*string) *armcompute.Snapshot {
+	return &armcompute.Snapshot{
+		ID:         to.Ptr(fmt.Sprintf(testInventorySnapshotID, name)),
+		Name:       to.Ptr(name),
+		Tags:       tags,
+		SKU:        &armcompute.SnapshotSKU{Name: to.Ptr(armcompute.SnapshotStorageAccountTypesStandardLRS)},
+		Properties: &armcompute.SnapshotProperties{DiskSizeGB: to.Ptr(int32(10))},
+	}
+}
+
+func TestInventoryScan(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	ownedSnapshotTags := func(clusterName string) map[string]*string {
+		return map[string]*string{azureconsts.CreatedByTag: to.Ptr(azureDDCreatedByTagValue), azureconsts.ClusterNameTagKey: to.Ptr(clusterName)}
+	}
+	withClusterTag := func(tags map[string]*string, clusterName string) map[string]*string {
+		newTags := copyTags(tags)
+		newTags[azureconsts.ClusterNameTagKey] = to.Ptr(clusterName)
+		return newTags
+	}
+	kubeObjects := func() *fake.Clientset {
+		return fake.NewSimpleClientset(
+			&v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-bound"},
+				Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: consts.DefaultDriverName, VolumeHandle: fmt.Sprintf(testInventoryDiskID, "bound")},
+				}},
+			},
+			&storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: "sc"},
+				Provisioner: consts.DefaultDriverName,
+				Parameters:  map[string]string{"resourceGroup": testInventorySCRG},
+			},
+		)
+	}
+	vscs := []snapshotv1.VolumeSnapshotContent{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "content"},
+			Spec:       snapshotv1.VolumeSnapshotContentSpec{Driver: consts.DefaultDriverName},
+			Status:     &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: to.Ptr(fmt.Sprintf(testInventorySnapshotID, testInventorySnapshotRef))},
+		},
+	}
+
+	tests := []struct {
+		desc                string
+		deleteOrphans       bool
+		orphanDiskTags      map[string]*string
+		boundDiskTags       map[string]*string
+		vscErr              error
+		expectPatch         int
+		expectDiskDelete    bool
+		expectSnapshotPatch bool
+		expectedOrphans     map[string]string
+		expectedSnapshots   int
+	}{
+		{
+			desc:              "report only",
+			expectedOrphans:   map[string]string{"orphan": "", "other-orphan": "", "snap-orphan": "", "snap-other": ""},
+			expectedSnapshots: 3,
+		},
+		{
+			desc:                "tag orphans on first detection",
+			deleteOrphans:       true,
+			expectPatch:         1,
+			expectSnapshotPatch: true,
+			expectedOrphans:     map[string]string{"orphan": orphanActionTagged, "other-orphan": orphanActionNotOwned, "snap-orphan": orphanActionTagged, "snap-other": orphanActionNotOwned},
+			expectedSnapshots:   3,
+		},
+		{
+			desc:                "delete orphans tagged longer than grace period",
+			deleteOrphans:       true,
+			orphanDiskTags:      map[string]*string{consts.OrphanedSinceTag: to.Ptr(now.Add(-2 * time.Hour).Format(time.RFC3339))},
+			expectDiskDelete:    true,
+			expectSnapshotPatch: true,
+			expectedOrphans:     map[string]string{"orphan": orphanActionDeleted, "other-orphan": orphanActionNotOwned, "snap-orphan": orphanActionTagged, "snap-other": orphanActionNotOwned},
+			expectedSnapshots:   3,
+		},
+		{
+			desc:                "keep orphans within grace period",
+			deleteOrphans:       true,
+			orphanDiskTags:      map[string]*string{consts.OrphanedSinceTag: to.Ptr(now.Add(-30 * time.Minute).Format(time.RFC3339))},
+			expectSnapshotPatch: true,
+			expectedOrphans:     map[string]string{"orphan": "", "other-orphan": orphanActionNotOwned, "snap-orphan": orphanActionTagged, "snap-other": orphanActionNotOwned},
+			expectedSnapshots:   3,
+		},
+		{
+			desc:                "remove orphaned-since tag from referenced disk",
+			deleteOrphans:       true,
+			boundDiskTags:       map[string]*string{consts.OrphanedSinceTag: to.Ptr(now.Format(time.RFC3339))},
+			orphanDiskTags:      map[string]*string{consts.OrphanedSinceTag: to.Ptr(now.Format(time.RFC3339))},
+			expectPatch:         1,
+			expectSnapshotPatch: true,
+			expectedOrphans:     map[string]string{"orphan": "", "other-orphan": orphanActionNotOwned, "snap-orphan": orphanActionTagged, "snap-other": orphanActionNotOwned},
+			expectedSnapshots:   3,
+		},
+		{
+			desc:            "skip snapshots when VolumeSnapshotContents are unavailable",
+			vscErr:          fmt.Errorf("the server could not find the requested resource"),
+			expectedOrphans: map[string]string{"orphan": "", "other-orphan": ""},
+		},
+	}
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		diskClient := mock_diskclient.NewMockInterface(ctrl)
+		snapshotClient := mock_snapshotclient.NewMockInterface(ctrl)
+		clientFactory := mock_azclient.NewMockClientFactory(ctrl)
+		clientFactory.EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+		clientFactory.EXPECT().GetSnapshotClientForSub(gomock.Any()).Return(snapshotClient, nil).AnyTimes()
+
+		attached := newTestInventoryDisk("attached", "pv-gone-2", nil)
+		attached.ManagedBy = to.Ptr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm")
+		diskClient.EXPECT().List(gomock.Any(), testInventoryRG).Return([]*armcompute.Disk{
+			newTestInventoryDisk("bound", "pv-bound", withClusterTag(test.boundDiskTags, "cluster")),
+			newTestInventoryDisk("orphan", "pv-gone", withClusterTag(test.orphanDiskTags, "Cluster")),
+			newTestInventoryDisk("other-orphan", "pv-gone-3", withClusterTag(test.orphanDiskTags, "other-cluster")),
+			newTestInventoryDisk("static", "", nil),
+			attached,
+		}, nil)
+		diskClient.EXPECT().List(gomock.Any(), testInventorySCRG).Return(nil, nil)
+		diskClient.EXPECT().Patch(gomock.Any(), testInventoryRG, gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, _, name string, update armcompute.DiskUpdate) (*armcompute.Disk, error) {
+				if name == "bound" {
+					assert.NotContains(t, update.Tags, consts.OrphanedSinceTag, test.desc)
+				} else {
+					assert.Equal(t, now.Format(time.RFC3339), *update.Tags[consts.OrphanedSinceTag], test.desc)
+				}
+				assert.Contains(t, update.Tags, consts.PvNameTag, test.desc)
+				assert.Contains(t, update.Tags, azureconsts.ClusterNameTagKey, test.desc)
+				return nil, nil
+			}).Times(test.expectPatch)
+		if test.expectDiskDelete {
+			diskClient.EXPECT().Delete(gomock.Any(), testInventoryRG, "orphan").Return(nil)
+		}
+		if test.vscErr == nil {
+			snapshotClient.EXPECT().List(gomock.Any(), testInventoryRG).Return([]*armcompute.Snapshot{
+				newTestInventorySnapshot(testInventorySnapshotRef, nil),
+				newTestInventorySnapshot("snap-orphan", ownedSnapshotTags("cluster")),
+				newTestInventorySnapshot("snap-other", ownedSnapshotTags("other-cluster")),
+				newTestInventorySnapshot("user-snapshot", nil),
+			}, nil)
+			snapshotClient.EXPECT().List(gomock.Any(), testInventorySCRG).Return(nil, nil)
+		}
+
+		scanner, err := newInventoryScanner(consts.DefaultDriverName, "cluster", "sub", []string{testInventoryRG}, kubeObjects(),
+			&fakeVolumeSnapshotContentLister{contents: vscs, err: test.vscErr}, clientFactory, test.deleteOrphans, time.Hour)
+		assert.NoError(t, err, test.desc)
+		scanner.now = func() time.Time { return now }
+		patchedSnapshots := []string{}
+		scanner.patchSnapshotTags = func(_ context.Context, _ snapshotclient.Interface, resourceGroup, name string, tags map[string]*string) error {
+			assert.Equal(t, testInventoryRG, resourceGroup, test.desc)
+			assert.Contains(t, tags, consts.OrphanedSinceTag, test.desc)
+			assert.Contains(t, tags, azureconsts.CreatedByTag, test.desc)
+			patchedSnapshots = append(patchedSnapshots, name)
+			return nil
+		}
+
+		report, err := scanner.scan(context.Background())
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, []string{testInventoryRG, testInventorySCRG}, report.ResourceGroups, test.desc)
+		assert.Equal(t, 5, report.Disks, test.desc)
+		assert.Equal(t, test.expectedSnapshots, report.Snapshots, test.desc)
+		orphans := map[string]string{}
+		for _, orphan := range report.Orphans {
+			orphans[orphan.Name] = orphan.Action
+		}
+		assert.Equal(t, test.expectedOrphans, orphans, test.desc)
+		if test.expectSnapshotPatch {
+			assert.Equal(t, []string{"snap-orphan"}, patchedSnapshots, test.desc)
+		} else {
+			assert.Empty(t, patchedSnapshots, test.desc)
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestNewInventoryScanner(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	clientFactory := mock_azclient.NewMockClientFactory(ctrl)
+
+	_, err := newInventoryScanner(consts.DefaultDriverName, "cluster", "sub", nil, nil, nil, clientFactory, false, 0)
+	assert.Error(t, err)
+	_, err = newInventoryScanner(consts.DefaultDriverName, "cluster", "sub", nil, fake.NewSimpleClientset(), nil, nil, false, 0)
+	assert.Error(t, err)
+	_, err = newInventoryScanner(consts.DefaultDriverName, "cluster", "sub", nil, fake.NewSimpleClientset(), nil, clientFactory, true, -time.Second)
+	assert.Error(t, err)
+	_, err = newInventoryScanner(consts.DefaultDriverName, "", "sub", nil, fake.NewSimpleClientset(), nil, clientFactory, true, time.Hour)
+	assert.Error(t, err, "cluster name is required to delete orphans")
+	_, err = newInventoryScanner(consts.DefaultDriverName, "", "sub", nil, fake.NewSimpleClientset(), nil, clientFactory, false, time.Hour)
+	assert.NoError(t, err, "cluster name is optional in report mode")
+	_, err = newInventoryScanner(consts.DefaultDriverName, "cluster", "sub", nil, fake.NewSimpleClientset(), nil, clientFactory, true, time.Hour)
+	assert.NoError(t, err)
+}
+
+func TestInventoryReportPrint(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := &InventoryReport{
+		ResourceGroups: []string{testInventoryRG},
+		Disks:          2,
+		Snapshots:      1,
+		Orphans: []OrphanedResource{
+			{
+				Kind:                 inventoryKindDisk,
+				ID:                   fmt.Sprintf(testInventoryDiskID, "orphan"),
+				Name:                 "orphan",
+				ResourceGroup:        testInventoryRG,
+				SKU:                  "Premium_LRS",
+				SizeGiB:              100,
+				TimeCreated:          &created,
+				EstimatedMonthlyCost: 13.2,
+			},
+		},
+		EstimatedMonthlyCost: 13.2,
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, report.Print(buf, InventoryOutputTable))
+	assert.Contains(t, buf.String(), "KIND")
+	assert.Contains(t, buf.String(), "orphan")
+	assert.Contains(t, buf.String(), "2024-01-02T03:04:05Z")
+	assert.Contains(t, buf.String(), "$13.20")
+	assert.True(t, strings.HasSuffix(buf.String(), "found 1 orphans with estimated monthly cost $13.20\n"))
+
+	buf.Reset()
+	assert.NoError(t, report.Print(buf, InventoryOutputJSON))
+	decoded := &InventoryReport{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), decoded))
+	assert.Equal(t, report.Orphans[0].ID, decoded.Orphans[0].ID)
+
+	assert.Error(t, report.Print(buf, "yaml"))
+}
+
+func TestEstimateMonthlyCost(t *testing.T) {
+	assert.InDelta(t, 13.2, estimateMonthlyCost(diskPricePerGiB, defaultDiskPricePerGiB, "Premium_LRS", 100), 0.001)
+	assert.InDelta(t, 7.5, estimateMonthlyCost(diskPricePerGiB, defaultDiskPricePerGiB, "unknown", 100), 0.001)
+	assert.InDelta(t, 0.5, estimateMonthlyCost(snapshotPricePerGiB, defaultSnapshotPricePerGiB, "Standard_LRS", 10), 0.001)
+}
+
+func TestIsDriverOwnedSnapshot(t *testing.T) {
+	tests := []struct {
+		desc     string
+		snapshot *armcompute.Snapshot
+		expected bool
+	}{
+		{
+			desc:     "created by driver",
+			snapshot: newTestInventorySnapshot("snap", map[string]*string{azureconsts.CreatedByTag: to.Ptr(azureDDCreatedByTagValue)}),
+			expected: true,
+		},
+		{
+			desc:     "created by others",
+			snapshot: newTestInventorySnapshot(testInventorySnapshotRef, map[string]*string{azureconsts.CreatedByTag: to.Ptr("other")}),
+		},
+		{
+			desc:     "default external-snapshotter name",
+			snapshot: newTestInventorySnapshot(testInventorySnapshotRef, nil),
+			expected: true,
+		},
+		{
+			desc:     "user snapshot",
+			snapshot: newTestInventorySnapshot("backup", nil),
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isDriverOwnedSnapshot(test.snapshot), test.desc)
+	}
+}
+
+func TestPatchSnapshotTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	err := patchSnapshotTags(context.Background(), mock_snapshotclient.NewMockInterface(ctrl), testInventoryRG, "snap", nil)
+	assert.Error(t, err, "snapshot client without PATCH is never updated with a PUT")
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+var (
+	// danglingAttachments is the number of driver-owned data disks attached to a VM without a matching VolumeAttachment
+	danglingAttachments = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "dangling_attachments",
+			Help:           "Number of driver-owned data disks attached to a node without a matching VolumeAttachment",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+
+	// orphanedAttachments is the number of VolumeAttachments reporting a disk that is not attached to the VM
+	orphanedAttachments = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "orphaned_attachments",
+			Help:           "Number of attached VolumeAttachments whose disk is not found on the node",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+
+	// reconcileDetachCount is the number of detach operations issued by the attachment reconciler
+	reconcileDetachCount = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "attachment_reconcile_detach_count",
+			Help:           "Number of dangling disk detach operations issued by the attachment reconciler",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node", "result"},
+	)
+
+	// orphanedResources is the number of driver-owned disks and snapshots found orphaned by the last inventory scan
+	orphanedResources = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "orphaned_resources",
+			Help:           "Number of driver-owned disks and snapshots without a PV or VolumeSnapshotContent",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	// orphanedResourcesSize is the total size in GiB of orphaned disks and snapshots found by the last inventory scan
+	orphanedResourcesSize = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "orphaned_resources_size_gib",
+			Help:           "Total size in GiB of driver-owned disks and snapshots without a PV or VolumeSnapshotContent",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	// attachDetachBatchSize is the number of disks sent to a node in one attach or detach operation
+	attachDetachBatchSize = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "attach_detach_batch_size",
+			Help:           "Number of disks attached to or detached from a node in one batch",
+			Buckets:        []float64{1, 2, 3, 4, 6, 8, 12, 16, 32, 64},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+
+	// attachDetachQueueWait is the time an attach or detach request waits in the node queue before its batch is sent
+	attachDetachQueueWait = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "attach_detach_queue_wait_seconds",
+			Help:           "Time an attach or detach request waits in the node queue before its batch is sent",
+			Buckets:        metrics.ExponentialBuckets(0.005, 2, 14),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+
+	// armCircuitBreakerState is the state of the ARM circuit breaker of an operation class in a subscription
+	armCircuitBreakerState = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "arm_circuit_breaker_state",
+			Help:           "State of the ARM circuit breaker of an operation class in a subscription, 0: closed, 1: half-open, 2: open",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"subscription", "operation_class"},
+	)
+
+	// armRequestsRejected is the number of ARM calls failed fast by an open circuit breaker
+	armRequestsRejected = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "arm_requests_rejected_total",
+			Help:           "Number of ARM calls failed fast because the circuit breaker of their operation class is open",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"subscription", "operation_class"},
+	)
+
+	// armRequestsDelayed is the number of ARM calls which waited for a token of the rate limiter
+	armRequestsDelayed = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "arm_requests_delayed_total",
+			Help:           "Number of ARM calls which waited for a token of the subscription rate limiter",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"subscription", "operation_class"},
+	)
+
+	// controllerShardMembers is the number of live controller replicas sharing attach and detach work
+	controllerShardMembers = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "controller_shard_members",
+			Help:           "Number of live controller replicas owning a shard of nodes",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// controllerShardForwardedRequests is the number of RPCs forwarded to the replica owning the node
+	controllerShardForwardedRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "controller_shard_forwarded_requests_total",
+			Help:           "Number of controller RPCs forwarded to the replica owning the node",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"method", "result"},
+	)
+
+	// fstrimTrimmedBytes is the number of bytes discarded by fstrim on each staged volume
+	fstrimTrimmedBytes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "fstrim_trimmed_bytes_total",
+			Help:           "Number of bytes discarded by fstrim on a staged volume",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"volume_id"},
+	)
+
+	// fstrimOperations is the number of fstrim operations run on each staged volume
+	fstrimOperations = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      consts.AzureDiskCSIDriverName,
+			Name:           "fstrim_operations_total",
+			Help:           "Number of fstrim operations run on a staged volume",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"volume_id", "result"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the driver specific metrics in the legacy registry served on the metrics address.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(danglingAttachments)
+		legacyregistry.MustRegister(orphanedAttachments)
+		legacyregistry.MustRegister(reconcileDetachCount)
+		legacyregistry.MustRegister(orphanedResources)
+		legacyregistry.MustRegister(orphanedResourcesSize)
+		legacyregistry.MustRegister(attachDetachBatchSize)
+		legacyregistry.MustRegister(attachDetachQueueWait)
+		legacyregistry.MustRegister(armCircuitBreakerState)
+		legacyregistry.MustRegister(armRequestsRejected)
+		legacyregistry.MustRegister(armRequestsDelayed)
+		legacyregistry.MustRegister(controllerShardMembers)
+		legacyregistry.MustRegister(controllerShardForwardedRequests)
+		legacyregistry.MustRegister(fstrimTrimmedBytes)
+		legacyregistry.MustRegister(fstrimOperations)
+	})
+}
@@ -39,6 +39,7 @@ import (
 	testingexec "k8s.io/utils/exec/testing"
 	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization/mockoptimization"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
@@ -99,6 +100,39 @@ func TestMain(m *testing.M) {
 
 }
 
+func TestCollectMountOptions(t *testing.T) {
+	tests := []struct {
+		fsType          string
+		mntFlags        []string
+		expectedOptions []string
+	}{
+		{
+			fsType:          "ext4",
+			mntFlags:        []string{"noatime"},
+			expectedOptions: []string{"noatime"},
+		},
+		{
+			fsType:          "xfs",
+			expectedOptions: []string{"nouuid"},
+		},
+		{
+			fsType:          "ext4",
+			mntFlags:        []string{"noatime", `context="system_u:object_r:container_file_t:s0:c1,c2"`},
+			expectedOptions: []string{"noatime", `context="system_u:object_r:container_file_t:s0:c1,c2"`},
+		},
+		{
+			fsType: "xfs",
+			mntFlags: []string{`context="system_u:object_r:nfs_t:s0"`, "noatime", `defcontext="system_u:object_r:default_t:s0"`,
+				`context="system_u:object_r:container_file_t:s0:c1,c2"`},
+			expectedOptions: []string{`context="system_u:object_r:container_file_t:s0:c1,c2"`, "noatime",
+				`defcontext="system_u:object_r:default_t:s0"`, "nouuid"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expectedOptions, collectMountOptions(test.fsType, test.mntFlags), test.mntFlags)
+	}
+}
+
 func TestNodeGetCapabilities(t *testing.T) {
 	cntl := gomock.NewController(t)
 	defer cntl.Finish()
@@ -479,6 +513,12 @@ func TestNodeStageVolume(t *testing.T) {
 				AccessType: stdVolCapBlock}, VolumeContext: volumeContextWithMaxShare},
 			expectedErr: status.Error(codes.InvalidArgument, "MaxShares value not supported"),
 		},
+		{
+			desc: "Volume mount group is not a group ID",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest, VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "staff"}}}},
+			expectedErr: status.Error(codes.InvalidArgument, "volume mount group staff is not a group ID"),
+		},
 		{
 			desc: "Volume operation in progress",
 			setupFunc: func(t *testing.T, d FakeDriver) {
@@ -538,6 +578,24 @@ func TestNodeStageVolume(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			desc:          "Refuse to format partitioned disk",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			setupFunc: func(t *testing.T, d FakeDriver) {
+				d.setNextCommandOutputScripts(func() ([]byte, []byte, error) {
+					return []byte("DEVICE=/dev/sdd\nPTTYPE=gpt"), []byte{}, nil
+				})
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContext,
+			},
+			expectedErr: status.Error(codes.FailedPrecondition, "refusing to format /dev/sdd which has a gpt partition table, "+
+				"select a partition with the partition attribute, or set formatPolicy to always to wipe and format it"),
+		},
 		{
 			desc:          "failed to get perf attributes",
 			skipOnDarwin:  true,
@@ -1229,6 +1287,50 @@ func TestNodeExpandVolume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeExpandVolumeEncryptedBlock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := NewFakeDriver(cntl)
+	fakeMounter, err := mounter.NewFakeSafeMounter()
+	assert.NoError(t, err)
+	d.setMounter(fakeMounter)
+	blockVolumePath := filepath.Join(t.TempDir(), "block-volume-path")
+	volumeID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"
+	d.getHostUtil().(*azureutils.FakeHostUtil).SetPathIsDeviceResult(blockVolumePath, true, nil)
+	d.getHostUtil().(*azureutils.FakeHostUtil).SetPathIsDeviceResult(luks.MapperPath(luks.MapperName(volumeID)), true, nil)
+
+	req := &csi.NodeExpandVolumeRequest{
+		CapacityRange: &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(15)},
+		VolumePath:    blockVolumePath,
+		VolumeId:      volumeID,
+	}
+	statusAction := func() ([]byte, []byte, error) {
+		return []byte("  device:  /dev/sdc\n"), []byte{}, nil
+	}
+	resizeAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	blockdevAction := func() ([]byte, []byte, error) {
+		// the LUKS header takes the first 16MiB of the disk
+		return []byte(fmt.Sprintf("%d\n", volumehelper.GiBToBytes(15)-16*1024*1024)), []byte{}, nil
+	}
+	// cryptsetup status, cryptsetup resize, blockdev --getsize64 on the mapper device
+	d.setNextCommandOutputScripts(statusAction, resizeAction, blockdevAction)
+	resp, err := d.NodeExpandVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, volumehelper.GiBToBytes(15)-16*1024*1024, resp.GetCapacityBytes())
+
+	failedAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, testingexec.FakeExitError{Status: 1}
+	}
+	d.setNextCommandOutputScripts(statusAction, resizeAction, failedAction)
+	_, err = d.NodeExpandVolume(context.Background(), req)
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
 func TestGetBlockSizeBytes(t *testing.T) {
 	cntl := gomock.NewController(t)
 	defer cntl.Finish()
@@ -1371,7 +1473,7 @@ func TestGetDevicePathWithLUN(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		_, err := d.getDevicePathWithLUN(test.req)
+		_, err := d.getDevicePathWithLUN(context.Background(), test.req, "")
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("desc: %s\n actualErr: (%v), expectedErr: (%v)", test.desc, err, test.expectedErr)
 		}
@@ -1469,3 +1571,18 @@ func TestNodePublishVolumeIdempotentMount(t *testing.T) {
 	err = os.RemoveAll(targetTest)
 	assert.NoError(t, err)
 }
+
+func TestReadOnlyMountOptions(t *testing.T) {
+	tests := []struct {
+		fsType   string
+		expected []string
+	}{
+		{fsType: "ext4", expected: []string{"ro", "norecovery"}},
+		{fsType: "XFS", expected: []string{"ro", "norecovery"}},
+		{fsType: "ext2", expected: []string{"ro"}},
+		{fsType: "ntfs", expected: []string{"ro"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, readOnlyMountOptions(test.fsType), test.fsType)
+	}
+}
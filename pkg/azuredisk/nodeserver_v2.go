@@ -21,6 +21,7 @@ package azuredisk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -28,7 +29,9 @@ import (
 	"strings"
 	"time"
 
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/luks"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/scsipr"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
 	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 
@@ -37,7 +40,6 @@ import (
 	"google.golang.org/grpc/status"
 
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
@@ -70,6 +72,10 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 	if err := azureutils.IsValidVolumeCapabilities([]*csi.VolumeCapability{volumeCapability}, maxShares); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	volumeMountGroup, err := d.getVolumeMountGroup(volumeCapability)
+	if err != nil {
+		return nil, err
+	}
 
 	if acquired := d.volumeLocks.TryAcquire(diskURI); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, diskURI)
@@ -81,10 +87,13 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 		return nil, status.Error(codes.InvalidArgument, "lun not provided")
 	}
 
-	source, err := d.getDevicePathWithLUN(lun)
+	source, err := d.getDevicePathWithLUN(ctx, lun, azureutils.GetDiskControllerType(params))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to find disk on lun %s. %v", lun, err)
 	}
+	if err := d.verifyDeviceIdentity(source, req.GetPublishContext()); err != nil {
+		return nil, err
+	}
 
 	// If perf optimizations are enabled
 	// tweak device settings to enhance performance
@@ -107,6 +116,18 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 	// If the access type is block, do nothing for stage
 	switch req.GetVolumeCapability().GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
+		if isFencedVolume(req.GetVolumeCapability(), req.GetVolumeContext()) {
+			if err := d.registerFencingKey(source, lun, target); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to register reservation key on %s(lun: %s): %v", source, lun, err)
+			}
+		}
+		recordBlockVolumeLun(target, lun)
+		// the mapper device is published instead of the disk
+		if azureutils.IsLuksEncryption(params) {
+			if _, err := d.openEncryptedDevice(ctx, diskURI, source, req.GetSecrets(), azureutils.IsMultiNodeReadOnly(volumeCapability)); err != nil {
+				return nil, err
+			}
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
@@ -116,9 +137,22 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 	}
 	if mnt {
 		klog.V(2).Infof("NodeStageVolume: already mounted on target %s", target)
+		if !azureutils.IsMultiNodeReadOnly(volumeCapability) {
+			d.fstrim.register(diskURI, target, params)
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
+	// the filesystem is created on the mapper device of the LUKS device
+	if azureutils.IsLuksEncryption(params) {
+		if _, ok := params[consts.VolumeAttributePartition]; ok {
+			return nil, status.Error(codes.InvalidArgument, "partition is not supported with LUKS encryption")
+		}
+		if source, err = d.openEncryptedDevice(ctx, diskURI, source, req.GetSecrets(), azureutils.IsMultiNodeReadOnly(volumeCapability)); err != nil {
+			return nil, err
+		}
+	}
+
 	// Get fsType and mountOptions that the volume will be formatted and mounted with
 	fstype := getDefaultFsType()
 	options := []string{}
@@ -126,7 +160,7 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 		if mnt.FsType != "" {
 			fstype = mnt.FsType
 		}
-		options = append(options, mnt.MountFlags...)
+		options = append(options, collectMountOptions(fstype, mnt.MountFlags)...)
 	}
 
 	volContextFSType := azureutils.GetFStype(req.GetVolumeContext())
@@ -135,18 +169,72 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 		fstype = volContextFSType
 	}
 
+	readOnlyMany := azureutils.IsMultiNodeReadOnly(volumeCapability)
+	if readOnlyMany {
+		// the disk is attached to other nodes, the filesystem must not be written including journal replay
+		options = append(options, readOnlyMountOptions(fstype)...)
+	} else if volumeMountGroup >= 0 {
+		// kubelet delegates the fsGroup of the pod instead of changing the owner of every file of the volume
+		options = append(options, volumeMountGroupOptions(fstype, volumeMountGroup)...)
+	}
+
 	// If partition is specified, should mount it only instead of the entire disk.
 	if partition, ok := req.GetVolumeContext()[consts.VolumeAttributePartition]; ok {
-		source = source + "-part" + partition
+		if source, err = d.getPartitionSource(source, partition); err != nil {
+			return nil, err
+		}
+	}
+
+	// a device with data in another layout than a filesystem must not be formatted
+	if !readOnlyMany {
+		if err := d.checkFormatPolicy(source, req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
 	}
 
-	// FormatAndMount will format only if needed
-	klog.V(2).Infof("NodeStageVolume: formatting %s and mounting at %s with mount options(%s)", source, target, options)
-	if err := d.formatAndMount(source, target, fstype, options); err != nil {
-		return nil, status.Errorf(codes.Internal, "could not format %s(lun: %s), and mount it at %s, failed with %v", source, lun, target, err)
+	mkfsArgs, err := azureutils.GetMkfsArgs(fstype, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// mkfs options only apply on first format, a read-only volume is never formatted
+	var formatted bool
+	if len(mkfsArgs) > 0 && !readOnlyMany {
+		if formatted, err = formatWithOptions(source, fstype, mkfsArgs, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not format %s(lun: %s) with options %v: %v", source, lun, mkfsArgs, err)
+		}
+	}
+
+	// a read-only volume is mounted without journal replay and never checked
+	var mounted bool
+	if !readOnlyMany {
+		if mounted, err = d.fsckAndMount(ctx, source, target, fstype, options, req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
+	}
+
+	if !mounted {
+		// FormatAndMount will format only if needed
+		klog.V(2).Infof("NodeStageVolume: formatting %s and mounting at %s with mount options(%s)", source, target, options)
+		if err := d.formatAndMount(source, target, fstype, options); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not format %s(lun: %s), and mount it at %s, failed with %v", source, lun, target, err)
+		}
 	}
 	klog.V(2).Infof("NodeStageVolume: format %s and mounting at %s successfully.", source, target)
 
+	if volumeMountGroup >= 0 && !readOnlyMany {
+		if err := setVolumeRootGroup(target, volumeMountGroup); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set group %d on %s: %v", volumeMountGroup, target, err)
+		}
+	}
+
+	if len(mkfsArgs) > 0 && !readOnlyMany {
+		checkMkfsOptions(target, strings.Join(mkfsArgs, " "), formatted)
+	}
+
+	if readOnlyMany {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	var needResize bool
 	if required, ok := req.GetVolumeContext()[consts.ResizeRequired]; ok && strings.EqualFold(required, consts.TrueValue) {
 		needResize = true
@@ -165,6 +253,7 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 		}
 		klog.V(2).Infof("NodeStageVolume: fs resize successful on target(%s) volumeid(%s).", target, diskURI)
 	}
+	d.fstrim.register(diskURI, target, params)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -185,6 +274,26 @@ func (d *DriverV2) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVo
 	}
 	defer d.volumeLocks.Release(volumeID)
 
+	// reservation keys are only registered on SCSI disks
+	getSCSIDevicePathWithLUN := func(lun string) (string, error) {
+		return d.getDevicePathWithLUN(ctx, lun, consts.DiskControllerTypeSCSI)
+	}
+	if err := d.unregisterFencingKey(stagingTargetPath, getSCSIDevicePathWithLUN); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unregister reservation key of volume %s: %v", volumeID, err)
+	}
+
+	if err := d.removeBlockVolumeLun(stagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove lun of volume %s recorded in %s: %v", volumeID, stagingTargetPath, err)
+	}
+
+	var devicePath string
+	if d.removeDeviceOnUnstage {
+		devicePath = d.getStagedDevice(volumeID, stagingTargetPath)
+	}
+
+	// a running fstrim keeps the filesystem busy
+	d.fstrim.unregister(volumeID)
+
 	klog.V(2).Infof("NodeUnstageVolume: unmounting %s", stagingTargetPath)
 	err := CleanupMountPoint(stagingTargetPath, d.mounter, false)
 	if err != nil {
@@ -192,6 +301,14 @@ func (d *DriverV2) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVo
 	}
 	klog.V(2).Infof("NodeUnstageVolume: unmount %s successfully", stagingTargetPath)
 
+	if err := d.closeEncryptedDevice(volumeID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to close LUKS device of volume %s: %v", volumeID, err)
+	}
+
+	if devicePath != "" {
+		d.removeDevice(devicePath)
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -216,6 +333,10 @@ func (d *DriverV2) NodePublishVolume(ctx context.Context, req *csi.NodePublishVo
 	if err := azureutils.IsValidVolumeCapabilities([]*csi.VolumeCapability{volumeCapability}, maxShares); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	volumeMountGroup, err := d.getVolumeMountGroup(volumeCapability)
+	if err != nil {
+		return nil, err
+	}
 
 	source := req.GetStagingTargetPath()
 	if len(source) == 0 {
@@ -238,7 +359,7 @@ func (d *DriverV2) NodePublishVolume(ctx context.Context, req *csi.NodePublishVo
 	defer d.volumeLocks.Release(volumeID)
 
 	mountOptions := []string{"bind"}
-	if req.GetReadonly() {
+	if req.GetReadonly() || azureutils.IsMultiNodeReadOnly(volumeCapability) {
 		mountOptions = append(mountOptions, "ro")
 	}
 
@@ -249,11 +370,27 @@ func (d *DriverV2) NodePublishVolume(ctx context.Context, req *csi.NodePublishVo
 			return nil, status.Error(codes.InvalidArgument, "lun not provided")
 		}
 		var err error
-		source, err = d.getDevicePathWithLUN(lun)
+		source, err = d.getDevicePathWithLUN(ctx, lun, azureutils.GetDiskControllerType(req.GetVolumeContext()))
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to find device path with lun %s. %v", lun, err)
 		}
 		klog.V(2).Infof("NodePublishVolume [block]: found device path %s with lun %s", source, lun)
+		if !req.GetReadonly() && isFencedVolume(volumeCapability, req.GetVolumeContext()) {
+			if err := d.reserveForWriter(source, req.GetPublishContext()); err != nil {
+				if errors.Is(err, scsipr.ErrReservationConflict) {
+					return nil, status.Errorf(codes.FailedPrecondition, "node %s is fenced from %s: %v", d.NodeID, source, err)
+				}
+				return nil, status.Errorf(codes.Internal, "failed to reserve %s for writing: %v", source, err)
+			}
+		}
+		if azureutils.IsLuksEncryption(req.GetVolumeContext()) {
+			name, ok := d.getOpenEncryptedDevice(volumeID)
+			if !ok {
+				return nil, status.Errorf(codes.FailedPrecondition, "LUKS device of volume %s is not open, the volume must be staged first", volumeID)
+			}
+			source = luks.MapperPath(name)
+			klog.V(2).Infof("NodePublishVolume [block]: publishing LUKS device %s", source)
+		}
 		if err = d.ensureBlockTargetFile(target); err != nil {
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
@@ -266,6 +403,12 @@ func (d *DriverV2) NodePublishVolume(ctx context.Context, req *csi.NodePublishVo
 			klog.V(2).Infof("NodePublishVolume: already mounted on target %s", target)
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
+		// the volume may have been staged with the group of another pod, which keeps using it
+		if volumeMountGroup >= 0 && !req.GetReadonly() && !azureutils.IsMultiNodeReadOnly(volumeCapability) {
+			if err := checkVolumeRootGroup(source, volumeMountGroup); err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s could not be published with group %d since it's staged with another group: %v", volumeID, volumeMountGroup, err)
+			}
+		}
 	}
 
 	klog.V(2).Infof("NodePublishVolume: mounting %s at %s", source, target)
@@ -289,6 +432,11 @@ func (d *DriverV2) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubli
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	var blockDevicePath string
+	if d.removeDeviceOnUnstage {
+		blockDevicePath = d.getPublishedBlockDevice(targetPath)
+	}
+
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
 	err := CleanupMountPoint(targetPath, d.mounter, false)
 	if err != nil {
@@ -302,6 +450,10 @@ func (d *DriverV2) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubli
 
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
+	if blockDevicePath != "" {
+		d.removeUnpublishedBlockDevice(blockDevicePath)
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -406,8 +558,18 @@ func (d *DriverV2) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolum
 	}
 
 	volUsage, err := GetVolumeStats(ctx, d.mounter, req.VolumePath, d.hostUtil)
+	if status.Code(err) == codes.NotFound {
+		return nil, err
+	}
+	condition := GetVolumeCondition(req.VolumePath)
+	if condition.GetAbnormal() {
+		klog.Warningf("NodeGetVolumeStats: volume %s on %s is abnormal: %s", req.VolumeId, req.VolumePath, condition.GetMessage())
+		// usage may not be available on an abnormal volume, the condition is reported anyway
+		err = nil
+	}
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: volUsage,
+		Usage:           volUsage,
+		VolumeCondition: condition,
 	}, err
 }
 
@@ -438,14 +600,48 @@ func (d *DriverV2) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolu
 	}
 
 	if isBlock {
+		if name, ok := d.getOpenEncryptedDevice(volumeID); ok {
+			if err := d.resizeEncryptedDevice(ctx, name, req.GetSecrets()); err != nil {
+				return nil, status.Errorf(codes.Internal, "could not resize LUKS device of volume %s: %v", volumeID, err)
+			}
+			devicePath := luks.MapperPath(name)
+			gotBlockSizeBytes, err := d.waitForBlockSize(ctx, devicePath, requestGiB)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "resize requested for %v, but size of LUKS device %s of block volume %s was %v bytes: %v",
+					requestGiB, devicePath, volumeID, gotBlockSizeBytes, err)
+			}
+			klog.V(2).Infof("NodeExpandVolume resized LUKS device %s of block volume %v to %v bytes", name, volumeID, gotBlockSizeBytes)
+			return &csi.NodeExpandVolumeResponse{
+				CapacityBytes: gotBlockSizeBytes,
+			}, nil
+		}
+		devicePath := d.getBlockVolumeDevice(volumePath, req.GetStagingTargetPath())
+		if devicePath == "" {
+			// the volume was staged without its lun recorded
+			if d.enableDiskOnlineResize {
+				klog.V(2).Infof("NodeExpandVolume begin to rescan all devices on block volume(%s)", volumeID)
+				if err := rescanAllVolumes(d.ioHandler); err != nil {
+					klog.Errorf("NodeExpandVolume rescanAllVolumes failed with error: %v", err)
+				}
+			}
+			klog.V(2).Infof("NodeExpandVolume skip resize operation on block volume(%s)", volumeID)
+			return &csi.NodeExpandVolumeResponse{}, nil
+		}
 		if d.enableDiskOnlineResize {
-			klog.V(2).Infof("NodeExpandVolume begin to rescan all devices on block volume(%s)", volumeID)
-			if err := rescanAllVolumes(d.ioHandler); err != nil {
-				klog.Errorf("NodeExpandVolume rescanAllVolumes failed with error: %v", err)
+			klog.V(2).Infof("NodeExpandVolume begin to rescan device %s on block volume(%s)", devicePath, volumeID)
+			if err := rescanVolume(d.ioHandler, devicePath); err != nil {
+				klog.Errorf("NodeExpandVolume rescanVolume failed with error: %v", err)
 			}
 		}
-		klog.V(2).Infof("NodeExpandVolume skip resize operation on block volume(%s)", volumeID)
-		return &csi.NodeExpandVolumeResponse{}, nil
+		gotBlockSizeBytes, err := d.waitForBlockSize(ctx, devicePath, requestGiB)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "resize requested for %v, but size of device %s of block volume %s was %v bytes: %v",
+				requestGiB, devicePath, volumeID, gotBlockSizeBytes, err)
+		}
+		klog.V(2).Infof("NodeExpandVolume succeeded on block volume %v of %v bytes", volumeID, gotBlockSizeBytes)
+		return &csi.NodeExpandVolumeResponse{
+			CapacityBytes: gotBlockSizeBytes,
+		}, nil
 	}
 
 	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
@@ -458,10 +654,21 @@ func (d *DriverV2) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolu
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
 
-	if d.enableDiskOnlineResize {
-		klog.V(2).Infof("NodeExpandVolume begin to rescan device %s on volume(%s)", devicePath, volumeID)
-		if err := rescanVolume(d.ioHandler, devicePath); err != nil {
-			klog.Errorf("NodeExpandVolume rescanVolume failed with error: %v", err)
+	if name, ok := d.getOpenEncryptedDevice(volumeID); ok {
+		// the filesystem is on the LUKS device, which must be grown first
+		if err := d.resizeEncryptedDevice(ctx, name, req.GetSecrets()); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not resize LUKS device of volume %s: %v", volumeID, err)
+		}
+	} else {
+		if d.enableDiskOnlineResize {
+			klog.V(2).Infof("NodeExpandVolume begin to rescan device %s on volume(%s)", devicePath, volumeID)
+			if err := rescanVolume(d.ioHandler, devicePath); err != nil {
+				klog.Errorf("NodeExpandVolume rescanVolume failed with error: %v", err)
+			}
+		}
+		// the partition of a volume with the partition attribute is grown before its filesystem
+		if err := growPartition(d.ioHandler, devicePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not grow partition %s of volume %s: %v", devicePath, volumeID, err)
 		}
 	}
 
@@ -556,29 +763,27 @@ func (d *DriverV2) formatAndMount(source, target, fstype string, options []strin
 	return formatAndMount(source, target, fstype, options, d.mounter)
 }
 
-func (d *DriverV2) getDevicePathWithLUN(lunStr string) (string, error) {
+func (d *DriverV2) getDevicePathWithLUN(ctx context.Context, lunStr, diskControllerType string) (string, error) {
 	lun, err := azureutils.GetDiskLUN(lunStr)
 	if err != nil {
 		return "", err
 	}
 
-	scsiHostRescan(d.ioHandler, d.mounter)
-
-	newDevicePath := ""
-	err = wait.PollImmediate(1*time.Second, 2*time.Minute, func() (bool, error) {
-		var err error
-		if newDevicePath, err = findDiskByLun(int(lun), d.ioHandler, d.mounter); err != nil {
-			return false, fmt.Errorf("azureDisk - findDiskByLun(%v) failed with error(%s)", lun, err)
-		}
+	scsiHostRescan(d.ioHandler, d.mounter, int(lun))
+	if diskControllerType != consts.DiskControllerTypeSCSI {
+		nvmeControllerRescan(d.ioHandler)
+	}
 
-		// did we find it?
-		if newDevicePath != "" {
-			return true, nil
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	newDevicePath, err := d.deviceWatcher.waitForDevice(ctx, int(lun), func() (string, error) {
+		newDevicePath, err := findDiskByLun(int(lun), d.ioHandler, d.mounter, diskControllerType)
+		if err != nil {
+			return "", fmt.Errorf("azureDisk - findDiskByLun(%v) failed with error(%s)", lun, err)
 		}
-		// wait until timeout
-		return false, nil
+		return newDevicePath, nil
 	})
-	if err == nil && newDevicePath == "" {
+	if errors.Is(err, context.DeadlineExceeded) {
 		err = fmt.Errorf("azureDisk - findDiskByLun(%v) failed within timeout", lun)
 	}
 	return newDevicePath, err
@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	sysClassNVMePath = "/sys/class/nvme/"
+	// populated by the udev rules of azure-vm-utils for both SCSI and NVMe data disks
+	azureDataDiskByLunPath = "/dev/disk/azure/data/by-lun/"
+	// model of the NVMe controller of remote disks, local NVMe disks are exposed by "Microsoft NVMe Direct Disk"
+	azureNVMeRemoteDiskModel = "MSFT NVMe Accelerator"
+	// namespace 1 is the OS disk, the data disk on lun N is namespace N+2
+	nvmeDataDiskNamespaceOffset = 2
+)
+
+var nvmeNamespaceRegexp = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+// findNVMeDiskByLun finds the NVMe namespace of the data disk on lun, e.g. /dev/nvme0n3 for lun 1
+func findNVMeDiskByLun(lun int, io azureutils.IOHandler) (string, error) {
+	if links, err := io.ReadDir(azureDataDiskByLunPath); err == nil {
+		for _, link := range links {
+			if link.Name() == strconv.Itoa(lun) {
+				diskPath := filepath.Join(azureDataDiskByLunPath, link.Name())
+				klog.V(4).Infof("azureDisk - found %s by lun %d", diskPath, lun)
+				return diskPath, nil
+			}
+		}
+	}
+
+	controllers, err := listAzureNVMeControllers(io)
+	if err != nil {
+		// no NVMe controller on this VM size, the disk may not be on the SCSI controller yet
+		klog.V(6).Infof("azureDisk - no NVMe controller to find lun %d: %v", lun, err)
+		return "", nil
+	}
+	for _, controller := range controllers {
+		namespaces, err := io.ReadDir(filepath.Join(sysClassNVMePath, controller))
+		if err != nil {
+			klog.Warningf("azureDisk - failed to list namespaces of NVMe controller %s: %v", controller, err)
+			continue
+		}
+		for _, ns := range namespaces {
+			// skip the hidden devices of NVMe multipath, e.g. nvme0c0n1
+			if !nvmeNamespaceRegexp.MatchString(ns.Name()) {
+				continue
+			}
+			nsidPath := filepath.Join(sysClassNVMePath, controller, ns.Name(), "nsid")
+			nsidBytes, err := io.ReadFile(nsidPath)
+			if err != nil {
+				klog.Warningf("azureDisk - failed to read %s: %v", nsidPath, err)
+				continue
+			}
+			nsid, err := strconv.Atoi(strings.TrimSpace(string(nsidBytes)))
+			if err != nil {
+				klog.Warningf("azureDisk - failed to parse nsid %q of %s: %v", string(nsidBytes), ns.Name(), err)
+				continue
+			}
+			if nsid == lun+nvmeDataDiskNamespaceOffset {
+				klog.V(4).Infof("azureDisk - found NVMe namespace %s(nsid: %d) by lun %d", ns.Name(), nsid, lun)
+				return "/dev/" + ns.Name(), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// listAzureNVMeControllers returns the NVMe controllers of remote disks, e.g. nvme0
+func listAzureNVMeControllers(io azureutils.IOHandler) ([]string, error) {
+	dirs, err := io.ReadDir(sysClassNVMePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", sysClassNVMePath, err)
+	}
+	var controllers []string
+	for _, f := range dirs {
+		modelBytes, err := io.ReadFile(filepath.Join(sysClassNVMePath, f.Name(), "model"))
+		if err != nil {
+			klog.Warningf("azureDisk - failed to read model of NVMe controller %s: %v", f.Name(), err)
+			continue
+		}
+		if model := strings.TrimSpace(string(modelBytes)); !strings.HasPrefix(model, azureNVMeRemoteDiskModel) {
+			klog.V(6).Infof("azureDisk - skip NVMe controller %s with model %s", f.Name(), model)
+			continue
+		}
+		controllers = append(controllers, f.Name())
+	}
+	return controllers, nil
+}
+
+// nvmeControllerRescan rescans the namespaces of NVMe controllers of remote disks for attached disks and size changes
+func nvmeControllerRescan(io azureutils.IOHandler) {
+	controllers, err := listAzureNVMeControllers(io)
+	if err != nil {
+		klog.V(6).Infof("azureDisk - no NVMe controller to rescan: %v", err)
+		return
+	}
+	for _, controller := range controllers {
+		name := filepath.Join(sysClassNVMePath, controller, "rescan_controller")
+		if err := io.WriteFile(name, []byte("1"), 0666); err != nil {
+			klog.Warningf("failed to rescan NVMe controller %s: %v", name, err)
+		}
+	}
+}
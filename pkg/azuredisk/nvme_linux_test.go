@@ -0,0 +1,178 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+type fakeSysfsDirEntry string
+
+func (e fakeSysfsDirEntry) Name() string               { return string(e) }
+func (e fakeSysfsDirEntry) IsDir() bool                { return true }
+func (e fakeSysfsDirEntry) Type() fs.FileMode          { return fs.ModeDir }
+func (e fakeSysfsDirEntry) Info() (fs.FileInfo, error) { return nil, fmt.Errorf("not supported") }
+
+// fakeSysfsIOHandler serves a sysfs tree from memory and records the written files
+type fakeSysfsIOHandler struct {
+	dirs    map[string][]string
+	links   map[string]string
+	files   map[string]string
+	written map[string]string
+}
+
+func (f *fakeSysfsIOHandler) ReadDir(dirname string) ([]os.DirEntry, error) {
+	names, ok := f.dirs[dirname]
+	if !ok {
+		return nil, fmt.Errorf("open %s: no such file or directory", dirname)
+	}
+	entries := []os.DirEntry{}
+	for _, name := range names {
+		entries = append(entries, fakeSysfsDirEntry(name))
+	}
+	return entries, nil
+}
+
+func (f *fakeSysfsIOHandler) WriteFile(filename string, data []byte, _ os.FileMode) error {
+	f.written[filename] = string(data)
+	return nil
+}
+
+func (f *fakeSysfsIOHandler) Readlink(name string) (string, error) {
+	if link, ok := f.links[name]; ok {
+		return link, nil
+	}
+	return "", fmt.Errorf("readlink %s: no such file or directory", name)
+}
+
+func (f *fakeSysfsIOHandler) ReadFile(filename string) ([]byte, error) {
+	if content, ok := f.files[filename]; ok {
+		return []byte(content), nil
+	}
+	return nil, fmt.Errorf("open %s: no such file or directory", filename)
+}
+
+// newFakeNVMeSysfs returns a sysfs with the local NVMe disk controller nvme0 and the remote disk controller nvme1
+// exposing the OS disk and the data disks on lun 0 and 1
+func newFakeNVMeSysfs() *fakeSysfsIOHandler {
+	return &fakeSysfsIOHandler{
+		dirs: map[string][]string{
+			"/sys/class/nvme/":      {"nvme0", "nvme1"},
+			"/sys/class/nvme/nvme0": {"device", "model", "nvme0n1"},
+			"/sys/class/nvme/nvme1": {"device", "model", "nvme1n1", "nvme1n2", "nvme1c1n3", "nvme1n3"},
+		},
+		files: map[string]string{
+			"/sys/class/nvme/nvme0/model":          "Microsoft NVMe Direct Disk              \n",
+			"/sys/class/nvme/nvme0/nvme0n1/nsid":   "3\n",
+			"/sys/class/nvme/nvme1/model":          "MSFT NVMe Accelerator v1.0              \n",
+			"/sys/class/nvme/nvme1/nvme1n1/nsid":   "1\n",
+			"/sys/class/nvme/nvme1/nvme1n2/nsid":   "2\n",
+			"/sys/class/nvme/nvme1/nvme1c1n3/nsid": "3\n",
+			"/sys/class/nvme/nvme1/nvme1n3/nsid":   "3\n",
+		},
+		written: map[string]string{},
+	}
+}
+
+func TestFindNVMeDiskByLun(t *testing.T) {
+	io := newFakeNVMeSysfs()
+	tests := []struct {
+		lun      int
+		expected string
+	}{
+		{lun: 0, expected: "/dev/nvme1n2"},
+		{lun: 1, expected: "/dev/nvme1n3"},
+		{lun: 2, expected: ""},
+	}
+	for _, test := range tests {
+		diskPath, err := findNVMeDiskByLun(test.lun, io)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, diskPath, "lun %d", test.lun)
+	}
+
+	// the udev links of azure-vm-utils are preferred
+	io.dirs["/dev/disk/azure/data/by-lun/"] = []string{"0", "1"}
+	diskPath, err := findNVMeDiskByLun(1, io)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/data/by-lun/1", diskPath)
+
+	diskPath, err = findNVMeDiskByLun(1, &fakeSysfsIOHandler{})
+	assert.NoError(t, err, "no NVMe controller")
+	assert.Equal(t, "", diskPath)
+}
+
+func TestFindDiskByLunWithDiskControllerType(t *testing.T) {
+	io := newFakeNVMeSysfs()
+	io.dirs["/sys/bus/scsi/devices"] = []string{"host0", "4:0:0:0"}
+	io.dirs["/sys/bus/scsi/devices/4:0:0:0/block"] = []string{"sdc"}
+	io.files["/sys/bus/scsi/devices/4:0:0:0/vendor"] = "Msft    \n"
+	io.files["/sys/bus/scsi/devices/4:0:0:0/model"] = "Virtual Disk    \n"
+
+	tests := []struct {
+		lun                int
+		diskControllerType string
+		expected           string
+	}{
+		{lun: 0, diskControllerType: "", expected: "/dev/sdc"},
+		{lun: 1, diskControllerType: "", expected: "/dev/nvme1n3"},
+		{lun: 0, diskControllerType: consts.DiskControllerTypeSCSI, expected: "/dev/sdc"},
+		{lun: 1, diskControllerType: consts.DiskControllerTypeSCSI, expected: ""},
+		{lun: 0, diskControllerType: consts.DiskControllerTypeNVMe, expected: "/dev/nvme1n2"},
+	}
+	for _, test := range tests {
+		diskPath, err := findDiskByLun(test.lun, io, nil, test.diskControllerType)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, diskPath, "lun %d on %q", test.lun, test.diskControllerType)
+	}
+}
+
+func TestNVMeControllerRescan(t *testing.T) {
+	io := newFakeNVMeSysfs()
+	nvmeControllerRescan(io)
+	assert.Equal(t, map[string]string{"/sys/class/nvme/nvme1/rescan_controller": "1"}, io.written)
+
+	io = newFakeNVMeSysfs()
+	assert.NoError(t, rescanVolume(io, "/dev/nvme1n3"))
+	assert.NoError(t, rescanVolume(io, "/dev/sdc"))
+	assert.Equal(t, map[string]string{
+		"/sys/class/block/nvme1n3/device/rescan_controller": "1",
+		"/sys/class/block/sdc/device/rescan":                "1",
+	}, io.written)
+
+	// the udev links of azure-vm-utils are resolved to their device
+	io = newFakeNVMeSysfs()
+	io.links = map[string]string{
+		"/dev/disk/azure/data/by-lun/1": "../../../../nvme1n3",
+		"/dev/disk/azure/data/by-lun/2": "../../../../sdd",
+	}
+	assert.NoError(t, rescanVolume(io, "/dev/disk/azure/data/by-lun/1"))
+	assert.NoError(t, rescanVolume(io, "/dev/disk/azure/data/by-lun/2"))
+	assert.Equal(t, map[string]string{
+		"/sys/class/block/nvme1n3/device/rescan_controller": "1",
+		"/sys/class/block/sdd/device/rescan":                "1",
+	}, io.written)
+}
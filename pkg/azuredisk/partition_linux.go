@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/growpart"
+)
+
+// getPartition returns the device name, the disk and the number of the partition devicePath, e.g. sdc1, sdc and 1
+// for /dev/sdc1, the disk is empty if devicePath is not a partition
+func getPartition(io azureutils.IOHandler, devicePath string) (string, string, int, error) {
+	name := filepath.Base(devicePath)
+	if filepath.Dir(devicePath) != "/dev" {
+		// udev link, e.g. /dev/disk/azure/scsi1/lun0-part1 -> ../../../sdc1
+		if link, err := io.Readlink(devicePath); err == nil {
+			name = filepath.Base(link)
+		}
+	}
+	partitionBytes, err := io.ReadFile(filepath.Join(sysClassBlockPath, name, "partition"))
+	if err != nil {
+		klog.V(6).Infof("%s is not a partition: %v", devicePath, err)
+		return name, "", 0, nil
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(string(partitionBytes)))
+	if err != nil {
+		return name, "", 0, fmt.Errorf("failed to parse partition number %q of %s: %v", string(partitionBytes), name, err)
+	}
+	// /sys/class/block/sdc1 -> ../../devices/.../block/sdc/sdc1
+	link, err := io.Readlink(filepath.Join(sysClassBlockPath, name))
+	if err != nil {
+		return name, "", 0, fmt.Errorf("failed to find the disk of partition %s: %v", name, err)
+	}
+	return name, filepath.Base(filepath.Dir(link)), number, nil
+}
+
+// growPartition grows the partition devicePath to the end of its disk like growpart, and updates its size in the kernel,
+// devices which are not partitions are left as they are
+func growPartition(io azureutils.IOHandler, devicePath string) error {
+	name, disk, number, err := getPartition(io, devicePath)
+	if err != nil || disk == "" {
+		return err
+	}
+
+	sectorSize := int64(growpart.DefaultSectorSize)
+	if sizeBytes, err := io.ReadFile(filepath.Join(sysClassBlockPath, disk, "queue/logical_block_size")); err == nil {
+		if size, err := strconv.ParseInt(strings.TrimSpace(string(sizeBytes)), 10, 64); err == nil {
+			sectorSize = size
+		}
+	}
+	diskPath := "/dev/" + disk
+	p, grown, err := growpart.GrowFile(diskPath, sectorSize, number)
+	if err != nil {
+		return err
+	}
+	if grown {
+		klog.V(2).Infof("grew partition %d of %s to %d bytes", number, diskPath, p.Size)
+	}
+
+	// the kernel keeps the size of a partition in use until it's updated, which may have failed after an earlier grow
+	kernelSizeBytes, err := io.ReadFile(filepath.Join(sysClassBlockPath, name, "size"))
+	if err == nil {
+		// the size in sysfs is in 512-byte sectors whatever the logical sector size of the disk
+		if sectors, err := strconv.ParseInt(strings.TrimSpace(string(kernelSizeBytes)), 10, 64); err == nil && sectors*512 == p.Size {
+			return nil
+		}
+	}
+	if err := growpart.ResizeKernelPartition(diskPath, p); err != nil {
+		return err
+	}
+	klog.V(2).Infof("partition %s is resized to %d bytes", name, p.Size)
+	return nil
+}
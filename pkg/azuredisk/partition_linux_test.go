@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakePartitionSysfs() *fakeSysfsIOHandler {
+	return &fakeSysfsIOHandler{
+		links: map[string]string{
+			"/dev/disk/azure/scsi1/lun0-part1": "../../../sdc1",
+			"/sys/class/block/sdc":             "../../devices/vmbus/host3/target3:0:0/3:0:0:0/block/sdc",
+			"/sys/class/block/sdc1":            "../../devices/vmbus/host3/target3:0:0/3:0:0:0/block/sdc/sdc1",
+		},
+		files: map[string]string{
+			"/sys/class/block/sdc1/partition": "1\n",
+			"/sys/class/block/sdc1/size":      "2093056\n",
+		},
+		written: map[string]string{},
+	}
+}
+
+func TestGetPartition(t *testing.T) {
+	io := newFakePartitionSysfs()
+	tests := []struct {
+		devicePath     string
+		expectedName   string
+		expectedDisk   string
+		expectedNumber int
+	}{
+		{devicePath: "/dev/sdc1", expectedName: "sdc1", expectedDisk: "sdc", expectedNumber: 1},
+		{devicePath: "/dev/disk/azure/scsi1/lun0-part1", expectedName: "sdc1", expectedDisk: "sdc", expectedNumber: 1},
+		{devicePath: "/dev/sdc", expectedName: "sdc"},
+		{devicePath: "/dev/mapper/vg-lv", expectedName: "vg-lv"},
+	}
+	for _, test := range tests {
+		name, disk, number, err := getPartition(io, test.devicePath)
+		assert.NoError(t, err, test.devicePath)
+		assert.Equal(t, test.expectedName, name, test.devicePath)
+		assert.Equal(t, test.expectedDisk, disk, test.devicePath)
+		assert.Equal(t, test.expectedNumber, number, test.devicePath)
+	}
+
+	io.files["/sys/class/block/sdc1/partition"] = "x\n"
+	_, _, _, err := getPartition(io, "/dev/sdc1")
+	assert.ErrorContains(t, err, "failed to parse partition number")
+
+	io.files["/sys/class/block/sdc1/partition"] = "1\n"
+	delete(io.links, "/sys/class/block/sdc1")
+	_, _, _, err = getPartition(io, "/dev/sdc1")
+	assert.ErrorContains(t, err, "failed to find the disk of partition sdc1")
+}
+
+func TestGrowPartitionSkipDisk(t *testing.T) {
+	io := newFakePartitionSysfs()
+	assert.NoError(t, growPartition(io, "/dev/sdc"))
+	assert.Empty(t, io.written)
+}
+
+func TestRescanPartition(t *testing.T) {
+	io := newFakePartitionSysfs()
+	assert.NoError(t, rescanVolume(io, "/dev/sdc1"))
+	assert.Equal(t, map[string]string{"/sys/class/block/sdc/device/rescan": "1"}, io.written)
+
+	io.written = map[string]string{}
+	assert.NoError(t, rescanVolume(io, "/dev/sdc"))
+	assert.Equal(t, map[string]string{"/sys/class/block/sdc/device/rescan": "1"}, io.written)
+}
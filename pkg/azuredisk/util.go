@@ -16,7 +16,16 @@ limitations under the License.
 
 package azuredisk
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+
+	csicommon "sigs.k8s.io/azuredisk-csi-driver/pkg/csi-common"
+)
 
 // lockMap used to lock on entries
 type lockMap struct {
@@ -55,3 +64,32 @@ func (lm *lockMap) UnlockEntry(entry string) {
 	}
 	mutex.Unlock()
 }
+
+// listenLocalEndpoint listens on endpoint of a handler which is not authenticated, endpoint must be a unix socket,
+// which is made only accessible by root, or a TCP address bound to the loopback interface
+func listenLocalEndpoint(ctx context.Context, endpoint string) (net.Listener, error) {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "tcp" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint(%s): %v", endpoint, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("endpoint(%s) must be a unix socket or bound to a loopback address", endpoint)
+		}
+	}
+	l, err := csicommon.Listen(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "unix" && runtime.GOOS != "windows" {
+		if err := os.Chmod(l.Addr().String(), 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to restrict access to socket %s: %v", l.Addr().String(), err)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,205 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	sysfsPath     = "/sys"
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// volumeHealthChecker detects abnormal volumes from the mount table and sysfs,
+// a volume is reported abnormal only on evidence, not when its state can't be determined
+type volumeHealthChecker struct {
+	sysfsPath     string
+	mountInfoPath string
+	// stat returns the mode of path and the device number of the device file for block devices
+	stat func(path string) (mode uint32, rdev uint64, err error)
+	// statfs returns the error of the statfs syscall on path
+	statfs func(path string) error
+}
+
+func newVolumeHealthChecker() *volumeHealthChecker {
+	return &volumeHealthChecker{
+		sysfsPath:     sysfsPath,
+		mountInfoPath: mountInfoPath,
+		stat: func(path string) (uint32, uint64, error) {
+			var st unix.Stat_t
+			if err := unix.Stat(path, &st); err != nil {
+				return 0, 0, err
+			}
+			return st.Mode, st.Rdev, nil
+		},
+		statfs: func(path string) error {
+			var st unix.Statfs_t
+			return unix.Statfs(path, &st)
+		},
+	}
+}
+
+// GetVolumeCondition returns the condition of the volume staged or published at target
+func GetVolumeCondition(target string) *csi.VolumeCondition {
+	return newVolumeHealthChecker().check(target)
+}
+
+func (c *volumeHealthChecker) check(target string) *csi.VolumeCondition {
+	var problems []string
+	mode, rdev, err := c.stat(target)
+	if err != nil {
+		klog.V(4).Infof("failed to stat %s: %v", target, err)
+		return &csi.VolumeCondition{}
+	}
+
+	var major, minor uint32
+	if mode&unix.S_IFMT == unix.S_IFBLK {
+		major, minor = unix.Major(rdev), unix.Minor(rdev)
+	} else {
+		mountInfo := c.findMount(target)
+		if mountInfo == nil {
+			return &csi.VolumeCondition{}
+		}
+		major, minor = uint32(mountInfo.Major), uint32(mountInfo.Minor)
+		problems = append(problems, c.checkFilesystem(target, mountInfo)...)
+	}
+	if major != 0 {
+		// major 0 is used by filesystems without block device, e.g. tmpfs
+		problems = append(problems, c.checkDevice(major, minor)...)
+	}
+
+	if len(problems) == 0 {
+		return &csi.VolumeCondition{Message: "volume is healthy"}
+	}
+	return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+}
+
+// findMount returns the last mount on target, nil if target is not a mount point
+func (c *volumeHealthChecker) findMount(target string) *mount.MountInfo {
+	mountInfos, err := mount.ParseMountInfo(c.mountInfoPath)
+	if err != nil {
+		klog.V(4).Infof("failed to parse %s: %v", c.mountInfoPath, err)
+		return nil
+	}
+	target = filepath.Clean(target)
+	var found *mount.MountInfo
+	for i := range mountInfos {
+		if mountInfos[i].MountPoint == target {
+			found = &mountInfos[i]
+		}
+	}
+	return found
+}
+
+func (c *volumeHealthChecker) checkFilesystem(target string, mountInfo *mount.MountInfo) []string {
+	var problems []string
+	devName := filepath.Base(mountInfo.Source)
+	if err := c.statfs(target); errors.Is(err, unix.EIO) {
+		if mountInfo.FsType == "xfs" {
+			problems = append(problems, fmt.Sprintf("xfs filesystem on %s is shut down", devName))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s filesystem on %s returns I/O errors", mountInfo.FsType, devName))
+		}
+	}
+
+	// a filesystem remounted read-only after errors, e.g. ext4 with errors=remount-ro, keeps read-write mount options
+	if hasOption(mountInfo.MountOptions, "rw") && hasOption(mountInfo.SuperOptions, "ro") {
+		problems = append(problems, fmt.Sprintf("%s filesystem on %s was remounted read-only after errors", mountInfo.FsType, devName))
+	}
+
+	switch mountInfo.FsType {
+	case "ext2", "ext3", "ext4":
+		if count, err := readUint(filepath.Join(c.sysfsPath, "fs", "ext4", devName, "errors_count"), 10); err == nil && count > 0 {
+			problems = append(problems, fmt.Sprintf("%s filesystem on %s recorded %d errors", mountInfo.FsType, devName, count))
+		}
+	}
+	return problems
+}
+
+func (c *volumeHealthChecker) checkDevice(major, minor uint32) []string {
+	devPath, err := filepath.EvalSymlinks(filepath.Join(c.sysfsPath, "dev", "block", fmt.Sprintf("%d:%d", major, minor)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{fmt.Sprintf("block device %d:%d has disappeared", major, minor)}
+		}
+		klog.V(4).Infof("failed to resolve block device %d:%d: %v", major, minor, err)
+		return nil
+	}
+	// the SCSI device of a partition is the one of its disk
+	diskPath := devPath
+	if _, err := os.Stat(filepath.Join(devPath, "partition")); err == nil {
+		diskPath = filepath.Dir(devPath)
+	}
+	disk := filepath.Base(diskPath)
+
+	scsiDevice, err := filepath.EvalSymlinks(filepath.Join(diskPath, "device"))
+	if err != nil {
+		// virtual device, e.g. loop or device mapper
+		return nil
+	}
+	hctl := filepath.Base(scsiDevice)
+	if strings.Count(hctl, ":") != 3 {
+		// not a SCSI disk, e.g. NVMe
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(c.sysfsPath, "bus", "scsi", "devices", hctl)); os.IsNotExist(err) {
+		return []string{fmt.Sprintf("SCSI device %s of %s has disappeared from /sys/bus/scsi", hctl, disk)}
+	}
+
+	var problems []string
+	if state, err := os.ReadFile(filepath.Join(scsiDevice, "state")); err == nil {
+		if s := strings.TrimSpace(string(state)); s != "running" {
+			problems = append(problems, fmt.Sprintf("SCSI device %s of %s is %s", hctl, disk, s))
+		}
+	}
+	if count, err := readUint(filepath.Join(scsiDevice, "ioerr_cnt"), 0); err == nil && count > 0 {
+		problems = append(problems, fmt.Sprintf("%s reported %d I/O errors", disk, count))
+	}
+	return problems
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// readUint reads an unsigned integer from a sysfs file, base 0 accepts the 0x prefix of hex counters
+func readUint(path string, base int) (uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), base, 64)
+}
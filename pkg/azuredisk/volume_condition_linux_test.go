@@ -0,0 +1,178 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newTestVolumeHealthChecker creates a sysfs with SCSI disk sdc(8:32) and its partition sdc1(8:33)
+func newTestVolumeHealthChecker(t *testing.T, mountInfo string) (*volumeHealthChecker, string) {
+	root := t.TempDir()
+	sysfs := filepath.Join(root, "sys")
+	scsiDevice := filepath.Join(sysfs, "devices", "pci0000:00", "host0", "target0:0:0", "0:0:0:1")
+	disk := filepath.Join(scsiDevice, "block", "sdc")
+	for _, dir := range []string{
+		filepath.Join(disk, "sdc1"),
+		filepath.Join(sysfs, "dev", "block"),
+		filepath.Join(sysfs, "bus", "scsi", "devices"),
+		filepath.Join(sysfs, "fs", "ext4", "sdc1"),
+	} {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	assert.NoError(t, os.Symlink(scsiDevice, filepath.Join(disk, "device")))
+	assert.NoError(t, os.Symlink(disk, filepath.Join(sysfs, "dev", "block", "8:32")))
+	assert.NoError(t, os.Symlink(filepath.Join(disk, "sdc1"), filepath.Join(sysfs, "dev", "block", "8:33")))
+	assert.NoError(t, os.Symlink(scsiDevice, filepath.Join(sysfs, "bus", "scsi", "devices", "0:0:0:1")))
+	for path, content := range map[string]string{
+		filepath.Join(disk, "sdc1", "partition"):                   "1\n",
+		filepath.Join(scsiDevice, "state"):                         "running\n",
+		filepath.Join(scsiDevice, "ioerr_cnt"):                     "0x0\n",
+		filepath.Join(sysfs, "fs", "ext4", "sdc1", "errors_count"): "0\n",
+		filepath.Join(root, "mountinfo"):                           mountInfo,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	return &volumeHealthChecker{
+		sysfsPath:     sysfs,
+		mountInfoPath: filepath.Join(root, "mountinfo"),
+		stat: func(path string) (uint32, uint64, error) {
+			if path == "/dev/block-volume" {
+				return unix.S_IFBLK, unix.Mkdev(8, 32), nil
+			}
+			return unix.S_IFDIR, 0, nil
+		},
+		statfs: func(string) error { return nil },
+	}, sysfs
+}
+
+func TestVolumeHealthChecker(t *testing.T) {
+	const (
+		target     = "/var/lib/kubelet/plugins/kubernetes.io/csi/disk.csi.azure.com/abc/globalmount"
+		scsiDevice = "devices/pci0000:00/host0/target0:0:0/0:0:0:1"
+	)
+	ext4MountInfo := "100 29 8:33 / " + target + " rw,relatime shared:1 - ext4 /dev/sdc1 rw\n"
+
+	tests := []struct {
+		desc      string
+		mountInfo string
+		target    string
+		setup     func(t *testing.T, c *volumeHealthChecker, sysfs string)
+		expected  *csi.VolumeCondition
+	}{
+		{
+			desc:      "healthy filesystem",
+			mountInfo: ext4MountInfo,
+			target:    target,
+			expected:  &csi.VolumeCondition{Message: "volume is healthy"},
+		},
+		{
+			desc:      "not a mount point",
+			mountInfo: ext4MountInfo,
+			target:    "/tmp/not-mounted",
+			expected:  &csi.VolumeCondition{},
+		},
+		{
+			desc:      "filesystem remounted read-only",
+			mountInfo: "100 29 8:33 / " + target + " rw,relatime shared:1 - ext4 /dev/sdc1 ro,errors=remount-ro\n",
+			target:    target,
+			expected:  &csi.VolumeCondition{Abnormal: true, Message: "ext4 filesystem on sdc1 was remounted read-only after errors"},
+		},
+		{
+			desc:      "filesystem mounted read-only",
+			mountInfo: "100 29 8:33 / " + target + " ro,relatime shared:1 - ext4 /dev/sdc1 ro\n",
+			target:    target,
+			expected:  &csi.VolumeCondition{Message: "volume is healthy"},
+		},
+		{
+			desc:      "ext4 errors",
+			mountInfo: ext4MountInfo,
+			target:    target,
+			setup: func(t *testing.T, _ *volumeHealthChecker, sysfs string) {
+				assert.NoError(t, os.WriteFile(filepath.Join(sysfs, "fs", "ext4", "sdc1", "errors_count"), []byte("3\n"), 0644))
+			},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "ext4 filesystem on sdc1 recorded 3 errors"},
+		},
+		{
+			desc:      "xfs shutdown",
+			mountInfo: "100 29 8:33 / " + target + " rw,relatime shared:1 - xfs /dev/sdc1 rw\n",
+			target:    target,
+			setup: func(_ *testing.T, c *volumeHealthChecker, _ string) {
+				c.statfs = func(string) error { return unix.EIO }
+			},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "xfs filesystem on sdc1 is shut down"},
+		},
+		{
+			desc:      "I/O errors and offline device",
+			mountInfo: ext4MountInfo,
+			target:    target,
+			setup: func(t *testing.T, _ *volumeHealthChecker, sysfs string) {
+				assert.NoError(t, os.WriteFile(filepath.Join(sysfs, scsiDevice, "ioerr_cnt"), []byte("0x1a\n"), 0644))
+				assert.NoError(t, os.WriteFile(filepath.Join(sysfs, scsiDevice, "state"), []byte("offline\n"), 0644))
+			},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "SCSI device 0:0:0:1 of sdc is offline; sdc reported 26 I/O errors"},
+		},
+		{
+			desc:      "device disappeared from SCSI bus",
+			mountInfo: ext4MountInfo,
+			target:    "/dev/block-volume",
+			setup: func(t *testing.T, _ *volumeHealthChecker, sysfs string) {
+				assert.NoError(t, os.Remove(filepath.Join(sysfs, "bus", "scsi", "devices", "0:0:0:1")))
+			},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "SCSI device 0:0:0:1 of sdc has disappeared from /sys/bus/scsi"},
+		},
+		{
+			desc:      "block device disappeared",
+			mountInfo: ext4MountInfo,
+			target:    target,
+			setup: func(t *testing.T, _ *volumeHealthChecker, sysfs string) {
+				assert.NoError(t, os.Remove(filepath.Join(sysfs, "dev", "block", "8:33")))
+			},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "block device 8:33 has disappeared"},
+		},
+		{
+			desc:      "healthy block volume",
+			mountInfo: ext4MountInfo,
+			target:    "/dev/block-volume",
+			expected:  &csi.VolumeCondition{Message: "volume is healthy"},
+		},
+		{
+			desc:      "filesystem without block device",
+			mountInfo: "100 29 0:45 / " + target + " rw,relatime shared:1 - tmpfs tmpfs rw\n",
+			target:    target,
+			expected:  &csi.VolumeCondition{Message: "volume is healthy"},
+		},
+	}
+
+	for _, test := range tests {
+		c, sysfs := newTestVolumeHealthChecker(t, test.mountInfo)
+		if test.setup != nil {
+			test.setup(t, c, sysfs)
+		}
+		assert.Equal(t, test.expected, c.check(test.target), test.desc)
+	}
+}
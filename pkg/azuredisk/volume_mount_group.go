@@ -0,0 +1,52 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getVolumeMountGroup returns the group ID kubelet delegates the fsGroup of the pod with, -1 if there is none
+// or VOLUME_MOUNT_GROUP is not enabled
+func (d *DriverCore) getVolumeMountGroup(volumeCapability *csi.VolumeCapability) (int, error) {
+	group := volumeCapability.GetMount().GetVolumeMountGroup()
+	if group == "" || !d.enableVolumeMountGroup {
+		return -1, nil
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return -1, status.Errorf(codes.InvalidArgument, "volume mount group %s is not a group ID", group)
+	}
+	return gid, nil
+}
+
+// volumeMountGroupOptions returns the mount options of a filesystem of fsType owned by the group gid, new files
+// inherit the group of their directory with grpid and resgid lets the group use the blocks reserved on ext filesystems
+func volumeMountGroupOptions(fsType string, gid int) []string {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return []string{"grpid", fmt.Sprintf("resgid=%d", gid)}
+	case "xfs":
+		return []string{"grpid"}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// setVolumeRootGroup gives the group gid access to the root of the filesystem mounted at path the way kubelet does
+// for fsGroup, without walking the files of the volume: the root is owned by the group, which can read, write and
+// traverse it, and the setgid bit makes new files inherit the group
+func setVolumeRootGroup(path string, gid int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the owner of %s", path)
+	}
+	mode := info.Mode() | 0070 | os.ModeSetgid
+	if int(stat.Gid) == gid && mode == info.Mode() {
+		return nil
+	}
+	if err := os.Lchown(path, -1, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	klog.V(2).Infof("set group %d on %s with mode %v", gid, path, mode)
+	return nil
+}
+
+// checkVolumeRootGroup returns an error if the root of the filesystem mounted at path is not owned by the group gid,
+// the group is only set at stage since changing it would revoke the access of pods already using the volume
+func checkVolumeRootGroup(path string, gid int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the owner of %s", path)
+	}
+	if int(stat.Gid) != gid {
+		return fmt.Errorf("%s is owned by group %d", path, stat.Gid)
+	}
+	return nil
+}
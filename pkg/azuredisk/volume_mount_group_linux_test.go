@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetVolumeRootGroup(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "globalmount")
+	assert.NoError(t, os.Mkdir(root, 0750))
+	// the group of the test process can be set without privileges
+	gid := os.Getgid()
+
+	assert.NoError(t, setVolumeRootGroup(root, gid))
+	info, err := os.Stat(root)
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSetgid|0770, info.Mode())
+	assert.Equal(t, uint32(gid), info.Sys().(*syscall.Stat_t).Gid)
+
+	assert.NoError(t, setVolumeRootGroup(root, gid))
+	assert.Error(t, setVolumeRootGroup(filepath.Join(root, "missing"), gid))
+}
+
+func TestCheckVolumeRootGroup(t *testing.T) {
+	root := t.TempDir()
+	gid := os.Getgid()
+	assert.NoError(t, checkVolumeRootGroup(root, gid))
+	assert.Error(t, checkVolumeRootGroup(root, gid+1), "volume staged with another group")
+	assert.Error(t, checkVolumeRootGroup(filepath.Join(root, "missing"), gid))
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetVolumeMountGroup(t *testing.T) {
+	mountCapability := func(group string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group}}}
+	}
+	tests := []struct {
+		desc          string
+		disabled      bool
+		capability    *csi.VolumeCapability
+		expectedGID   int
+		expectedError error
+	}{
+		{
+			desc:        "VOLUME_MOUNT_GROUP is not enabled",
+			disabled:    true,
+			capability:  mountCapability("2000"),
+			expectedGID: -1,
+		},
+		{
+			desc:        "block volume",
+			capability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+			expectedGID: -1,
+		},
+		{
+			desc:        "no volume mount group",
+			capability:  mountCapability(""),
+			expectedGID: -1,
+		},
+		{
+			desc:        "volume mount group",
+			capability:  mountCapability("2000"),
+			expectedGID: 2000,
+		},
+		{
+			desc:          "group name",
+			capability:    mountCapability("staff"),
+			expectedGID:   -1,
+			expectedError: status.Error(codes.InvalidArgument, "volume mount group staff is not a group ID"),
+		},
+		{
+			desc:          "negative group ID",
+			capability:    mountCapability("-1"),
+			expectedGID:   -1,
+			expectedError: status.Error(codes.InvalidArgument, "volume mount group -1 is not a group ID"),
+		},
+	}
+	for _, test := range tests {
+		d := &DriverCore{enableVolumeMountGroup: !test.disabled}
+		gid, err := d.getVolumeMountGroup(test.capability)
+		assert.Equal(t, test.expectedError, err, test.desc)
+		assert.Equal(t, test.expectedGID, gid, test.desc)
+	}
+}
+
+func TestVolumeMountGroupOptions(t *testing.T) {
+	assert.Equal(t, []string{"grpid", "resgid=2000"}, volumeMountGroupOptions("ext4", 2000))
+	assert.Equal(t, []string{"grpid", "resgid=0"}, volumeMountGroupOptions("ext3", 0))
+	assert.Equal(t, []string{"grpid"}, volumeMountGroupOptions("xfs", 2000))
+	assert.Empty(t, volumeMountGroupOptions("btrfs", 2000))
+}
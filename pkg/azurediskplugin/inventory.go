@@ -0,0 +1,66 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azuredisk"
+)
+
+const inventoryCommand = "inventory"
+
+// runInventory handles `azurediskplugin inventory [flags]`, which reports orphaned disks and snapshots
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet(inventoryCommand, flag.ExitOnError)
+	options := azuredisk.InventoryOptions{}
+	fs.StringVar(&options.DriverName, "drivername", consts.DefaultDriverName, "name of the driver")
+	fs.StringVar(&options.Kubeconfig, "kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+	fs.StringVar(&options.CloudConfigSecretName, "cloud-config-secret-name", "azure-cloud-provider", "cloud config secret name")
+	fs.StringVar(&options.CloudConfigSecretNamespace, "cloud-config-secret-namespace", "kube-system", "cloud config secret namespace")
+	resourceGroups := fs.String("resource-groups", "", "comma separated resource groups scanned in addition to the resource groups used by the cluster")
+	fs.StringVar(&options.ClusterName, "cluster-name", "", "name of the cluster, only orphans with a matching k8s-azure-cluster-name tag are deleted, required by delete-orphans")
+	fs.BoolVar(&options.DeleteOrphans, "delete-orphans", false, "tag orphans not tagged yet, and delete orphans tagged longer than orphan-grace-period")
+	fs.DurationVar(&options.OrphanGracePeriod, "orphan-grace-period", 7*24*time.Hour, "time an orphan is kept after being tagged before it's deleted")
+	output := fs.String("output", azuredisk.InventoryOutputTable, "output format, available values: table, json")
+	if v := flag.CommandLine.Lookup("v"); v != nil {
+		fs.Var(v.Value, v.Name, v.Usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != azuredisk.InventoryOutputTable && *output != azuredisk.InventoryOutputJSON {
+		return fmt.Errorf("output format(%s) is not supported, supported values are %s, %s", *output, azuredisk.InventoryOutputTable, azuredisk.InventoryOutputJSON)
+	}
+	for _, rg := range strings.Split(*resourceGroups, ",") {
+		if rg = strings.TrimSpace(rg); rg != "" {
+			options.ResourceGroups = append(options.ResourceGroups, rg)
+		}
+	}
+
+	report, err := azuredisk.RunInventory(context.Background(), &options)
+	if err != nil {
+		return err
+	}
+	return report.Print(os.Stdout, *output)
+}
@@ -40,10 +40,19 @@ func init() {
 var (
 	version        = flag.Bool("version", false, "Print the version and exit.")
 	metricsAddress = flag.String("metrics-address", "", "export the metrics")
+	fstrimEndpoint = flag.String("fstrim-hook-endpoint", "", "endpoint serving POST "+azuredisk.FstrimHookPath+" to trim a staged volume on demand, a unix socket (e.g. unix:///csi/fstrim.sock) or a TCP address bound to the loopback interface (e.g. tcp://127.0.0.1:29605), empty disables the hook")
+	debugEndpoint  = flag.String("debug-endpoint", "", "endpoint serving GET "+azuredisk.ARMLimiterDebugPath+" with the state of the ARM rate limiter, a unix socket (e.g. unix:///csi/debug.sock) or a TCP address bound to the loopback interface (e.g. tcp://127.0.0.1:29606), empty disables it")
 	driverOptions  azuredisk.DriverOptions
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == inventoryCommand {
+		if err := runInventory(os.Args[2:]); err != nil {
+			klog.Fatalf("inventory failed with %v", err)
+		}
+		os.Exit(0)
+	}
+
 	flag.Parse()
 	if *version {
 		info, err := azuredisk.GetVersionYAML(driverOptions.DriverName)
@@ -55,6 +64,8 @@ func main() {
 	}
 
 	exportMetrics()
+	serveFstrimHook()
+	serveDebugEndpoint()
 	handle()
 	os.Exit(0)
 }
@@ -81,6 +92,44 @@ func exportMetrics() {
 	serve(context.Background(), l, serveMetrics)
 }
 
+func serveFstrimHook() {
+	if *fstrimEndpoint == "" {
+		return
+	}
+	l, err := azuredisk.ListenFstrimHook(context.Background(), *fstrimEndpoint)
+	if err != nil {
+		klog.Fatalf("failed to get listener for fstrim hook endpoint: %v", err)
+	}
+	klog.V(2).Infof("set up fstrim hook on %v", l.Addr().String())
+	go func() {
+		defer l.Close()
+		m := http.NewServeMux()
+		m.Handle(azuredisk.FstrimHookPath, azuredisk.FstrimHookHandler())
+		if err := trapClosedConnErr(http.Serve(l, m)); err != nil {
+			klog.Fatalf("fstrim hook serve failure(%v), endpoint(%v)", err, *fstrimEndpoint)
+		}
+	}()
+}
+
+func serveDebugEndpoint() {
+	if *debugEndpoint == "" {
+		return
+	}
+	l, err := azuredisk.ListenDebugEndpoint(context.Background(), *debugEndpoint)
+	if err != nil {
+		klog.Fatalf("failed to get listener for debug endpoint: %v", err)
+	}
+	klog.V(2).Infof("set up debug endpoint on %v", l.Addr().String())
+	go func() {
+		defer l.Close()
+		m := http.NewServeMux()
+		m.Handle(azuredisk.ARMLimiterDebugPath, azuredisk.ARMLimiterDebugHandler())
+		if err := trapClosedConnErr(http.Serve(l, m)); err != nil {
+			klog.Fatalf("debug endpoint serve failure(%v), endpoint(%v)", err, *debugEndpoint)
+		}
+	}()
+}
+
 func serve(_ context.Context, l net.Listener, serveFunc func(net.Listener) error) {
 	path := l.Addr().String()
 	klog.V(2).Infof("set up prometheus server on %v", path)
@@ -95,6 +144,7 @@ func serve(_ context.Context, l net.Listener, serveFunc func(net.Listener) error
 func serveMetrics(l net.Listener) error {
 	m := http.NewServeMux()
 	m.Handle("/metrics", legacyregistry.Handler()) //nolint, because azure cloud provider uses legacyregistry currently
+	m.Handle(azuredisk.HealthzPath, azuredisk.HealthzHandler())
 	return trapClosedConnErr(http.Serve(l, m))
 }
 
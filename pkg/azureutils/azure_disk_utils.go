@@ -32,6 +32,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	snapshotclientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/uuid"
@@ -116,11 +117,15 @@ type ManagedDiskParameters struct {
 	DiskMBPSReadWrite       string
 	DiskName                string
 	EnableBursting          *bool
+	Encryption              string
+	FencingMode             string
 	PerformancePlus         *bool
+	FsFeatures              string
 	FsType                  string
 	Location                string
 	LogicalSectorSize       int
 	MaxShares               int
+	MkfsOptions             string
 	NetworkAccessPolicy     string
 	PublicNetworkAccess     string
 	PerfProfile             string
@@ -266,6 +271,16 @@ func GetKubeClient(kubeconfig string) (clientset.Interface, error) {
 	return clientset.NewForConfig(config)
 }
 
+// GetSnapshotClient returns the clientset of VolumeSnapshot CRDs
+func GetSnapshotClient(kubeconfig string) (snapshotclientset.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshotclientset.NewForConfig(config)
+}
+
 // GetDiskLUN : deviceInfo could be a LUN number or a device path, e.g. /dev/disk/azure/scsi1/lun2
 func GetDiskLUN(deviceInfo string) (int32, error) {
 	var diskLUN string
@@ -347,6 +362,103 @@ func GetMaxShares(attributes map[string]string) (int, error) {
 	return 1, nil // disk is not shared
 }
 
+// IsPersistentReservationFencing returns whether the nodes writing to the shared disk are fenced with SCSI persistent reservations
+func IsPersistentReservationFencing(attributes map[string]string) bool {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.FencingModeField) {
+			return strings.EqualFold(v, consts.FencingModePersistentReservation)
+		}
+	}
+	return false
+}
+
+// IsLuksEncryption returns whether the volume is encrypted with LUKS on the node
+func IsLuksEncryption(attributes map[string]string) bool {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.EncryptionField) {
+			return strings.EqualFold(v, consts.EncryptionLuks)
+		}
+	}
+	return false
+}
+
+// GetDiskControllerType returns the type of the controller the disk is attached to on the node, scsi or nvme,
+// an empty string means the disk is discovered on both
+func GetDiskControllerType(attributes map[string]string) string {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.DiskControllerTypeField) {
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// GetFormatPolicy returns the format policy in attributes, ifEmpty by default
+func GetFormatPolicy(attributes map[string]string) (string, error) {
+	policy := consts.FormatPolicyIfEmpty
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.FormatPolicyField) {
+			switch strings.ToLower(v) {
+			case consts.FormatPolicyIfEmpty, consts.FormatPolicyAlways, consts.FormatPolicyNever:
+				policy = strings.ToLower(v)
+			default:
+				return "", fmt.Errorf("formatPolicy %s is not supported, supported policies are ifEmpty, %s and %s",
+					v, consts.FormatPolicyAlways, consts.FormatPolicyNever)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// IsFstrimEnabled returns whether the volume is trimmed periodically and on demand, defaultEnabled if fstrim is
+// not set in attributes
+func IsFstrimEnabled(attributes map[string]string, defaultEnabled bool) (bool, error) {
+	enabled := defaultEnabled
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.FstrimField) {
+			value, err := strconv.ParseBool(v)
+			if err != nil {
+				return false, fmt.Errorf("fstrim %s is not supported, supported values are true and false", v)
+			}
+			enabled = value
+		}
+	}
+	return enabled, nil
+}
+
+// GetFsckPolicy returns the filesystem check policy and timeout in attributes, fsckTimeout is a duration, e.g. 10m,
+// or a number of seconds
+func GetFsckPolicy(attributes map[string]string) (string, time.Duration, error) {
+	policy := consts.FsckPolicyAuto
+	timeout := consts.DefaultFsckTimeoutSec * time.Second
+	for k, v := range attributes {
+		switch strings.ToLower(k) {
+		case consts.FsckPolicyField:
+			switch strings.ToLower(v) {
+			case consts.FsckPolicyAuto, consts.FsckPolicyAlways, consts.FsckPolicyNever, consts.FsckPolicyRepairOnError:
+				policy = strings.ToLower(v)
+			default:
+				return "", 0, fmt.Errorf("fsckPolicy %s is not supported, supported policies are %s, %s, %s and %s",
+					v, consts.FsckPolicyAuto, consts.FsckPolicyAlways, consts.FsckPolicyNever, consts.FsckPolicyRepairOnError)
+			}
+		case consts.FsckTimeoutField:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				seconds, convErr := strconv.Atoi(v)
+				if convErr != nil {
+					return "", 0, fmt.Errorf("invalid fsckTimeout %s: %v", v, err)
+				}
+				d = time.Duration(seconds) * time.Second
+			}
+			if d <= 0 {
+				return "", 0, fmt.Errorf("fsckTimeout %s must be positive", v)
+			}
+			timeout = d
+		}
+	}
+	return policy, timeout, nil
+}
+
 func GetResourceGroupFromURI(diskURI string) (string, error) {
 	fields := strings.Split(diskURI, "/")
 	if len(fields) != 9 || strings.ToLower(fields[3]) != "resourcegroups" {
@@ -451,8 +563,8 @@ func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability, maxShares int) e
 		if blockVolume != nil && mountVolume != nil {
 			return fmt.Errorf("blockVolume and mountVolume are both not nil")
 		}
+		// a filesystem could only be shared across nodes read-only
 		if mountVolume != nil && (accessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
-			accessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY ||
 			accessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER) {
 			return fmt.Errorf("mountVolume is not supported for access mode: %s", accessMode.String())
 		}
@@ -465,6 +577,17 @@ func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability, maxShares int) e
 	return nil
 }
 
+// IsMultiNodeReadOnly returns whether volCap is MULTI_NODE_READER_ONLY
+func IsMultiNodeReadOnly(volCap *csi.VolumeCapability) bool {
+	return volCap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// IsReadOnlyAccessMode returns whether volCap is SINGLE_NODE_READER_ONLY or MULTI_NODE_READER_ONLY
+func IsReadOnlyAccessMode(volCap *csi.VolumeCapability) bool {
+	mode := volCap.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
 func IsValidAccessModes(volCaps []*csi.VolumeCapability) bool {
 	hasSupport := func(cap *csi.VolumeCapability) bool {
 		for _, c := range volumeCaps {
@@ -636,6 +759,36 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 			diskParams.Tags[consts.PvNameTag] = v
 		case consts.FsTypeField:
 			diskParams.FsType = strings.ToLower(v)
+		case consts.MkfsOptionsField:
+			diskParams.MkfsOptions = v
+		case consts.FsFeaturesField:
+			diskParams.FsFeatures = v
+		case consts.EncryptionField:
+			if !strings.EqualFold(v, consts.EncryptionNone) && !strings.EqualFold(v, consts.EncryptionLuks) {
+				return diskParams, fmt.Errorf("encryption %s is not supported, supported values are %s and %s", v, consts.EncryptionNone, consts.EncryptionLuks)
+			}
+			diskParams.Encryption = strings.ToLower(v)
+		case consts.DiskControllerTypeField:
+			if !strings.EqualFold(v, consts.DiskControllerTypeSCSI) && !strings.EqualFold(v, consts.DiskControllerTypeNVMe) {
+				return diskParams, fmt.Errorf("diskControllerType %s is not supported, supported values are SCSI and NVMe", v)
+			}
+		case consts.FormatPolicyField:
+			if _, err := GetFormatPolicy(map[string]string{k: v}); err != nil {
+				return diskParams, err
+			}
+		case consts.FsckPolicyField, consts.FsckTimeoutField:
+			if _, _, err := GetFsckPolicy(map[string]string{k: v}); err != nil {
+				return diskParams, err
+			}
+		case consts.FstrimField:
+			if _, err := IsFstrimEnabled(map[string]string{k: v}, true); err != nil {
+				return diskParams, err
+			}
+		case consts.FencingModeField:
+			if !strings.EqualFold(v, consts.FencingModeNone) && !strings.EqualFold(v, consts.FencingModePersistentReservation) {
+				return diskParams, fmt.Errorf("fencingMode %s is not supported, supported modes are %s and %s", v, consts.FencingModeNone, consts.FencingModePersistentReservation)
+			}
+			diskParams.FencingMode = strings.ToLower(v)
 		case consts.KindField:
 			// fix csi migration issue: https://github.com/kubernetes/kubernetes/issues/103433
 			diskParams.VolumeContext[consts.KindField] = string(v1.AzureManagedDisk)
@@ -681,6 +834,10 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 		}
 	}
 
+	if diskParams.FencingMode == consts.FencingModePersistentReservation && diskParams.MaxShares < 2 {
+		return diskParams, fmt.Errorf("fencingMode %s requires a shared disk with maxShares greater than 1", consts.FencingModePersistentReservation)
+	}
+
 	if strings.EqualFold(diskParams.AccountType, string(armcompute.DiskStorageAccountTypesPremiumV2LRS)) {
 		if diskParams.CachingMode != "" && !strings.EqualFold(string(diskParams.CachingMode), string(v1.AzureDataDiskCachingNone)) {
 			return diskParams, fmt.Errorf("cachingMode %s is not supported for %s", diskParams.CachingMode, armcompute.DiskStorageAccountTypesPremiumV2LRS)
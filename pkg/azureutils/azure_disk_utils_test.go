@@ -327,6 +327,11 @@ users:
 	}
 }
 
+func TestGetSnapshotClient(t *testing.T) {
+	_, err := GetSnapshotClient("/tmp/non-existing-kubeconfig")
+	assert.Error(t, err)
+}
+
 func TestGetDiskLUN(t *testing.T) {
 	tests := []struct {
 		deviceInfo  string
@@ -474,6 +479,149 @@ func TestGetFStype(t *testing.T) {
 	}
 }
 
+func TestGetFormatPolicy(t *testing.T) {
+	tests := []struct {
+		attributes     map[string]string
+		expectedPolicy string
+		expectedErr    bool
+	}{
+		{
+			expectedPolicy: consts.FormatPolicyIfEmpty,
+		},
+		{
+			attributes:     map[string]string{"formatPolicy": "IfEmpty"},
+			expectedPolicy: consts.FormatPolicyIfEmpty,
+		},
+		{
+			attributes:     map[string]string{"formatpolicy": "never"},
+			expectedPolicy: consts.FormatPolicyNever,
+		},
+		{
+			attributes:     map[string]string{"formatPolicy": "Always"},
+			expectedPolicy: consts.FormatPolicyAlways,
+		},
+		{
+			attributes:  map[string]string{"formatPolicy": "sometimes"},
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		policy, err := GetFormatPolicy(test.attributes)
+		if test.expectedErr {
+			assert.Error(t, err, test.attributes)
+			continue
+		}
+		assert.NoError(t, err, test.attributes)
+		assert.Equal(t, test.expectedPolicy, policy, test.attributes)
+	}
+}
+
+func TestIsFstrimEnabled(t *testing.T) {
+	tests := []struct {
+		attributes      map[string]string
+		defaultEnabled  bool
+		expectedEnabled bool
+		expectedErr     bool
+	}{
+		{
+			defaultEnabled:  true,
+			expectedEnabled: true,
+		},
+		{
+			defaultEnabled:  false,
+			expectedEnabled: false,
+		},
+		{
+			attributes:      map[string]string{"fstrim": "true"},
+			defaultEnabled:  false,
+			expectedEnabled: true,
+		},
+		{
+			attributes:      map[string]string{"fsTrim": "False"},
+			defaultEnabled:  true,
+			expectedEnabled: false,
+		},
+		{
+			attributes:     map[string]string{"fstrim": "weekly"},
+			defaultEnabled: true,
+			expectedErr:    true,
+		},
+	}
+	for _, test := range tests {
+		enabled, err := IsFstrimEnabled(test.attributes, test.defaultEnabled)
+		if test.expectedErr {
+			assert.Error(t, err, test.attributes)
+			continue
+		}
+		assert.NoError(t, err, test.attributes)
+		assert.Equal(t, test.expectedEnabled, enabled, test.attributes)
+	}
+}
+
+func TestGetFsckPolicy(t *testing.T) {
+	tests := []struct {
+		attributes      map[string]string
+		expectedPolicy  string
+		expectedTimeout time.Duration
+		expectedErr     bool
+	}{
+		{
+			expectedPolicy:  consts.FsckPolicyAuto,
+			expectedTimeout: 10 * time.Minute,
+		},
+		{
+			attributes:      map[string]string{"fsckPolicy": "RepairOnError", "fsckTimeout": "30m"},
+			expectedPolicy:  consts.FsckPolicyRepairOnError,
+			expectedTimeout: 30 * time.Minute,
+		},
+		{
+			attributes:      map[string]string{"fsckpolicy": "never", "fscktimeout": "120"},
+			expectedPolicy:  consts.FsckPolicyNever,
+			expectedTimeout: 2 * time.Minute,
+		},
+		{
+			attributes:  map[string]string{"fsckPolicy": "sometimes"},
+			expectedErr: true,
+		},
+		{
+			attributes:  map[string]string{"fsckTimeout": "soon"},
+			expectedErr: true,
+		},
+		{
+			attributes:  map[string]string{"fsckTimeout": "-1m"},
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		policy, timeout, err := GetFsckPolicy(test.attributes)
+		if test.expectedErr {
+			assert.Error(t, err, test.attributes)
+			continue
+		}
+		assert.NoError(t, err, test.attributes)
+		assert.Equal(t, test.expectedPolicy, policy, test.attributes)
+		assert.Equal(t, test.expectedTimeout, timeout, test.attributes)
+	}
+}
+
+func TestIsPersistentReservationFencing(t *testing.T) {
+	assert.False(t, IsPersistentReservationFencing(nil))
+	assert.False(t, IsPersistentReservationFencing(map[string]string{consts.FencingModeField: consts.FencingModeNone}))
+	assert.True(t, IsPersistentReservationFencing(map[string]string{"fencingMode": "persistentReservation"}))
+}
+
+func TestGetDiskControllerType(t *testing.T) {
+	assert.Equal(t, "", GetDiskControllerType(nil))
+	assert.Equal(t, consts.DiskControllerTypeNVMe, GetDiskControllerType(map[string]string{"diskControllerType": "NVMe"}))
+	assert.Equal(t, consts.DiskControllerTypeSCSI, GetDiskControllerType(map[string]string{consts.DiskControllerTypeField: "SCSI"}))
+}
+
+func TestIsLuksEncryption(t *testing.T) {
+	assert.False(t, IsLuksEncryption(nil))
+	assert.False(t, IsLuksEncryption(map[string]string{consts.EncryptionField: consts.EncryptionNone}))
+	assert.True(t, IsLuksEncryption(map[string]string{"Encryption": "LUKS"}))
+}
+
 func TestGetMaxShares(t *testing.T) {
 	tests := []struct {
 		options       map[string]string
@@ -976,6 +1124,51 @@ func TestIsValidVolumeCapabilities(t *testing.T) {
 			maxShares:      2,
 			expectedResult: fmt.Errorf("mountVolume is not supported for access mode: MULTI_NODE_MULTI_WRITER"),
 		},
+		{
+			description: "[Success] Returns true for shared read-only mount access mode",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
+			},
+			maxShares:      2,
+			expectedResult: nil,
+		},
+		{
+			description: "[Failure] Returns false for read-only mount access mode on non-shared disk",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
+			},
+			maxShares:      1,
+			expectedResult: fmt.Errorf("access mode: MULTI_NODE_READER_ONLY is not supported for non-shared disk"),
+		},
+		{
+			description: "[Success] Returns true for shared read-only block access mode",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Block{
+						Block: &csi.VolumeCapability_BlockVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
+			},
+			maxShares:      2,
+			expectedResult: nil,
+		},
 		{
 			description: "[Failure] Returns false for invalid mount access mode",
 			volCaps: []*csi.VolumeCapability{
@@ -1404,6 +1597,109 @@ func TestParseDiskParameters(t *testing.T) {
 			},
 			expectedError: fmt.Errorf("parse invalidValue failed with error: strconv.Atoi: parsing \"invalidValue\": invalid syntax"),
 		},
+		{
+			name:        "invalid fencingMode value in parameters",
+			inputParams: map[string]string{consts.FencingModeField: "invalidValue"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FencingModeField: "invalidValue"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("fencingMode invalidValue is not supported, supported modes are none and persistentreservation"),
+		},
+		{
+			name:        "persistent reservation fencing without shared disk",
+			inputParams: map[string]string{consts.FencingModeField: "persistentReservation"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FencingModeField: "persistentReservation"},
+				DeviceSettings: make(map[string]string),
+				FencingMode:    consts.FencingModePersistentReservation,
+			},
+			expectedError: fmt.Errorf("fencingMode persistentreservation requires a shared disk with maxShares greater than 1"),
+		},
+		{
+			name:        "persistent reservation fencing",
+			inputParams: map[string]string{consts.FencingModeField: "persistentReservation", consts.MaxSharesField: "2"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FencingModeField: "persistentReservation", consts.MaxSharesField: "2"},
+				DeviceSettings: make(map[string]string),
+				FencingMode:    consts.FencingModePersistentReservation,
+				MaxShares:      2,
+			},
+		},
+		{
+			name:        "invalid fsckPolicy value in parameters",
+			inputParams: map[string]string{consts.FsckPolicyField: "sometimes"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FsckPolicyField: "sometimes"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("fsckPolicy sometimes is not supported, supported policies are auto, always, never and repaironerror"),
+		},
+		{
+			name:        "invalid formatPolicy value in parameters",
+			inputParams: map[string]string{consts.FormatPolicyField: "sometimes"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FormatPolicyField: "sometimes"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("formatPolicy sometimes is not supported, supported policies are ifEmpty, always and never"),
+		},
+		{
+			name:        "invalid fstrim value in parameters",
+			inputParams: map[string]string{consts.FstrimField: "weekly"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FstrimField: "weekly"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("fstrim weekly is not supported, supported values are true and false"),
+		},
+		{
+			name:        "invalid diskControllerType value in parameters",
+			inputParams: map[string]string{consts.DiskControllerTypeField: "IDE"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.DiskControllerTypeField: "IDE"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("diskControllerType IDE is not supported, supported values are SCSI and NVMe"),
+		},
+		{
+			name:        "luks encryption in parameters",
+			inputParams: map[string]string{consts.EncryptionField: "LUKS"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.EncryptionField: "LUKS"},
+				DeviceSettings: make(map[string]string),
+				Encryption:     consts.EncryptionLuks,
+			},
+		},
+		{
+			name:        "invalid encryption value in parameters",
+			inputParams: map[string]string{consts.EncryptionField: "aes"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.EncryptionField: "aes"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("encryption aes is not supported, supported values are none and luks"),
+		},
+		{
+			name:        "mkfs options and filesystem features",
+			inputParams: map[string]string{"mkfsOptions": "-b 4096", "fsFeatures": "^has_journal"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{"mkfsOptions": "-b 4096", "fsFeatures": "^has_journal"},
+				DeviceSettings: make(map[string]string),
+				MkfsOptions:    "-b 4096",
+				FsFeatures:     "^has_journal",
+			},
+		},
 		{
 			name:        "disk parameters with PremiumV2_LRS",
 			inputParams: map[string]string{consts.SkuNameField: "PremiumV2_LRS"},
@@ -1944,3 +2240,22 @@ func TestIsThrottlingError(t *testing.T) {
 		}
 	}
 }
+
+func TestIsReadOnlyAccessMode(t *testing.T) {
+	tests := []struct {
+		mode              csi.VolumeCapability_AccessMode_Mode
+		expectedReadOnly  bool
+		expectedMultiNode bool
+	}{
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, expectedReadOnly: true},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, expectedReadOnly: true, expectedMultiNode: true},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	for _, test := range tests {
+		volCap := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode}}
+		assert.Equal(t, test.expectedReadOnly, IsReadOnlyAccessMode(volCap), test.mode.String())
+		assert.Equal(t, test.expectedMultiNode, IsMultiNodeReadOnly(volCap), test.mode.String())
+	}
+	assert.False(t, IsReadOnlyAccessMode(nil))
+}
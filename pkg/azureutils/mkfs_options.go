@@ -0,0 +1,180 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azureutils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+// mkfsOption describes an mkfs option allowed in the mkfsOptions parameter
+type mkfsOption struct {
+	// value is the pattern of the option value, nil if the option takes no value or takes sub options
+	value *regexp.Regexp
+	// subOptions are the keys allowed in the comma separated key[=value] list taken by the option
+	subOptions sets.Set[string]
+}
+
+var (
+	numberValue      = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	wordValue        = regexp.MustCompile(`^[a-z0-9_]+$`)
+	subOptionValue   = regexp.MustCompile(`^[A-Za-z0-9.:_-]+$`)
+	extFeatureValue  = regexp.MustCompile(`^\^?[a-z0-9_]+$`)
+	extMkfsAllowlist = map[string]mkfsOption{
+		// block size
+		"-b": {value: numberValue},
+		// bytes per inode
+		"-i": {value: numberValue},
+		// inode size
+		"-I": {value: numberValue},
+		// reserved blocks percentage
+		"-m": {value: numberValue},
+		// number of inodes
+		"-N": {value: numberValue},
+		// usage type of mke2fs.conf
+		"-T": {value: wordValue},
+		"-E": {subOptions: sets.New("lazy_itable_init", "lazy_journal_init", "stride", "stripe_width", "stripe-width",
+			"discard", "nodiscard", "packed_meta_blocks", "root_owner", "num_backup_sb", "resize")},
+		"-J": {subOptions: sets.New("size")},
+	}
+	xfsMkfsAllowlist = map[string]mkfsOption{
+		"-b": {subOptions: sets.New("size")},
+		"-m": {subOptions: sets.New("crc", "finobt", "reflink", "rmapbt", "bigtime", "inobtcount")},
+		"-i": {subOptions: sets.New("size", "maxpct", "align", "sparse", "nrext64")},
+		"-d": {subOptions: sets.New("agcount", "agsize", "su", "sw", "sunit", "swidth")},
+		"-l": {subOptions: sets.New("size", "su", "sunit", "lazy-count", "version")},
+		"-n": {subOptions: sets.New("size", "ftype")},
+		"-s": {subOptions: sets.New("size")},
+		// do not discard blocks
+		"-K": {},
+	}
+	mkfsAllowlists = map[string]map[string]mkfsOption{
+		"ext2": extMkfsAllowlist,
+		"ext3": extMkfsAllowlist,
+		"ext4": extMkfsAllowlist,
+		"xfs":  xfsMkfsAllowlist,
+	}
+)
+
+// GetMkfsArgs returns the mkfs arguments given by the mkfsOptions and fsFeatures parameters in attributes,
+// validated against the options allowed for fstype. fsFeatures is a comma separated list of ext features
+// given to -O, e.g. ^has_journal, or of xfs metadata features given to -m, e.g. reflink=1.
+func GetMkfsArgs(fstype string, attributes map[string]string) ([]string, error) {
+	var mkfsOptions, fsFeatures string
+	for k, v := range attributes {
+		switch strings.ToLower(k) {
+		case consts.MkfsOptionsField:
+			mkfsOptions = strings.TrimSpace(v)
+		case consts.FsFeaturesField:
+			fsFeatures = strings.TrimSpace(v)
+		}
+	}
+	if mkfsOptions == "" && fsFeatures == "" {
+		return nil, nil
+	}
+	fstype = strings.ToLower(fstype)
+	allowlist, ok := mkfsAllowlists[fstype]
+	if !ok {
+		return nil, fmt.Errorf("mkfsOptions and fsFeatures are not supported for fsType %q", fstype)
+	}
+
+	var args []string
+	fields := strings.Fields(mkfsOptions)
+	for i := 0; i < len(fields); i++ {
+		option, ok := allowlist[fields[i]]
+		if !ok {
+			return nil, fmt.Errorf("mkfsOptions: option %q is not allowed for %s", fields[i], fstype)
+		}
+		if option.value == nil && option.subOptions == nil {
+			args = append(args, fields[i])
+			continue
+		}
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("mkfsOptions: option %s requires a value", fields[i])
+		}
+		if err := validateMkfsOptionValue(option, fields[i+1]); err != nil {
+			return nil, fmt.Errorf("mkfsOptions: invalid value of option %s: %v", fields[i], err)
+		}
+		args = append(args, fields[i], fields[i+1])
+		i++
+	}
+
+	if fsFeatures != "" {
+		switch fstype {
+		case "xfs":
+			if err := validateMkfsOptionValue(xfsMkfsAllowlist["-m"], fsFeatures); err != nil {
+				return nil, fmt.Errorf("fsFeatures: %v", err)
+			}
+			args = append(args, "-m", fsFeatures)
+		default:
+			for _, feature := range strings.Split(fsFeatures, ",") {
+				if !extFeatureValue.MatchString(feature) {
+					return nil, fmt.Errorf("fsFeatures: invalid feature %q", feature)
+				}
+			}
+			args = append(args, "-O", fsFeatures)
+		}
+	}
+	return args, nil
+}
+
+func validateMkfsOptionValue(option mkfsOption, value string) error {
+	if option.value != nil {
+		if !option.value.MatchString(value) {
+			return fmt.Errorf("%q does not match %s", value, option.value)
+		}
+		return nil
+	}
+	for _, subOption := range strings.Split(value, ",") {
+		key, val, hasValue := strings.Cut(subOption, "=")
+		if !option.subOptions.Has(key) {
+			return fmt.Errorf("sub option %q is not allowed", key)
+		}
+		if hasValue && !subOptionValue.MatchString(val) {
+			return fmt.Errorf("invalid value %q of sub option %s", val, key)
+		}
+	}
+	return nil
+}
+
+// ValidateMkfsParameters validates the mkfsOptions and fsFeatures parameters against the filesystem
+// of every mount volume capability, fsType parameter takes precedence over the capability
+func ValidateMkfsParameters(fsType string, volCaps []*csi.VolumeCapability, attributes map[string]string) error {
+	for _, volCap := range volCaps {
+		mnt := volCap.GetMount()
+		if mnt == nil {
+			continue
+		}
+		fstype := fsType
+		if fstype == "" {
+			fstype = mnt.GetFsType()
+		}
+		if fstype == "" {
+			fstype = "ext4"
+		}
+		if _, err := GetMkfsArgs(fstype, attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
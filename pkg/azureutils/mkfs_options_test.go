@@ -0,0 +1,135 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azureutils
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMkfsArgs(t *testing.T) {
+	tests := []struct {
+		desc        string
+		fstype      string
+		attributes  map[string]string
+		expected    []string
+		expectedErr bool
+	}{
+		{
+			desc:   "no mkfs options",
+			fstype: "ext4",
+		},
+		{
+			desc:       "ext4 options",
+			fstype:     "ext4",
+			attributes: map[string]string{"mkfsOptions": " -b 4096 -m 1 -T largefile -E lazy_itable_init=0,stride=16 "},
+			expected:   []string{"-b", "4096", "-m", "1", "-T", "largefile", "-E", "lazy_itable_init=0,stride=16"},
+		},
+		{
+			desc:       "ext4 features",
+			fstype:     "EXT4",
+			attributes: map[string]string{"mkfsoptions": "-I 256", "fsFeatures": "^has_journal,metadata_csum"},
+			expected:   []string{"-I", "256", "-O", "^has_journal,metadata_csum"},
+		},
+		{
+			desc:       "xfs options and features",
+			fstype:     "xfs",
+			attributes: map[string]string{"mkfsOptions": "-K -d su=64k,sw=4 -i size=512", "fsFeatures": "reflink=1,bigtime=1"},
+			expected:   []string{"-K", "-d", "su=64k,sw=4", "-i", "size=512", "-m", "reflink=1,bigtime=1"},
+		},
+		{
+			desc:        "option not allowed",
+			fstype:      "ext4",
+			attributes:  map[string]string{"mkfsOptions": "-F"},
+			expectedErr: true,
+		},
+		{
+			desc:        "ext4 option not allowed for xfs",
+			fstype:      "xfs",
+			attributes:  map[string]string{"mkfsOptions": "-T largefile"},
+			expectedErr: true,
+		},
+		{
+			desc:        "missing value",
+			fstype:      "ext4",
+			attributes:  map[string]string{"mkfsOptions": "-b"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid value",
+			fstype:      "ext4",
+			attributes:  map[string]string{"mkfsOptions": "-b 4096;reboot"},
+			expectedErr: true,
+		},
+		{
+			desc:        "sub option not allowed",
+			fstype:      "ext4",
+			attributes:  map[string]string{"mkfsOptions": "-E test_fs"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid sub option value",
+			fstype:      "xfs",
+			attributes:  map[string]string{"mkfsOptions": "-d su=$(id)"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid ext4 feature",
+			fstype:      "ext4",
+			attributes:  map[string]string{"fsFeatures": "has journal"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid xfs feature",
+			fstype:      "xfs",
+			attributes:  map[string]string{"fsFeatures": "sparse=1"},
+			expectedErr: true,
+		},
+		{
+			desc:        "unsupported filesystem",
+			fstype:      "btrfs",
+			attributes:  map[string]string{"mkfsOptions": "-b 4096"},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		args, err := GetMkfsArgs(test.fstype, test.attributes)
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expected, args, test.desc)
+	}
+}
+
+func TestValidateMkfsParameters(t *testing.T) {
+	mountCap := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}}}
+	}
+	blockCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	extOptions := map[string]string{"mkfsOptions": "-T largefile"}
+
+	assert.NoError(t, ValidateMkfsParameters("", []*csi.VolumeCapability{mountCap("")}, extOptions), "ext4 by default")
+	assert.NoError(t, ValidateMkfsParameters("", []*csi.VolumeCapability{blockCap}, extOptions), "not formatted")
+	assert.Error(t, ValidateMkfsParameters("", []*csi.VolumeCapability{mountCap("xfs")}, extOptions))
+	assert.Error(t, ValidateMkfsParameters("xfs", []*csi.VolumeCapability{mountCap("ext4")}, extOptions), "fsType parameter takes precedence")
+	assert.NoError(t, ValidateMkfsParameters("ext4", []*csi.VolumeCapability{mountCap("xfs")}, extOptions))
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package growpart grows the last partition of a GPT or MBR partitioned disk to the end of the disk,
+// the equivalent of growpart of cloud-utils.
+package growpart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	// DefaultSectorSize is the logical sector size of disk image files
+	DefaultSectorSize = 512
+
+	mbrSignatureOffset     = 510
+	mbrPartitionOffset     = 446
+	mbrPartitionEntrySize  = 16
+	mbrPartitionEntries    = 4
+	mbrTypeGPTProtective   = 0xee
+	mbrMaxSectors          = 1<<32 - 1
+	gptHeaderLBA           = 1
+	gptMinHeaderSize       = 92
+	gptEntryStartLBAOffset = 32
+	gptEntryEndLBAOffset   = 40
+)
+
+var (
+	mbrSignature = []byte{0x55, 0xaa}
+	gptSignature = []byte("EFI PART")
+	// types of the extended partitions holding logical partitions
+	mbrExtendedTypes = map[byte]bool{0x05: true, 0x0f: true, 0x85: true}
+)
+
+// Disk is a disk image file or a block device
+type Disk interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Partition is a partition of a disk in bytes
+type Partition struct {
+	// Number is the number of the partition, starting from 1
+	Number int
+	Start  int64
+	Size   int64
+}
+
+// GrowFile grows partition number of the disk image file or block device at path to the end of the disk,
+// it returns the partition and whether it was grown
+func GrowFile(path string, sectorSize int64, number int) (*Partition, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	diskSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get size of %s: %v", path, err)
+	}
+	p, grown, err := Grow(f, diskSize, sectorSize, number)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to grow partition %d of %s: %v", number, path, err)
+	}
+	if grown {
+		if err := f.Sync(); err != nil {
+			return nil, false, fmt.Errorf("failed to sync %s: %v", path, err)
+		}
+	}
+	return p, grown, nil
+}
+
+// Grow grows partition number of disk, whose size is diskSize bytes, to the end of the disk.
+// The partition must be the last partition of the disk, and a primary partition on MBR partitioned disks.
+// On GPT partitioned disks, the backup partition table is moved to the end of the disk.
+// It returns the partition and whether it was grown.
+func Grow(disk Disk, diskSize, sectorSize int64, number int) (*Partition, bool, error) {
+	if sectorSize < DefaultSectorSize || sectorSize%DefaultSectorSize != 0 {
+		return nil, false, fmt.Errorf("invalid sector size %d", sectorSize)
+	}
+	if number < 1 {
+		return nil, false, fmt.Errorf("invalid partition number %d", number)
+	}
+	mbr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(mbr, 0); err != nil {
+		return nil, false, fmt.Errorf("failed to read MBR: %v", err)
+	}
+	if !bytes.Equal(mbr[mbrSignatureOffset:mbrSignatureOffset+2], mbrSignature) {
+		return nil, false, fmt.Errorf("no partition table found")
+	}
+	for i := 0; i < mbrPartitionEntries; i++ {
+		if mbrPartitionType(mbr, i) == mbrTypeGPTProtective {
+			return growGPT(disk, mbr, diskSize, sectorSize, number)
+		}
+	}
+	return growMBR(disk, mbr, diskSize, sectorSize, number)
+}
+
+func mbrPartitionEntry(mbr []byte, i int) []byte {
+	offset := mbrPartitionOffset + i*mbrPartitionEntrySize
+	return mbr[offset : offset+mbrPartitionEntrySize]
+}
+
+func mbrPartitionType(mbr []byte, i int) byte {
+	return mbrPartitionEntry(mbr, i)[4]
+}
+
+// growMBR grows the primary partition number of the MBR partition table mbr
+func growMBR(disk Disk, mbr []byte, diskSize, sectorSize int64, number int) (*Partition, bool, error) {
+	if number > mbrPartitionEntries {
+		return nil, false, fmt.Errorf("partition %d is a logical partition, which is not supported", number)
+	}
+	entry := mbrPartitionEntry(mbr, number-1)
+	if entry[4] == 0 {
+		return nil, false, fmt.Errorf("partition %d not found", number)
+	}
+	if mbrExtendedTypes[entry[4]] {
+		return nil, false, fmt.Errorf("partition %d is an extended partition, which is not supported", number)
+	}
+	start := int64(binary.LittleEndian.Uint32(entry[8:12]))
+	sectors := int64(binary.LittleEndian.Uint32(entry[12:16]))
+	for i := 0; i < mbrPartitionEntries; i++ {
+		other := mbrPartitionEntry(mbr, i)
+		if i != number-1 && other[4] != 0 && int64(binary.LittleEndian.Uint32(other[8:12])) > start {
+			return nil, false, fmt.Errorf("partition %d is not the last partition", number)
+		}
+	}
+
+	// the end of a partition can't be beyond 2^32 sectors in MBR
+	maxSectors := diskSize / sectorSize
+	if maxSectors > mbrMaxSectors {
+		maxSectors = mbrMaxSectors
+	}
+	newSectors := maxSectors - start
+	p := &Partition{Number: number, Start: start * sectorSize, Size: sectors * sectorSize}
+	if newSectors <= sectors {
+		return p, false, nil
+	}
+
+	// CHS addresses beyond 1024 cylinders are all set to the maximum
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(newSectors))
+	if _, err := disk.WriteAt(mbr, 0); err != nil {
+		return nil, false, fmt.Errorf("failed to write MBR: %v", err)
+	}
+	p.Size = newSectors * sectorSize
+	return p, true, nil
+}
+
+// gptHeader is the GPT header fields used to grow a partition
+type gptHeader struct {
+	raw             []byte
+	headerSize      uint32
+	backupLBA       uint64
+	lastUsableLBA   uint64
+	entriesLBA      uint64
+	numEntries      uint32
+	entrySize       uint32
+	entriesChecksum uint32
+}
+
+func readGPTHeader(disk Disk, sectorSize int64) (*gptHeader, error) {
+	raw := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(raw, gptHeaderLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %v", err)
+	}
+	if !bytes.Equal(raw[:8], gptSignature) {
+		return nil, fmt.Errorf("invalid GPT header signature")
+	}
+	h := &gptHeader{
+		raw:             raw,
+		headerSize:      binary.LittleEndian.Uint32(raw[12:16]),
+		backupLBA:       binary.LittleEndian.Uint64(raw[32:40]),
+		lastUsableLBA:   binary.LittleEndian.Uint64(raw[48:56]),
+		entriesLBA:      binary.LittleEndian.Uint64(raw[72:80]),
+		numEntries:      binary.LittleEndian.Uint32(raw[80:84]),
+		entrySize:       binary.LittleEndian.Uint32(raw[84:88]),
+		entriesChecksum: binary.LittleEndian.Uint32(raw[88:92]),
+	}
+	if h.headerSize < gptMinHeaderSize || int64(h.headerSize) > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", h.headerSize)
+	}
+	if checksum := binary.LittleEndian.Uint32(raw[16:20]); checksum != h.checksum() {
+		return nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+	if h.entrySize < 128 || h.numEntries == 0 {
+		return nil, fmt.Errorf("invalid GPT partition entries: %d entries of %d bytes", h.numEntries, h.entrySize)
+	}
+	return h, nil
+}
+
+// checksum returns the CRC32 of the header with a zero checksum field
+func (h *gptHeader) checksum() uint32 {
+	header := make([]byte, h.headerSize)
+	copy(header, h.raw)
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	return crc32.ChecksumIEEE(header)
+}
+
+// encode returns the header at currentLBA pointing to alternateLBA and the partition entries at entriesLBA
+func (h *gptHeader) encode(currentLBA, alternateLBA, entriesLBA uint64) []byte {
+	header := &gptHeader{raw: make([]byte, len(h.raw)), headerSize: h.headerSize}
+	copy(header.raw, h.raw)
+	binary.LittleEndian.PutUint64(header.raw[24:32], currentLBA)
+	binary.LittleEndian.PutUint64(header.raw[32:40], alternateLBA)
+	binary.LittleEndian.PutUint64(header.raw[48:56], h.lastUsableLBA)
+	binary.LittleEndian.PutUint64(header.raw[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(header.raw[88:92], h.entriesChecksum)
+	binary.LittleEndian.PutUint32(header.raw[16:20], header.checksum())
+	return header.raw
+}
+
+// growGPT grows partition number of the GPT partition table and moves the backup GPT to the end of the disk
+func growGPT(disk Disk, mbr []byte, diskSize, sectorSize int64, number int) (*Partition, bool, error) {
+	h, err := readGPTHeader(disk, sectorSize)
+	if err != nil {
+		return nil, false, err
+	}
+	if uint32(number) > h.numEntries {
+		return nil, false, fmt.Errorf("partition %d not found", number)
+	}
+	entries := make([]byte, int64(h.numEntries)*int64(h.entrySize))
+	if _, err := disk.ReadAt(entries, int64(h.entriesLBA)*sectorSize); err != nil {
+		return nil, false, fmt.Errorf("failed to read GPT partition entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != h.entriesChecksum {
+		return nil, false, fmt.Errorf("GPT partition entries checksum mismatch")
+	}
+
+	entry := func(i int) []byte {
+		return entries[i*int(h.entrySize) : (i+1)*int(h.entrySize)]
+	}
+	target := entry(number - 1)
+	if isZero(target[:16]) {
+		return nil, false, fmt.Errorf("partition %d not found", number)
+	}
+	start := binary.LittleEndian.Uint64(target[gptEntryStartLBAOffset:])
+	end := binary.LittleEndian.Uint64(target[gptEntryEndLBAOffset:])
+	for i := 0; i < int(h.numEntries); i++ {
+		other := entry(i)
+		if i != number-1 && !isZero(other[:16]) && binary.LittleEndian.Uint64(other[gptEntryStartLBAOffset:]) > start {
+			return nil, false, fmt.Errorf("partition %d is not the last partition", number)
+		}
+	}
+
+	// the backup GPT is the partition entries followed by the header in the last sector of the disk
+	lastLBA := uint64(diskSize/sectorSize) - 1
+	entriesSectors := (uint64(len(entries)) + uint64(sectorSize) - 1) / uint64(sectorSize)
+	backupEntriesLBA := lastLBA - entriesSectors
+	lastUsableLBA := backupEntriesLBA - 1
+	if lastUsableLBA < end || lastUsableLBA < h.lastUsableLBA {
+		return nil, false, fmt.Errorf("disk of %d bytes is smaller than its GPT partition table", diskSize)
+	}
+	p := &Partition{Number: number, Start: int64(start) * sectorSize, Size: int64(end-start+1) * sectorSize}
+	if end == lastUsableLBA && h.backupLBA == lastLBA {
+		return p, false, nil
+	}
+
+	binary.LittleEndian.PutUint64(target[gptEntryEndLBAOffset:], lastUsableLBA)
+	h.lastUsableLBA = lastUsableLBA
+	h.entriesChecksum = crc32.ChecksumIEEE(entries)
+
+	// write the backup GPT first so that the primary one stays valid until the backup one is complete
+	if _, err := disk.WriteAt(entries, int64(backupEntriesLBA)*sectorSize); err != nil {
+		return nil, false, fmt.Errorf("failed to write backup GPT partition entries: %v", err)
+	}
+	if _, err := disk.WriteAt(h.encode(lastLBA, gptHeaderLBA, backupEntriesLBA), int64(lastLBA)*sectorSize); err != nil {
+		return nil, false, fmt.Errorf("failed to write backup GPT header: %v", err)
+	}
+	if _, err := disk.WriteAt(entries, int64(h.entriesLBA)*sectorSize); err != nil {
+		return nil, false, fmt.Errorf("failed to write GPT partition entries: %v", err)
+	}
+	if _, err := disk.WriteAt(h.encode(gptHeaderLBA, lastLBA, h.entriesLBA), gptHeaderLBA*sectorSize); err != nil {
+		return nil, false, fmt.Errorf("failed to write GPT header: %v", err)
+	}
+
+	// the protective MBR partition covers the whole disk, or 2^32 sectors at most
+	for i := 0; i < mbrPartitionEntries; i++ {
+		if mbrPartitionType(mbr, i) != mbrTypeGPTProtective {
+			continue
+		}
+		protective := mbrPartitionEntry(mbr, i)
+		sectors := lastLBA
+		if sectors > mbrMaxSectors {
+			sectors = mbrMaxSectors
+		}
+		binary.LittleEndian.PutUint32(protective[12:16], uint32(sectors))
+		if _, err := disk.WriteAt(mbr, 0); err != nil {
+			return nil, false, fmt.Errorf("failed to write protective MBR: %v", err)
+		}
+		break
+	}
+
+	p.Size = int64(lastUsableLBA-start+1) * sectorSize
+	return p, p.Size > int64(end-start+1)*sectorSize, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
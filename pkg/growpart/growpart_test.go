@@ -0,0 +1,277 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package growpart
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mib           = 1 << 20
+	testEntries   = 128
+	testEntrySize = 128
+)
+
+type testPartition struct {
+	typ        byte
+	start, end uint64
+}
+
+// newImage creates a sparse disk image file of size bytes
+func newImage(t *testing.T, size int64) string {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(size))
+	assert.NoError(t, f.Close())
+	return path
+}
+
+func writeAt(t *testing.T, path string, data []byte, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteAt(data, offset)
+	assert.NoError(t, err)
+}
+
+func readAt(t *testing.T, path string, size int, offset int64) []byte {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	data := make([]byte, size)
+	_, err = f.ReadAt(data, offset)
+	assert.NoError(t, err)
+	return data
+}
+
+func resize(t *testing.T, path string, size int64) {
+	assert.NoError(t, os.Truncate(path, size))
+}
+
+// newMBRImage creates a disk image of size bytes with the primary partitions, start and end are in sectors
+func newMBRImage(t *testing.T, size int64, partitions ...testPartition) string {
+	path := newImage(t, size)
+	mbr := make([]byte, DefaultSectorSize)
+	for i, p := range partitions {
+		entry := mbrPartitionEntry(mbr, i)
+		entry[4] = p.typ
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(p.start))
+		binary.LittleEndian.PutUint32(entry[12:16], uint32(p.end-p.start+1))
+	}
+	copy(mbr[mbrSignatureOffset:], mbrSignature)
+	writeAt(t, path, mbr, 0)
+	return path
+}
+
+// newGPTImage creates a disk image of size bytes with a protective MBR and a GPT of the partitions,
+// start and end are in sectors
+func newGPTImage(t *testing.T, size int64, partitions ...testPartition) string {
+	path := newMBRImage(t, size, testPartition{typ: mbrTypeGPTProtective, start: 1, end: uint64(size/DefaultSectorSize) - 1})
+
+	entries := make([]byte, testEntries*testEntrySize)
+	for i, p := range partitions {
+		entry := entries[i*testEntrySize:]
+		// partition type and unique GUIDs
+		for j := 0; j < 32; j++ {
+			entry[j] = byte(i + j + 1)
+		}
+		binary.LittleEndian.PutUint64(entry[gptEntryStartLBAOffset:], p.start)
+		binary.LittleEndian.PutUint64(entry[gptEntryEndLBAOffset:], p.end)
+	}
+	lastLBA := uint64(size/DefaultSectorSize) - 1
+	backupEntriesLBA := lastLBA - uint64(len(entries)/DefaultSectorSize)
+
+	raw := make([]byte, DefaultSectorSize)
+	copy(raw, gptSignature)
+	binary.LittleEndian.PutUint32(raw[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(raw[12:16], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(raw[40:48], 34)
+	binary.LittleEndian.PutUint32(raw[80:84], testEntries)
+	binary.LittleEndian.PutUint32(raw[84:88], testEntrySize)
+	h := &gptHeader{raw: raw, headerSize: gptMinHeaderSize, lastUsableLBA: backupEntriesLBA - 1, entriesChecksum: crc32.ChecksumIEEE(entries)}
+
+	writeAt(t, path, entries, 2*DefaultSectorSize)
+	writeAt(t, path, h.encode(gptHeaderLBA, lastLBA, 2), gptHeaderLBA*DefaultSectorSize)
+	writeAt(t, path, entries, int64(backupEntriesLBA)*DefaultSectorSize)
+	writeAt(t, path, h.encode(lastLBA, gptHeaderLBA, backupEntriesLBA), int64(lastLBA)*DefaultSectorSize)
+	return path
+}
+
+// assertGPT checks both GPT headers and partition entries of the image, and returns the entries
+func assertGPT(t *testing.T, path string, size int64) []byte {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	lastLBA := uint64(size/DefaultSectorSize) - 1
+	primary, err := readGPTHeader(f, DefaultSectorSize)
+	assert.NoError(t, err)
+	assert.Equal(t, lastLBA, primary.backupLBA)
+	assert.Equal(t, lastLBA-33, primary.lastUsableLBA)
+	entries := readAt(t, path, testEntries*testEntrySize, int64(primary.entriesLBA)*DefaultSectorSize)
+	assert.Equal(t, primary.entriesChecksum, crc32.ChecksumIEEE(entries))
+
+	backup := readAt(t, path, DefaultSectorSize, int64(lastLBA)*DefaultSectorSize)
+	assert.Equal(t, gptSignature, backup[:8])
+	assert.Equal(t, lastLBA, binary.LittleEndian.Uint64(backup[24:32]))
+	assert.Equal(t, uint64(gptHeaderLBA), binary.LittleEndian.Uint64(backup[32:40]))
+	assert.Equal(t, primary.lastUsableLBA, binary.LittleEndian.Uint64(backup[48:56]))
+	backupHeader := &gptHeader{raw: backup, headerSize: gptMinHeaderSize}
+	assert.Equal(t, backupHeader.checksum(), binary.LittleEndian.Uint32(backup[16:20]))
+	backupEntriesLBA := binary.LittleEndian.Uint64(backup[72:80])
+	assert.Equal(t, lastLBA-32, backupEntriesLBA)
+	assert.Equal(t, entries, readAt(t, path, testEntries*testEntrySize, int64(backupEntriesLBA)*DefaultSectorSize))
+
+	mbr := readAt(t, path, DefaultSectorSize, 0)
+	assert.Equal(t, uint32(lastLBA), binary.LittleEndian.Uint32(mbrPartitionEntry(mbr, 0)[12:16]))
+	return entries
+}
+
+func TestGrowGPT(t *testing.T) {
+	size := int64(64 * mib)
+	path := newGPTImage(t, size,
+		testPartition{start: 2048, end: 4095},
+		testPartition{start: 4096, end: 40959})
+
+	// the partition is grown to the end of the disk
+	p, grown, err := GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.True(t, grown)
+	lastUsableLBA := uint64(size/DefaultSectorSize) - 34
+	assert.Equal(t, &Partition{Number: 2, Start: 4096 * DefaultSectorSize, Size: int64(lastUsableLBA-4095) * DefaultSectorSize}, p)
+	entries := assertGPT(t, path, size)
+	assert.Equal(t, lastUsableLBA, binary.LittleEndian.Uint64(entries[testEntrySize+gptEntryEndLBAOffset:]))
+
+	// the backup GPT is moved to the end of the resized disk
+	resize(t, path, 2*size)
+	lastUsableLBA = uint64(2*size/DefaultSectorSize) - 34
+	p, grown, err = GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.True(t, grown)
+	assert.Equal(t, &Partition{Number: 2, Start: 4096 * DefaultSectorSize, Size: int64(lastUsableLBA-4095) * DefaultSectorSize}, p)
+	entries = assertGPT(t, path, 2*size)
+	assert.Equal(t, uint64(4095), binary.LittleEndian.Uint64(entries[gptEntryEndLBAOffset:]))
+	assert.Equal(t, lastUsableLBA, binary.LittleEndian.Uint64(entries[testEntrySize+gptEntryEndLBAOffset:]))
+
+	// growing again is a no-op
+	p2, grown, err := GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.False(t, grown)
+	assert.Equal(t, p, p2)
+}
+
+func TestGrowGPTErrors(t *testing.T) {
+	size := int64(64 * mib)
+	path := newGPTImage(t, size,
+		testPartition{start: 2048, end: 4095},
+		testPartition{start: 4096, end: 40959})
+	resize(t, path, 2*size)
+
+	_, _, err := GrowFile(path, DefaultSectorSize, 1)
+	assert.ErrorContains(t, err, "partition 1 is not the last partition")
+	_, _, err = GrowFile(path, DefaultSectorSize, 3)
+	assert.ErrorContains(t, err, "partition 3 not found")
+	_, _, err = GrowFile(path, DefaultSectorSize, 129)
+	assert.ErrorContains(t, err, "partition 129 not found")
+
+	// corrupted primary GPT header
+	writeAt(t, path, []byte{0xff}, gptHeaderLBA*DefaultSectorSize+60)
+	_, _, err = GrowFile(path, DefaultSectorSize, 2)
+	assert.ErrorContains(t, err, "GPT header checksum mismatch")
+
+	// corrupted partition entries
+	path = newGPTImage(t, size, testPartition{start: 2048, end: 40959})
+	writeAt(t, path, []byte{0xff}, 2*DefaultSectorSize+testEntrySize+1)
+	_, _, err = GrowFile(path, DefaultSectorSize, 1)
+	assert.ErrorContains(t, err, "GPT partition entries checksum mismatch")
+
+	// the disk is shrunk
+	path = newGPTImage(t, size, testPartition{start: 2048, end: 131037})
+	resize(t, path, size/2)
+	_, _, err = GrowFile(path, DefaultSectorSize, 1)
+	assert.ErrorContains(t, err, "smaller than its GPT partition table")
+}
+
+func TestGrowMBR(t *testing.T) {
+	size := int64(64 * mib)
+	path := newMBRImage(t, size,
+		testPartition{typ: 0x83, start: 2048, end: 4095},
+		testPartition{typ: 0x83, start: 4096, end: 40959})
+
+	p, grown, err := GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.True(t, grown)
+	assert.Equal(t, &Partition{Number: 2, Start: 4096 * DefaultSectorSize, Size: size - 4096*DefaultSectorSize}, p)
+
+	resize(t, path, 2*size)
+	p, grown, err = GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.True(t, grown)
+	assert.Equal(t, &Partition{Number: 2, Start: 4096 * DefaultSectorSize, Size: 2*size - 4096*DefaultSectorSize}, p)
+
+	mbr := readAt(t, path, DefaultSectorSize, 0)
+	assert.Equal(t, uint32(2*size/DefaultSectorSize-4096), binary.LittleEndian.Uint32(mbrPartitionEntry(mbr, 1)[12:16]))
+	assert.Equal(t, uint32(2048), binary.LittleEndian.Uint32(mbrPartitionEntry(mbr, 0)[12:16]))
+	assert.Equal(t, mbrSignature, mbr[mbrSignatureOffset:])
+
+	_, grown, err = GrowFile(path, DefaultSectorSize, 2)
+	assert.NoError(t, err)
+	assert.False(t, grown)
+}
+
+func TestGrowMBRLimit(t *testing.T) {
+	// a 3TiB sparse disk is beyond the 2^32 sectors MBR can address
+	path := newMBRImage(t, 3<<40, testPartition{typ: 0x83, start: 2048, end: 4095})
+	p, grown, err := GrowFile(path, DefaultSectorSize, 1)
+	assert.NoError(t, err)
+	assert.True(t, grown)
+	assert.Equal(t, int64(mbrMaxSectors-2048)*DefaultSectorSize, p.Size)
+}
+
+func TestGrowMBRErrors(t *testing.T) {
+	path := newMBRImage(t, 64*mib,
+		testPartition{typ: 0x83, start: 2048, end: 4095},
+		testPartition{typ: 0x05, start: 4096, end: 40959})
+
+	_, _, err := GrowFile(path, DefaultSectorSize, 1)
+	assert.ErrorContains(t, err, "partition 1 is not the last partition")
+	_, _, err = GrowFile(path, DefaultSectorSize, 2)
+	assert.ErrorContains(t, err, "partition 2 is an extended partition")
+	_, _, err = GrowFile(path, DefaultSectorSize, 3)
+	assert.ErrorContains(t, err, "partition 3 not found")
+	_, _, err = GrowFile(path, DefaultSectorSize, 5)
+	assert.ErrorContains(t, err, "partition 5 is a logical partition")
+}
+
+func TestGrowInvalidDisk(t *testing.T) {
+	path := newImage(t, mib)
+	_, _, err := GrowFile(path, DefaultSectorSize, 1)
+	assert.ErrorContains(t, err, "no partition table found")
+	_, _, err = GrowFile(path, 1000, 1)
+	assert.ErrorContains(t, err, "invalid sector size 1000")
+	_, _, err = GrowFile(path, DefaultSectorSize, 0)
+	assert.ErrorContains(t, err, "invalid partition number 0")
+	_, _, err = GrowFile(filepath.Join(t.TempDir(), "missing.img"), DefaultSectorSize, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package luks
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+const (
+	// PassphraseKey is the node stage secret key of the passphrase of the LUKS device
+	PassphraseKey = "passphrase"
+	// WrappedKeyKey is the node stage secret key of the base64 encoded passphrase wrapped by a Key Vault key
+	WrappedKeyKey = "wrappedKey"
+	// KeyEncryptionKeyURLKey is the node stage secret key of the URL of the Key Vault key wrapping the passphrase
+	KeyEncryptionKeyURLKey = "keyEncryptionKeyURL"
+	// KeyWrapAlgorithmKey is the node stage secret key of the algorithm the passphrase was wrapped with
+	KeyWrapAlgorithmKey = "keyWrapAlgorithm"
+
+	defaultKeyWrapAlgorithm = "RSA-OAEP-256"
+	keyVaultAPIVersion      = "7.4"
+)
+
+// KeyUnwrapper unwraps a key wrapped by a key encryption key held in a KMS
+type KeyUnwrapper interface {
+	UnwrapKey(ctx context.Context, keyURL, algorithm string, wrappedKey []byte) ([]byte, error)
+}
+
+// GetPassphrase returns the passphrase of the LUKS device from node stage secrets, either given in clear or
+// wrapped by a Key Vault key which is unwrapped with unwrapper, so the key never leaves the tenant
+func GetPassphrase(ctx context.Context, secrets map[string]string, unwrapper KeyUnwrapper) ([]byte, error) {
+	if passphrase := secrets[PassphraseKey]; passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	wrappedKey, keyURL := secrets[WrappedKeyKey], secrets[KeyEncryptionKeyURLKey]
+	if wrappedKey == "" || keyURL == "" {
+		return nil, fmt.Errorf("node stage secrets must contain %s, or %s and %s", PassphraseKey, WrappedKeyKey, KeyEncryptionKeyURLKey)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64 encoded: %v", WrappedKeyKey, err)
+	}
+	if unwrapper == nil {
+		return nil, fmt.Errorf("unwrapping %s is not configured on the node", WrappedKeyKey)
+	}
+	algorithm := secrets[KeyWrapAlgorithmKey]
+	if algorithm == "" {
+		algorithm = defaultKeyWrapAlgorithm
+	}
+	passphrase, err := unwrapper.UnwrapKey(ctx, keyURL, algorithm, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap %s with %s: %v", WrappedKeyKey, keyURL, err)
+	}
+	return passphrase, nil
+}
+
+// KeyVaultUnwrapper unwraps keys with the unwrapkey operation of Azure Key Vault or Managed HSM
+type KeyVaultUnwrapper struct {
+	cred    azcore.TokenCredential
+	options *policy.ClientOptions
+}
+
+// NewKeyVaultUnwrapper creates a KeyVaultUnwrapper authenticating with cred
+func NewKeyVaultUnwrapper(cred azcore.TokenCredential, options *policy.ClientOptions) *KeyVaultUnwrapper {
+	if options == nil {
+		options = &policy.ClientOptions{}
+	}
+	return &KeyVaultUnwrapper{cred: cred, options: options}
+}
+
+type keyOperationParameters struct {
+	Algorithm string `json:"alg"`
+	Value     string `json:"value"`
+}
+
+type keyOperationResult struct {
+	Value string `json:"value"`
+}
+
+// UnwrapKey unwraps wrappedKey with the key keyURL, e.g. https://myvault.vault.azure.net/keys/mykey/<version>
+func (u *KeyVaultUnwrapper) UnwrapKey(ctx context.Context, keyURL, algorithm string, wrappedKey []byte) ([]byte, error) {
+	scope, err := keyVaultScope(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	pl := runtime.NewPipeline("azuredisk-csi-driver", "", runtime.PipelineOptions{
+		PerRetry: []policy.Policy{runtime.NewBearerTokenPolicy(u.cred, []string{scope}, nil)},
+	}, u.options)
+
+	req, err := runtime.NewRequest(ctx, http.MethodPost, strings.TrimSuffix(keyURL, "/")+"/unwrapkey")
+	if err != nil {
+		return nil, err
+	}
+	query := req.Raw().URL.Query()
+	query.Set("api-version", keyVaultAPIVersion)
+	req.Raw().URL.RawQuery = query.Encode()
+	if err := runtime.MarshalAsJSON(req, keyOperationParameters{
+		Algorithm: algorithm,
+		Value:     base64.RawURLEncoding.EncodeToString(wrappedKey),
+	}); err != nil {
+		return nil, err
+	}
+
+	resp, err := pl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, runtime.NewResponseError(resp)
+	}
+	var result keyOperationResult
+	if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+}
+
+// keyVaultScope returns the token scope of the vault of keyURL, the audience of a vault is its DNS suffix,
+// e.g. https://vault.azure.net for myvault.vault.azure.net
+func keyVaultScope(keyURL string) (string, error) {
+	endpoint, err := url.Parse(keyURL)
+	if err != nil || endpoint.Scheme != "https" || !strings.HasPrefix(endpoint.Path, "/keys/") {
+		return "", fmt.Errorf("invalid key URL %s", keyURL)
+	}
+	_, suffix, ok := strings.Cut(endpoint.Hostname(), ".")
+	if !ok {
+		return "", fmt.Errorf("invalid key vault host %s", endpoint.Hostname())
+	}
+	return "https://" + suffix + "/.default", nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package luks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUnwrapper struct {
+	key []byte
+	err error
+}
+
+func (f *fakeUnwrapper) UnwrapKey(_ context.Context, _, _ string, _ []byte) ([]byte, error) {
+	return f.key, f.err
+}
+
+func TestGetPassphrase(t *testing.T) {
+	wrapped := base64.StdEncoding.EncodeToString([]byte("wrapped"))
+	keyURL := "https://myvault.vault.azure.net/keys/mykey/1"
+	tests := []struct {
+		desc        string
+		secrets     map[string]string
+		unwrapper   KeyUnwrapper
+		expected    string
+		expectedErr bool
+	}{
+		{
+			desc:     "passphrase",
+			secrets:  map[string]string{PassphraseKey: "secret"},
+			expected: "secret",
+		},
+		{
+			desc:      "wrapped key",
+			secrets:   map[string]string{WrappedKeyKey: wrapped, KeyEncryptionKeyURLKey: keyURL},
+			unwrapper: &fakeUnwrapper{key: []byte("unwrapped")},
+			expected:  "unwrapped",
+		},
+		{
+			desc:        "no secrets",
+			expectedErr: true,
+		},
+		{
+			desc:        "wrapped key without key URL",
+			secrets:     map[string]string{WrappedKeyKey: wrapped},
+			unwrapper:   &fakeUnwrapper{key: []byte("unwrapped")},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid wrapped key",
+			secrets:     map[string]string{WrappedKeyKey: "not base64!", KeyEncryptionKeyURLKey: keyURL},
+			unwrapper:   &fakeUnwrapper{key: []byte("unwrapped")},
+			expectedErr: true,
+		},
+		{
+			desc:        "unwrapping not configured",
+			secrets:     map[string]string{WrappedKeyKey: wrapped, KeyEncryptionKeyURLKey: keyURL},
+			expectedErr: true,
+		},
+		{
+			desc:        "unwrap failure",
+			secrets:     map[string]string{WrappedKeyKey: wrapped, KeyEncryptionKeyURLKey: keyURL},
+			unwrapper:   &fakeUnwrapper{err: fmt.Errorf("forbidden")},
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		passphrase, err := GetPassphrase(context.Background(), test.secrets, test.unwrapper)
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expected, string(passphrase), test.desc)
+	}
+}
+
+type fakeTokenCredential struct {
+	scopes []string
+}
+
+func (f *fakeTokenCredential) GetToken(_ context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	f.scopes = options.Scopes
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestKeyVaultUnwrapper(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params keyOperationParameters
+		if r.Method != http.MethodPost || r.URL.Path != "/keys/mykey/1/unwrapkey" || r.URL.Query().Get("api-version") != keyVaultAPIVersion ||
+			r.Header.Get("Authorization") != "Bearer token" || json.NewDecoder(r.Body).Decode(&params) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if params.Algorithm != "RSA-OAEP-256" || params.Value != base64.RawURLEncoding.EncodeToString([]byte("wrapped")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(keyOperationResult{Value: base64.RawURLEncoding.EncodeToString([]byte("unwrapped"))})
+	}))
+	defer server.Close()
+
+	cred := &fakeTokenCredential{}
+	u := NewKeyVaultUnwrapper(cred, &policy.ClientOptions{Transport: server.Client(), Retry: policy.RetryOptions{MaxRetries: -1}})
+	key, err := u.UnwrapKey(context.Background(), server.URL+"/keys/mykey/1", "RSA-OAEP-256", []byte("wrapped"))
+	assert.NoError(t, err)
+	assert.Equal(t, "unwrapped", string(key))
+	assert.Len(t, cred.scopes, 1)
+
+	_, err = u.UnwrapKey(context.Background(), server.URL+"/keys/mykey/1", "RSA1_5", []byte("wrapped"))
+	assert.Error(t, err)
+	_, err = u.UnwrapKey(context.Background(), "http://myvault.vault.azure.net/keys/mykey", "RSA-OAEP-256", []byte("wrapped"))
+	assert.Error(t, err, "https is required")
+}
+
+func TestKeyVaultScope(t *testing.T) {
+	scope, err := keyVaultScope("https://myvault.vault.azure.net/keys/mykey/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://vault.azure.net/.default", scope)
+	scope, err = keyVaultScope("https://myhsm.managedhsm.azure.net/keys/mykey")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://managedhsm.azure.net/.default", scope)
+	scope, err = keyVaultScope("https://myvault.vault.azure.cn:443/keys/mykey")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://vault.azure.cn/.default", scope)
+
+	_, err = keyVaultScope("https://myvault.vault.azure.net/secrets/mysecret")
+	assert.Error(t, err, "not a key")
+	_, err = keyVaultScope("https://localhost/keys/mykey")
+	assert.Error(t, err)
+}
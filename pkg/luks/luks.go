@@ -0,0 +1,146 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package luks manages LUKS encrypted devices through cryptsetup.
+package luks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	cryptsetupCmd = "cryptsetup"
+	// MapperDir is the directory of the device mapper devices
+	MapperDir = "/dev/mapper"
+	// mapperNamePrefix is the prefix of the mappings created by the driver
+	mapperNamePrefix = "azuredisk-luks-"
+	// cryptsetup exits with 4 if the device doesn't exist or isn't active
+	cryptsetupExitNoDevice = 4
+)
+
+var invalidMapperNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Cryptsetup runs cryptsetup commands through exec, the passphrase is always given on stdin
+type Cryptsetup struct {
+	exec utilexec.Interface
+}
+
+// New creates a Cryptsetup running commands through exec
+func New(exec utilexec.Interface) *Cryptsetup {
+	return &Cryptsetup{exec: exec}
+}
+
+// MapperName returns the device mapper name of the LUKS device of the disk diskURI, which is stable across
+// stages so that the mapping can be found without state on the node
+func MapperName(diskURI string) string {
+	name := strings.ToLower(diskURI)
+	sum := sha256.Sum256([]byte(name))
+	name = invalidMapperNameChars.ReplaceAllString(filepath.Base(name), "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return mapperNamePrefix + name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// MapperPath returns the path of the device mapper device name
+func MapperPath(name string) string {
+	return filepath.Join(MapperDir, name)
+}
+
+// IsLuks returns whether device has a LUKS header
+func (c *Cryptsetup) IsLuks(device string) (bool, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "isLuks", device).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("cryptsetup isLuks %s failed with %v, output: %s", device, err, string(output))
+	}
+	return true, nil
+}
+
+// Format writes a LUKS2 header to device with passphrase, all data on device is lost
+func (c *Cryptsetup) Format(device string, passphrase []byte) error {
+	klog.V(2).Infof("formatting %s as LUKS device", device)
+	return c.run(passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device)
+}
+
+// Open maps the LUKS device to MapperPath(name) with passphrase
+func (c *Cryptsetup) Open(device, name string, passphrase []byte, readOnly bool) error {
+	args := []string{"luksOpen", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	klog.V(2).Infof("opening LUKS device %s as %s", device, name)
+	return c.run(passphrase, append(args, device, name)...)
+}
+
+// Close removes the mapping name
+func (c *Cryptsetup) Close(name string) error {
+	klog.V(2).Infof("closing LUKS device %s", name)
+	return c.run(nil, "luksClose", name)
+}
+
+// Resize grows the mapping name to the size of its underlying device, passphrase may be nil if the volume key
+// isn't needed, e.g. it's not kept in the kernel keyring
+func (c *Cryptsetup) Resize(name string, passphrase []byte) error {
+	args := []string{"resize"}
+	if passphrase != nil {
+		args = append(args, "--key-file", "-")
+	}
+	klog.V(2).Infof("resizing LUKS device %s", name)
+	return c.run(passphrase, append(args, name)...)
+}
+
+// Status returns the underlying device of the mapping name, active is false if the mapping doesn't exist
+func (c *Cryptsetup) Status(name string) (device string, active bool, err error) {
+	output, err := c.exec.Command(cryptsetupCmd, "status", name).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == cryptsetupExitNoDevice {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("cryptsetup status %s failed with %v, output: %s", name, err, string(output))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && key == "device" {
+			device = strings.TrimSpace(value)
+		}
+	}
+	return device, true, nil
+}
+
+func (c *Cryptsetup) run(passphrase []byte, args ...string) error {
+	cmd := c.exec.Command(cryptsetupCmd, args...)
+	if passphrase != nil {
+		cmd.SetStdin(bytes.NewReader(passphrase))
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed with %v, output: %s", strings.Join(args, " "), err, string(output))
+	}
+	return nil
+}
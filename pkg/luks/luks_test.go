@@ -0,0 +1,138 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package luks
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+type fakeCommand struct {
+	output string
+	code   int
+	err    error
+}
+
+// newFakeExec returns a FakeExec running commands in order, the command lines and stdin are appended to calls
+func newFakeExec(calls *[]string, commands ...fakeCommand) *testingexec.FakeExec {
+	fakeExec := &testingexec.FakeExec{ExactOrder: true}
+	for _, command := range commands {
+		command := command
+		fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			fakeCmd := &testingexec.FakeCmd{}
+			action := func() ([]byte, []byte, error) {
+				call := strings.Join(append([]string{cmd}, args...), " ")
+				if fakeCmd.Stdin != nil {
+					stdin, _ := io.ReadAll(fakeCmd.Stdin)
+					call += " <" + string(stdin)
+				}
+				*calls = append(*calls, call)
+				switch {
+				case command.err != nil:
+					return nil, nil, command.err
+				case command.code != 0:
+					return []byte(command.output), nil, testingexec.FakeExitError{Status: command.code}
+				}
+				return []byte(command.output), nil, nil
+			}
+			fakeCmd.CombinedOutputScript = []testingexec.FakeAction{action}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return fakeExec
+}
+
+func TestMapperName(t *testing.T) {
+	diskURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/Disk_1"
+	name := MapperName(diskURI)
+	assert.True(t, strings.HasPrefix(name, "azuredisk-luks-disk_1-"), name)
+	assert.Equal(t, name, MapperName(strings.ToUpper(diskURI)), "case insensitive")
+	assert.NotEqual(t, name, MapperName("/subscriptions/sub/resourceGroups/rg2/providers/Microsoft.Compute/disks/disk_1"))
+	assert.LessOrEqual(t, len(MapperName("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/"+strings.Repeat("a", 80))), 127)
+	assert.Equal(t, "/dev/mapper/"+name, MapperPath(name))
+}
+
+func TestCryptsetup(t *testing.T) {
+	var calls []string
+	c := New(newFakeExec(&calls,
+		fakeCommand{},
+		fakeCommand{code: 1},
+		fakeCommand{code: 2, output: "permission denied"},
+		fakeCommand{},
+		fakeCommand{},
+		fakeCommand{},
+		fakeCommand{output: "/dev/mapper/luks-1 is active.\n  type:    LUKS2\n  cipher:  aes-xts-plain64\n  device:  /dev/sdc\n  sector size:  512\n"},
+		fakeCommand{code: 4, output: "/dev/mapper/luks-1 is inactive."},
+		fakeCommand{},
+		fakeCommand{},
+		fakeCommand{code: 2, output: "No key available with this passphrase."},
+	))
+
+	isLuks, err := c.IsLuks("/dev/sdc")
+	assert.NoError(t, err)
+	assert.True(t, isLuks)
+	isLuks, err = c.IsLuks("/dev/sdc")
+	assert.NoError(t, err)
+	assert.False(t, isLuks)
+	_, err = c.IsLuks("/dev/sdc")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Format("/dev/sdc", []byte("secret")))
+	assert.NoError(t, c.Open("/dev/sdc", "luks-1", []byte("secret"), true))
+	assert.NoError(t, c.Resize("luks-1", nil))
+
+	device, active, err := c.Status("luks-1")
+	assert.NoError(t, err)
+	assert.True(t, active)
+	assert.Equal(t, "/dev/sdc", device)
+	_, active, err = c.Status("luks-1")
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	assert.NoError(t, c.Resize("luks-1", []byte("secret")))
+	assert.NoError(t, c.Close("luks-1"))
+	err = c.Open("/dev/sdc", "luks-1", []byte("wrong"), false)
+	assert.Error(t, err)
+	assert.False(t, strings.Contains(err.Error(), "wrong"), "passphrase is not leaked in errors")
+
+	assert.Equal(t, []string{
+		"cryptsetup isLuks /dev/sdc",
+		"cryptsetup isLuks /dev/sdc",
+		"cryptsetup isLuks /dev/sdc",
+		"cryptsetup luksFormat --batch-mode --type luks2 --key-file - /dev/sdc <secret",
+		"cryptsetup luksOpen --key-file - --readonly /dev/sdc luks-1 <secret",
+		"cryptsetup resize luks-1",
+		"cryptsetup status luks-1",
+		"cryptsetup status luks-1",
+		"cryptsetup resize --key-file - luks-1 <secret",
+		"cryptsetup luksClose luks-1",
+		"cryptsetup luksOpen --key-file - /dev/sdc luks-1 <wrong",
+	}, calls)
+}
+
+func TestCryptsetupNotFound(t *testing.T) {
+	var calls []string
+	c := New(newFakeExec(&calls, fakeCommand{err: fmt.Errorf("executable file not found in $PATH")}))
+	_, _, err := c.Status("luks-1")
+	assert.Error(t, err)
+}
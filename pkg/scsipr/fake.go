@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scsipr
+
+import (
+	"sort"
+	"sync"
+)
+
+// Fake keeps persistent reservations in memory, one registration per key.
+// Registrations of several nodes can be simulated by using their keys on the same device name.
+type Fake struct {
+	mu      sync.Mutex
+	devices map[string]*fakeDevice
+}
+
+type fakeDevice struct {
+	keys        map[uint64]bool
+	reservation *Reservation
+}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+	return &Fake{devices: map[string]*fakeDevice{}}
+}
+
+var _ Interface = &Fake{}
+
+func (f *Fake) device(device string) *fakeDevice {
+	d, ok := f.devices[device]
+	if !ok {
+		d = &fakeDevice{keys: map[uint64]bool{}}
+		f.devices[device] = d
+	}
+	return d
+}
+
+func (f *Fake) Register(device string, key uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.device(device).keys[key] = true
+	return nil
+}
+
+func (f *Fake) Unregister(device string, key uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.device(device)
+	d.remove(key)
+	return nil
+}
+
+func (f *Fake) Reserve(device string, key uint64, reservationType ReservationType) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.device(device)
+	if !d.keys[key] {
+		return ErrReservationConflict
+	}
+	if d.reservation == nil {
+		d.reservation = &Reservation{Key: key, Type: reservationType}
+		return nil
+	}
+	if d.reservation.Type != reservationType || (!reservationType.isAllRegistrants() && d.reservation.Key != key) {
+		return ErrReservationConflict
+	}
+	return nil
+}
+
+func (f *Fake) Preempt(device string, key, preemptKey uint64, reservationType ReservationType) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.device(device)
+	if !d.keys[key] || !d.keys[preemptKey] {
+		return ErrReservationConflict
+	}
+	holder := d.reservation != nil && !d.reservation.Type.isAllRegistrants() && d.reservation.Key == preemptKey
+	d.remove(preemptKey)
+	if holder {
+		d.reservation = &Reservation{Key: key, Type: reservationType}
+	}
+	return nil
+}
+
+func (f *Fake) ReadKeys(device string) ([]uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []uint64{}
+	for key := range f.device(device).keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
+func (f *Fake) ReadReservation(device string) (*Reservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.device(device).reservation
+	if r == nil {
+		return nil, nil
+	}
+	if r.Type.isAllRegistrants() {
+		return &Reservation{Type: r.Type}, nil
+	}
+	return &Reservation{Key: r.Key, Type: r.Type}, nil
+}
+
+// remove removes the registration of key, the reservation is released when its holder is unregistered
+func (d *fakeDevice) remove(key uint64) {
+	delete(d.keys, key)
+	if d.reservation == nil {
+		return
+	}
+	if d.reservation.Type.isAllRegistrants() {
+		if len(d.keys) == 0 {
+			d.reservation = nil
+		}
+	} else if d.reservation.Key == key {
+		d.reservation = nil
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scsipr issues SCSI-3 persistent reservation commands (PERSISTENT RESERVE IN/OUT),
+// the equivalent of sg_persist, to fence nodes sharing a disk.
+package scsipr
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ReservationType is the TYPE field of a persistent reservation
+type ReservationType uint8
+
+const (
+	WriteExclusive                 ReservationType = 0x1
+	ExclusiveAccess                ReservationType = 0x3
+	WriteExclusiveRegistrantsOnly  ReservationType = 0x5
+	ExclusiveAccessRegistrantsOnly ReservationType = 0x6
+	WriteExclusiveAllRegistrants   ReservationType = 0x7
+	ExclusiveAccessAllRegistrants  ReservationType = 0x8
+)
+
+// isAllRegistrants returns whether every registered initiator holds a reservation of type t
+func (t ReservationType) isAllRegistrants() bool {
+	return t == WriteExclusiveAllRegistrants || t == ExclusiveAccessAllRegistrants
+}
+
+const (
+	persistentReserveIn  = 0x5e
+	persistentReserveOut = 0x5f
+
+	// PERSISTENT RESERVE IN service actions
+	readKeys        = 0x0
+	readReservation = 0x1
+
+	// PERSISTENT RESERVE OUT service actions
+	register                     = 0x0
+	reserve                      = 0x1
+	preempt                      = 0x4
+	registerAndIgnoreExistingKey = 0x6
+
+	persistentReserveInCDBLength  = 10
+	persistentReserveOutCDBLength = 10
+	// parameter list of PERSISTENT RESERVE OUT without transport IDs
+	parameterListLength = 24
+	// enough for the header and 1023 registration keys
+	allocationLength = 8192
+)
+
+// ErrReservationConflict is returned when the device completes a command with RESERVATION CONFLICT status,
+// e.g. the key of the node was preempted by another node
+var ErrReservationConflict = errors.New("reservation conflict")
+
+// Reservation is the persistent reservation held on a device.
+// Key is 0 for all registrants reservations since every registered key holds the reservation.
+type Reservation struct {
+	Key  uint64
+	Type ReservationType
+}
+
+// Interface issues persistent reservation commands to block devices
+type Interface interface {
+	// Register registers key for this node on device, replacing the key it registered before if any
+	Register(device string, key uint64) error
+	// Unregister removes the registration of this node from device, it succeeds if the node is not registered
+	Unregister(device string, key uint64) error
+	// Reserve creates a reservation of reservationType on device held by key
+	Reserve(device string, key uint64, reservationType ReservationType) error
+	// Preempt removes the registrations of preemptKey from device, the reservation held by preemptKey moves to key
+	Preempt(device string, key, preemptKey uint64, reservationType ReservationType) error
+	// ReadKeys returns the keys registered on device
+	ReadKeys(device string) ([]uint64, error)
+	// ReadReservation returns the reservation held on device, nil if there is none
+	ReadReservation(device string) (*Reservation, error)
+}
+
+// NodeKey returns the reservation key of nodeName, it can be computed by any component knowing the node name
+func NodeKey(nodeName string) uint64 {
+	sum := sha256.Sum256([]byte(strings.ToLower(nodeName)))
+	key := binary.BigEndian.Uint64(sum[:8])
+	if key == 0 {
+		// a zero key unregisters
+		key = 1
+	}
+	return key
+}
+
+// FormatKey returns key as a hex string as printed by sg_persist
+func FormatKey(key uint64) string {
+	return fmt.Sprintf("0x%016x", key)
+}
+
+// ParseKey parses a key formatted by FormatKey
+func ParseKey(s string) (uint64, error) {
+	var key uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "0x%x", &key); err != nil {
+		return 0, fmt.Errorf("invalid reservation key %q: %v", s, err)
+	}
+	return key, nil
+}
+
+func persistentReserveInCDB(serviceAction byte) []byte {
+	cdb := make([]byte, persistentReserveInCDBLength)
+	cdb[0] = persistentReserveIn
+	cdb[1] = serviceAction
+	binary.BigEndian.PutUint16(cdb[7:9], allocationLength)
+	return cdb
+}
+
+func persistentReserveOutCDB(serviceAction byte, reservationType ReservationType) []byte {
+	cdb := make([]byte, persistentReserveOutCDBLength)
+	cdb[0] = persistentReserveOut
+	cdb[1] = serviceAction
+	// LU_SCOPE
+	cdb[2] = byte(reservationType) & 0x0f
+	binary.BigEndian.PutUint32(cdb[5:9], parameterListLength)
+	return cdb
+}
+
+func persistentReserveOutParameters(key, serviceActionKey uint64) []byte {
+	data := make([]byte, parameterListLength)
+	binary.BigEndian.PutUint64(data[0:8], key)
+	binary.BigEndian.PutUint64(data[8:16], serviceActionKey)
+	return data
+}
+
+// parseReadKeys parses the parameter data returned by PERSISTENT RESERVE IN with READ KEYS service action
+func parseReadKeys(data []byte) ([]uint64, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("READ KEYS returned %d bytes", len(data))
+	}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	if length%8 != 0 {
+		return nil, fmt.Errorf("READ KEYS returned invalid additional length %d", length)
+	}
+	if length > len(data)-8 {
+		// truncated by the allocation length
+		length = (len(data) - 8) / 8 * 8
+	}
+	keys := make([]uint64, 0, length/8)
+	for i := 8; i < 8+length; i += 8 {
+		keys = append(keys, binary.BigEndian.Uint64(data[i:i+8]))
+	}
+	return keys, nil
+}
+
+// parseReadReservation parses the parameter data returned by PERSISTENT RESERVE IN with READ RESERVATION service action
+func parseReadReservation(data []byte) (*Reservation, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("READ RESERVATION returned %d bytes", len(data))
+	}
+	length := binary.BigEndian.Uint32(data[4:8])
+	if length == 0 {
+		return nil, nil
+	}
+	if length < 16 || len(data) < 24 {
+		return nil, fmt.Errorf("READ RESERVATION returned invalid additional length %d", length)
+	}
+	return &Reservation{
+		Key:  binary.BigEndian.Uint64(data[8:16]),
+		Type: ReservationType(data[21] & 0x0f),
+	}, nil
+}
@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scsipr
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SG_IO ioctl, see <scsi/sg.h>
+	sgIO            = 0x2285
+	sgDxferNone     = -1
+	sgDxferToDev    = -2
+	sgDxferFromDev  = -3
+	sgInterfaceID   = 'S'
+	sgIOTimeoutInMs = 30000
+	senseLength     = 32
+
+	scsiStatusGood                = 0x00
+	scsiStatusReservationConflict = 0x18
+)
+
+// sgIOHdr is struct sg_io_hdr of <scsi/sg.h>
+type sgIOHdr struct {
+	interfaceID    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         uintptr
+	cmdp           uintptr
+	sbp            uintptr
+	timeout        uint32
+	flags          uint32
+	packID         int32
+	usrPtr         uintptr
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+type persistentReserver struct{}
+
+// New returns an Interface issuing SG_IO ioctls to the devices
+func New() Interface {
+	return &persistentReserver{}
+}
+
+func (r *persistentReserver) Register(device string, key uint64) error {
+	return r.out(device, registerAndIgnoreExistingKey, 0, 0, key)
+}
+
+func (r *persistentReserver) Unregister(device string, _ uint64) error {
+	// a zero service action key removes the registration of the I_T nexus whatever its key
+	return r.out(device, registerAndIgnoreExistingKey, 0, 0, 0)
+}
+
+func (r *persistentReserver) Reserve(device string, key uint64, reservationType ReservationType) error {
+	return r.out(device, reserve, reservationType, key, 0)
+}
+
+func (r *persistentReserver) Preempt(device string, key, preemptKey uint64, reservationType ReservationType) error {
+	return r.out(device, preempt, reservationType, key, preemptKey)
+}
+
+func (r *persistentReserver) ReadKeys(device string) ([]uint64, error) {
+	data := make([]byte, allocationLength)
+	n, err := sendCommand(device, persistentReserveInCDB(readKeys), sgDxferFromDev, data)
+	if err != nil {
+		return nil, fmt.Errorf("READ KEYS on %s failed: %w", device, err)
+	}
+	return parseReadKeys(data[:n])
+}
+
+func (r *persistentReserver) ReadReservation(device string) (*Reservation, error) {
+	data := make([]byte, allocationLength)
+	n, err := sendCommand(device, persistentReserveInCDB(readReservation), sgDxferFromDev, data)
+	if err != nil {
+		return nil, fmt.Errorf("READ RESERVATION on %s failed: %w", device, err)
+	}
+	return parseReadReservation(data[:n])
+}
+
+func (r *persistentReserver) out(device string, serviceAction byte, reservationType ReservationType, key, serviceActionKey uint64) error {
+	if _, err := sendCommand(device, persistentReserveOutCDB(serviceAction, reservationType), sgDxferToDev,
+		persistentReserveOutParameters(key, serviceActionKey)); err != nil {
+		return fmt.Errorf("PERSISTENT RESERVE OUT(service action 0x%x) on %s failed: %w", serviceAction, device, err)
+	}
+	return nil
+}
+
+// sendCommand sends cdb to device through SG_IO and returns the number of bytes transferred
+func sendCommand(device string, cdb []byte, direction int32, data []byte) (int, error) {
+	f, err := os.OpenFile(device, os.O_RDWR|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sense := make([]byte, senseLength)
+	hdr := sgIOHdr{
+		interfaceID:    sgInterfaceID,
+		dxferDirection: direction,
+		cmdLen:         uint8(len(cdb)),
+		mxSbLen:        uint8(len(sense)),
+		dxferLen:       uint32(len(data)),
+		cmdp:           uintptr(unsafe.Pointer(&cdb[0])),
+		sbp:            uintptr(unsafe.Pointer(&sense[0])),
+		timeout:        sgIOTimeoutInMs,
+	}
+	if len(data) == 0 {
+		hdr.dxferDirection = sgDxferNone
+	} else {
+		hdr.dxferp = uintptr(unsafe.Pointer(&data[0]))
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), sgIO, uintptr(unsafe.Pointer(&hdr)))
+	runtime.KeepAlive(cdb)
+	runtime.KeepAlive(sense)
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return 0, fmt.Errorf("SG_IO ioctl failed: %v", errno)
+	}
+
+	switch {
+	case hdr.status == scsiStatusReservationConflict:
+		return 0, ErrReservationConflict
+	case hdr.status != scsiStatusGood:
+		return 0, fmt.Errorf("SCSI status 0x%x, sense key 0x%x", hdr.status, senseKey(sense[:hdr.sbLenWr]))
+	case hdr.hostStatus != 0 || hdr.driverStatus != 0:
+		return 0, fmt.Errorf("host status 0x%x, driver status 0x%x", hdr.hostStatus, hdr.driverStatus)
+	}
+	return len(data) - int(hdr.resid), nil
+}
+
+// senseKey returns the sense key of fixed or descriptor format sense data
+func senseKey(sense []byte) byte {
+	if len(sense) < 3 {
+		return 0
+	}
+	if sense[0]&0x7f >= 0x72 {
+		return sense[1] & 0x0f
+	}
+	return sense[2] & 0x0f
+}
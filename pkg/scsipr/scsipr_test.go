@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scsipr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeKey(t *testing.T) {
+	assert.Equal(t, NodeKey("aks-nodepool1-0"), NodeKey("AKS-NODEPOOL1-0"))
+	assert.NotEqual(t, NodeKey("aks-nodepool1-0"), NodeKey("aks-nodepool1-1"))
+	assert.NotZero(t, NodeKey(""))
+
+	key, err := ParseKey(FormatKey(NodeKey("node")))
+	assert.NoError(t, err)
+	assert.Equal(t, NodeKey("node"), key)
+	assert.Equal(t, "0x00000000000000ff", FormatKey(0xff))
+	_, err = ParseKey("node")
+	assert.Error(t, err)
+}
+
+func TestCDB(t *testing.T) {
+	assert.Equal(t, []byte{0x5e, 0x01, 0, 0, 0, 0, 0, 0x20, 0x00, 0}, persistentReserveInCDB(readReservation))
+	assert.Equal(t, []byte{0x5f, 0x04, 0x07, 0, 0, 0, 0, 0, 24, 0}, persistentReserveOutCDB(preempt, WriteExclusiveAllRegistrants))
+	assert.Equal(t, []byte{
+		0, 0, 0, 0, 0, 0, 0x12, 0x34,
+		0, 0, 0, 0, 0, 0, 0x56, 0x78,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}, persistentReserveOutParameters(0x1234, 0x5678))
+}
+
+func TestParseReadKeys(t *testing.T) {
+	keys, err := parseReadKeys([]byte{
+		0, 0, 0, 1, 0, 0, 0, 16,
+		0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 2,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, keys)
+
+	keys, err = parseReadKeys([]byte{0, 0, 0, 1, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, keys, "keys truncated by the allocation length")
+
+	keys, err = parseReadKeys([]byte{0, 0, 0, 1, 0, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = parseReadKeys([]byte{0, 0, 0, 1, 0, 0, 0, 3})
+	assert.Error(t, err)
+	_, err = parseReadKeys([]byte{0})
+	assert.Error(t, err)
+}
+
+func TestParseReadReservation(t *testing.T) {
+	r, err := parseReadReservation([]byte{
+		0, 0, 0, 1, 0, 0, 0, 16,
+		0, 0, 0, 0, 0, 0, 0x12, 0x34,
+		0, 0, 0, 0, 0, 0x05, 0, 0,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &Reservation{Key: 0x1234, Type: WriteExclusiveRegistrantsOnly}, r)
+
+	r, err = parseReadReservation([]byte{0, 0, 0, 1, 0, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	_, err = parseReadReservation([]byte{0, 0, 0, 1, 0, 0, 0, 16})
+	assert.Error(t, err)
+}
+
+func TestFake(t *testing.T) {
+	f := NewFake()
+	device := "/dev/sdc"
+
+	assert.Equal(t, ErrReservationConflict, f.Reserve(device, 1, WriteExclusiveAllRegistrants), "unregistered key")
+	assert.NoError(t, f.Register(device, 1))
+	assert.NoError(t, f.Register(device, 2))
+	assert.NoError(t, f.Reserve(device, 1, WriteExclusiveAllRegistrants))
+	assert.NoError(t, f.Reserve(device, 2, WriteExclusiveAllRegistrants), "every registrant holds an all registrants reservation")
+	assert.Equal(t, ErrReservationConflict, f.Reserve(device, 2, WriteExclusive))
+	r, err := f.ReadReservation(device)
+	assert.NoError(t, err)
+	assert.Equal(t, &Reservation{Type: WriteExclusiveAllRegistrants}, r)
+
+	assert.NoError(t, f.Preempt(device, 2, 1, WriteExclusiveAllRegistrants))
+	keys, err := f.ReadKeys(device)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2}, keys)
+	assert.Equal(t, ErrReservationConflict, f.Preempt(device, 1, 2, WriteExclusiveAllRegistrants), "preempted key")
+
+	assert.NoError(t, f.Unregister(device, 2))
+	r, err = f.ReadReservation(device)
+	assert.NoError(t, err)
+	assert.Nil(t, r, "reservation is released with the last registrant")
+
+	// the reservation of a single holder moves to the preempting key
+	assert.NoError(t, f.Register(device, 1))
+	assert.NoError(t, f.Register(device, 2))
+	assert.NoError(t, f.Reserve(device, 1, WriteExclusiveRegistrantsOnly))
+	assert.Equal(t, ErrReservationConflict, f.Reserve(device, 2, WriteExclusiveRegistrantsOnly))
+	assert.NoError(t, f.Preempt(device, 2, 1, WriteExclusiveRegistrantsOnly))
+	r, err = f.ReadReservation(device)
+	assert.NoError(t, err)
+	assert.Equal(t, &Reservation{Key: 2, Type: WriteExclusiveRegistrantsOnly}, r)
+}
@@ -0,0 +1,55 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scsipr
+
+import "fmt"
+
+type persistentReserver struct{}
+
+// New returns an Interface failing every command on unsupported platforms
+func New() Interface {
+	return &persistentReserver{}
+}
+
+var errNotSupported = fmt.Errorf("SCSI persistent reservations are not supported on this platform")
+
+func (r *persistentReserver) Register(_ string, _ uint64) error {
+	return errNotSupported
+}
+
+func (r *persistentReserver) Unregister(_ string, _ uint64) error {
+	return errNotSupported
+}
+
+func (r *persistentReserver) Reserve(_ string, _ uint64, _ ReservationType) error {
+	return errNotSupported
+}
+
+func (r *persistentReserver) Preempt(_ string, _, _ uint64, _ ReservationType) error {
+	return errNotSupported
+}
+
+func (r *persistentReserver) ReadKeys(_ string) ([]uint64, error) {
+	return nil, errNotSupported
+}
+
+func (r *persistentReserver) ReadReservation(_ string) (*Reservation, error) {
+	return nil, errNotSupported
+}